@@ -0,0 +1,52 @@
+package audit
+
+import (
+	"b-pay/config/auth"
+	"b-pay/config/logger"
+	"b-pay/models"
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Actor returns who makes the request: the User and the email of the token,
+// with the client IP, user agent and request ID.
+func Actor(c *gin.Context) models.AuditActor {
+	actor := models.AuditActor{
+		Email:     c.GetString("email"),
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		RequestID: c.GetString("requestID"),
+	}
+	if userID, err := auth.UserID(c); err == nil {
+		actor.UserID = &userID
+	}
+	return actor
+}
+
+// Context returns the context of the request with its Actor. The money
+// operations made with it write their audit entry in their own DB
+// transaction, so they fail rather than go unrecorded.
+func Context(c *gin.Context) context.Context {
+	return models.WithAuditActor(c.Request.Context(), Actor(c))
+}
+
+// Record appends the action of the request to the audit log. A failure is
+// logged, the change is already made. Money operations use Context instead.
+func Record(c *gin.Context, action, targetType string, targetID uint, before, after interface{}) {
+	RecordAs(Actor(c), action, targetType, targetID, before, after)
+}
+
+// RecordAs is Record with another actor, like the User who logs in.
+func RecordAs(actor models.AuditActor, action, targetType string, targetID uint, before, after interface{}) {
+	if err := models.Audit(actor, action, targetType, targetID, before, after); err != nil {
+		logger.Log.Error("audit failed",
+			zap.String("request_id", actor.RequestID),
+			zap.String("action", action),
+			zap.String("target_type", targetType),
+			zap.Uint("target_id", targetID),
+			zap.Error(err),
+		)
+	}
+}
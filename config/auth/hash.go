@@ -0,0 +1,24 @@
+package auth
+
+import (
+	"b-pay/config/tracing"
+	"context"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// HashSecret hashes a password or a PIN with bcrypt. Traced as a span of ctx,
+// since bcrypt is slow on purpose.
+func HashSecret(ctx context.Context, secret string) ([]byte, error) {
+	_, span := tracing.Start(ctx, "bcrypt.GenerateFromPassword")
+	defer span.End()
+	return bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+}
+
+// CompareSecret returns nil when secret matches the bcrypt hash. Traced as a
+// span of ctx.
+func CompareSecret(ctx context.Context, hash []byte, secret string) error {
+	_, span := tracing.Start(ctx, "bcrypt.CompareHashAndPassword")
+	defer span.End()
+	return bcrypt.CompareHashAndPassword(hash, []byte(secret))
+}
@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"b-pay/models"
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrUserNotFound is returned when the User of the token does not exist.
+var ErrUserNotFound = errors.New("User not found.")
+
+// UserID returns the ID of the User of the token, from the email AuthJWT
+// puts in the context. Must be used after AuthJWT. The User is looked up
+// once per request, and kept as "userID" for the logs.
+func UserID(c *gin.Context) (uint, error) {
+	if id, ok := c.Get("userID"); ok {
+		return id.(uint), nil
+	}
+
+	email := c.GetString("email")
+	if email == "" {
+		return 0, ErrUserNotFound
+	}
+	userEmail := models.User{
+		Email: email,
+	}
+	user := userEmail.GetUserByEmail()
+	if user == nil {
+		return 0, ErrUserNotFound
+	}
+
+	c.Set("userID", user.ID)
+	return user.ID, nil
+}
@@ -1,11 +1,15 @@
 package database
 
 import (
-	"log"
+	"b-pay/config/logger"
+	"b-pay/config/metrics"
+	"b-pay/config/tracing"
 	"os"
 
+	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
 )
 
 var DB *gorm.DB
@@ -15,12 +19,20 @@ func InitDB() {
 	// Get database string information.
 	dsn := os.Getenv("DATABASE_URL")
 	if dsn == "" {
-		log.Fatalf("No database string found.")
+		logger.Log.Fatal("no database string found")
 	}
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
+		Logger: logger.Gorm{Level: gormlogger.Warn},
+	})
 	if err != nil {
-		log.Fatalf(err.Error())
+		logger.Log.Fatal("opening database failed", zap.Error(err))
+	}
+	if err := db.Use(metrics.GormPlugin{}); err != nil {
+		logger.Log.Fatal("registering database metrics failed", zap.Error(err))
+	}
+	if err := db.Use(tracing.GormPlugin{}); err != nil {
+		logger.Log.Fatal("registering database tracing failed", zap.Error(err))
 	}
 
 	DB = db
@@ -0,0 +1,174 @@
+package events
+
+import (
+	"b-pay/config/logger"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Message is one domain event. ID is unique per event and stays the same
+// when the event is published again, so consumers can skip duplicates.
+type Message struct {
+	ID string
+	// Sequence is the position of the Message in the outbox. It grows with
+	// every event, so live streams resume from it.
+	Sequence uint
+	Topic    string
+	// Key orders the messages of one aggregate, like "saving:12".
+	Key       string
+	Payload   json.RawMessage
+	CreatedAt time.Time
+}
+
+// Sink publishes Messages. A Message is only marked as published when
+// Publish returns nil, so a Sink can get a Message more than once.
+type Sink interface {
+	Publish(m Message) error
+}
+
+// Handler consumes the Messages of a Bus.
+type Handler func(m Message) error
+
+// Bus is an in-process Sink which calls the Handlers of the topic of every
+// Message, and the Handlers of "*".
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// NewBus returns a Bus without Handlers.
+func NewBus() *Bus {
+	return &Bus{handlers: map[string][]Handler{}}
+}
+
+// Subscribe calls handler for every Message of topic, "*" for every topic.
+func (b *Bus) Subscribe(topic string, handler Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[topic] = append(b.handlers[topic], handler)
+}
+
+// Publish calls the Handlers in order and stops at the first error.
+func (b *Bus) Publish(m Message) error {
+	b.mu.RLock()
+	handlers := append(append([]Handler{}, b.handlers[m.Topic]...), b.handlers["*"]...)
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		if err := handler(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileSink appends every Message to a file as one JSON line.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileSink opens or creates the file at path for appending.
+func NewFileSink(path string) (*FileSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file}, nil
+}
+
+// Publish writes the Message and syncs the file.
+func (f *FileSink) Publish(m Message) error {
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Close closes the file.
+func (f *FileSink) Close() error {
+	return f.file.Close()
+}
+
+// Broker is the publishing side of a NATS or Kafka client. Headers carry the
+// message ID for broker side deduplication, like Nats-Msg-Id.
+type Broker interface {
+	Publish(subject string, key []byte, value []byte, headers map[string]string) error
+}
+
+// BrokerSink publishes every Message to a Broker. The subject is Prefix
+// followed by the topic.
+type BrokerSink struct {
+	Broker Broker
+	Prefix string
+}
+
+// Publish sends the payload of the Message keyed by its Key.
+func (b BrokerSink) Publish(m Message) error {
+	return b.Broker.Publish(b.Prefix+m.Topic, []byte(m.Key), m.Payload, map[string]string{
+		"Nats-Msg-Id": m.ID,
+		"event-id":    m.ID,
+		"event-topic": m.Topic,
+		"event-time":  m.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+}
+
+// Fanout publishes every Message to each Sink in order and stops at the first
+// error. The Sinks before it get the Message again on the next try.
+type Fanout []Sink
+
+// Publish publishes the Message to every Sink.
+func (f Fanout) Publish(m Message) error {
+	for _, sink := range f {
+		if err := sink.Publish(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LocalBus is the in-process Bus, in-process consumers subscribe to it. It
+// always gets the events.
+var LocalBus = NewBus()
+
+// Default is the Sink used by the outbox relay.
+var Default Sink = LocalBus
+
+// fileSink is the Sink of EVENTS_FILE, nil without one.
+var fileSink *FileSink
+
+// InitEvents also appends the events to EVENTS_FILE when it is set. A Broker
+// is added the same way, with a Fanout of LocalBus and a BrokerSink.
+func InitEvents() {
+	path := os.Getenv("EVENTS_FILE")
+	if path == "" {
+		return
+	}
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		logger.Log.Fatal("opening events file failed", zap.String("path", path), zap.Error(err))
+	}
+	Default = Fanout{LocalBus, sink}
+	fileSink = sink
+}
+
+// CloseEvents closes the file of EVENTS_FILE, if any. Called on shutdown
+// after the outbox relay stopped.
+func CloseEvents() error {
+	if fileSink == nil {
+		return nil
+	}
+	return fileSink.Close()
+}
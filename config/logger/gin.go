@@ -0,0 +1,37 @@
+package logger
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// For returns Log with the request ID, and the User and Saving of the
+// request when they are known.
+func For(c *gin.Context) *zap.Logger {
+	return Log.With(Fields(c)...)
+}
+
+// Fields are the fields which correlate the log lines of a request, with
+// its trace.
+func Fields(c *gin.Context) []zap.Field {
+	fields := []zap.Field{zap.String("request_id", c.GetString("requestID"))}
+	if span := trace.SpanContextFromContext(c.Request.Context()); span.IsValid() {
+		fields = append(fields,
+			zap.String("trace_id", span.TraceID().String()),
+			zap.String("span_id", span.SpanID().String()),
+		)
+	}
+	if userID, ok := c.Get("userID"); ok {
+		fields = append(fields, zap.Any("user_id", userID))
+	}
+	if savingID, ok := c.Get("savingID"); ok {
+		fields = append(fields, zap.Any("saving_id", savingID))
+	}
+	return fields
+}
+
+// SetSavingID sets the Saving of the request for its log lines.
+func SetSavingID(c *gin.Context, savingID uint) {
+	c.Set("savingID", savingID)
+}
@@ -0,0 +1,76 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// slowQuery is how long a query takes before it is logged as slow.
+const slowQuery = 200 * time.Millisecond
+
+// Gorm logs the failed and slow queries of gorm to Log. Missing records are
+// not failures.
+type Gorm struct {
+	Level gormlogger.LogLevel
+}
+
+// LogMode returns the logger with another level.
+func (g Gorm) LogMode(level gormlogger.LogLevel) gormlogger.Interface {
+	return Gorm{Level: level}
+}
+
+// Info logs a message of gorm.
+func (g Gorm) Info(ctx context.Context, msg string, args ...interface{}) {
+	if g.Level >= gormlogger.Info {
+		Log.Info(fmt.Sprintf(msg, args...))
+	}
+}
+
+// Warn logs a warning of gorm.
+func (g Gorm) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if g.Level >= gormlogger.Warn {
+		Log.Warn(fmt.Sprintf(msg, args...))
+	}
+}
+
+// Error logs an error of gorm.
+func (g Gorm) Error(ctx context.Context, msg string, args ...interface{}) {
+	if g.Level >= gormlogger.Error {
+		Log.Error(fmt.Sprintf(msg, args...))
+	}
+}
+
+// Trace logs a query which failed or was slow.
+func (g Gorm) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && g.Level >= gormlogger.Error:
+		sql, rows := fc()
+		Log.Error("query failed",
+			zap.String("sql", sql),
+			zap.Int64("rows", rows),
+			zap.Float64("latency_ms", float64(elapsed.Microseconds())/1000),
+			zap.Error(err),
+		)
+	case elapsed > slowQuery && g.Level >= gormlogger.Warn:
+		sql, rows := fc()
+		Log.Warn("slow query",
+			zap.String("sql", sql),
+			zap.Int64("rows", rows),
+			zap.Float64("latency_ms", float64(elapsed.Microseconds())/1000),
+		)
+	case g.Level >= gormlogger.Info:
+		sql, rows := fc()
+		Log.Debug("query",
+			zap.String("sql", sql),
+			zap.Int64("rows", rows),
+			zap.Float64("latency_ms", float64(elapsed.Microseconds())/1000),
+		)
+	}
+}
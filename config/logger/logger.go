@@ -0,0 +1,173 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Log is the JSON logger of the service. Every line goes through the
+// redaction of Redact. Replaced by InitLogger.
+var Log = zap.New(newCore(zapcore.InfoLevel, os.Stdout))
+
+// Redacted replaces the secrets in the log lines.
+const Redacted = "[REDACTED]"
+
+// redactions mask the personal data and secrets which can be in a log line,
+// in order.
+var redactions = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	// JWTs, in headers, bodies or URLs.
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), Redacted},
+	{regexp.MustCompile(`(?i)\bbearer\s+\S+`), "Bearer " + Redacted},
+	// The PIN of a Saving is sent as "key_<PIN>".
+	{regexp.MustCompile(`\bkey_[^\s&"',;]+`), "key_" + Redacted},
+	// Secrets in query strings and form bodies, like "pin=123456".
+	{regexp.MustCompile(`(?i)\b([a-z_-]*(?:pin|password|token|secret|key)[a-z_-]*=)[^&\s"']+`), "${1}" + Redacted},
+	// Emails keep their domain.
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@([A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,})`), "***@$1"},
+}
+
+// InitLogger sets the level from LOG_LEVEL, info by default.
+func InitLogger() {
+	level := zapcore.InfoLevel
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.Set(value); err != nil {
+			Log.Warn("invalid LOG_LEVEL, using info", zap.String("value", value))
+		}
+	}
+	Log = zap.New(newCore(level, os.Stdout), zap.AddCaller())
+}
+
+// newCore returns the redacting JSON core which writes to out.
+func newCore(level zapcore.Level, out zapcore.WriteSyncer) zapcore.Core {
+	config := zap.NewProductionEncoderConfig()
+	config.TimeKey = "time"
+	config.MessageKey = "msg"
+	config.EncodeTime = zapcore.ISO8601TimeEncoder
+	return redactCore{zapcore.NewCore(zapcore.NewJSONEncoder(config), zapcore.Lock(out), level)}
+}
+
+// SecretKey reports whether a field or JSON key holds a secret, like "PIN",
+// "new-password" or "api_key".
+func SecretKey(key string) bool {
+	key = strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+	for _, word := range []string{"password", "secret", "token", "authorization"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return strings.HasSuffix(key, "pin") || strings.HasSuffix(key, "key")
+}
+
+// Redact masks the emails, tokens, PINs and passwords in text.
+func Redact(text string) string {
+	for _, r := range redactions {
+		text = r.pattern.ReplaceAllString(text, r.replace)
+	}
+	return text
+}
+
+// redactCore redacts the message and the fields of every entry.
+type redactCore struct {
+	zapcore.Core
+}
+
+// With adds the fields redacted.
+func (r redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactCore{r.Core.With(redactFields(fields))}
+}
+
+// Check adds the core when the entry is logged.
+func (r redactCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if r.Enabled(entry.Level) {
+		return checked.AddCore(entry, r)
+	}
+	return checked
+}
+
+// Write redacts the entry and writes it.
+func (r redactCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = Redact(entry.Message)
+	entry.Stack = Redact(entry.Stack)
+	return r.Core.Write(entry, redactFields(fields))
+}
+
+// redactFields masks the fields with a secret key, and the secrets in the
+// text of the others. Objects, arrays and reflected values are masked by key
+// at every level too.
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	results := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		switch {
+		case SecretKey(field.Key):
+			results[i] = zap.String(field.Key, Redacted)
+		case field.Type == zapcore.StringType:
+			results[i] = zap.String(field.Key, Redact(field.String))
+		case field.Type == zapcore.ByteStringType:
+			results[i] = zap.String(field.Key, Redact(string(field.Interface.([]byte))))
+		case field.Type == zapcore.ErrorType:
+			results[i] = zap.String(field.Key, Redact(field.Interface.(error).Error()))
+		case field.Type == zapcore.StringerType:
+			results[i] = zap.String(field.Key, Redact(field.Interface.(interface{ String() string }).String()))
+		case field.Type == zapcore.ReflectType, field.Type == zapcore.ObjectMarshalerType,
+			field.Type == zapcore.ArrayMarshalerType:
+			results[i] = redactStructured(field)
+		default:
+			results[i] = field
+		}
+	}
+	return results
+}
+
+// redactStructured encodes the object, array or reflected value of field as
+// JSON and masks it.
+func redactStructured(field zapcore.Field) zapcore.Field {
+	encoder := zapcore.NewMapObjectEncoder()
+	field.AddTo(encoder)
+	raw, err := json.Marshal(encoder.Fields[field.Key])
+	if err != nil {
+		return zap.String(field.Key, Redacted)
+	}
+
+	// Numbers are kept as they are, not as float64.
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return zap.String(field.Key, Redacted)
+	}
+	return zap.Any(field.Key, redactJSON(value))
+}
+
+// redactJSON masks the values with a secret key and the secrets in the
+// strings of a decoded JSON value.
+func redactJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if SecretKey(key) {
+				v[key] = Redacted
+			} else {
+				v[key] = redactJSON(item)
+			}
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactJSON(item)
+		}
+		return v
+	case string:
+		return Redact(v)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,64 @@
+package mail
+
+import (
+	"b-pay/config/logger"
+	"fmt"
+	"net/smtp"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// Sender sends an email.
+type Sender interface {
+	Send(to, subject, body string) error
+}
+
+// LogSender only logs the emails. Used when no SMTP server is configured.
+type LogSender struct{}
+
+// Send logs the email.
+func (LogSender) Send(to, subject, body string) error {
+	logger.Log.Info("mail", zap.String("to", to), zap.String("subject", subject), zap.String("body", body))
+	return nil
+}
+
+// SMTPSender sends the emails through an SMTP server.
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send sends the email.
+func (s SMTPSender) Send(to, subject, body string) error {
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", s.From, to, subject, body)
+	auth := smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	return smtp.SendMail(s.Host+":"+s.Port, auth, s.From, []string{to}, []byte(message))
+}
+
+// Mailer is the Sender used by the app.
+var Mailer Sender = LogSender{}
+
+// InitMail uses SMTP when SMTP_HOST is set, otherwise emails are logged.
+func InitMail() {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	Mailer = SMTPSender{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+	}
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// startKey keeps the start of a query in its statement.
+const startKey = "metrics:start"
+
+// GormPlugin observes the latency of every gorm query in DBQueryDuration.
+type GormPlugin struct{}
+
+// Name returns the name of the plugin.
+func (GormPlugin) Name() string {
+	return "metrics"
+}
+
+// Initialize registers the callbacks around every operation.
+func (GormPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	register := []func() error{
+		func() error { return callbacks.Create().Before("gorm:create").Register("metrics:before_create", start) },
+		func() error {
+			return callbacks.Create().After("gorm:create").Register("metrics:after_create", observe("create"))
+		},
+		func() error { return callbacks.Query().Before("gorm:query").Register("metrics:before_query", start) },
+		func() error {
+			return callbacks.Query().After("gorm:query").Register("metrics:after_query", observe("query"))
+		},
+		func() error { return callbacks.Update().Before("gorm:update").Register("metrics:before_update", start) },
+		func() error {
+			return callbacks.Update().After("gorm:update").Register("metrics:after_update", observe("update"))
+		},
+		func() error { return callbacks.Delete().Before("gorm:delete").Register("metrics:before_delete", start) },
+		func() error {
+			return callbacks.Delete().After("gorm:delete").Register("metrics:after_delete", observe("delete"))
+		},
+		func() error { return callbacks.Row().Before("gorm:row").Register("metrics:before_row", start) },
+		func() error { return callbacks.Row().After("gorm:row").Register("metrics:after_row", observe("row")) },
+		func() error { return callbacks.Raw().Before("gorm:raw").Register("metrics:before_raw", start) },
+		func() error { return callbacks.Raw().After("gorm:raw").Register("metrics:after_raw", observe("raw")) },
+	}
+	for _, fn := range register {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start records when a query starts.
+func start(db *gorm.DB) {
+	db.InstanceSet(startKey, time.Now())
+}
+
+// observe records how long a query took.
+func observe(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		value, ok := db.InstanceGet(startKey)
+		if !ok {
+			return
+		}
+		table := db.Statement.Table
+		if table == "" {
+			table = "unknown"
+		}
+		DBQueryDuration.WithLabelValues(operation, table).Observe(time.Since(value.(time.Time)).Seconds())
+	}
+}
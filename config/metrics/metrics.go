@@ -0,0 +1,110 @@
+package metrics
+
+import (
+	"b-pay/config/events"
+	"encoding/json"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Login results.
+const (
+	LoginSuccess = "success"
+	LoginFailure = "failure"
+)
+
+var (
+	// HTTPRequests counts the requests by route template, like
+	// "/v1/protected/s/:id", so IDs do not make new series.
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bpay_http_requests_total",
+		Help: "HTTP requests by method, route template and status.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPDuration is the latency of the requests by route template.
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bpay_http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// DBQueryDuration is the latency of the gorm queries, see GormPlugin.
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bpay_db_query_duration_seconds",
+		Help:    "Database query latency by operation and table.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "table"})
+
+	// Logins counts the logins by result.
+	Logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bpay_logins_total",
+		Help: "Logins by result, success or failure.",
+	}, []string{"result"})
+
+	// Transactions counts the committed Transactions by type and currency.
+	Transactions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bpay_transactions_total",
+		Help: "Committed transactions by type and currency.",
+	}, []string{"type", "currency"})
+
+	// TransactionAmount sums the absolute value of the committed
+	// Transactions, in minor units of the currency.
+	TransactionAmount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bpay_transaction_amount_minor_total",
+		Help: "Absolute value of committed transactions in minor units, by type and currency.",
+	}, []string{"type", "currency"})
+
+	// PINFailures counts the Saving PINs and keys which did not match.
+	PINFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bpay_pin_failures_total",
+		Help: "Saving PINs and keys which did not match.",
+	})
+
+	// PINLockouts counts the Saving PINs locked after too many failures.
+	PINLockouts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bpay_pin_lockouts_total",
+		Help: "Saving PINs locked after too many failures.",
+	})
+
+	// ReconciliationMismatches counts the Savings whose balance did not match
+	// the sum of their Transactions, every time one is found.
+	ReconciliationMismatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "bpay_reconciliation_mismatches_total",
+		Help: "Savings whose balance did not match the sum of their transactions.",
+	})
+)
+
+// transactionEvent is the part of the transaction.created payload the
+// counters need.
+type transactionEvent struct {
+	Type     string
+	Value    int64
+	Currency string
+}
+
+// InitMetrics counts the committed Transactions from the events of
+// events.LocalBus. Each instance counts the events its outbox relay
+// publishes.
+func InitMetrics() {
+	events.LocalBus.Subscribe("transaction.created", func(m events.Message) error {
+		var t transactionEvent
+		if err := json.Unmarshal(m.Payload, &t); err != nil {
+			return nil
+		}
+		amount := t.Value
+		if amount < 0 {
+			amount = -amount
+		}
+		Transactions.WithLabelValues(t.Type, t.Currency).Inc()
+		TransactionAmount.WithLabelValues(t.Type, t.Currency).Add(float64(amount))
+		return nil
+	})
+}
+
+// Handler serves the metrics in the Prometheus format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"b-pay/models"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminOnly is a middleware for admin APIs. Must be used after AuthJWT.
+// Checks whether the User in the token is an admin.
+func AdminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userEmail := models.User{
+			Email: c.GetString("email"),
+		}
+
+		user := userEmail.GetUserByEmail()
+		if user == nil || !user.IsAdmin {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "Admin only.",
+			})
+			c.Abort()
+			return
+		}
+
+		c.Set("adminID", user.ID)
+		c.Next()
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"b-pay/config/logger"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// Logger is a middleware which logs every request as one JSON line, after
+// RequestID. Secrets in the path and query are redacted by the logger.
+func Logger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := c.Writer.Status()
+		fields := append(logger.Fields(c),
+			zap.String("method", c.Request.Method),
+			zap.String("route", route),
+			zap.String("path", c.Request.URL.Path),
+			zap.String("query", c.Request.URL.RawQuery),
+			zap.Int("status", status),
+			zap.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+			zap.Int("bytes", c.Writer.Size()),
+			zap.String("ip", c.ClientIP()),
+			zap.String("user_agent", c.Request.UserAgent()),
+		)
+		if len(c.Errors) > 0 {
+			fields = append(fields, zap.String("errors", c.Errors.String()))
+		}
+
+		switch {
+		case status >= http.StatusInternalServerError:
+			logger.Log.Error("request", fields...)
+		case status >= http.StatusBadRequest:
+			logger.Log.Warn("request", fields...)
+		default:
+			logger.Log.Info("request", fields...)
+		}
+	}
+}
+
+// Recovery is a middleware which turns a panic into a 500 response, and logs
+// it with its stack.
+func Recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logger.For(c).Error("panic", zap.Any("panic", recovered), zap.Stack("stack"))
+				c.AbortWithStatus(http.StatusInternalServerError)
+			}
+		}()
+		c.Next()
+	}
+}
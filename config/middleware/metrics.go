@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"b-pay/config/logger"
+	"b-pay/config/metrics"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics is a middleware which counts the requests and observes their
+// latency by route template. Unknown routes share one label.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.HTTPRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		metrics.HTTPDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsToken is a middleware for the metrics endpoint. Requires the token
+// as "Authorization: Bearer <token>". Without a token the endpoint is open
+// in debug mode only, and closed in release mode.
+func MetricsToken(token string) gin.HandlerFunc {
+	closed := token == "" && gin.Mode() == gin.ReleaseMode
+	if closed {
+		logger.Log.Warn("METRICS_TOKEN is not set, the metrics endpoint is closed")
+	}
+	expected := []byte("Bearer " + token)
+
+	return func(c *gin.Context) {
+		if closed {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		given := []byte(c.Request.Header.Get("Authorization"))
+		if token != "" && subtle.ConstantTimeCompare(given, expected) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// validRequestID is what a request ID from the client can look like.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestID is a middleware which gives every request an ID. Keeps the
+// "X-Request-ID" header of the client when it is valid, otherwise makes one.
+// The ID is returned in the same header and set as "requestID".
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.Request.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(requestID) {
+			buf := make([]byte, 16)
+			rand.Read(buf)
+			requestID = hex.EncodeToString(buf)
+		}
+
+		c.Set("requestID", requestID)
+		c.Header("X-Request-ID", requestID)
+		c.Next()
+	}
+}
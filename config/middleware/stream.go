@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"b-pay/config/logger"
+	"context"
+	"net"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// connKey is the context key of the connection of a request.
+type connKey struct{}
+
+// KeepConn is the ConnContext of the server, which keeps the connection in
+// the context of its requests for NoWriteTimeout.
+func KeepConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// NoWriteTimeout is a middleware which lifts the write timeout of the server
+// for the streams, which write for as long as the client stays. They find
+// broken clients with their heartbeat instead.
+func NoWriteTimeout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if conn, ok := c.Request.Context().Value(connKey{}).(net.Conn); ok {
+			if err := conn.SetWriteDeadline(time.Time{}); err != nil {
+				logger.For(c).Warn("lifting write timeout failed", zap.Error(err))
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"b-pay/config/tracing"
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing is a middleware which makes a server span for every request, named
+// by its route template. Continues the trace of the W3C "traceparent" header
+// of the client.
+func Tracing() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := tracing.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(c.Request.Method),
+				semconv.HTTPRouteKey.String(route),
+				semconv.HTTPTargetKey.String(c.Request.URL.Path),
+				semconv.HTTPClientIPKey.String(c.ClientIP()),
+				attribute.String("request_id", c.GetString("requestID")),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// HandlerSpan is a middleware which makes a span for the controller of the
+// request, like "savingcontroller.ShowSavingHandler". Used after the auth
+// middlewares, so their time is left out.
+func HandlerSpan() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := path.Base(c.HandlerName())
+		ctx, span := tracing.Start(c.Request.Context(), name,
+			trace.WithAttributes(semconv.CodeFunctionKey.String(name)),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
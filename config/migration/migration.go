@@ -2,16 +2,48 @@ package migration
 
 import (
 	"b-pay/models"
+	"sync/atomic"
 
 	"gorm.io/gorm"
 )
 
+// migrated is set once every table and column exists, they are not removed
+// while the service runs.
+var migrated int32
+
 // AutoMigrate uses GORM's AutoMigrate to migrate Models.
-// Input models manually
-func AutoMigrate(db *gorm.DB) {
-	db.AutoMigrate(
-		&models.User{},
-		&models.Saving{},
-		&models.Transaction{},
-	)
+func AutoMigrate(db *gorm.DB) error {
+	return db.AutoMigrate(models.AllModels...)
+}
+
+// Pending returns the tables and columns of the Models which are missing in
+// the database, like "savings" or "savings.currency". Empty once migrated.
+func Pending(db *gorm.DB) ([]string, error) {
+	if atomic.LoadInt32(&migrated) == 1 {
+		return nil, nil
+	}
+
+	var pending []string
+	migrator := db.Migrator()
+	for _, model := range models.AllModels {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return nil, err
+		}
+		table := stmt.Schema.Table
+		if !migrator.HasTable(model) {
+			pending = append(pending, table)
+			continue
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !migrator.HasColumn(model, field.DBName) {
+				pending = append(pending, table+"."+field.DBName)
+			}
+		}
+	}
+
+	if len(pending) == 0 {
+		atomic.StoreInt32(&migrated, 1)
+	}
+	return pending, nil
 }
@@ -0,0 +1,48 @@
+package notify
+
+import (
+	"b-pay/config/logger"
+	"b-pay/config/mail"
+
+	"go.uber.org/zap"
+)
+
+// Notification is a message for one User.
+type Notification struct {
+	UserID uint
+	Email  string
+	// Kind identifies the event, like BUDGET_THRESHOLD.
+	Kind    string
+	Subject string
+	Body    string
+}
+
+// Notifier delivers Notifications.
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// LogNotifier only logs the Notifications.
+type LogNotifier struct{}
+
+// Notify logs the Notification.
+func (LogNotifier) Notify(n Notification) error {
+	logger.Log.Info("notification",
+		zap.String("kind", n.Kind),
+		zap.Uint("user_id", n.UserID),
+		zap.String("subject", n.Subject),
+	)
+	return nil
+}
+
+// MailNotifier emails the Notifications with mail.Mailer.
+type MailNotifier struct{}
+
+// Notify emails the Notification to the User.
+func (MailNotifier) Notify(n Notification) error {
+	return mail.Mailer.Send(n.Email, n.Subject, n.Body)
+}
+
+// Default is the Notifier used by the app. Notifications are emailed, so
+// they are logged when no SMTP server is configured.
+var Default Notifier = MailNotifier{}
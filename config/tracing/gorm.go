@@ -0,0 +1,97 @@
+package tracing
+
+import (
+	"errors"
+	"regexp"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// spanKey keeps the span of a query in its statement.
+const spanKey = "tracing:span"
+
+// literals are the values written into raw SQL instead of being bound.
+var literals = regexp.MustCompile(`'(?:[^']|'')*'`)
+
+// GormPlugin makes a span for every gorm query made with the context of a
+// span, see Saving.WithContext. The statement is recorded with its bound
+// parameters left out and its literals replaced.
+type GormPlugin struct{}
+
+// Name returns the name of the plugin.
+func (GormPlugin) Name() string {
+	return "tracing"
+}
+
+// Initialize registers the callbacks around every operation.
+func (GormPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	register := []func() error{
+		func() error {
+			return callbacks.Create().Before("gorm:create").Register("tracing:before_create", start("create"))
+		},
+		func() error { return callbacks.Create().After("gorm:create").Register("tracing:after_create", end) },
+		func() error {
+			return callbacks.Query().Before("gorm:query").Register("tracing:before_query", start("query"))
+		},
+		func() error { return callbacks.Query().After("gorm:query").Register("tracing:after_query", end) },
+		func() error {
+			return callbacks.Update().Before("gorm:update").Register("tracing:before_update", start("update"))
+		},
+		func() error { return callbacks.Update().After("gorm:update").Register("tracing:after_update", end) },
+		func() error {
+			return callbacks.Delete().Before("gorm:delete").Register("tracing:before_delete", start("delete"))
+		},
+		func() error { return callbacks.Delete().After("gorm:delete").Register("tracing:after_delete", end) },
+		func() error { return callbacks.Row().Before("gorm:row").Register("tracing:before_row", start("row")) },
+		func() error { return callbacks.Row().After("gorm:row").Register("tracing:after_row", end) },
+		func() error { return callbacks.Raw().Before("gorm:raw").Register("tracing:before_raw", start("raw")) },
+		func() error { return callbacks.Raw().After("gorm:raw").Register("tracing:after_raw", end) },
+	}
+	for _, fn := range register {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start starts the span of a query, unless its context has no span.
+func start(operation string) func(db *gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		if ctx == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+		_, span := Tracer.Start(ctx, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemPostgreSQL,
+				semconv.DBOperationKey.String(operation),
+			),
+		)
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+// end ends the span of a query with its statement and result.
+func end(db *gorm.DB) {
+	value, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	defer span.End()
+
+	span.SetAttributes(
+		semconv.DBStatementKey.String(literals.ReplaceAllString(db.Statement.SQL.String(), "'?'")),
+		semconv.DBSQLTableKey.String(db.Statement.Table),
+		attribute.Int64("db.rows_affected", db.RowsAffected),
+	)
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		Fail(span, db.Error)
+	}
+}
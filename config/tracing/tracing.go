@@ -0,0 +1,81 @@
+package tracing
+
+import (
+	"b-pay/config/logger"
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// serviceName is the service of the spans, OTEL_SERVICE_NAME overrides it.
+const serviceName = "b-pay"
+
+// Tracer starts the spans of the service. It uses the provider set by
+// InitTracing, and makes no spans before.
+var Tracer = otel.Tracer(serviceName)
+
+// InitTracing exports the spans to the exporter in OTEL_TRACES_EXPORTER:
+// "otlp" sends them over OTLP/HTTP to OTEL_EXPORTER_OTLP_ENDPOINT, "stdout"
+// prints them for local use. None by default. The W3C traceparent header is
+// propagated either way. Returns the function which flushes the spans left
+// on shutdown.
+func InitTracing() func(ctx context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch kind := os.Getenv("OTEL_TRACES_EXPORTER"); kind {
+	case "", "none":
+		return func(ctx context.Context) error { return nil }
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		logger.Log.Fatal("unknown OTEL_TRACES_EXPORTER", zap.String("value", kind))
+	}
+	if err != nil {
+		logger.Log.Fatal("creating trace exporter failed", zap.Error(err))
+	}
+
+	res, err := resource.New(context.Background(),
+		resource.WithAttributes(semconv.ServiceNameKey.String(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithHost(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		logger.Log.Fatal("creating trace resource failed", zap.Error(err))
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+// Start starts a span as a child of the span in ctx.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return Tracer.Start(ctx, name, opts...)
+}
+
+// Fail records err on the span and marks it as failed.
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
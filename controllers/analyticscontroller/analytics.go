@@ -0,0 +1,121 @@
+package analyticscontroller
+
+import (
+	"b-pay/config/auth"
+	"b-pay/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AnalyticsQuery is a struct to bind with the analytics query.
+type AnalyticsQuery struct {
+	// From and To are dates in YYYY-MM-DD format, both included. Optional,
+	// the last 6 months until the end of this month by default.
+	From string `form:"from"`
+	To   string `form:"to"`
+	// Period is day, week or month. Optional, month by default.
+	Period string `form:"period"`
+	// GroupBy is saving, type or category. Optional.
+	GroupBy string `form:"group-by"`
+	// Saving limits the analytics to one Saving. Optional.
+	Saving uint `form:"saving"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// ShowAnalyticsHandler shows the inflows, outflows and net change of the
+// Savings of the User by period and group, compared with the previous
+// range of the same length.
+func ShowAnalyticsHandler(c *gin.Context) {
+	var input AnalyticsQuery
+	if err := c.ShouldBindQuery(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	now := time.Now()
+	to := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local).AddDate(0, 1, 0)
+	if input.To != "" {
+		if to, err = time.ParseInLocation("2006-01-02", input.To, time.Local); err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, "To must be in YYYY-MM-DD format.")
+			return
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	from := to.AddDate(0, -6, 0)
+	if input.From != "" {
+		if from, err = time.ParseInLocation("2006-01-02", input.From, time.Local); err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, "From must be in YYYY-MM-DD format.")
+			return
+		}
+	}
+
+	if input.Saving != 0 {
+		var saving models.Saving
+		source := saving.WithContext(c.Request.Context()).GetSavingByID(strconv.FormatUint(uint64(input.Saving), 10))
+		if source == nil {
+			returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+			return
+		}
+		if !source.HasRole(userID, models.RoleViewer) {
+			returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this data.")
+			return
+		}
+	}
+
+	period := strings.ToLower(input.Period)
+	if period == "" {
+		period = models.PeriodMonth
+	}
+	result, err := models.GetAnalytics(models.AnalyticsQuery{
+		UserID:   userID,
+		SavingID: input.Saving,
+		From:     from,
+		To:       to,
+		Period:   period,
+		GroupBy:  strings.ToLower(input.GroupBy),
+	})
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+		"qty":  len(result.Buckets),
+	})
+	return
+}
+
+// RebuildRollupsHandler recomputes the analytics rollups from every
+// Transaction. Admin only.
+func RebuildRollupsHandler(c *gin.Context) {
+	count, err := models.RebuildRollups()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"qty": count,
+		"msg": "Rollups are rebuilt successfully.",
+	})
+	return
+}
@@ -0,0 +1,146 @@
+package auditcontroller
+
+import (
+	"b-pay/config/auth"
+	"b-pay/models"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AuditQuery is a struct to bind with the audit log query. Every filter is
+// optional.
+type AuditQuery struct {
+	Actor      uint   `form:"actor"`
+	Action     string `form:"action"`
+	TargetType string `form:"target-type"`
+	Target     uint   `form:"target"`
+	RequestID  string `form:"request-id"`
+	// From and To are dates in YYYY-MM-DD format, both included.
+	From  string `form:"from"`
+	To    string `form:"to"`
+	Page  int    `form:"page"`
+	Limit int    `form:"limit"`
+}
+
+// ActivityQuery is a struct to bind with the security activity query.
+type ActivityQuery struct {
+	Limit int `form:"limit"`
+}
+
+// defaultActivitySize is how many entries the security activity shows.
+const defaultActivitySize = 50
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// parseDay parses an optional date, days later.
+func parseDay(value string, days int) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	day = day.AddDate(0, 0, days)
+	return &day, nil
+}
+
+// IndexAuditLogHandler shows a page of the audit log, newest first. Admin
+// only.
+func IndexAuditLogHandler(c *gin.Context) {
+	var input AuditQuery
+	if err := c.ShouldBindQuery(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	from, err := parseDay(input.From, 0)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "From must be in YYYY-MM-DD format.")
+		return
+	}
+	to, err := parseDay(input.To, 1)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "To must be in YYYY-MM-DD format.")
+		return
+	}
+
+	results, err := models.GetAuditLogs(models.AuditQuery{
+		ActorID:    input.Actor,
+		Action:     input.Action,
+		TargetType: input.TargetType,
+		TargetID:   input.Target,
+		RequestID:  input.RequestID,
+		From:       from,
+		To:         to,
+		Page:       input.Page,
+		Limit:      input.Limit,
+	})
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": results,
+	})
+	return
+}
+
+// VerifyAuditChainHandler checks the hash chain of the audit log. Admin only.
+func VerifyAuditChainHandler(c *gin.Context) {
+	result, err := models.VerifyAuditChain()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	msg := "Audit log is intact."
+	if result.BrokenID != nil {
+		msg = "Audit log is tampered with."
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+		"msg":  msg,
+	})
+	return
+}
+
+// SecurityActivityHandler shows the latest logins, password and PIN changes
+// and other security actions of the User, newest first.
+func SecurityActivityHandler(c *gin.Context) {
+	var input ActivityQuery
+	if err := c.ShouldBindQuery(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if input.Limit == 0 {
+		input.Limit = defaultActivitySize
+	}
+
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	results, err := models.GetSecurityActivity(userID, input.Limit)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": results,
+	})
+	return
+}
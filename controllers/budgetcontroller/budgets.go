@@ -0,0 +1,144 @@
+package budgetcontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/config/logger"
+	"b-pay/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BudgetForm is a struct to bind with the Budget creation form.
+type BudgetForm struct {
+	Name string `form:"name" binding:"required"`
+	// Amount is the limit of every period, in minor units.
+	Amount int64 `form:"amount" binding:"required"`
+	// Period is WEEKLY, MONTHLY or YEARLY. Optional, MONTHLY by default.
+	Period string `form:"period"`
+	// Rollover is NONE, UNUSED or ALL. Optional, NONE by default.
+	Rollover string `form:"rollover"`
+	// Keywords are comma separated. Optional.
+	Keywords string `form:"keywords"`
+	// Thresholds are comma separated percents. Optional, 80,100 by default.
+	Thresholds string `form:"thresholds"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// getSavingWithRole gets the Saving with savingID and validates whether the
+// User of the token has at least role on it. Aborts and returns nil
+// if not.
+func getSavingWithRole(c *gin.Context, savingID string, role string) *models.Saving {
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return nil
+	}
+	logger.SetSavingID(c, source.ID)
+
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, role) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this data.")
+		return nil
+	}
+
+	return source
+}
+
+// CreateBudgetHandler creates a Budget of a Saving. Owner only.
+//
+// Requires "id" param
+func CreateBudgetHandler(c *gin.Context) {
+	var input BudgetForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	source := getSavingWithRole(c, c.Param("id"), models.RoleOwner)
+	if source == nil {
+		return
+	}
+
+	budget := models.Budget{
+		SavingID:   source.ID,
+		Name:       input.Name,
+		Amount:     input.Amount,
+		Period:     input.Period,
+		Rollover:   input.Rollover,
+		Keywords:   input.Keywords,
+		Thresholds: input.Thresholds,
+	}
+	if err := budget.Store(); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": budget,
+		"msg":  "Budget is created successfully.",
+	})
+	return
+}
+
+// ShowBudgetUsageHandler shows how much of every active Budget of a Saving is
+// spent in its current period.
+//
+// Requires "id" param
+func ShowBudgetUsageHandler(c *gin.Context) {
+	source := getSavingWithRole(c, c.Param("id"), models.RoleViewer)
+	if source == nil {
+		return
+	}
+
+	results, err := source.GetBudgetUsages(time.Now())
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": results,
+		"qty":  len(*results),
+	})
+	return
+}
+
+// DeleteBudgetHandler removes a Budget. Owner only.
+//
+// Requires "id" param
+func DeleteBudgetHandler(c *gin.Context) {
+	budget := models.GetBudgetByID(c.Param("id"))
+	if budget == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+
+	source := getSavingWithRole(c, strconv.FormatUint(uint64(budget.SavingID), 10), models.RoleOwner)
+	if source == nil {
+		return
+	}
+
+	if err := budget.Delete(); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit.Record(c, models.AuditBudgetDeleted, "budget", budget.ID, budget, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Budget is removed successfully.",
+	})
+	return
+}
@@ -0,0 +1,245 @@
+package categorycontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CategoryForm is a struct to bind with the Category creation form.
+type CategoryForm struct {
+	Name string `form:"name" binding:"required"`
+}
+
+// RuleForm is a struct to bind with the CategoryRule creation form. At least
+// one condition should be set, a rule without any matches everything.
+type RuleForm struct {
+	Category uint `form:"category" binding:"required"`
+	// Pattern is a case-insensitive regular expression of the description.
+	Pattern string `form:"pattern"`
+	Type    string `form:"type"`
+	// MinAmount and MaxAmount bound the absolute value. 0 means no bound.
+	MinAmount int64 `form:"min-amount"`
+	MaxAmount int64 `form:"max-amount"`
+	// Priority orders the rules, lowest first.
+	Priority int `form:"priority"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// getUserID gets the User ID from the token. Aborts and returns false if
+// there is none.
+func getUserID(c *gin.Context) (uint, bool) {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return 0, false
+	}
+	return userID, true
+}
+
+// IndexCategoryHandler shows the system categories and the categories of the
+// User.
+func IndexCategoryHandler(c *gin.Context) {
+	userID, ok := getUserID(c)
+	if !ok {
+		return
+	}
+
+	results, err := models.GetCategories(userID)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": results,
+		"qty":  len(*results),
+	})
+	return
+}
+
+// CreateCategoryHandler creates a category of the User.
+func CreateCategoryHandler(c *gin.Context) {
+	var input CategoryForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, ok := getUserID(c)
+	if !ok {
+		return
+	}
+
+	category := models.Category{
+		UserID: &userID,
+		Name:   input.Name,
+	}
+	if err := category.Store(); err != nil {
+		code := http.StatusBadRequest
+		if err == models.ErrCategoryExists {
+			code = http.StatusConflict
+		}
+		returnErrorAndAbort(c, code, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": category,
+		"msg":  "Category is created successfully.",
+	})
+	return
+}
+
+// DeleteCategoryHandler removes a category of the User with its rules. The
+// Transactions in it lose their category and the rules are applied to them
+// again.
+//
+// Requires "id" param
+func DeleteCategoryHandler(c *gin.Context) {
+	categoryID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Category ID is not valid.")
+		return
+	}
+
+	userID, ok := getUserID(c)
+	if !ok {
+		return
+	}
+
+	if err := models.DeleteCategory(userID, uint(categoryID)); err != nil {
+		code := http.StatusBadRequest
+		if err == models.ErrCategoryNotFound {
+			code = http.StatusNotFound
+		}
+		returnErrorAndAbort(c, code, err.Error())
+		return
+	}
+	audit.Record(c, models.AuditCategoryDeleted, "category", uint(categoryID), nil, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Category is removed successfully.",
+	})
+	return
+}
+
+// IndexRuleHandler shows the rules of the User in the order they are tried.
+func IndexRuleHandler(c *gin.Context) {
+	userID, ok := getUserID(c)
+	if !ok {
+		return
+	}
+
+	results, err := models.GetCategoryRules(userID)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": results,
+		"qty":  len(*results),
+	})
+	return
+}
+
+// CreateRuleHandler creates a rule of the User. It only applies to new
+// Transactions until the rules are applied again.
+func CreateRuleHandler(c *gin.Context) {
+	var input RuleForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, ok := getUserID(c)
+	if !ok {
+		return
+	}
+
+	rule := models.CategoryRule{
+		UserID:     userID,
+		CategoryID: input.Category,
+		Pattern:    input.Pattern,
+		Type:       input.Type,
+		MinAmount:  input.MinAmount,
+		MaxAmount:  input.MaxAmount,
+		Priority:   input.Priority,
+	}
+	if err := rule.Store(); err != nil {
+		code := http.StatusBadRequest
+		if err == models.ErrCategoryNotFound {
+			code = http.StatusNotFound
+		}
+		returnErrorAndAbort(c, code, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": rule,
+		"msg":  "Rule is created successfully.",
+	})
+	return
+}
+
+// DeleteRuleHandler removes a rule of the User. Transactions keep the
+// category it gave them until the rules are applied again.
+//
+// Requires "id" param
+func DeleteRuleHandler(c *gin.Context) {
+	userID, ok := getUserID(c)
+	if !ok {
+		return
+	}
+
+	if err := models.DeleteCategoryRule(userID, c.Param("id")); err != nil {
+		code := http.StatusBadRequest
+		if err == gorm.ErrRecordNotFound {
+			code = http.StatusNotFound
+		}
+		returnErrorAndAbort(c, code, err.Error())
+		return
+	}
+	ruleID, _ := strconv.ParseUint(c.Param("id"), 10, 0)
+	audit.Record(c, models.AuditRuleDeleted, "category_rule", uint(ruleID), nil, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Rule is removed successfully.",
+	})
+	return
+}
+
+// ApplyRulesHandler applies the rules of the User again to every Transaction
+// of their Savings. Manual categories are kept.
+func ApplyRulesHandler(c *gin.Context) {
+	userID, ok := getUserID(c)
+	if !ok {
+		return
+	}
+
+	changed, err := models.ReapplyRules(userID)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"qty": changed,
+		"msg": "Rules are applied successfully.",
+	})
+	return
+}
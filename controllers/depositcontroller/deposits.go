@@ -0,0 +1,236 @@
+package depositcontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/config/logger"
+	"b-pay/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateTimeDepositForm is a struct to bind with the time deposit creation
+// form.
+type CreateTimeDepositForm struct {
+	Name string `form:"name" binding:"required"`
+	PIN  string `form:"pin" binding:"required"`
+	// From is the Saving which funds the time deposit.
+	From   uint   `form:"from" binding:"required"`
+	Amount int64  `form:"amount" binding:"required"`
+	Tenor  int    `form:"tenor" binding:"required"`
+	Action string `form:"action" binding:"required"`
+	// Payout is the Saving which receives the money. Defaults to From.
+	Payout uint `form:"payout"`
+	// ProductID is the InterestProduct of the time deposit. Optional.
+	ProductID uint `form:"product"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// getOwnedSaving gets the Saving with savingID and validates whether the User
+// with userID is one of its owners. Aborts and returns nil if not.
+func getOwnedSaving(c *gin.Context, userID uint, savingID string) *models.Saving {
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Saving.")
+		return nil
+	}
+	logger.SetSavingID(c, source.ID)
+
+	if !source.HasRole(userID, models.RoleOwner) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this Saving.")
+		return nil
+	}
+
+	return source
+}
+
+// depositErrorCode maps the time deposit errors from models to an HTTP code.
+func depositErrorCode(err error) int {
+	if _, ok := err.(*models.LimitError); ok {
+		return http.StatusForbidden
+	}
+	switch err {
+	case models.ErrDepositNotActive:
+		return http.StatusConflict
+	case models.ErrInsufficientBalance, models.ErrInsufficientAvailableBalance:
+		return http.StatusNotAcceptable
+	case models.ErrGoalLocked, models.ErrTimeDepositLocked, models.ErrApprovalRequired:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// CreateTimeDepositHandler handles time deposit creation. Creates a Saving of
+// TIME_DEPOSIT kind funded from another Saving of the User.
+func CreateTimeDepositHandler(c *gin.Context) {
+	var input CreateTimeDepositForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if len(input.Name) < 3 {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Input name must be more than 3 characters")
+		return
+	}
+
+	_, err = strconv.Atoi(input.PIN)
+	if err != nil || len(input.PIN) != 6 {
+		returnErrorAndAbort(c, http.StatusBadRequest, "PIN must be numeric with 6 digits.")
+		return
+	}
+
+	if input.Payout == 0 {
+		input.Payout = input.From
+	}
+
+	from := getOwnedSaving(c, userID, strconv.FormatUint(uint64(input.From), 10))
+	if from == nil {
+		return
+	}
+	payout := getOwnedSaving(c, userID, strconv.FormatUint(uint64(input.Payout), 10))
+	if payout == nil {
+		return
+	}
+	if payout.IsTimeDeposit() {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Payout Saving can not be a time deposit.")
+		return
+	}
+	if payout.Currency != from.Currency {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Payout Saving must be in the currency of the funding Saving.")
+		return
+	}
+
+	hashedPIN, err := auth.HashSecret(c.Request.Context(), input.PIN)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest,
+			fmt.Sprintf("ERROR: Could not encrypt password. %s", err.Error()),
+		)
+		return
+	}
+
+	saving := models.Saving{
+		UserID: userID,
+		Name:   input.Name,
+		PIN:    hashedPIN,
+	}
+
+	if input.ProductID != 0 {
+		var product models.InterestProduct
+		if product.GetInterestProductByID(strconv.FormatUint(uint64(input.ProductID), 10)) == nil {
+			returnErrorAndAbort(c, http.StatusNotFound, "Interest product not found.")
+			return
+		}
+		saving.InterestProductID = &input.ProductID
+	}
+
+	deposit := models.TimeDeposit{
+		PayoutSavingID: payout.ID,
+		Principal:      input.Amount,
+		TenorMonths:    input.Tenor,
+		MaturityAction: strings.ToUpper(input.Action),
+	}
+
+	if err := deposit.WithContext(audit.Context(c)).Open(&saving, from.ID); err != nil {
+		returnErrorAndAbort(c, depositErrorCode(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": deposit,
+		"msg":  "Time deposit is opened successfully.",
+	})
+	return
+}
+
+// ShowTimeDepositHandler shows the term of a time deposit, with the penalty
+// of breaking it now.
+//
+// Requires "id" param
+func ShowTimeDepositHandler(c *gin.Context) {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	source := getOwnedSaving(c, userID, c.Param("id"))
+	if source == nil {
+		return
+	}
+
+	var deposit models.TimeDeposit
+	result := deposit.GetTimeDepositBySavingID(c.Param("id"))
+	if result == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+
+	var penalty int64
+	if result.Status == models.DepositActive {
+		penalty = result.Penalty(source.Balance, time.Now())
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":         result,
+		"balance":      source.Money(),
+		"breakPenalty": models.NewMoney(penalty, source.Currency),
+	})
+	return
+}
+
+// BreakTimeDepositHandler handles the early break of a time deposit. The
+// penalty is posted as its own Transaction and the rest is paid out.
+//
+// Requires "id" param
+func BreakTimeDepositHandler(c *gin.Context) {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if getOwnedSaving(c, userID, c.Param("id")) == nil {
+		return
+	}
+
+	var deposit models.TimeDeposit
+	result := deposit.GetTimeDepositBySavingID(c.Param("id"))
+	if result == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+
+	penalty, err := result.WithContext(audit.Context(c)).Break(time.Now())
+	if err != nil {
+		returnErrorAndAbort(c, depositErrorCode(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"penalty": penalty,
+		"msg":     "Time deposit is broken successfully.",
+	})
+	return
+}
@@ -0,0 +1,265 @@
+package feecontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// PreviewFeeForm is a struct to bind with the fee preview query.
+type PreviewFeeForm struct {
+	SavingID uint `form:"saving" binding:"required"`
+	// Type is DEPOSIT, WITHDRAWAL or TRANSFER.
+	Type  string `form:"type" binding:"required"`
+	Value int64  `form:"value" binding:"required"`
+}
+
+// CreateFeeScheduleForm is a struct to bind with the FeeSchedule creation
+// form.
+type CreateFeeScheduleForm struct {
+	Name string `form:"name" binding:"required"`
+	// Currency is an ISO 4217 code. Optional, IDR by default.
+	Currency   string `form:"currency"`
+	AppliesTo  string `form:"on" binding:"required"`
+	Method     string `form:"method" binding:"required"`
+	Kind       string `form:"kind"`
+	Flat       int64  `form:"flat"`
+	RateBps    int64  `form:"rate"`
+	Min        int64  `form:"min"`
+	Max        int64  `form:"max"`
+	MinBalance int64  `form:"min-balance"`
+}
+
+// UpdateFeeScheduleForm is a struct to bind with the FeeSchedule status form.
+type UpdateFeeScheduleForm struct {
+	Active bool `form:"active"`
+}
+
+// CreateWaiverForm is a struct to bind with the FeeWaiver creation form.
+type CreateWaiverForm struct {
+	UserID uint `form:"user" binding:"required"`
+	// FeeScheduleID is empty to waive every fee.
+	FeeScheduleID uint `form:"fee"`
+	// Until is an optional date in YYYY-MM-DD format.
+	Until  string `form:"until"`
+	Reason string `form:"reason"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// PreviewFeeHandler shows the fees of a Transaction before it is made.
+func PreviewFeeHandler(c *gin.Context) {
+	var input PreviewFeeForm
+	if err := c.ShouldBindQuery(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	on := strings.ToUpper(input.Type)
+	if on != models.FeeOnDeposit && on != models.FeeOnWithdrawal && on != models.FeeOnTransfer {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Type must be DEPOSIT, WITHDRAWAL or TRANSFER.")
+		return
+	}
+	if input.Value <= 0 {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Value must be more than 0.")
+		return
+	}
+
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(strconv.FormatUint(uint64(input.SavingID), 10))
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Saving.")
+		return
+	}
+
+	// Same roles as making the Transaction.
+	requiredRole := models.RoleOwner
+	if on == models.FeeOnDeposit {
+		requiredRole = models.RoleContributor
+	}
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, requiredRole) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this Saving.")
+		return
+	}
+
+	quotes, total, err := source.PreviewFees(on, input.Value)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":  quotes,
+		"value": models.NewMoney(input.Value, source.Currency),
+		"fee":   models.NewMoney(total, source.Currency),
+		"total": models.NewMoney(input.Value+total, source.Currency),
+	})
+	return
+}
+
+// IndexFeeScheduleHandler shows every FeeSchedule.
+func IndexFeeScheduleHandler(c *gin.Context) {
+	var schedule models.FeeSchedule
+
+	result, err := schedule.GetFeeSchedules()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+		"qty":  len(*result),
+	})
+	return
+}
+
+// CreateFeeScheduleHandler handles FeeSchedule creation. Admin only.
+func CreateFeeScheduleHandler(c *gin.Context) {
+	var input CreateFeeScheduleForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	schedule := models.FeeSchedule{
+		Name:       input.Name,
+		Currency:   strings.ToUpper(input.Currency),
+		AppliesTo:  strings.ToUpper(input.AppliesTo),
+		Method:     strings.ToUpper(input.Method),
+		Kind:       strings.ToUpper(input.Kind),
+		Flat:       input.Flat,
+		RateBps:    input.RateBps,
+		Min:        input.Min,
+		Max:        input.Max,
+		MinBalance: input.MinBalance,
+		Active:     true,
+	}
+
+	if err := schedule.Store(); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": schedule,
+		"msg":  "Fee schedule is stored successfully.",
+	})
+	return
+}
+
+// UpdateFeeScheduleHandler turns a FeeSchedule on or off. Admin only.
+//
+// Requires "id" param
+func UpdateFeeScheduleHandler(c *gin.Context) {
+	var input UpdateFeeScheduleForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var schedule models.FeeSchedule
+	if err := schedule.UpdateActive(c.Param("id"), input.Active); err != nil {
+		code := http.StatusBadRequest
+		if err == gorm.ErrRecordNotFound {
+			code = http.StatusNotFound
+		}
+		returnErrorAndAbort(c, code, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Fee schedule is updated successfully.",
+	})
+	return
+}
+
+// CreateWaiverHandler waives one or every fee for a User. Admin only.
+func CreateWaiverHandler(c *gin.Context) {
+	var input CreateWaiverForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	waiver := models.FeeWaiver{
+		UserID: input.UserID,
+		Reason: input.Reason,
+	}
+	if input.FeeScheduleID != 0 {
+		waiver.FeeScheduleID = &input.FeeScheduleID
+	}
+	if input.Until != "" {
+		until, err := time.ParseInLocation("2006-01-02", input.Until, time.Local)
+		if err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, "Until must be in YYYY-MM-DD format.")
+			return
+		}
+		// The waiver still applies on the until date.
+		until = until.AddDate(0, 0, 1)
+		waiver.Until = &until
+	}
+
+	if err := waiver.Store(); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit.Record(c, models.AuditFeeWaiverCreated, "fee_waiver", waiver.ID, nil, waiver)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": waiver,
+		"msg":  "Fee waiver is stored successfully.",
+	})
+	return
+}
+
+// IndexWaiverHandler shows every FeeWaiver of a User. Admin only.
+//
+// Requires "user" param
+func IndexWaiverHandler(c *gin.Context) {
+	var waiver models.FeeWaiver
+
+	result, err := waiver.GetFeeWaiversByUserID(c.Param("user"))
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+		"qty":  len(*result),
+	})
+	return
+}
+
+// DeleteWaiverHandler removes a FeeWaiver. Admin only.
+//
+// Requires "id" param
+func DeleteWaiverHandler(c *gin.Context) {
+	if err := models.DeleteFeeWaiver(c.Param("id")); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	waiverID, _ := strconv.ParseUint(c.Param("id"), 10, 0)
+	audit.Record(c, models.AuditFeeWaiverDeleted, "fee_waiver", uint(waiverID), nil, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Fee waiver is removed successfully.",
+	})
+	return
+}
@@ -0,0 +1,312 @@
+package fxcontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateQuoteForm is a struct to bind with the conversion quote form.
+type CreateQuoteForm struct {
+	SavingID uint `form:"saving" binding:"required"`
+	// Side is DEPOSIT or WITHDRAWAL.
+	Side     string `form:"side" binding:"required"`
+	Currency string `form:"currency" binding:"required"`
+	// Amount is in minor units of Currency.
+	Amount int64 `form:"amount" binding:"required"`
+	// Lock is how many seconds the quote can be executed. Optional.
+	Lock int `form:"lock"`
+}
+
+// ExecuteQuoteForm is a struct to bind with the quote execution form.
+type ExecuteQuoteForm struct {
+	Description string `form:"desc"`
+}
+
+// CreateRateForm is a struct to bind with the ExchangeRate creation form.
+type CreateRateForm struct {
+	Base  string `form:"base" binding:"required"`
+	Quote string `form:"quote" binding:"required"`
+	// Mid is a decimal, like "15750.25".
+	Mid          string `form:"mid" binding:"required"`
+	BidSpreadBps int64  `form:"bid"`
+	AskSpreadBps int64  `form:"ask"`
+	// EffectiveAt is in RFC 3339 format. Optional, now by default.
+	EffectiveAt string `form:"effective"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// returnExecuteErrorAndAbort returns the error of executing a quote. A
+// rejection by a Limit also returns its reason and the remaining allowance.
+func returnExecuteErrorAndAbort(ctx *gin.Context, err error) {
+	if limitErr, ok := err.(*models.LimitError); ok {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error":     limitErr.Error(),
+			"reason":    limitErr.Reason,
+			"scope":     limitErr.Scope,
+			"limit":     limitErr.Limit,
+			"remaining": limitErr.Remaining,
+		})
+		ctx.Abort()
+		return
+	}
+
+	switch err {
+	case models.ErrQuoteInvalid:
+		returnErrorAndAbort(ctx, http.StatusConflict, err.Error())
+	case models.ErrInsufficientBalance, models.ErrInsufficientAvailableBalance:
+		returnErrorAndAbort(ctx, http.StatusNotAcceptable, err.Error())
+	case models.ErrGoalLocked, models.ErrTimeDepositLocked, models.ErrApprovalRequired:
+		returnErrorAndAbort(ctx, http.StatusForbidden, err.Error())
+	default:
+		returnErrorAndAbort(ctx, http.StatusBadRequest, err.Error())
+	}
+}
+
+// requiredRole returns the role needed on a Saving for side. Contributors can
+// deposit, only owners can withdraw.
+func requiredRole(side string) string {
+	if side == models.TypeDeposit {
+		return models.RoleContributor
+	}
+	return models.RoleOwner
+}
+
+// checkApproval aborts when a WITHDRAWAL of value from the Saving needs the
+// approval of another owner, which quotes do not support.
+func checkApproval(c *gin.Context, source *models.Saving, side string, value int64) bool {
+	if side != models.TypeWithdrawal {
+		return true
+	}
+	needsApproval, err := source.NeedsApproval(value)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return false
+	}
+	if needsApproval {
+		returnErrorAndAbort(c, http.StatusForbidden, "This withdrawal needs the approval of another owner.")
+		return false
+	}
+	return true
+}
+
+// IndexRateHandler shows the effective rate of every currency pair.
+func IndexRateHandler(c *gin.Context) {
+	result, err := models.GetEffectiveRates(time.Now())
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	rates := make([]gin.H, 0, len(*result))
+	for _, rate := range *result {
+		rates = append(rates, gin.H{
+			"base":        rate.Base,
+			"quote":       rate.Quote,
+			"mid":         models.FormatRate(rate.MidRate),
+			"bidSpread":   rate.BidSpreadBps,
+			"askSpread":   rate.AskSpreadBps,
+			"effectiveAt": rate.EffectiveAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": rates,
+		"qty":  len(rates),
+	})
+	return
+}
+
+// CreateQuoteHandler quotes a conversion into or out of a Saving and locks it.
+func CreateQuoteHandler(c *gin.Context) {
+	var input CreateQuoteForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if input.Lock == 0 {
+		input.Lock = models.DefaultQuoteLock
+	}
+	side := strings.ToUpper(input.Side)
+
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(strconv.FormatUint(uint64(input.SavingID), 10))
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Saving.")
+		return
+	}
+
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, requiredRole(side)) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this Saving.")
+		return
+	}
+
+	quote, err := models.NewFxQuote(userID, source, side, strings.ToUpper(input.Currency), input.Amount, input.Lock)
+	if err != nil {
+		code := http.StatusBadRequest
+		if err == models.ErrRateNotFound {
+			code = http.StatusNotFound
+		}
+		returnErrorAndAbort(c, code, err.Error())
+		return
+	}
+	if !checkApproval(c, source, side, quote.Amount) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":    quote,
+		"foreign": models.NewMoney(quote.ForeignAmount, quote.ForeignCurrency),
+		"amount":  models.NewMoney(quote.Amount, quote.Currency),
+		"rate":    models.FormatRate(quote.Rate),
+		"msg":     "Quote is locked until it expires.",
+	})
+	return
+}
+
+// executeQuote executes the quote in the "id" param as side.
+func executeQuote(c *gin.Context, side string) {
+	var input ExecuteQuoteForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var quote models.FxQuote
+	source := quote.GetFxQuoteByID(c.Param("id"))
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+
+	// The role is checked again, it may have changed since the quote.
+	var saving models.Saving
+	target := saving.WithContext(c.Request.Context()).GetSavingByID(strconv.FormatUint(uint64(source.SavingID), 10))
+	if target == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Saving.")
+		return
+	}
+	userID, err := auth.UserID(c)
+	if err != nil || !target.HasRole(userID, requiredRole(side)) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to do this Transaction.")
+		return
+	}
+	if !checkApproval(c, target, side, source.Amount) {
+		return
+	}
+
+	transaction, err := source.WithContext(audit.Context(c)).Execute(userID, side, input.Description)
+	if err != nil {
+		returnExecuteErrorAndAbort(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": transaction,
+		"msg":  "Transaction added successfully.",
+	})
+	return
+}
+
+// DepositQuoteHandler deposits foreign currency into a Saving against a
+// locked quote.
+//
+// Requires "id" param
+func DepositQuoteHandler(c *gin.Context) {
+	executeQuote(c, models.TypeDeposit)
+}
+
+// WithdrawQuoteHandler withdraws foreign currency from a Saving against a
+// locked quote.
+//
+// Requires "id" param
+func WithdrawQuoteHandler(c *gin.Context) {
+	executeQuote(c, models.TypeWithdrawal)
+}
+
+// CreateRateHandler stores an ExchangeRate. Admin only.
+func CreateRateHandler(c *gin.Context) {
+	var input CreateRateForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	mid, err := models.ParseRate(input.Mid)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	effectiveAt := time.Now()
+	if input.EffectiveAt != "" {
+		effectiveAt, err = time.Parse(time.RFC3339, input.EffectiveAt)
+		if err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, "Effective date must be in RFC 3339 format.")
+			return
+		}
+	}
+
+	rate := models.ExchangeRate{
+		Base:         strings.ToUpper(input.Base),
+		Quote:        strings.ToUpper(input.Quote),
+		MidRate:      mid,
+		BidSpreadBps: input.BidSpreadBps,
+		AskSpreadBps: input.AskSpreadBps,
+		EffectiveAt:  effectiveAt,
+	}
+	if err := rate.Store(); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": rate,
+		"msg":  "Exchange rate is stored successfully.",
+	})
+	return
+}
+
+// UploadRatesHandler stores every rate of an uploaded CSV "file", see
+// models.LoadExchangeRates. Admin only.
+func UploadRatesHandler(c *gin.Context) {
+	header, err := c.FormFile("file")
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Rates file is required.")
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	count, err := models.LoadExchangeRates(file)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"qty": count,
+		"msg": "Exchange rates are loaded successfully.",
+	})
+	return
+}
@@ -0,0 +1,82 @@
+package healthcontroller
+
+import (
+	"b-pay/config/database"
+	"b-pay/config/migration"
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pingTimeout is how long the readiness check waits for the database.
+const pingTimeout = 2 * time.Second
+
+// draining is set once the service is shutting down.
+var draining int32
+
+// Drain makes the readiness check fail, so the load balancer stops sending
+// requests before the server stops.
+func Drain() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// HealthHandler reports that the process is up. Checks nothing else, so a
+// database outage does not restart every instance.
+func HealthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "OK.",
+	})
+	return
+}
+
+// ReadyHandler reports whether the service can take requests: it is not
+// shutting down, the database answers and no migration is pending.
+func ReadyHandler(c *gin.Context) {
+	if atomic.LoadInt32(&draining) == 1 {
+		returnErrorAndAbort(c, http.StatusServiceUnavailable, "Service is shutting down.")
+		return
+	}
+
+	sqlDB, err := database.DB.DB()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), pingTimeout)
+	defer cancel()
+	if err := sqlDB.PingContext(ctx); err != nil {
+		returnErrorAndAbort(c, http.StatusServiceUnavailable, "Database is unreachable.")
+		return
+	}
+
+	pending, err := migration.Pending(database.DB.WithContext(ctx))
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if len(pending) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"data":  pending,
+			"error": "Migrations are pending.",
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Ready.",
+	})
+	return
+}
@@ -0,0 +1,228 @@
+package holdcontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/config/logger"
+	"b-pay/models"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateHoldForm is a struct to bind with the Hold creation form.
+type CreateHoldForm struct {
+	SavingID  uint   `form:"saving" binding:"required"`
+	Amount    int64  `form:"amount" binding:"required"`
+	Reference string `form:"ref" binding:"required"`
+	// ExpiresIn is the lifetime of the Hold in minutes.
+	ExpiresIn int `form:"expires-in" binding:"required"`
+}
+
+// CaptureHoldForm is a struct to bind with the Hold capture form.
+type CaptureHoldForm struct {
+	// Value to be captured. Leave empty to capture the whole Hold.
+	Value int64 `form:"value"`
+}
+
+// maxHoldLifetime is the longest time a Hold can reserve money.
+const maxHoldLifetime = 30 * 24 * time.Hour
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// getSavingWithRole gets the Saving with savingID and validates whether the
+// User of the token has at least role on it. Aborts and returns nil
+// if not.
+func getSavingWithRole(c *gin.Context, savingID uint, role string) *models.Saving {
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(strconv.FormatUint(uint64(savingID), 10))
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Saving.")
+		return nil
+	}
+	logger.SetSavingID(c, source.ID)
+
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, role) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this Saving.")
+		return nil
+	}
+
+	return source
+}
+
+// getOwnedHold gets the Hold from the "id" param and validates whether the
+// User of the token is an owner of its Saving. Aborts and returns nil
+// if not.
+func getOwnedHold(c *gin.Context) *models.Hold {
+	holdID := c.Param("id")
+	if holdID == "" {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Hold ID is empty")
+		return nil
+	}
+
+	var hold models.Hold
+	source := hold.GetHoldByID(holdID)
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Hold.")
+		return nil
+	}
+
+	if getSavingWithRole(c, source.SavingID, models.RoleOwner) == nil {
+		return nil
+	}
+
+	return source
+}
+
+// holdErrorCode maps the Hold errors from models to an HTTP code.
+func holdErrorCode(err error) int {
+	if _, ok := err.(*models.LimitError); ok {
+		return http.StatusForbidden
+	}
+	switch err {
+	case models.ErrHoldNotActive, models.ErrHoldExpired:
+		return http.StatusConflict
+	case models.ErrInsufficientBalance, models.ErrInsufficientAvailableBalance:
+		return http.StatusNotAcceptable
+	case models.ErrGoalLocked, models.ErrTimeDepositLocked, models.ErrApprovalRequired:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// CreateHoldHandler handles Hold creation. Reserves an amount of a Saving.
+func CreateHoldHandler(c *gin.Context) {
+	var input CreateHoldForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.Amount <= 0 {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Amount must be more than 0.")
+		return
+	}
+
+	lifetime := time.Duration(input.ExpiresIn) * time.Minute
+	if lifetime <= 0 || lifetime > maxHoldLifetime {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Expiry must be between 1 minute and 30 days.")
+		return
+	}
+
+	source := getSavingWithRole(c, input.SavingID, models.RoleOwner)
+	if source == nil {
+		return
+	}
+
+	hold := models.Hold{
+		SavingID:  source.ID,
+		Amount:    input.Amount,
+		Reference: input.Reference,
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+
+	if err := hold.Store(); err != nil {
+		returnErrorAndAbort(c, holdErrorCode(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": hold,
+		"msg":  "Hold placed successfully.",
+	})
+	return
+}
+
+// IndexHoldHandler shows every Hold of a Saving.
+//
+// Requires "id" param
+func IndexHoldHandler(c *gin.Context) {
+	savingID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Saving ID is invalid")
+		return
+	}
+
+	source := getSavingWithRole(c, uint(savingID), models.RoleViewer)
+	if source == nil {
+		return
+	}
+
+	var hold models.Hold
+	result, err := hold.GetHoldsBySavingID(source.ID)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+		"qty":  len(*result),
+	})
+	return
+}
+
+// CaptureHoldHandler handles Hold capture. Settles the Hold, fully or
+// partially, as a WITHDRAWAL.
+//
+// Requires "id" param
+func CaptureHoldHandler(c *gin.Context) {
+	var input CaptureHoldForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.Value < 0 {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Value can not be negative.")
+		return
+	}
+
+	source := getOwnedHold(c)
+	if source == nil {
+		return
+	}
+
+	transaction, err := source.WithContext(audit.Context(c)).Capture(input.Value)
+	if err != nil {
+		returnErrorAndAbort(c, holdErrorCode(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": transaction,
+		"msg":  "Hold captured successfully.",
+	})
+	return
+}
+
+// ReleaseHoldHandler handles Hold release. No money is moved.
+//
+// Requires "id" param
+func ReleaseHoldHandler(c *gin.Context) {
+	source := getOwnedHold(c)
+	if source == nil {
+		return
+	}
+
+	if err := source.Release(); err != nil {
+		returnErrorAndAbort(c, holdErrorCode(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Hold released successfully.",
+	})
+	return
+}
@@ -0,0 +1,126 @@
+package importcontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ImportForm is a struct to bind with the import form. The "file" field is
+// the CSV. Every column is a header name, see models.DefaultImportMapping for
+// the defaults.
+type ImportForm struct {
+	DateColumn        string `form:"date-column"`
+	AmountColumn      string `form:"amount-column"`
+	TypeColumn        string `form:"type-column"`
+	DescriptionColumn string `form:"description-column"`
+	ReferenceColumn   string `form:"reference-column"`
+	// DateFormat is a Go time layout, like 02/01/2006.
+	DateFormat string `form:"date-format"`
+	// DryRun only validates the file and returns the report.
+	DryRun bool `form:"dry-run"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// ImportTransactionsHandler imports the Transactions of a CSV "file" to a
+// Saving, or only validates them on a dry run. Nothing is imported when any
+// row is bad. Owner or admin only, and only admins can import DEPOSITs.
+//
+// Requires "id" param
+func ImportTransactionsHandler(c *gin.Context) {
+	var input ImportForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	savingID := c.Param("id")
+	if savingID == "" {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Saving ID is empty")
+		return
+	}
+
+	var saving models.Saving
+	source := saving.WithContext(audit.Context(c)).GetSavingByID(savingID)
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return
+	}
+	var user models.User
+	account := user.GetUserByID(strconv.FormatUint(uint64(userID), 10))
+	admin := account != nil && account.IsAdmin
+	if !admin && !source.HasRole(userID, models.RoleOwner) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this data.")
+		return
+	}
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Import file is required.")
+		return
+	}
+	file, err := header.Open()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer file.Close()
+
+	mapping := models.ImportMapping{
+		Date:        input.DateColumn,
+		Amount:      input.AmountColumn,
+		Type:        input.TypeColumn,
+		Description: input.DescriptionColumn,
+		Reference:   input.ReferenceColumn,
+		DateFormat:  input.DateFormat,
+	}
+	report, err := source.ImportTransactions(file, mapping, !input.DryRun, admin)
+	if err == models.ErrImportInvalid {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error": err.Error(),
+			"data":  report,
+		})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		code := http.StatusBadRequest
+		if err == models.ErrTimeDepositLocked {
+			code = http.StatusForbidden
+		}
+		returnErrorAndAbort(c, code, err.Error())
+		return
+	}
+
+	msg := "Import is valid."
+	if !report.OK() {
+		msg = "Import has errors."
+	}
+	if report.Committed {
+		msg = "Transactions are imported successfully."
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": report,
+		"qty":  report.Valid,
+		"msg":  msg,
+	})
+	return
+}
@@ -0,0 +1,132 @@
+package interestcontroller
+
+import (
+	"b-pay/models"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateProductForm is a struct to bind with the InterestProduct creation
+// form.
+type CreateProductForm struct {
+	Name string `form:"name" binding:"required"`
+	// Currency is an ISO 4217 code. Optional, IDR by default.
+	Currency          string `form:"currency"`
+	AnnualRateBps     int64  `form:"rate"`
+	DayCount          string `form:"day-count" binding:"required"`
+	WithholdingTaxBps int64  `form:"tax"`
+	// TierMins and TierRates are the tiers, in the same order.
+	TierMins  []int64 `form:"tier-min"`
+	TierRates []int64 `form:"tier-rate"`
+}
+
+// RunInterestForm is a struct to bind with the interest engine run form.
+type RunInterestForm struct {
+	// Date in YYYY-MM-DD format.
+	Date string `form:"date" binding:"required"`
+	// Capitalise also posts the interest of the month of Date.
+	Capitalise bool `form:"capitalise"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// CreateProductHandler handles InterestProduct creation. Admin only.
+func CreateProductHandler(c *gin.Context) {
+	var input CreateProductForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if len(input.TierMins) != len(input.TierRates) {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Every tier needs a minimum balance and a rate.")
+		return
+	}
+
+	product := models.InterestProduct{
+		Name:              input.Name,
+		Currency:          strings.ToUpper(input.Currency),
+		AnnualRateBps:     input.AnnualRateBps,
+		DayCount:          strings.ToUpper(input.DayCount),
+		WithholdingTaxBps: input.WithholdingTaxBps,
+	}
+	for i := range input.TierMins {
+		product.Tiers = append(product.Tiers, models.InterestTier{
+			MinBalance: input.TierMins[i],
+			RateBps:    input.TierRates[i],
+		})
+	}
+
+	if err := product.Store(); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": product,
+		"msg":  "Interest product is stored successfully.",
+	})
+	return
+}
+
+// IndexProductHandler shows every InterestProduct.
+func IndexProductHandler(c *gin.Context) {
+	var product models.InterestProduct
+
+	result, err := product.GetInterestProducts()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+		"qty":  len(*result),
+	})
+	return
+}
+
+// RunInterestHandler runs the interest engine for a date. Admin only.
+//
+// Accrues the interest of the date, and capitalises its month if asked.
+// Running it again for the same date does not post anything twice.
+func RunInterestHandler(c *gin.Context) {
+	var input RunInterestForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", input.Date, time.Local)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Date must be in YYYY-MM-DD format.")
+		return
+	}
+
+	if err := models.AccrueInterest(date); err != nil {
+		returnErrorAndAbort(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if input.Capitalise {
+		if err := models.CapitaliseInterest(date); err != nil {
+			returnErrorAndAbort(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Interest engine ran successfully.",
+	})
+	return
+}
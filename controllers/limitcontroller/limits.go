@@ -0,0 +1,208 @@
+package limitcontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/config/logger"
+	"b-pay/models"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LimitForm is a struct to bind with the Limit form of a User. A value of 0
+// means no cap.
+type LimitForm struct {
+	Direction      string `form:"direction" binding:"required"`
+	PerTransaction int64  `form:"per-transaction"`
+	Daily          int64  `form:"daily"`
+	Monthly        int64  `form:"monthly"`
+	// Currency is an ISO 4217 code. Optional, IDR by default. Limits of a
+	// Saving are in its currency.
+	Currency string `form:"currency"`
+}
+
+// AdminLimitForm is a struct to bind with the Limit form of an admin.
+type AdminLimitForm struct {
+	LimitForm
+	Scope string `form:"scope" binding:"required"`
+	// Ref is the Saving kind, the User ID or the Saving ID, by scope.
+	Ref string `form:"ref" binding:"required"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// getSavingWithRole gets the Saving from the "id" param and validates whether
+// the User of the token has at least role on it. Aborts and returns
+// nil if not.
+func getSavingWithRole(c *gin.Context, role string) *models.Saving {
+	savingID := c.Param("id")
+	if savingID == "" {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Saving ID is empty")
+		return nil
+	}
+
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return nil
+	}
+	logger.SetSavingID(c, source.ID)
+
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, role) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this data.")
+		return nil
+	}
+
+	return source
+}
+
+// saveLimit stores the Limit and returns it, or the error.
+func saveLimit(c *gin.Context, limit *models.Limit) {
+	if err := limit.Save(); err != nil {
+		code := http.StatusBadRequest
+		if err == models.ErrLimitRaise {
+			code = http.StatusForbidden
+		}
+		returnErrorAndAbort(c, code, err.Error())
+		return
+	}
+	audit.Record(c, models.AuditLimitSet, "limit", limit.ID, nil, limit)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": limit,
+		"msg":  "Limit is stored successfully.",
+	})
+}
+
+// ShowSavingLimitsHandler shows every Limit which applies to a Saving and
+// what it can still deposit and withdraw.
+//
+// Requires "id" param
+func ShowSavingLimitsHandler(c *gin.Context) {
+	source := getSavingWithRole(c, models.RoleViewer)
+	if source == nil {
+		return
+	}
+
+	limits, err := source.GetLimits()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	allowances, err := source.GetAllowances()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":       limits,
+		"allowances": allowances,
+	})
+	return
+}
+
+// SetUserLimitHandler lowers the Limit of the User on all of their Savings.
+func SetUserLimitHandler(c *gin.Context) {
+	var input LimitForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	saveLimit(c, &models.Limit{
+		Scope:          models.ScopeUser,
+		ScopeRef:       strconv.FormatUint(uint64(userID), 10),
+		Direction:      strings.ToUpper(input.Direction),
+		SetBy:          models.SetByUser,
+		Currency:       strings.ToUpper(input.Currency),
+		PerTransaction: input.PerTransaction,
+		Daily:          input.Daily,
+		Monthly:        input.Monthly,
+	})
+	return
+}
+
+// SetSavingLimitHandler lowers the Limit of one Saving. Owner only.
+//
+// Requires "id" param
+func SetSavingLimitHandler(c *gin.Context) {
+	var input LimitForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	source := getSavingWithRole(c, models.RoleOwner)
+	if source == nil {
+		return
+	}
+
+	saveLimit(c, &models.Limit{
+		Scope:          models.ScopeSaving,
+		ScopeRef:       strconv.FormatUint(uint64(source.ID), 10),
+		Direction:      strings.ToUpper(input.Direction),
+		SetBy:          models.SetByUser,
+		Currency:       source.Currency,
+		PerTransaction: input.PerTransaction,
+		Daily:          input.Daily,
+		Monthly:        input.Monthly,
+	})
+	return
+}
+
+// SetLimitHandler sets a Limit of any scope. Admin only.
+func SetLimitHandler(c *gin.Context) {
+	var input AdminLimitForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	saveLimit(c, &models.Limit{
+		Scope:          strings.ToUpper(input.Scope),
+		ScopeRef:       input.Ref,
+		Direction:      strings.ToUpper(input.Direction),
+		SetBy:          models.SetByAdmin,
+		Currency:       strings.ToUpper(input.Currency),
+		PerTransaction: input.PerTransaction,
+		Daily:          input.Daily,
+		Monthly:        input.Monthly,
+	})
+	return
+}
+
+// DeleteLimitHandler removes a Limit, also one set by a User. Admin only.
+//
+// Requires "id" param
+func DeleteLimitHandler(c *gin.Context) {
+	if err := models.DeleteLimit(c.Param("id")); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	limitID, _ := strconv.ParseUint(c.Param("id"), 10, 0)
+	audit.Record(c, models.AuditLimitDeleted, "limit", uint(limitID), nil, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Limit is removed successfully.",
+	})
+	return
+}
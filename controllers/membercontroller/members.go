@@ -0,0 +1,370 @@
+package membercontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/config/logger"
+	"b-pay/config/mail"
+	"b-pay/models"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InviteMemberForm is a struct to bind with the member invitation form.
+type InviteMemberForm struct {
+	Email string `form:"email" binding:"required"`
+	Role  string `form:"role" binding:"required"`
+}
+
+// AcceptInvitationForm is a struct to bind with the invitation acceptance
+// form.
+type AcceptInvitationForm struct {
+	Token string `form:"token" binding:"required"`
+}
+
+// UpdateThresholdForm is a struct to bind with the approval threshold form.
+type UpdateThresholdForm struct {
+	// Threshold of 0 turns approvals off.
+	Threshold int64 `form:"threshold"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// getSavingWithRole gets the Saving from the "id" param and validates whether
+// the User of the token has at least role on it. Aborts and returns
+// nil if not.
+func getSavingWithRole(c *gin.Context, role string) (*models.Saving, uint) {
+	savingID := c.Param("id")
+	if savingID == "" {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Saving ID is empty")
+		return nil, 0
+	}
+
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return nil, 0
+	}
+	logger.SetSavingID(c, source.ID)
+
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, role) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this data.")
+		return nil, 0
+	}
+
+	return source, userID
+}
+
+// InviteMemberHandler invites an email to a Saving with a role. The token is
+// sent to the email. Owner only. Inviting an owner to a Saving which needs
+// approvals waits for the approval of another owner.
+//
+// Requires "id" param
+func InviteMemberHandler(c *gin.Context) {
+	var input InviteMemberForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	role := strings.ToUpper(input.Role)
+	if !models.ValidRole(role) {
+		returnErrorAndAbort(c, http.StatusBadRequest, models.ErrInvalidRole.Error())
+		return
+	}
+
+	source, userID := getSavingWithRole(c, models.RoleOwner)
+	if source == nil {
+		return
+	}
+
+	invitation := models.SavingInvitation{
+		SavingID:  source.ID,
+		Email:     input.Email,
+		Role:      role,
+		InvitedBy: userID,
+	}
+
+	token, pending, err := invitation.Store()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	body := fmt.Sprintf("You are invited as %s. Use this token to accept the invitation: %s", role, token)
+	if pending != nil {
+		body += "\nThe invitation can be accepted once another owner approves it."
+	}
+	err = mail.Mailer.Send(invitation.Email, fmt.Sprintf("You are invited to the Saving %s", source.Name), body)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusInternalServerError, "Failed to send invitation email.")
+		return
+	}
+	audit.Record(c, models.AuditMemberInvited, "saving", source.ID, nil, invitation)
+
+	if pending != nil {
+		c.JSON(http.StatusAccepted, gin.H{
+			"data": pending.ID,
+			"msg":  "Invitation sent, it is waiting for the approval of another owner.",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data": invitation.ID,
+		"msg":  "Invitation sent successfully.",
+	})
+	return
+}
+
+// AcceptInvitationHandler makes the User in the token a member of the Saving
+// of the invitation.
+func AcceptInvitationHandler(c *gin.Context) {
+	var input AcceptInvitationForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The invitation must be for the email of the logged in User.
+	userEmail := models.User{
+		Email: c.GetString("email"),
+	}
+	user := userEmail.GetUserByEmail()
+	if user == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "User not found.")
+		return
+	}
+
+	member, err := models.AcceptInvitation(input.Token, user)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusForbidden, err.Error())
+		return
+	}
+	audit.Record(c, models.AuditMemberJoined, "saving", member.SavingID, nil, member)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": member,
+		"msg":  "Invitation accepted successfully.",
+	})
+	return
+}
+
+// IndexMemberHandler shows every member of a Saving.
+//
+// Requires "id" param
+func IndexMemberHandler(c *gin.Context) {
+	source, _ := getSavingWithRole(c, models.RoleViewer)
+	if source == nil {
+		return
+	}
+
+	result, err := source.GetMembers()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"owner": source.UserID,
+		"data":  result,
+		"qty":   len(*result),
+	})
+	return
+}
+
+// RemoveMemberHandler removes a member from a Saving. Owners can remove
+// anyone but the creator of the Saving, members can remove themselves.
+//
+// Requires "id" and "member" params
+func RemoveMemberHandler(c *gin.Context) {
+	memberID, err := strconv.ParseUint(c.Param("member"), 10, 0)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Member ID is invalid")
+		return
+	}
+
+	source, userID := getSavingWithRole(c, models.RoleViewer)
+	if source == nil {
+		return
+	}
+
+	if uint(memberID) != userID && !source.HasRole(userID, models.RoleOwner) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to remove this member.")
+		return
+	}
+	if uint(memberID) == source.UserID {
+		returnErrorAndAbort(c, http.StatusBadRequest, "The creator of the Saving can not be removed.")
+		return
+	}
+
+	pending, err := source.RemoveMember(userID, uint(memberID))
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if pending != nil {
+		c.JSON(http.StatusAccepted, gin.H{
+			"data": pending.ID,
+			"msg":  "Removing an owner is waiting for the approval of another owner.",
+		})
+		return
+	}
+	audit.Record(c, models.AuditMemberRemoved, "user", uint(memberID), gin.H{"SavingID": source.ID}, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Member removed successfully.",
+	})
+	return
+}
+
+// UpdateThresholdHandler changes the withdrawal value above which a second
+// owner must approve. Owner only. Raising it or turning it off waits for the
+// approval of another owner.
+//
+// Requires "id" param
+func UpdateThresholdHandler(c *gin.Context) {
+	var input UpdateThresholdForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.Threshold < 0 {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Threshold can not be negative.")
+		return
+	}
+
+	source, userID := getSavingWithRole(c, models.RoleOwner)
+	if source == nil {
+		return
+	}
+
+	before := gin.H{"ApprovalThreshold": source.ApprovalThreshold}
+	pending, err := source.UpdateApprovalThreshold(userID, input.Threshold)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if pending != nil {
+		c.JSON(http.StatusAccepted, gin.H{
+			"data": pending.ID,
+			"msg":  "Approval threshold change is waiting for the approval of another owner.",
+		})
+		return
+	}
+	audit.Record(c, models.AuditThresholdChanged, "saving", source.ID, before, gin.H{"ApprovalThreshold": input.Threshold})
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Approval threshold updated successfully.",
+	})
+	return
+}
+
+// IndexPendingChangeHandler shows every change of a Saving waiting for the
+// approval of another owner. Owner only.
+//
+// Requires "id" param
+func IndexPendingChangeHandler(c *gin.Context) {
+	source, _ := getSavingWithRole(c, models.RoleOwner)
+	if source == nil {
+		return
+	}
+
+	var pending models.PendingChange
+	result, err := pending.GetPendingChangesBySavingID(source.ID)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+		"qty":  len(*result),
+	})
+	return
+}
+
+// decideChange approves or rejects the pending change from the "id" param.
+// Must be an owner other than the one who requested it.
+func decideChange(c *gin.Context, approve bool) {
+	var pending models.PendingChange
+	source := pending.GetPendingChangeByID(c.Param("id"))
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+
+	var saving models.Saving
+	target := saving.WithContext(c.Request.Context()).GetSavingByID(strconv.FormatUint(uint64(source.SavingID), 10))
+	if target == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+	logger.SetSavingID(c, target.ID)
+
+	userID, err := auth.UserID(c)
+	if err != nil || !target.HasRole(userID, models.RoleOwner) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this data.")
+		return
+	}
+
+	err = source.Decide(userID, approve)
+	switch err {
+	case nil:
+	case models.ErrChangeInvalid:
+		returnErrorAndAbort(c, http.StatusConflict, err.Error())
+		return
+	default:
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !approve {
+		c.JSON(http.StatusOK, gin.H{
+			"msg": "Change rejected.",
+		})
+		return
+	}
+
+	switch source.Kind {
+	case models.ChangeRemoveOwner:
+		audit.Record(c, models.AuditMemberRemoved, "user", source.MemberID, gin.H{"SavingID": source.SavingID}, nil)
+	case models.ChangeThreshold:
+		audit.Record(c, models.AuditThresholdChanged, "saving", source.SavingID,
+			gin.H{"ApprovalThreshold": target.ApprovalThreshold}, gin.H{"ApprovalThreshold": source.Threshold})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": source,
+		"msg":  "Change approved and made successfully.",
+	})
+}
+
+// ApproveChangeHandler approves a pending change and makes it.
+//
+// Requires "id" param
+func ApproveChangeHandler(c *gin.Context) {
+	decideChange(c, true)
+	return
+}
+
+// RejectChangeHandler rejects a pending change.
+//
+// Requires "id" param
+func RejectChangeHandler(c *gin.Context) {
+	decideChange(c, false)
+	return
+}
@@ -1,20 +1,34 @@
 package savingcontroller
 
 import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/config/logger"
+	"b-pay/config/metrics"
 	"b-pay/models"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
+	"go.uber.org/zap"
 )
 
 // CreateSavingForm is a struct for Create a Saving.
 type CreateSavingForm struct {
 	Name string `form:"name" binding:"required"`
 	PIN  string `form:"pin" binding:"required"`
+	// ProductID is the InterestProduct of the Saving. Optional.
+	ProductID uint `form:"product"`
+	// Target, TargetDate (YYYY-MM-DD) and Lock set a goal. Optional.
+	Target     int64  `form:"target"`
+	TargetDate string `form:"target-date"`
+	Lock       bool   `form:"lock"`
+	// Currency is an ISO 4217 code. Optional, IDR by default.
+	Currency string `form:"currency"`
 }
 
 // LoginSavingForm is a struct for accessing a Saving.
@@ -22,6 +36,14 @@ type LoginSavingForm struct {
 	PIN string `form:"pin" binding:"required"`
 }
 
+// UpdateGoalForm is a struct for Updating the goal of a Saving.
+// A Target of 0 removes the goal.
+type UpdateGoalForm struct {
+	Target     int64  `form:"target"`
+	TargetDate string `form:"target-date"`
+	Lock       bool   `form:"lock"`
+}
+
 // UpdateSavingForm is a struct for Updating Saving data.
 type UpdateSavingForm struct {
 	Name string `form:"name" binding:"required"`
@@ -39,6 +61,40 @@ func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
 	ctx.Abort()
 }
 
+// checkRole validates whether the User of the token has at least
+// role on the Saving. Aborts and returns false if not.
+func checkRole(c *gin.Context, source *models.Saving, role string) bool {
+	logger.SetSavingID(c, source.ID)
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, role) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this data.")
+		return false
+	}
+	return true
+}
+
+// parseGoal validates the goal inputs. Returns the parsed target date, which is
+// nil when it is empty.
+func parseGoal(target int64, targetDate string, lock bool) (*time.Time, error) {
+	if target < 0 {
+		return nil, errors.New("Target can not be negative.")
+	}
+
+	var date *time.Time
+	if targetDate != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", targetDate, time.Local)
+		if err != nil {
+			return nil, errors.New("Target date must be in YYYY-MM-DD format.")
+		}
+		date = &parsed
+	}
+
+	if lock && target == 0 && date == nil {
+		return nil, errors.New("Locking a Saving needs a target or a target date.")
+	}
+	return date, nil
+}
+
 // CreateSavingHandler handles Saving creation.
 func CreateSavingHandler(c *gin.Context) {
 	var input CreateSavingForm
@@ -47,10 +103,9 @@ func CreateSavingHandler(c *gin.Context) {
 		return
 	}
 
-	// Get UserID from Header.
-	userID, err := strconv.ParseUint(c.Request.Header.Get("userID"), 10, 0)
+	userID, err := auth.UserID(c)
 	if err != nil {
-		returnErrorAndAbort(c, http.StatusBadRequest, "User ID is not found.")
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
 		return
 	}
 
@@ -66,7 +121,7 @@ func CreateSavingHandler(c *gin.Context) {
 	}
 
 	// Encrypt password for an account.
-	hashedPIN, err := bcrypt.GenerateFromPassword([]byte(input.PIN), bcrypt.DefaultCost)
+	hashedPIN, err := auth.HashSecret(c.Request.Context(), input.PIN)
 	if err != nil {
 		returnErrorAndAbort(c, http.StatusBadRequest,
 			fmt.Sprintf("ERROR: Could not encrypt password. %s", err.Error()),
@@ -75,16 +130,43 @@ func CreateSavingHandler(c *gin.Context) {
 	}
 
 	saving := models.Saving{
-		UserID:  uint(userID),
-		Name:    input.Name,
-		Balance: 0,
-		PIN:     hashedPIN,
+		UserID:   userID,
+		Name:     input.Name,
+		Balance:  0,
+		Currency: strings.ToUpper(input.Currency),
+		PIN:      hashedPIN,
+	}
+	if saving.Currency != "" && !models.ValidCurrency(saving.Currency) {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Currency is not supported.")
+		return
+	}
+
+	targetDate, err := parseGoal(input.Target, input.TargetDate, input.Lock)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	saving.TargetAmount = input.Target
+	saving.TargetDate = targetDate
+	saving.LockUntilGoal = input.Lock
+
+	if input.ProductID != 0 {
+		var product models.InterestProduct
+		if product.GetInterestProductByID(strconv.FormatUint(uint64(input.ProductID), 10)) == nil {
+			returnErrorAndAbort(c, http.StatusNotFound, "Interest product not found.")
+			return
+		}
+		saving.InterestProductID = &input.ProductID
 	}
 
 	if err := saving.Store(); err != nil {
 		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
 		return
 	}
+	audit.Record(c, models.AuditSavingCreated, "saving", saving.ID, nil, saving)
+	if err := saving.PublishEvent(models.EventSavingCreated); err != nil {
+		logger.For(c).Error("publishing webhook event failed", zap.Uint("saving_id", saving.ID), zap.Error(err))
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"data": saving.ID,
@@ -98,14 +180,37 @@ func CreateSavingHandler(c *gin.Context) {
 func IndexSavingHandler(c *gin.Context) {
 	var saving models.Saving
 
-	userID := c.Request.Header.Get("userID")
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return
+	}
 
-	result, err := saving.GetSavingsByUserID(userID)
+	result, err := saving.GetSavingsByUserID(strconv.FormatUint(uint64(userID), 10))
 	if err != nil {
 		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	for i := range *result {
+		index := &(*result)[i]
+		if index.TargetAmount == 0 {
+			continue
+		}
+		goal := models.Saving{
+			Balance:      index.BalanceMinor,
+			TargetAmount: index.TargetAmount,
+			TargetDate:   index.TargetDate,
+		}
+		goal.ID = uint(index.ID)
+		progress, err := goal.GetGoalProgress()
+		if err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		index.Progress = progress
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"data": result,
 		"qty":  len(*result),
@@ -135,11 +240,16 @@ func LoginSavingHandler(c *gin.Context) {
 	}
 
 	var saving models.Saving
-	savingPIN := saving.GetPINBySavingID(savingID)
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+	if !checkRole(c, source, models.RoleViewer) {
+		return
+	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(savingPIN), []byte(input.PIN))
-	if err != nil {
-		returnErrorAndAbort(c, http.StatusForbidden, "PIN is incorrect.")
+	if !checkPIN(c, source, input.PIN, "PIN is incorrect.") {
 		return
 	}
 
@@ -154,6 +264,36 @@ func LoginSavingHandler(c *gin.Context) {
 	return
 }
 
+// checkPIN compares pin with the PIN of the Saving. Aborts with wrong and
+// returns false when it does not match, or when the PIN is locked after too
+// many wrong attempts.
+func checkPIN(c *gin.Context, source *models.Saving, pin, wrong string) bool {
+	now := time.Now()
+	if source.PINLocked(now) {
+		returnErrorAndAbort(c, http.StatusLocked, models.ErrPINLocked.Error())
+		return false
+	}
+
+	if err := auth.CompareSecret(c.Request.Context(), source.PIN, pin); err != nil {
+		metrics.PINFailures.Inc()
+		locked, err := source.RecordPINFailure(now)
+		if err != nil {
+			logger.For(c).Error("recording PIN failure failed", zap.Uint("saving_id", source.ID), zap.Error(err))
+		}
+		if locked {
+			metrics.PINLockouts.Inc()
+			audit.Record(c, models.AuditPINLocked, "saving", source.ID, nil, nil)
+		}
+		returnErrorAndAbort(c, http.StatusForbidden, wrong)
+		return false
+	}
+
+	if err := source.ResetPINFailures(); err != nil {
+		logger.For(c).Error("resetting PIN failures failed", zap.Uint("saving_id", source.ID), zap.Error(err))
+	}
+	return true
+}
+
 // ShowSavingHandler handles the Show Saving data information.
 func ShowSavingHandler(c *gin.Context) {
 	savingID := c.Param("id")
@@ -171,25 +311,42 @@ func ShowSavingHandler(c *gin.Context) {
 	}
 
 	var saving models.Saving
-	result := saving.GetSavingByID(savingID)
+	result := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
 	if result == nil {
 		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
 		return
 	}
+	if !checkRole(c, result, models.RoleViewer) {
+		return
+	}
 
 	// Check if key's last 6 digits is the same with PIN
 	key := parts[1]
-	err := bcrypt.CompareHashAndPassword(result.PIN, []byte(key))
-	if err != nil {
-		returnErrorAndAbort(c, http.StatusForbidden, "Key does not match.")
+	if !checkPIN(c, result, key, "Key does not match.") {
 		return
 	}
 
 	result.PIN = nil
 
+	available, err := result.GetAvailableBalance()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	result.AvailableBalance = available
+
+	progress, err := result.GetGoalProgress()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"data":           result,
-		"transactionQty": len(result.Transactions),
+		"data":             result,
+		"ledgerBalance":    result.Money(),
+		"availableBalance": models.NewMoney(result.AvailableBalance, result.Currency),
+		"goal":             progress,
+		"transactionQty":   len(result.Transactions),
 	})
 	return
 }
@@ -198,7 +355,7 @@ func ShowSavingHandler(c *gin.Context) {
 //
 // ONLY WORKS FOR UPDATING NAME AND PIN.
 //
-// Requires "id" param and "userID" header
+// Requires "id" param
 func UpdateSavingHandler(c *gin.Context) {
 	savingID := c.Param("id")
 	if savingID == "" {
@@ -216,17 +373,21 @@ func UpdateSavingHandler(c *gin.Context) {
 
 	// Get the Saving that is about to be updated.
 	var saving models.Saving
-	source := saving.GetSavingByID(savingID)
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
 	if source == nil {
 		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
 		return
 	}
 
+	// Only owners get to try a key, so the wrong ones of anyone else can not
+	// lock the PIN.
+	if !checkRole(c, source, models.RoleOwner) {
+		return
+	}
+
 	// Check if key's last 6 digits is the same with PIN
 	key := parts[1]
-	err := bcrypt.CompareHashAndPassword(source.PIN, []byte(key))
-	if err != nil {
-		returnErrorAndAbort(c, http.StatusForbidden, "Key does not match.")
+	if !checkPIN(c, source, key, "Key does not match.") {
 		return
 	}
 
@@ -241,21 +402,13 @@ func UpdateSavingHandler(c *gin.Context) {
 		return
 	}
 
-	_, err = strconv.Atoi(input.PIN)
+	_, err := strconv.Atoi(input.PIN)
 	if err != nil || len(input.PIN) != 6 {
 		returnErrorAndAbort(c, http.StatusBadRequest, "PIN must be numeric with 6 digits.")
 		return
 	}
 
-	// Validate whether the User who's about to perform this action is the same User
-	// who has the Saving account.
-	userID, err := strconv.ParseUint(c.Request.Header.Get("userID"), 10, 0)
-	if uint(userID) != source.UserID || err != nil {
-		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to edit this data.")
-		return
-	}
-
-	hashedPIN, err := bcrypt.GenerateFromPassword([]byte(input.PIN), bcrypt.DefaultCost)
+	hashedPIN, err := auth.HashSecret(c.Request.Context(), input.PIN)
 	if err != nil {
 		returnErrorAndAbort(c, http.StatusBadRequest, "Failed to encrypt PIN.")
 		return
@@ -265,11 +418,19 @@ func UpdateSavingHandler(c *gin.Context) {
 		Name: input.Name,
 		PIN:  hashedPIN,
 	}
+	// The PIN is always set again, it only changed when the old one does not
+	// match it.
+	action := models.AuditSavingUpdated
+	if auth.CompareSecret(c.Request.Context(), source.PIN, input.PIN) != nil {
+		action = models.AuditPINChanged
+	}
+	before := gin.H{"Name": source.Name}
 
 	if err := inputSaving.Update(source); err != nil {
 		returnErrorAndAbort(c, http.StatusBadRequest, "ERROR: Failed to update data."+err.Error())
 		return
 	}
+	audit.Record(c, action, "saving", source.ID, before, gin.H{"Name": input.Name})
 
 	c.JSON(http.StatusOK, gin.H{
 		"msg": "Data is updated successfully.",
@@ -279,7 +440,7 @@ func UpdateSavingHandler(c *gin.Context) {
 
 // DeleteSavingHandler handles Saving data removal.
 //
-// Requires "id" param and "userID" header
+// Requires "id" param
 func DeleteSavingHandler(c *gin.Context) {
 	savingID := c.Param("id")
 	if savingID == "" {
@@ -297,35 +458,88 @@ func DeleteSavingHandler(c *gin.Context) {
 
 	// Get the Saving account data that is about to be deleted.
 	var saving models.Saving
-	source := saving.GetSavingByID(savingID)
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
 	if source == nil {
 		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
 		return
 	}
 
+	// Only owners get to try a key, so the wrong ones of anyone else can not
+	// lock the PIN.
+	if !checkRole(c, source, models.RoleOwner) {
+		return
+	}
+
 	// Check if key's last 6 digits is the same with PIN
 	key := parts[1]
-	err := bcrypt.CompareHashAndPassword(source.PIN, []byte(key))
+	if !checkPIN(c, source, key, "Key does not match.") {
+		return
+	}
+
+	before := gin.H{"Name": source.Name, "Balance": source.Balance, "Currency": source.Currency}
+	if err := source.Delete(); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "ERROR: Failed to delete data."+err.Error())
+		return
+	}
+	audit.Record(c, models.AuditSavingDeleted, "saving", source.ID, before, nil)
+	if err := source.PublishEvent(models.EventSavingDeleted); err != nil {
+		logger.For(c).Error("publishing webhook event failed", zap.Error(err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Data successfully deleted.",
+	})
+	return
+}
+
+// UpdateGoalHandler handles the goal update of a Saving account.
+//
+// Requires "id" param
+func UpdateGoalHandler(c *gin.Context) {
+	savingID := c.Param("id")
+	if savingID == "" {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Saving ID is empty")
+		return
+	}
+
+	var input UpdateGoalForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	targetDate, err := parseGoal(input.Target, input.TargetDate, input.Lock)
 	if err != nil {
-		returnErrorAndAbort(c, http.StatusForbidden, "Key does not match.")
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
 		return
 	}
 
-	// Validate whether the User who's about to perform this action is the same User
-	// who has the Saving account.
-	userID, err := strconv.ParseUint(c.Request.Header.Get("userID"), 10, 0)
-	if uint(userID) != source.UserID || err != nil {
+	// Validate whether the User who's about to perform this action is an owner
+	// of the Saving account.
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, models.RoleOwner) {
 		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to edit this data.")
 		return
 	}
 
-	if err := source.Delete(); err != nil {
-		returnErrorAndAbort(c, http.StatusBadRequest, "ERROR: Failed to delete data."+err.Error())
+	if err := source.UpdateGoal(input.Target, targetDate, input.Lock); err != nil {
+		if err == models.ErrGoalLockWeakened {
+			returnErrorAndAbort(c, http.StatusForbidden, err.Error())
+			return
+		}
+		returnErrorAndAbort(c, http.StatusBadRequest, "ERROR: Failed to update goal."+err.Error())
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"msg": "Data successfully deleted.",
+		"msg": "Goal is updated successfully.",
 	})
 	return
 }
@@ -0,0 +1,231 @@
+package schedulecontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateScheduleForm is a struct to bind with the Schedule creation form.
+type CreateScheduleForm struct {
+	SavingID       uint   `form:"saving" binding:"required"`
+	TargetSavingID uint   `form:"target"` // Only for TRANSFER.
+	Type           string `form:"type" binding:"required"`
+	Value          int64  `form:"value" binding:"required"`
+	Description    string `form:"desc"`
+	Rule           string `form:"rule" binding:"required"`
+	Hour           int    `form:"hour"`
+	Minute         int    `form:"minute"`
+	Weekday        int    `form:"weekday"`
+	DayOfMonth     int    `form:"day"`
+	CronExpr       string `form:"cron"`
+	MissedPolicy   string `form:"missed"`
+	MaxRetries     *int   `form:"max-retries"`
+	// EndAt is an optional date in YYYY-MM-DD format.
+	EndAt string `form:"end"`
+}
+
+// UpdateScheduleStatusForm is a struct to bind with the Schedule status form.
+type UpdateScheduleStatusForm struct {
+	Status string `form:"status" binding:"required"`
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// hasRole validates whether the User has at least role on the Saving with
+// savingID.
+func hasRole(userID uint, savingID uint, role string) bool {
+	var saving models.Saving
+	source := saving.GetSavingByID(strconv.FormatUint(uint64(savingID), 10))
+	return source != nil && source.HasRole(userID, role)
+}
+
+// getOwnedSchedule gets the Schedule from the "id" param and validates whether
+// the User of the token owns it. Aborts and returns nil if not.
+func getOwnedSchedule(c *gin.Context) *models.Schedule {
+	scheduleID := c.Param("id")
+	if scheduleID == "" {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Schedule ID is empty")
+		return nil
+	}
+
+	var schedule models.Schedule
+	source := schedule.GetScheduleByID(scheduleID)
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return nil
+	}
+
+	userID, err := auth.UserID(c)
+	if userID != source.UserID || err != nil {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this data.")
+		return nil
+	}
+
+	return source
+}
+
+// CreateScheduleHandler handles Schedule creation.
+func CreateScheduleHandler(c *gin.Context) {
+	var input CreateScheduleForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	schedule := models.Schedule{
+		UserID:       userID,
+		SavingID:     input.SavingID,
+		Type:         strings.ToUpper(input.Type),
+		Value:        input.Value,
+		Description:  input.Description,
+		Rule:         strings.ToUpper(input.Rule),
+		Hour:         input.Hour,
+		Minute:       input.Minute,
+		Weekday:      input.Weekday,
+		DayOfMonth:   input.DayOfMonth,
+		CronExpr:     input.CronExpr,
+		MissedPolicy: strings.ToUpper(input.MissedPolicy),
+		MaxRetries:   3,
+	}
+	if schedule.MissedPolicy == "" {
+		schedule.MissedPolicy = models.MissedSkip
+	}
+	if input.MaxRetries != nil {
+		schedule.MaxRetries = *input.MaxRetries
+	}
+	if schedule.MaxRetries < 0 || schedule.MaxRetries > 10 {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Max retries must be between 0 and 10.")
+		return
+	}
+
+	if input.TargetSavingID != 0 {
+		schedule.TargetSavingID = &input.TargetSavingID
+	}
+
+	if input.EndAt != "" {
+		endAt, err := time.ParseInLocation("2006-01-02", input.EndAt, time.Local)
+		if err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, "End date must be in YYYY-MM-DD format.")
+			return
+		}
+		// Runs on the end date are still executed.
+		endAt = endAt.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		schedule.EndAt = &endAt
+	}
+
+	// Contributors can schedule deposits, only owners can take money out.
+	sourceRole := models.RoleOwner
+	if schedule.Type == models.TypeDeposit {
+		sourceRole = models.RoleContributor
+	}
+	if !hasRole(schedule.UserID, schedule.SavingID, sourceRole) ||
+		(schedule.TargetSavingID != nil && !hasRole(schedule.UserID, *schedule.TargetSavingID, models.RoleContributor)) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this Saving.")
+		return
+	}
+
+	if err := schedule.Store(); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit.Record(c, models.AuditScheduleCreated, "schedule", schedule.ID, nil, schedule)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": schedule,
+		"msg":  "Schedule is stored successfully.",
+	})
+	return
+}
+
+// IndexScheduleHandler shows every Schedule of the User.
+func IndexScheduleHandler(c *gin.Context) {
+	var schedule models.Schedule
+
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return
+	}
+
+	result, err := schedule.GetSchedulesByUserID(strconv.FormatUint(uint64(userID), 10))
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+		"qty":  len(*result),
+	})
+	return
+}
+
+// ShowScheduleHandler shows a Schedule with its runs.
+//
+// Requires "id" param
+func ShowScheduleHandler(c *gin.Context) {
+	source := getOwnedSchedule(c)
+	if source == nil {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   source,
+		"runQty": len(source.Runs),
+	})
+	return
+}
+
+// UpdateScheduleStatusHandler pauses, resumes or cancels a Schedule.
+//
+// Requires "id" param
+func UpdateScheduleStatusHandler(c *gin.Context) {
+	var input UpdateScheduleStatusForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	status := strings.ToUpper(input.Status)
+	if status != models.ScheduleActive && status != models.SchedulePaused && status != models.ScheduleCancelled {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Status must be ACTIVE, PAUSED or CANCELLED.")
+		return
+	}
+
+	source := getOwnedSchedule(c)
+	if source == nil {
+		return
+	}
+
+	before := gin.H{"Status": source.Status}
+	if err := source.UpdateStatus(status); err != nil {
+		returnErrorAndAbort(c, http.StatusConflict, err.Error())
+		return
+	}
+	audit.Record(c, models.AuditScheduleUpdated, "schedule", source.ID, before, gin.H{"Status": status})
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Schedule status is updated successfully.",
+	})
+	return
+}
@@ -0,0 +1,284 @@
+package statementcontroller
+
+import (
+	"b-pay/config/auth"
+	"b-pay/config/logger"
+	"b-pay/models"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StatementQuery is a struct to bind with the statement query.
+type StatementQuery struct {
+	// From and To are dates in YYYY-MM-DD format, both included.
+	From string `form:"from" binding:"required"`
+	To   string `form:"to" binding:"required"`
+	// Format is json, csv or pdf. Optional, json by default.
+	Format string `form:"format"`
+}
+
+// DownloadQuery is a struct to bind with the stored statement query.
+type DownloadQuery struct {
+	// Format is csv or pdf. Optional, pdf by default.
+	Format string `form:"format"`
+}
+
+// ExportQuery is a struct to bind with the export query.
+type ExportQuery struct {
+	// Format is ofx, qif or camt053.
+	Format string `form:"format" binding:"required"`
+	// From and To are dates in YYYY-MM-DD format, both included. Optional,
+	// from the creation of the Saving until today by default.
+	From string `form:"from"`
+	To   string `form:"to"`
+}
+
+// exportTypes are the file extension and the content type of every export
+// format.
+var exportTypes = map[string][2]string{
+	"ofx":     {"ofx", "application/x-ofx"},
+	"qif":     {"qif", "application/qif"},
+	"camt053": {"xml", "application/xml"},
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// getViewableSaving gets the Saving from the "id" param and validates whether
+// the User of the token can see it. Aborts and returns nil if not.
+func getViewableSaving(c *gin.Context) *models.Saving {
+	savingID := c.Param("id")
+	if savingID == "" {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Saving ID is empty")
+		return nil
+	}
+
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return nil
+	}
+	logger.SetSavingID(c, source.ID)
+
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, models.RoleViewer) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this data.")
+		return nil
+	}
+
+	return source
+}
+
+// sendFile sends a statement file as an attachment.
+func sendFile(c *gin.Context, name, format string, data []byte) {
+	contentType := "text/csv"
+	if format == "pdf" {
+		contentType = "application/pdf"
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+	c.Data(http.StatusOK, contentType, data)
+}
+
+// ShowStatementHandler generates the statement of a Saving for a period.
+//
+// Requires "id" param
+func ShowStatementHandler(c *gin.Context) {
+	var input StatementQuery
+	if err := c.ShouldBindQuery(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	format := strings.ToLower(input.Format)
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "pdf" {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Format must be json, csv or pdf.")
+		return
+	}
+
+	from, err := time.ParseInLocation("2006-01-02", input.From, time.Local)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "From must be in YYYY-MM-DD format.")
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", input.To, time.Local)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "To must be in YYYY-MM-DD format.")
+		return
+	}
+
+	source := getViewableSaving(c)
+	if source == nil {
+		return
+	}
+
+	// The to date is included.
+	statement, err := models.BuildStatement(source, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name := fmt.Sprintf("statement-%d-%s-%s", source.ID, input.From, input.To)
+	switch format {
+	case "csv":
+		data, err := statement.CSV()
+		if err != nil {
+			returnErrorAndAbort(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		sendFile(c, name, format, data)
+	case "pdf":
+		data, err := statement.PDF()
+		if err != nil {
+			returnErrorAndAbort(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		sendFile(c, name, format, data)
+	default:
+		c.JSON(http.StatusOK, gin.H{
+			"data": statement,
+		})
+	}
+	return
+}
+
+// IndexStoredStatementHandler shows every monthly statement of a Saving.
+//
+// Requires "id" param
+func IndexStoredStatementHandler(c *gin.Context) {
+	source := getViewableSaving(c)
+	if source == nil {
+		return
+	}
+
+	result, err := models.GetStoredStatementsBySavingID(source.ID)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+		"qty":  len(*result),
+	})
+	return
+}
+
+// DownloadStoredStatementHandler downloads a monthly statement of a Saving.
+//
+// Requires "id" and "period" (YYYY-MM) params
+func DownloadStoredStatementHandler(c *gin.Context) {
+	var input DownloadQuery
+	if err := c.ShouldBindQuery(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	format := strings.ToLower(input.Format)
+	if format == "" {
+		format = "pdf"
+	}
+	if format != "csv" && format != "pdf" {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Format must be csv or pdf.")
+		return
+	}
+
+	source := getViewableSaving(c)
+	if source == nil {
+		return
+	}
+
+	stored := models.GetStoredStatement(source.ID, c.Param("period"))
+	if stored == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+
+	data := stored.PDF
+	if format == "csv" {
+		data = stored.CSV
+	}
+	sendFile(c, fmt.Sprintf("statement-%d-%s", source.ID, stored.Period), format, data)
+	return
+}
+
+// ExportStatementHandler exports the Transactions of a Saving as OFX, QIF or
+// CAMT.053.
+//
+// Requires "id" param
+func ExportStatementHandler(c *gin.Context) {
+	var input ExportQuery
+	if err := c.ShouldBindQuery(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	format := strings.ToLower(input.Format)
+	fileType, ok := exportTypes[format]
+	if !ok {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Format must be ofx, qif or camt053.")
+		return
+	}
+
+	source := getViewableSaving(c)
+	if source == nil {
+		return
+	}
+
+	now := time.Now()
+	from := time.Date(source.CreatedAt.Year(), source.CreatedAt.Month(), source.CreatedAt.Day(), 0, 0, 0, 0, time.Local)
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	var err error
+	if input.From != "" {
+		if from, err = time.ParseInLocation("2006-01-02", input.From, time.Local); err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, "From must be in YYYY-MM-DD format.")
+			return
+		}
+	}
+	if input.To != "" {
+		if to, err = time.ParseInLocation("2006-01-02", input.To, time.Local); err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, "To must be in YYYY-MM-DD format.")
+			return
+		}
+	}
+
+	// The to date is included.
+	statement, err := models.BuildStatement(source, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var data []byte
+	switch format {
+	case "ofx":
+		data, err = statement.OFX(now)
+	case "qif":
+		data = statement.QIF()
+	case "camt053":
+		data, err = statement.CAMT053(now)
+	}
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	name := fmt.Sprintf("transactions-%d-%s-%s.%s", source.ID, from.Format("20060102"), to.Format("20060102"), fileType[0])
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	c.Data(http.StatusOK, fileType[1], data)
+	return
+}
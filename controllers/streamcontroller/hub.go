@@ -0,0 +1,115 @@
+package streamcontroller
+
+import (
+	"b-pay/models"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer is how many events a stream can fall behind before it is
+// closed. The client then resumes from its last event.
+const subscriberBuffer = 64
+
+// subscriber is one open stream.
+type subscriber struct {
+	savings map[uint]bool
+	events  chan models.StreamEvent
+	// behind is closed when the stream fell too far behind.
+	behind chan struct{}
+	once   sync.Once
+}
+
+// hub fans the stream events of the outbox out to the open streams of the
+// Savings.
+type hub struct {
+	mu          sync.RWMutex
+	subscribers map[*subscriber]bool
+	// done is closed on shutdown, which ends every stream.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// streams is the hub of this instance.
+var streams = &hub{subscribers: map[*subscriber]bool{}, done: make(chan struct{})}
+
+// tail reads the outbox for the hub, nil until the first TailStreams.
+var tail *models.StreamTail
+
+// TailStreams sends the outbox events committed since the last run to the
+// open streams. Each instance tails the outbox itself, so it streams the
+// events relayed by every instance. Runs as a job.
+func TailStreams(now time.Time) error {
+	if tail == nil {
+		next, err := models.NewStreamTail()
+		if err != nil {
+			return err
+		}
+		tail = next
+	}
+
+	events, err := tail.Next(now)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		streams.publish(event)
+	}
+	return nil
+}
+
+// CloseStreams ends every open stream, as the server does not wait for them
+// on shutdown. Clients resume on another instance.
+func CloseStreams() {
+	streams.closeOnce.Do(func() { close(streams.done) })
+}
+
+// subscribe opens a stream of the Savings.
+func (h *hub) subscribe(savingIDs []uint) *subscriber {
+	sub := &subscriber{
+		events: make(chan models.StreamEvent, subscriberBuffer),
+		behind: make(chan struct{}),
+	}
+	h.setSavings(sub, savingIDs)
+
+	h.mu.Lock()
+	h.subscribers[sub] = true
+	h.mu.Unlock()
+	return sub
+}
+
+// unsubscribe closes a stream.
+func (h *hub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+}
+
+// setSavings replaces the Savings of a stream, after the memberships of the
+// User changed.
+func (h *hub) setSavings(sub *subscriber, savingIDs []uint) {
+	savings := make(map[uint]bool, len(savingIDs))
+	for _, id := range savingIDs {
+		savings[id] = true
+	}
+
+	h.mu.Lock()
+	sub.savings = savings
+	h.mu.Unlock()
+}
+
+// publish sends the event to every stream of its Saving. Never blocks the
+// tail, a stream which is full is closed instead.
+func (h *hub) publish(event models.StreamEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for sub := range h.subscribers {
+		if !sub.savings[event.SavingID] {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			sub.once.Do(func() { close(sub.behind) })
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package streamcontroller
+
+import (
+	"b-pay/config/auth"
+	"b-pay/config/logger"
+	"b-pay/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// StreamQuery is a struct to bind with the stream query.
+type StreamQuery struct {
+	// SavingID limits the stream to one Saving, otherwise it has every Saving
+	// of the User.
+	SavingID uint `form:"saving"`
+	// LastEventID resumes the stream after an event. The "Last-Event-ID"
+	// header of EventSource does the same.
+	LastEventID uint `form:"last-event-id"`
+}
+
+const (
+	// heartbeatInterval is how often an idle stream is pinged, and the
+	// memberships of the User checked again.
+	heartbeatInterval = 15 * time.Second
+	// replayBatch is how many missed events are read at once on resume.
+	replayBatch = 500
+	// writeTimeout is how long a WebSocket write can take.
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	errNotAllowed = errors.New("You are not allowed to access this Saving.")
+	errBehind     = errors.New("Stream fell behind, resume from the last event.")
+	errShutdown   = errors.New("Service is shutting down, resume from the last event.")
+)
+
+// upgrader upgrades the WebSocket requests. Browsers can only connect from
+// the same origin.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// stream is an open stream of the Savings of a User.
+type stream struct {
+	userID   uint
+	savingID uint
+	savings  []uint
+	lastID   uint
+	sub      *subscriber
+	// replayed are the events sent on resume which the hub can still send.
+	replayed map[uint]bool
+}
+
+// openStream validates the query and subscribes to the Savings the User of
+// the token can see. Aborts and returns nil if the User is not a
+// member of the Saving in the query.
+func openStream(c *gin.Context) *stream {
+	var input StreamQuery
+	if err := c.ShouldBindQuery(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	if header := c.Request.Header.Get("Last-Event-ID"); header != "" {
+		lastID, err := strconv.ParseUint(header, 10, 0)
+		if err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, "Last-Event-ID must be an event ID.")
+			return nil
+		}
+		input.LastEventID = uint(lastID)
+	}
+
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return nil
+	}
+
+	s := &stream{
+		userID:   userID,
+		savingID: input.SavingID,
+		lastID:   input.LastEventID,
+		replayed: map[uint]bool{},
+	}
+	if err := s.refresh(); err == errNotAllowed {
+		returnErrorAndAbort(c, http.StatusForbidden, err.Error())
+		return nil
+	} else if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	s.sub = streams.subscribe(s.savings)
+	return s
+}
+
+// refresh reads the Savings the User can see again, so a removed member
+// stops getting their events.
+func (s *stream) refresh() error {
+	savings, err := models.GetViewableSavingIDs(s.userID)
+	if err != nil {
+		return err
+	}
+	if s.savingID != 0 {
+		found := false
+		for _, id := range savings {
+			found = found || id == s.savingID
+		}
+		if !found {
+			return errNotAllowed
+		}
+		savings = []uint{s.savingID}
+	}
+
+	s.savings = savings
+	if s.sub != nil {
+		streams.setSavings(s.sub, savings)
+	}
+	return nil
+}
+
+// replay sends the events written after the last event of the client, and
+// the ones which committed after it within models.StreamLookback.
+func (s *stream) replay(send func(models.StreamEvent) error) error {
+	if s.lastID == 0 {
+		return nil
+	}
+	resumeID, err := models.GetStreamResumeID(s.savings, s.lastID)
+	if err != nil {
+		return err
+	}
+	s.lastID = resumeID
+	for {
+		missed, err := models.GetStreamEvents(s.savings, s.lastID, replayBatch)
+		if err != nil {
+			return err
+		}
+		for _, event := range missed {
+			if err := send(event); err != nil {
+				return err
+			}
+			s.replayed[event.ID] = true
+			s.lastID = event.ID
+		}
+		if len(missed) < replayBatch {
+			return nil
+		}
+	}
+}
+
+// run sends the missed events, then the live ones until ctx is done. Pings
+// the client when it is idle. The hub is subscribed before the replay, so no
+// event is lost in between and the replayed ones are skipped.
+func (s *stream) run(ctx context.Context, send func(models.StreamEvent) error, ping func() error) error {
+	if err := s.replay(send); err != nil {
+		return err
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-streams.done:
+			return errShutdown
+		case <-s.sub.behind:
+			return errBehind
+		case event := <-s.sub.events:
+			if s.replayed[event.ID] {
+				delete(s.replayed, event.ID)
+				continue
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+		case <-heartbeat.C:
+			if err := s.refresh(); err != nil {
+				return err
+			}
+			if err := ping(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// logStreamError logs why a stream ended, unless it is expected.
+func logStreamError(c *gin.Context, err error) {
+	if err != nil && err != errBehind && err != errNotAllowed && err != errShutdown {
+		logger.For(c).Warn("stream failed", zap.Error(err))
+	}
+}
+
+// SavingEventsHandler streams the balance changes and the new Transactions of
+// the Savings of the User as Server-Sent Events. The ID of every event can be
+// sent back as "Last-Event-ID" to resume. IDs are not always in order, and a
+// resumed stream can send an event again, so clients skip the IDs they
+// already have.
+func SavingEventsHandler(c *gin.Context) {
+	s := openStream(c)
+	if s == nil {
+		return
+	}
+	defer streams.unsubscribe(s.sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Stops nginx from buffering the stream.
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+	c.Writer.Flush()
+
+	err := s.run(c.Request.Context(), func(event models.StreamEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Topic, data)
+		c.Writer.Flush()
+		return err
+	}, func() error {
+		_, err := fmt.Fprint(c.Writer, ": ping\n\n")
+		c.Writer.Flush()
+		return err
+	})
+	logStreamError(c, err)
+}
+
+// SavingSocketHandler streams the same events as SavingEventsHandler over a
+// WebSocket, one JSON message per event. Resumes after "last-event-id".
+func SavingSocketHandler(c *gin.Context) {
+	s := openStream(c)
+	if s == nil {
+		return
+	}
+	defer streams.unsubscribe(s.sub)
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade already returned the error to the client.
+		return
+	}
+	defer conn.Close()
+
+	// Read until the client closes the connection, which also handles the
+	// control messages. Clients send nothing else.
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	conn.SetReadLimit(512)
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = s.run(ctx, func(event models.StreamEvent) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		return conn.WriteJSON(event)
+	}, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout))
+	})
+	logStreamError(c, err)
+
+	code := websocket.CloseNormalClosure
+	switch {
+	case err == errBehind:
+		code = websocket.CloseTryAgainLater
+	case err == errShutdown:
+		code = websocket.CloseGoingAway
+	case err == errNotAllowed:
+		code = websocket.ClosePolicyViolation
+	case err != nil:
+		code = websocket.CloseInternalServerErr
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(writeTimeout))
+}
@@ -1,12 +1,17 @@
 package transactioncontroller
 
 import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/config/logger"
 	"b-pay/models"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 )
 
 // CreateTransactionForm is a struct to bind with the Transaction
@@ -27,6 +32,47 @@ func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
 	ctx.Abort()
 }
 
+// postErrorCode maps the errors of posting a Transaction to an HTTP code.
+func postErrorCode(err error) int {
+	switch err {
+	case models.ErrInsufficientBalance, models.ErrInsufficientAvailableBalance:
+		return http.StatusNotAcceptable
+	case models.ErrGoalLocked, models.ErrTimeDepositLocked, models.ErrApprovalRequired:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// postErrorText returns the error text of posting a Transaction.
+func postErrorText(err error) string {
+	switch err {
+	case models.ErrInsufficientBalance:
+		return "Balance can not be lower than 0."
+	case models.ErrInsufficientAvailableBalance:
+		return "Available balance is not enough."
+	default:
+		return err.Error()
+	}
+}
+
+// returnPostErrorAndAbort returns the error of posting a Transaction. A
+// rejection by a Limit also returns its reason and the remaining allowance.
+func returnPostErrorAndAbort(ctx *gin.Context, err error) {
+	if limitErr, ok := err.(*models.LimitError); ok {
+		ctx.JSON(http.StatusForbidden, gin.H{
+			"error":     limitErr.Error(),
+			"reason":    limitErr.Reason,
+			"scope":     limitErr.Scope,
+			"limit":     limitErr.Limit,
+			"remaining": limitErr.Remaining,
+		})
+		ctx.Abort()
+		return
+	}
+	returnErrorAndAbort(ctx, postErrorCode(err), postErrorText(err))
+}
+
 // CreateTransactionHandler handles Transaction creation
 func CreateTransactionHandler(c *gin.Context) {
 	var input CreateTransactionForm
@@ -40,27 +86,65 @@ func CreateTransactionHandler(c *gin.Context) {
 		return
 	}
 
-	if strings.ToUpper(input.Type) == "WITHDRAWAL" {
+	// The Type gives the sign, a negative DEPOSIT would take money out.
+	if input.Value <= 0 {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Value must be more than 0.")
+		return
+	}
+
+	input.Type = strings.ToUpper(input.Type)
+	if input.Type == "WITHDRAWAL" {
 		input.Value = -input.Value
 	}
 
 	var saving models.Saving
 	savingID := strconv.FormatUint(uint64(input.SavingID), 10)
 	// Get the Saving Source
-	source := saving.GetSavingByID(savingID)
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(savingID)
 	if source == nil {
 		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Saving.")
 		return
 	}
-	// Balance calculation.
-	newBalance := source.Balance + input.Value
-	// fmt.Printf("\nSource Balance: %d\nInput Value: %d\nNew Balance: %d\n", source.Balance, input.Value, newBalance)
 
-	if newBalance < 0 {
-		returnErrorAndAbort(c, http.StatusNotAcceptable, "Balance can not be lower than 0.")
+	// Contributors can deposit, only owners can withdraw.
+	requiredRole := models.RoleContributor
+	if input.Type == "WITHDRAWAL" {
+		requiredRole = models.RoleOwner
+	}
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, requiredRole) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to do this Transaction.")
 		return
 	}
 
+	// Big withdrawals from a Saving with more than one owner wait for the
+	// approval of another owner.
+	if input.Type == "WITHDRAWAL" {
+		needsApproval, err := source.NeedsApproval(-input.Value)
+		if err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if needsApproval {
+			pending := models.PendingWithdrawal{
+				SavingID:    source.ID,
+				RequestedBy: userID,
+				Value:       -input.Value,
+				Description: input.Description,
+			}
+			if err := pending.Store(); err != nil {
+				returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			c.JSON(http.StatusAccepted, gin.H{
+				"data": pending.ID,
+				"msg":  "Withdrawal is waiting for the approval of another owner.",
+			})
+			return
+		}
+	}
+
 	transaction := models.Transaction{
 		SavingID:    input.SavingID,
 		Type:        input.Type,
@@ -68,20 +152,397 @@ func CreateTransactionHandler(c *gin.Context) {
 		Description: input.Description,
 	}
 
-	if err := transaction.Store(); err != nil {
+	// Stores the Transaction, its audit entry and the balance of the source
+	// together. Withdrawals can not use the money reserved by Holds.
+	if err := transaction.WithContext(audit.Context(c)).Post(); err != nil {
+		returnPostErrorAndAbort(c, err)
+		return
+	}
+
+	// The Transaction is stored, so failing to show its alerts loses nothing.
+	alerts, err := transaction.GetBudgetAlerts()
+	if err != nil {
+		logger.For(c).Error("getting budget alerts failed", zap.Uint("transaction_id", transaction.ID), zap.Error(err))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":    "Transaction added successfully.",
+		"alerts": alerts,
+	})
+	return
+}
+
+// ReverseTransactionForm is a struct to bind with the Transaction Reversal form.
+type ReverseTransactionForm struct {
+	// Value to be reversed. Leave empty to reverse everything that is left.
+	Value       int64  `form:"value"`
+	Reason      string `form:"reason"`
+	Description string `form:"desc"`
+}
+
+// ownerReversalWindow is how long the owner of a Saving can reverse a
+// Transaction after it was made. Admins can reverse at any time.
+const ownerReversalWindow = 30 * time.Minute
+
+// reasonCodes are the accepted reason codes for a reversal.
+var reasonCodes = map[string]bool{
+	"CUSTOMER_REQUEST": true,
+	"DUPLICATE":        true,
+	"WRONG_AMOUNT":     true,
+	"FRAUD":            true,
+	"OTHER":            true,
+}
+
+// ReverseTransactionHandler handles Transaction reversal.
+//
+// Creates a REVERSAL Transaction linked to the original one. The owner of the
+// Saving can reverse within ownerReversalWindow, admins can reverse at any
+// time but must give a reason code.
+func ReverseTransactionHandler(c *gin.Context) {
+	transactionID := c.Param("id")
+	if transactionID == "" {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Transaction ID is empty")
+		return
+	}
+
+	var input ReverseTransactionForm
+	if err := c.ShouldBind(&input); err != nil {
 		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	// Change the balance of the source's balance.
-	err := source.ChangeBalance(newBalance)
+	if input.Value < 0 {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Value can not be negative.")
+		return
+	}
+
+	input.Reason = strings.ToUpper(input.Reason)
+	if input.Reason != "" && !reasonCodes[input.Reason] {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Unknown reason code.")
+		return
+	}
+
+	// Get the User who's performing this action from the token.
+	userEmail := models.User{
+		Email: c.GetString("email"),
+	}
+	user := userEmail.GetUserByEmail()
+	if user == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "User not found.")
+		return
+	}
+
+	var transaction models.Transaction
+	original := transaction.WithContext(audit.Context(c)).GetTransactionByID(transactionID)
+	if original == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Transaction.")
+		return
+	}
+
+	if user.IsAdmin {
+		if input.Reason == "" {
+			returnErrorAndAbort(c, http.StatusBadRequest, "Reason code is required.")
+			return
+		}
+	} else {
+		var saving models.Saving
+		source := saving.WithContext(c.Request.Context()).GetSavingByID(strconv.FormatUint(uint64(original.SavingID), 10))
+		if source == nil || !source.HasRole(user.ID, models.RoleOwner) {
+			returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to reverse this Transaction.")
+			return
+		}
+
+		if time.Since(original.CreatedAt) > ownerReversalWindow {
+			returnErrorAndAbort(c, http.StatusForbidden, "Reversal window has passed.")
+			return
+		}
+
+		if input.Reason == "" {
+			input.Reason = "CUSTOMER_REQUEST"
+		}
+	}
+
+	reversal, err := original.Reverse(input.Value, input.Reason, input.Description)
+	switch err {
+	case nil:
+	case models.ErrAlreadyReversed:
+		returnErrorAndAbort(c, http.StatusConflict, err.Error())
+		return
+	default:
+		returnErrorAndAbort(c, postErrorCode(err), err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": reversal,
+		"msg":  "Transaction reversed successfully.",
+	})
+	return
+}
+
+// getSavingAsOwner gets the Saving with savingID and validates whether the User
+// of the token is one of its owners. Aborts and returns nil if not.
+func getSavingAsOwner(c *gin.Context, savingID uint) (*models.Saving, uint) {
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(strconv.FormatUint(uint64(savingID), 10))
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Saving.")
+		return nil, 0
+	}
+	logger.SetSavingID(c, source.ID)
+
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, models.RoleOwner) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this Saving.")
+		return nil, 0
+	}
+
+	return source, userID
+}
+
+// IndexPendingWithdrawalHandler shows every withdrawal of a Saving waiting
+// for approval. Owner only.
+//
+// Requires "id" param
+func IndexPendingWithdrawalHandler(c *gin.Context) {
+	savingID, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, "Saving ID is invalid")
+		return
+	}
+
+	source, _ := getSavingAsOwner(c, uint(savingID))
+	if source == nil {
+		return
+	}
+
+	var pending models.PendingWithdrawal
+	result, err := pending.GetPendingWithdrawalsBySavingID(source.ID)
 	if err != nil {
 		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"msg": "Transaction added successfully.",
+		"data": result,
+		"qty":  len(*result),
+	})
+	return
+}
+
+// decideWithdrawal approves or rejects the pending withdrawal from the "id"
+// param. Must be an owner other than the one who requested it.
+func decideWithdrawal(c *gin.Context, approve bool) {
+	var pending models.PendingWithdrawal
+	source := pending.GetPendingWithdrawalByID(c.Param("id"))
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+
+	saving, userID := getSavingAsOwner(c, source.SavingID)
+	if saving == nil {
+		return
+	}
+
+	transaction, err := source.WithContext(audit.Context(c)).Decide(userID, approve)
+	switch err {
+	case nil:
+	case models.ErrApprovalInvalid:
+		returnErrorAndAbort(c, http.StatusConflict, err.Error())
+		return
+	default:
+		returnPostErrorAndAbort(c, err)
+		return
+	}
+
+	if !approve {
+		c.JSON(http.StatusOK, gin.H{
+			"msg": "Withdrawal rejected.",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": transaction,
+		"msg":  "Withdrawal approved and added successfully.",
+	})
+}
+
+// ApproveWithdrawalHandler approves a pending withdrawal and posts it.
+//
+// Requires "id" param
+func ApproveWithdrawalHandler(c *gin.Context) {
+	decideWithdrawal(c, true)
+	return
+}
+
+// RejectWithdrawalHandler rejects a pending withdrawal.
+//
+// Requires "id" param
+func RejectWithdrawalHandler(c *gin.Context) {
+	decideWithdrawal(c, false)
+	return
+}
+
+// TransactionQuery is a struct to bind with the Transaction listing query.
+type TransactionQuery struct {
+	Type string `form:"type"`
+	// Category is a category ID, or "none" for Transactions without one.
+	Category string `form:"category"`
+	Tag      string `form:"tag"`
+}
+
+// CategoryForm is a struct to bind with the Transaction category form.
+type CategoryForm struct {
+	// Category is the category ID. 0 removes the manual category and applies
+	// the rules again.
+	Category uint `form:"category"`
+}
+
+// TagsForm is a struct to bind with the Transaction tags form.
+type TagsForm struct {
+	// Tags are comma separated. Empty removes every tag.
+	Tags string `form:"tags"`
+}
+
+// IndexTransactionHandler shows the Transactions of a Saving, newest first,
+// filtered by type, category and tag.
+//
+// Requires "id" param
+func IndexTransactionHandler(c *gin.Context) {
+	var input TransactionQuery
+	if err := c.ShouldBindQuery(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filter := models.TransactionFilter{Type: input.Type, Tag: input.Tag}
+	switch strings.ToLower(input.Category) {
+	case "":
+	case "none":
+		filter.Uncategorized = true
+	default:
+		categoryID, err := strconv.ParseUint(input.Category, 10, 0)
+		if err != nil {
+			returnErrorAndAbort(c, http.StatusBadRequest, "Category must be an ID or none.")
+			return
+		}
+		filter.CategoryID = uint(categoryID)
+	}
+
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(c.Param("id"))
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Saving.")
+		return
+	}
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, models.RoleViewer) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to access this Saving.")
+		return
+	}
+
+	results, err := source.GetTransactions(filter)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": results,
+		"qty":  len(*results),
+	})
+	return
+}
+
+// getTransactionAsContributor gets the Transaction from the "id" param and
+// the Saving it belongs to, and validates whether the User of the
+// token can contribute to the Saving. Aborts and returns nil if not.
+func getTransactionAsContributor(c *gin.Context) (*models.Transaction, *models.Saving) {
+	var transaction models.Transaction
+	result := transaction.WithContext(c.Request.Context()).GetTransactionByID(c.Param("id"))
+	if result == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Transaction.")
+		return nil, nil
+	}
+
+	var saving models.Saving
+	source := saving.WithContext(c.Request.Context()).GetSavingByID(strconv.FormatUint(uint64(result.SavingID), 10))
+	if source == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "Could not find Saving.")
+		return nil, nil
+	}
+	logger.SetSavingID(c, source.ID)
+	userID, err := auth.UserID(c)
+	if err != nil || !source.HasRole(userID, models.RoleContributor) {
+		returnErrorAndAbort(c, http.StatusForbidden, "You are not allowed to change this Transaction.")
+		return nil, nil
+	}
+
+	return result, source
+}
+
+// SetCategoryHandler sets the category of a Transaction by hand. The rules
+// never change it again, until it is set to 0. The category must be a system
+// one or one of the owner of the Saving.
+//
+// Requires "id" param
+func SetCategoryHandler(c *gin.Context) {
+	var input CategoryForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	transaction, source := getTransactionAsContributor(c)
+	if transaction == nil {
+		return
+	}
+
+	if err := transaction.SetCategory(source.UserID, input.Category); err != nil {
+		code := http.StatusBadRequest
+		if err == models.ErrCategoryNotFound {
+			code = http.StatusNotFound
+		}
+		returnErrorAndAbort(c, code, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": transaction,
+		"msg":  "Category is set successfully.",
+	})
+	return
+}
+
+// SetTagsHandler replaces the tags of a Transaction.
+//
+// Requires "id" param
+func SetTagsHandler(c *gin.Context) {
+	var input TagsForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	transaction, _ := getTransactionAsContributor(c)
+	if transaction == nil {
+		return
+	}
+
+	var tags []string
+	if strings.TrimSpace(input.Tags) != "" {
+		tags = strings.Split(input.Tags, ",")
+	}
+	if err := transaction.SetTags(tags); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": transaction.Tags,
+		"msg":  "Tags are set successfully.",
 	})
 	return
 }
@@ -1,14 +1,18 @@
 package usercontroller
 
 import (
+	"b-pay/config/audit"
 	"b-pay/config/auth"
+	"b-pay/config/logger"
+	"b-pay/config/metrics"
 	"b-pay/models"
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
+	"go.uber.org/zap"
 )
 
 // RegisterForm is for binding the data from the Registration Form to the struct.
@@ -66,7 +70,7 @@ func RegisterUserHandler(c *gin.Context) {
 	}
 
 	// Password encryption using bcrypt
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	hashedPassword, err := auth.HashSecret(c.Request.Context(), input.Password)
 	if err != nil {
 		returnErrorAndAbort(c, http.StatusBadRequest,
 			fmt.Sprintf("ERROR: Could not encrypt password. %s", err.Error()),
@@ -86,6 +90,9 @@ func RegisterUserHandler(c *gin.Context) {
 		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
 		return
 	}
+	actor := audit.Actor(c)
+	actor.UserID, actor.Email = &user.ID, user.Email
+	audit.RecordAs(actor, models.AuditUserRegistered, "user", user.ID, nil, user)
 
 	c.JSON(http.StatusOK, gin.H{
 		"data": "ok",
@@ -128,9 +135,15 @@ func LoginHandler(c *gin.Context) {
 		Email: input.Email,
 	}
 
+	// Failed and successful logins are audited as the User who logs in.
+	actor := audit.Actor(c)
+	actor.Email = input.Email
+
 	// Check if user with inputted email exists.
 	user := userEmail.GetUserByEmail()
 	if user == nil {
+		audit.RecordAs(actor, models.AuditLoginFailed, "user", 0, nil, nil)
+		metrics.Logins.WithLabelValues(metrics.LoginFailure).Inc()
 		returnErrorAndAbort(c, http.StatusNotFound,
 			fmt.Sprintf("ERROR: User with email %s does not exist.", input.Email),
 		)
@@ -138,8 +151,11 @@ func LoginHandler(c *gin.Context) {
 	}
 
 	// Check if inputted password is the same as the User's stored password.
-	err := bcrypt.CompareHashAndPassword(user.Password, []byte(input.Password))
+	actor.UserID = &user.ID
+	err := auth.CompareSecret(c.Request.Context(), user.Password, input.Password)
 	if err != nil {
+		audit.RecordAs(actor, models.AuditLoginFailed, "user", user.ID, nil, nil)
+		metrics.Logins.WithLabelValues(metrics.LoginFailure).Inc()
 		returnErrorAndAbort(c, http.StatusUnauthorized, "Password invalid.")
 		return
 	}
@@ -163,6 +179,11 @@ func LoginHandler(c *gin.Context) {
 		return
 	}
 
+	metrics.Logins.WithLabelValues(metrics.LoginSuccess).Inc()
+	audit.RecordAs(actor, models.AuditLogin, "user", user.ID, nil, gin.H{
+		"Remembered": input.Remembered,
+	})
+
 	c.JSON(http.StatusOK, gin.H{
 		"token":     signedToken,
 		"userID":    user.ID,
@@ -186,29 +207,25 @@ func UpdatePasswordHandler(c *gin.Context) {
 		return
 	}
 
-	userID := c.GetHeader("userID")
-	if userID == "" {
-		returnErrorAndAbort(c, http.StatusBadRequest, "userID is empty.")
-		return
+	// Get the User from the token.
+	userEmail := models.User{
+		Email: c.GetString("email"),
 	}
-
-	// Get User from User ID
-	var user models.User
-	source := user.GetUserByID(userID)
+	source := userEmail.GetUserByEmail()
 	if source == nil {
 		returnErrorAndAbort(c, http.StatusNotFound, "User not found.")
 		return
 	}
 
 	// Check if the Old Password is the same with the new one.
-	err := bcrypt.CompareHashAndPassword(source.Password, []byte(input.OldPassword))
+	err := auth.CompareSecret(c.Request.Context(), source.Password, input.OldPassword)
 	if err != nil {
 		returnErrorAndAbort(c, http.StatusForbidden, "Old password is invalid.")
 		return
 	}
 
 	// Generate New Password.
-	newPassword, err := bcrypt.GenerateFromPassword([]byte(input.NewPassword), bcrypt.DefaultCost)
+	newPassword, err := auth.HashSecret(c.Request.Context(), input.NewPassword)
 	if err != nil {
 		returnErrorAndAbort(c, http.StatusBadRequest, "Failed to encrypt password.")
 		return
@@ -219,6 +236,14 @@ func UpdatePasswordHandler(c *gin.Context) {
 		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
 		return
 	}
+	audit.Record(c, models.AuditPasswordChanged, "user", source.ID, nil, nil)
+	err = models.PublishEvent(models.EventPasswordChanged, source.ID, gin.H{
+		"UserID":    source.ID,
+		"ChangedAt": time.Now(),
+	})
+	if err != nil {
+		logger.For(c).Error("publishing webhook event failed", zap.Error(err))
+	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"msg": "Password updated successfully.",
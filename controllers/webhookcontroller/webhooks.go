@@ -0,0 +1,209 @@
+package webhookcontroller
+
+import (
+	"b-pay/config/audit"
+	"b-pay/config/auth"
+	"b-pay/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WebhookForm is a struct to bind with the WebhookSubscription form.
+type WebhookForm struct {
+	Name string `form:"name"`
+	URL  string `form:"url" binding:"required"`
+	// Events are comma separated, "*" for every event.
+	Events string `form:"events" binding:"required"`
+}
+
+// deliveryLogSize is how many deliveries the delivery log shows.
+const deliveryLogSize = 100
+
+// returnErrorAndAbort returns a JSON with error key and text value.
+// And then abort any other handlers.
+func returnErrorAndAbort(ctx *gin.Context, code int, errorText string) {
+	ctx.JSON(code, gin.H{
+		"error": errorText,
+	})
+	ctx.Abort()
+}
+
+// getUserID gets the User ID from the token. Aborts and returns false if
+// there is none.
+func getUserID(c *gin.Context) (uint, bool) {
+	userID, err := auth.UserID(c)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusNotFound, err.Error())
+		return 0, false
+	}
+	return userID, true
+}
+
+// getOwnSubscription gets the WebhookSubscription with id and validates
+// whether it belongs to the User of the token. Aborts and returns
+// nil if not.
+func getOwnSubscription(c *gin.Context, id string) *models.WebhookSubscription {
+	userID, ok := getUserID(c)
+	if !ok {
+		return nil
+	}
+
+	subscription := models.GetWebhookSubscriptionByID(id)
+	if subscription == nil || subscription.UserID == nil || *subscription.UserID != userID {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return nil
+	}
+	return subscription
+}
+
+// storeSubscription stores the subscription and returns it with its secret,
+// which is never shown again.
+func storeSubscription(c *gin.Context, subscription *models.WebhookSubscription) {
+	secret, err := subscription.Store()
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit.Record(c, models.AuditWebhookCreated, "webhook", subscription.ID, nil, subscription)
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":   subscription,
+		"secret": secret,
+		"msg":    "Webhook is created successfully. Keep the secret, it is not shown again.",
+	})
+}
+
+// CreateWebhookHandler subscribes a URL to events of the User.
+func CreateWebhookHandler(c *gin.Context) {
+	var input WebhookForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	userID, ok := getUserID(c)
+	if !ok {
+		return
+	}
+
+	storeSubscription(c, &models.WebhookSubscription{
+		UserID: &userID,
+		Name:   input.Name,
+		URL:    input.URL,
+		Events: input.Events,
+	})
+	return
+}
+
+// CreateAppWebhookHandler subscribes the URL of an app to events of every
+// User. Admin only.
+func CreateAppWebhookHandler(c *gin.Context) {
+	var input WebhookForm
+	if err := c.ShouldBind(&input); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	storeSubscription(c, &models.WebhookSubscription{
+		Name:   input.Name,
+		URL:    input.URL,
+		Events: input.Events,
+	})
+	return
+}
+
+// IndexWebhookHandler shows every WebhookSubscription of the User.
+func IndexWebhookHandler(c *gin.Context) {
+	userID, ok := getUserID(c)
+	if !ok {
+		return
+	}
+
+	results, err := models.GetWebhookSubscriptionsByUserID(userID)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": results,
+		"qty":  len(*results),
+	})
+	return
+}
+
+// DeleteWebhookHandler removes a WebhookSubscription of the User.
+//
+// Requires "id" param
+func DeleteWebhookHandler(c *gin.Context) {
+	subscription := getOwnSubscription(c, c.Param("id"))
+	if subscription == nil {
+		return
+	}
+
+	if err := subscription.Delete(); err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	audit.Record(c, models.AuditWebhookDeleted, "webhook", subscription.ID, subscription, nil)
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "Webhook is removed successfully.",
+	})
+	return
+}
+
+// IndexDeliveryHandler shows the latest deliveries of a WebhookSubscription
+// of the User, newest first.
+//
+// Requires "id" param
+func IndexDeliveryHandler(c *gin.Context) {
+	subscription := getOwnSubscription(c, c.Param("id"))
+	if subscription == nil {
+		return
+	}
+
+	results, err := subscription.GetDeliveries(deliveryLogSize)
+	if err != nil {
+		returnErrorAndAbort(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": results,
+		"qty":  len(*results),
+	})
+	return
+}
+
+// RedeliverHandler sends a delivery of a WebhookSubscription of the User
+// again now and shows the result.
+//
+// Requires "id" param
+func RedeliverHandler(c *gin.Context) {
+	delivery := models.GetWebhookDeliveryByID(c.Param("id"))
+	if delivery == nil {
+		returnErrorAndAbort(c, http.StatusNotFound, "No data found.")
+		return
+	}
+	if getOwnSubscription(c, strconv.FormatUint(uint64(delivery.SubscriptionID), 10)) == nil {
+		return
+	}
+
+	if err := delivery.Redeliver(); err != nil {
+		code := http.StatusBadRequest
+		if err == models.ErrDeliveryBusy {
+			code = http.StatusConflict
+		}
+		returnErrorAndAbort(c, code, err.Error())
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": delivery,
+		"msg":  "Delivery is sent again.",
+	})
+	return
+}
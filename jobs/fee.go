@@ -0,0 +1,14 @@
+package jobs
+
+import (
+	"b-pay/models"
+	"time"
+)
+
+// RunMaintenanceFees charges the maintenance fees of the month before the
+// current one. It is safe to run again, so this can run more than once a
+// month.
+func RunMaintenanceFees(now time.Time) error {
+	lastMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, -1, 0)
+	return models.ChargeMaintenanceFees(lastMonth)
+}
@@ -0,0 +1,20 @@
+package jobs
+
+import (
+	"b-pay/models"
+	"time"
+)
+
+// RunInterest accrues the interest of every day up to yesterday which has not
+// been accrued yet, then capitalises the month before the current one. Both
+// steps are safe to run again, so this can run more than once a day, and a
+// run after a downtime catches up on the missed days.
+func RunInterest(now time.Time) error {
+	yesterday := now.AddDate(0, 0, -1)
+	if err := models.AccrueInterestUntil(yesterday); err != nil {
+		return err
+	}
+
+	lastMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, -1, 0)
+	return models.CapitaliseInterest(lastMonth)
+}
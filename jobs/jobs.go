@@ -0,0 +1,41 @@
+package jobs
+
+import (
+	"b-pay/config/logger"
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// wg tracks every running job so that shutdown can wait for them.
+var wg sync.WaitGroup
+
+// Start runs fn every interval in its own goroutine until ctx is done.
+// Errors are logged, the job keeps running.
+func Start(ctx context.Context, name string, interval time.Duration, fn func(now time.Time) error) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := fn(now); err != nil {
+					logger.Log.Error("job failed", zap.String("job", name), zap.Error(err))
+				}
+			}
+		}
+	}()
+}
+
+// Wait blocks until every job started with Start has returned.
+func Wait() {
+	wg.Wait()
+}
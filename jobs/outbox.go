@@ -0,0 +1,21 @@
+package jobs
+
+import (
+	"b-pay/models"
+	"time"
+)
+
+// outboxRetention is how long published outbox events are kept.
+const outboxRetention = 7 * 24 * time.Hour
+
+// RunOutbox publishes the outbox events written since the last run.
+func RunOutbox(now time.Time) error {
+	_, err := models.RelayOutbox(now)
+	return err
+}
+
+// PruneOutbox removes the outbox events published more than outboxRetention
+// ago.
+func PruneOutbox(now time.Time) error {
+	return models.PruneOutbox(now.Add(-outboxRetention))
+}
@@ -0,0 +1,29 @@
+package jobs
+
+import (
+	"b-pay/config/logger"
+	"b-pay/config/metrics"
+	"b-pay/models"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RunReconciliation checks that the balance of every Saving is the sum of its
+// Transactions, and counts and logs the ones which are not.
+func RunReconciliation(now time.Time) error {
+	mismatches, err := models.ReconcileBalances()
+	if err != nil {
+		return err
+	}
+
+	metrics.ReconciliationMismatches.Add(float64(len(mismatches)))
+	for _, mismatch := range mismatches {
+		logger.Log.Error("balance does not match the ledger",
+			zap.Uint("saving_id", mismatch.SavingID),
+			zap.Int64("balance", mismatch.Balance),
+			zap.Int64("ledger", mismatch.Ledger),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package jobs
+
+import (
+	"b-pay/config/logger"
+	"b-pay/models"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RunSchedules advances every due Schedule, then executes its new runs and
+// every run waiting for a retry.
+func RunSchedules(now time.Time) error {
+	schedules, err := models.GetDueSchedules(now)
+	if err != nil {
+		return err
+	}
+
+	for i := range schedules {
+		runs, err := schedules[i].Advance(now)
+		if err != nil {
+			logger.Log.Error("schedule failed", zap.Uint("schedule_id", schedules[i].ID), zap.Error(err))
+			continue
+		}
+		for j := range runs {
+			if err := runs[j].Execute(now); err != nil {
+				logger.Log.Error("schedule run failed", zap.Uint("schedule_run_id", runs[j].ID), zap.Error(err))
+			}
+		}
+	}
+
+	retries, err := models.GetRetryableRuns(now)
+	if err != nil {
+		return err
+	}
+	for i := range retries {
+		if err := retries[i].Execute(now); err != nil {
+			logger.Log.Error("schedule run failed", zap.Uint("schedule_run_id", retries[i].ID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// ExpireHolds keeps the status of expired Holds up to date.
+func ExpireHolds(now time.Time) error {
+	return models.ExpireHolds()
+}
@@ -0,0 +1,14 @@
+package jobs
+
+import (
+	"b-pay/models"
+	"time"
+)
+
+// RunStatements generates the statements of the month before the current one.
+// Statements already generated are skipped, so this can run more than once a
+// month.
+func RunStatements(now time.Time) error {
+	lastMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, -1, 0)
+	return models.GenerateMonthlyStatements(lastMonth)
+}
@@ -0,0 +1,25 @@
+package jobs
+
+import (
+	"b-pay/config/logger"
+	"b-pay/models"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RunMaturities rolls over or pays out every time deposit which has reached
+// its maturity.
+func RunMaturities(now time.Time) error {
+	deposits, err := models.GetMaturedTimeDeposits(now)
+	if err != nil {
+		return err
+	}
+
+	for i := range deposits {
+		if err := deposits[i].Mature(now); err != nil {
+			logger.Log.Error("time deposit failed", zap.Uint("time_deposit_id", deposits[i].ID), zap.Error(err))
+		}
+	}
+	return nil
+}
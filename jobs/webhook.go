@@ -0,0 +1,12 @@
+package jobs
+
+import (
+	"b-pay/models"
+	"time"
+)
+
+// RunWebhooks sends every webhook delivery which is due, new ones and
+// retries.
+func RunWebhooks(now time.Time) error {
+	return models.DeliverDueWebhooks(now)
+}
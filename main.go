@@ -1,19 +1,48 @@
 package main
 
 import (
+	"b-pay/config/logger"
+	"b-pay/config/metrics"
+	"context"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"b-pay/config/database"
+	"b-pay/config/events"
+	"b-pay/config/mail"
 	"b-pay/config/middleware"
 	"b-pay/config/migration"
+	"b-pay/config/tracing"
+	analyticsController "b-pay/controllers/analyticscontroller"
+	auditController "b-pay/controllers/auditcontroller"
+	budgetController "b-pay/controllers/budgetcontroller"
+	categoryController "b-pay/controllers/categorycontroller"
+	depositController "b-pay/controllers/depositcontroller"
+	feeController "b-pay/controllers/feecontroller"
+	fxController "b-pay/controllers/fxcontroller"
+	healthController "b-pay/controllers/healthcontroller"
+	holdController "b-pay/controllers/holdcontroller"
+	importController "b-pay/controllers/importcontroller"
+	interestController "b-pay/controllers/interestcontroller"
+	limitController "b-pay/controllers/limitcontroller"
+	memberController "b-pay/controllers/membercontroller"
 	savingController "b-pay/controllers/savingcontroller"
+	scheduleController "b-pay/controllers/schedulecontroller"
+	statementController "b-pay/controllers/statementcontroller"
+	streamController "b-pay/controllers/streamcontroller"
 	transactionController "b-pay/controllers/transactioncontroller"
 	userController "b-pay/controllers/usercontroller"
+	webhookController "b-pay/controllers/webhookcontroller"
+	"b-pay/jobs"
+	"b-pay/models"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"go.uber.org/zap"
 )
 
 func main() {
@@ -23,9 +52,12 @@ func main() {
 		// Loads .env file
 		err := godotenv.Load()
 		if err != nil {
-			log.Printf(err.Error())
+			logger.Log.Warn("loading .env failed", zap.Error(err))
 		}
 	}
+	logger.InitLogger()
+	defer logger.Log.Sync()
+	shutdownTracing := tracing.InitTracing()
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -33,9 +65,56 @@ func main() {
 	}
 
 	database.InitDB()
-	migration.AutoMigrate(database.DB)
-	// Initialize Gin with default settings.
-	r := gin.Default()
+	mail.InitMail()
+	events.InitEvents()
+	metrics.InitMetrics()
+	models.InitBudgetAlerts()
+	if err := migration.AutoMigrate(database.DB); err != nil {
+		logger.Log.Fatal("migrating database failed", zap.Error(err))
+	}
+	if err := models.SeedCategories(); err != nil {
+		logger.Log.Fatal("seeding categories failed", zap.Error(err))
+	}
+	if err := models.InitRollups(); err != nil {
+		logger.Log.Fatal("building analytics rollups failed", zap.Error(err))
+	}
+
+	// Loads the exchange rates file, if any.
+	if ratesFile := os.Getenv("FX_RATES_FILE"); ratesFile != "" {
+		count, err := models.LoadExchangeRatesFile(ratesFile)
+		if err != nil {
+			logger.Log.Fatal("loading exchange rates failed", zap.String("path", ratesFile), zap.Error(err))
+		}
+		logger.Log.Info("loaded exchange rates", zap.Int("count", count))
+	}
+
+	// Background jobs run until the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs.Start(ctx, "scheduler", time.Minute, jobs.RunSchedules)
+	jobs.Start(ctx, "hold-expiry", time.Minute, jobs.ExpireHolds)
+	jobs.Start(ctx, "interest", time.Hour, jobs.RunInterest)
+	jobs.Start(ctx, "maturity", time.Hour, jobs.RunMaturities)
+	jobs.Start(ctx, "maintenance-fee", time.Hour, jobs.RunMaintenanceFees)
+	jobs.Start(ctx, "statements", time.Hour, jobs.RunStatements)
+	jobs.Start(ctx, "webhooks", 5*time.Second, jobs.RunWebhooks)
+	jobs.Start(ctx, "outbox", time.Second, jobs.RunOutbox)
+	jobs.Start(ctx, "outbox-prune", 24*time.Hour, jobs.PruneOutbox)
+	jobs.Start(ctx, "streams", 500*time.Millisecond, streamController.TailStreams)
+	jobs.Start(ctx, "reconciliation", time.Hour, jobs.RunReconciliation)
+
+	// Initialize Gin with JSON request logs. Every request gets an ID for
+	// the logs and the audit log.
+	r := gin.New()
+	r.Use(middleware.RequestID(), middleware.Logger(), middleware.Metrics(), middleware.Tracing(), middleware.Recovery())
+
+	// Prometheus metrics. Needs METRICS_TOKEN as a bearer token, closed in
+	// release mode without one.
+	r.GET("/metrics", middleware.MetricsToken(os.Getenv("METRICS_TOKEN")), gin.WrapH(metrics.Handler()))
+
+	// Liveness and readiness checks of the load balancer.
+	r.GET("/healthz", healthController.HealthHandler)
+	r.GET("/readyz", healthController.ReadyHandler)
 
 	r.GET("/", func(c *gin.Context) {
 		c.String(200,
@@ -48,6 +127,7 @@ func main() {
 	{
 		// Can be accessed without token
 		public := v1.Group("/public")
+		public.Use(middleware.HandlerSpan())
 		{
 			// User Registration
 			public.POST("/register", userController.RegisterUserHandler)
@@ -57,11 +137,13 @@ func main() {
 
 		// Can be accessed with token.
 		protected := v1.Group("/protected")
-		protected.Use(middleware.AuthJWT())
+		protected.Use(middleware.AuthJWT(), middleware.HandlerSpan())
 		{
 			user := protected.Group("/profile")
 			{
 				user.PATCH("/change-password", userController.UpdatePasswordHandler)
+				// Get the latest logins and security changes of the User.
+				user.GET("/activity", auditController.SecurityActivityHandler)
 			}
 
 			saving := protected.Group("/s")
@@ -76,6 +158,8 @@ func main() {
 				saving.GET("/:id", savingController.ShowSavingHandler)
 				// Update a Saving data info. (Only Name and PIN)
 				saving.PATCH("/update/:id", savingController.UpdateSavingHandler)
+				// Set, change or remove the goal of a Saving.
+				saving.PATCH("/goal/:id", savingController.UpdateGoalHandler)
 				// Delete a Saving account.
 				saving.DELETE("/delete/:id", savingController.DeleteSavingHandler)
 			}
@@ -84,10 +168,315 @@ func main() {
 			{
 				// Add a Transaction to a saving account.
 				transaction.POST("/add", transactionController.CreateTransactionHandler)
+				// Reverse (refund) a Transaction, fully or partially.
+				transaction.POST("/reverse/:id", transactionController.ReverseTransactionHandler)
+				// Get all withdrawals of a Saving waiting for approval.
+				transaction.GET("/pending/:id", transactionController.IndexPendingWithdrawalHandler)
+				// Approve or reject a withdrawal as another owner.
+				transaction.POST("/approve/:id", transactionController.ApproveWithdrawalHandler)
+				transaction.POST("/reject/:id", transactionController.RejectWithdrawalHandler)
+				// Get the Transactions of a Saving, by type, category and tag.
+				transaction.GET("/list/:id", transactionController.IndexTransactionHandler)
+				// Set the category of a Transaction by hand.
+				transaction.PATCH("/category/:id", transactionController.SetCategoryHandler)
+				// Replace the tags of a Transaction.
+				transaction.PUT("/tags/:id", transactionController.SetTagsHandler)
+			}
+
+			member := protected.Group("/m")
+			{
+				// Invite an email to a Saving.
+				member.POST("/invite/:id", memberController.InviteMemberHandler)
+				// Accept an invitation.
+				member.POST("/accept", memberController.AcceptInvitationHandler)
+				// Get all members of a Saving.
+				member.GET("/:id", memberController.IndexMemberHandler)
+				// Remove a member from a Saving.
+				member.DELETE("/:id/:member", memberController.RemoveMemberHandler)
+				// Set the withdrawal value which needs a second owner.
+				member.PATCH("/threshold/:id", memberController.UpdateThresholdHandler)
+				// Get all changes of a Saving waiting for approval.
+				member.GET("/pending/:id", memberController.IndexPendingChangeHandler)
+				// Approve or reject a change as another owner.
+				member.POST("/approve/:id", memberController.ApproveChangeHandler)
+				member.POST("/reject/:id", memberController.RejectChangeHandler)
+			}
+
+			hold := protected.Group("/h")
+			{
+				// Reserve an amount of a Saving.
+				hold.POST("/create", holdController.CreateHoldHandler)
+				// Get all Holds of a Saving.
+				hold.GET("/saving/:id", holdController.IndexHoldHandler)
+				// Settle a Hold, fully or partially.
+				hold.POST("/capture/:id", holdController.CaptureHoldHandler)
+				// Release a Hold without moving any money.
+				hold.POST("/release/:id", holdController.ReleaseHoldHandler)
+			}
+
+			deposit := protected.Group("/td")
+			{
+				// Open a time deposit funded from another Saving.
+				deposit.POST("/create", depositController.CreateTimeDepositHandler)
+				// Show the term of a time deposit.
+				deposit.GET("/:id", depositController.ShowTimeDepositHandler)
+				// Break a time deposit before maturity.
+				deposit.POST("/break/:id", depositController.BreakTimeDepositHandler)
+			}
+
+			schedule := protected.Group("/schedule")
+			{
+				// Create a recurring Transaction or transfer.
+				schedule.POST("/create", scheduleController.CreateScheduleHandler)
+				// Get all Schedules owned by the User.
+				schedule.GET("/", scheduleController.IndexScheduleHandler)
+				// Show a Schedule with its runs.
+				schedule.GET("/:id", scheduleController.ShowScheduleHandler)
+				// Pause, resume or cancel a Schedule.
+				schedule.PATCH("/status/:id", scheduleController.UpdateScheduleStatusHandler)
+			}
+
+			interest := protected.Group("/interest")
+			{
+				// Get all interest products.
+				interest.GET("/products", interestController.IndexProductHandler)
+			}
+
+			statement := protected.Group("/statement")
+			{
+				// Generate the statement of a Saving for a period.
+				statement.GET("/:id", statementController.ShowStatementHandler)
+				// Get all monthly statements of a Saving.
+				statement.GET("/:id/monthly", statementController.IndexStoredStatementHandler)
+				// Download a monthly statement of a Saving.
+				statement.GET("/:id/monthly/:period", statementController.DownloadStoredStatementHandler)
+				// Export the Transactions of a Saving as OFX, QIF or CAMT.053.
+				statement.GET("/:id/export", statementController.ExportStatementHandler)
+			}
+
+			stream := protected.Group("/stream")
+			stream.Use(middleware.NoWriteTimeout())
+			{
+				// Stream the balance changes and new Transactions of the
+				// Savings of the User as Server-Sent Events.
+				stream.GET("/events", streamController.SavingEventsHandler)
+				// Stream the same events over a WebSocket.
+				stream.GET("/ws", streamController.SavingSocketHandler)
+			}
+
+			// Get the inflows, outflows and net change of the Savings of the
+			// User by period, saving, type or category.
+			protected.GET("/analytics", analyticsController.ShowAnalyticsHandler)
+
+			budget := protected.Group("/budget")
+			{
+				// Get the usage of every Budget of a Saving in its current
+				// period.
+				budget.GET("/:id", budgetController.ShowBudgetUsageHandler)
+				// Create a Budget for a Saving.
+				budget.POST("/:id", budgetController.CreateBudgetHandler)
+				// Delete a Budget.
+				budget.DELETE("/delete/:id", budgetController.DeleteBudgetHandler)
+			}
+
+			category := protected.Group("/category")
+			{
+				// Get the system categories and the categories of the User.
+				category.GET("/", categoryController.IndexCategoryHandler)
+				// Create a category.
+				category.POST("/create", categoryController.CreateCategoryHandler)
+				// Delete a category.
+				category.DELETE("/delete/:id", categoryController.DeleteCategoryHandler)
+				// Get the auto-categorisation rules of the User.
+				category.GET("/rules", categoryController.IndexRuleHandler)
+				// Create an auto-categorisation rule.
+				category.POST("/rules", categoryController.CreateRuleHandler)
+				// Delete an auto-categorisation rule.
+				category.DELETE("/rules/:id", categoryController.DeleteRuleHandler)
+				// Apply the rules again to every Transaction of the User.
+				category.POST("/rules/apply", categoryController.ApplyRulesHandler)
+			}
+
+			webhook := protected.Group("/webhook")
+			{
+				// Get all webhooks of the User.
+				webhook.GET("/", webhookController.IndexWebhookHandler)
+				// Subscribe a URL to events of the User.
+				webhook.POST("/create", webhookController.CreateWebhookHandler)
+				// Delete a webhook.
+				webhook.DELETE("/delete/:id", webhookController.DeleteWebhookHandler)
+				// Get the delivery log of a webhook.
+				webhook.GET("/deliveries/:id", webhookController.IndexDeliveryHandler)
+				// Send a delivery again.
+				webhook.POST("/redeliver/:id", webhookController.RedeliverHandler)
+			}
+
+			imports := protected.Group("/import")
+			{
+				// Import the Transactions of a CSV to a Saving, or validate
+				// them on a dry run.
+				imports.POST("/:id", importController.ImportTransactionsHandler)
+			}
+
+			fee := protected.Group("/fee")
+			{
+				// Get all fee schedules.
+				fee.GET("/schedules", feeController.IndexFeeScheduleHandler)
+				// Show the fees of a Transaction before making it.
+				fee.GET("/preview", feeController.PreviewFeeHandler)
+			}
+
+			fx := protected.Group("/fx")
+			{
+				// Get the effective exchange rates.
+				fx.GET("/rates", fxController.IndexRateHandler)
+				// Quote a currency conversion and lock it.
+				fx.POST("/quote", fxController.CreateQuoteHandler)
+				// Deposit foreign currency against a locked quote.
+				fx.POST("/deposit/:id", fxController.DepositQuoteHandler)
+				// Withdraw foreign currency against a locked quote.
+				fx.POST("/withdraw/:id", fxController.WithdrawQuoteHandler)
+			}
+
+			limit := protected.Group("/limit")
+			{
+				// Get the Limits and the remaining allowances of a Saving.
+				limit.GET("/saving/:id", limitController.ShowSavingLimitsHandler)
+				// Lower the Limit of a Saving.
+				limit.POST("/saving/:id", limitController.SetSavingLimitHandler)
+				// Lower the Limit of the User on all of their Savings.
+				limit.POST("/user", limitController.SetUserLimitHandler)
+			}
+
+			// Can only be accessed by admins.
+			admin := protected.Group("/admin")
+			admin.Use(middleware.AdminOnly())
+			{
+				adminInterest := admin.Group("/interest")
+				{
+					// Create an interest product.
+					adminInterest.POST("/products", interestController.CreateProductHandler)
+					// Run the interest engine for a date.
+					adminInterest.POST("/run", interestController.RunInterestHandler)
+				}
+
+				adminFee := admin.Group("/fees")
+				{
+					// Create a fee schedule.
+					adminFee.POST("", feeController.CreateFeeScheduleHandler)
+					// Turn a fee schedule on or off.
+					adminFee.PATCH("/:id", feeController.UpdateFeeScheduleHandler)
+					// Waive one or every fee for a User.
+					adminFee.POST("/waivers", feeController.CreateWaiverHandler)
+					// Get all fee waivers of a User.
+					adminFee.GET("/waivers/:user", feeController.IndexWaiverHandler)
+					// Remove a fee waiver.
+					adminFee.DELETE("/waivers/:id", feeController.DeleteWaiverHandler)
+				}
+
+				adminFx := admin.Group("/fx")
+				{
+					// Store an exchange rate.
+					adminFx.POST("/rates", fxController.CreateRateHandler)
+					// Load exchange rates from a CSV file.
+					adminFx.POST("/rates/file", fxController.UploadRatesHandler)
+				}
+
+				adminLimit := admin.Group("/limits")
+				{
+					// Set a Limit of a product, a User or a Saving.
+					adminLimit.POST("", limitController.SetLimitHandler)
+					// Remove a Limit.
+					adminLimit.DELETE("/:id", limitController.DeleteLimitHandler)
+				}
+
+				// Subscribe the URL of an app to events of every User.
+				admin.POST("/webhooks", webhookController.CreateAppWebhookHandler)
+
+				// Recompute the analytics rollups from every Transaction.
+				admin.POST("/analytics/rebuild", analyticsController.RebuildRollupsHandler)
+
+				adminAudit := admin.Group("/audit")
+				{
+					// Search the audit log.
+					adminAudit.GET("", auditController.IndexAuditLogHandler)
+					// Check that no audit log entry was changed or removed.
+					adminAudit.GET("/verify", auditController.VerifyAuditChainHandler)
+				}
 			}
 
 		}
 	}
 
-	r.Run(":" + port)
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           r,
+		ConnContext:       middleware.KeepConn,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       envDuration("HTTP_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      envDuration("HTTP_WRITE_TIMEOUT", time.Minute),
+		IdleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+	}
+	// Shutdown does not wait for the streams, they are ended instead.
+	srv.RegisterOnShutdown(streamController.CloseStreams)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	logger.Log.Info("listening", zap.String("addr", srv.Addr))
+
+	var serveErr error
+	select {
+	case sig := <-signals:
+		logger.Log.Info("shutting down", zap.String("signal", sig.String()))
+		// Fails the readiness check, and gives the load balancer time to
+		// stop sending requests.
+		healthController.Drain()
+		time.Sleep(envDuration("SHUTDOWN_DELAY", 5*time.Second))
+	case serveErr = <-served:
+	}
+
+	// Stops in order: the requests in flight finish, so no Transaction is
+	// cut in half, then the jobs finish their current run, then the events
+	// file, the spans and the database are closed.
+	shutdownCtx, done := context.WithTimeout(context.Background(), envDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer done()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Log.Error("draining requests failed", zap.Error(err))
+	}
+	cancel()
+	jobs.Wait()
+	if err := events.CloseEvents(); err != nil {
+		logger.Log.Error("closing events file failed", zap.Error(err))
+	}
+	flushCtx, flushed := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushed()
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.Log.Error("flushing spans failed", zap.Error(err))
+	}
+	if sqlDB, err := database.DB.DB(); err == nil {
+		sqlDB.Close()
+	}
+	if serveErr != nil {
+		logger.Log.Fatal("server failed", zap.Error(serveErr))
+	}
+	logger.Log.Info("stopped")
+}
+
+// envDuration returns the duration in the environment variable key, like
+// "30s", or fallback when it is not set or invalid.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logger.Log.Warn("invalid duration, using default", zap.String("key", key), zap.String("value", value))
+		return fallback
+	}
+	return d
 }
@@ -0,0 +1,412 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Analytics periods.
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+// What Analytics can be grouped by, besides nothing.
+const (
+	GroupBySaving   = "saving"
+	GroupByType     = "type"
+	GroupByCategory = "category"
+)
+
+// ErrInvalidAnalytics is returned when the period or the grouping of an
+// AnalyticsQuery is not known.
+var ErrInvalidAnalytics = errors.New("period must be day, week or month and group by saving, type or category")
+
+// rollupGroups are the SQL expressions of every grouping.
+var rollupGroups = map[string]string{
+	"":              "''",
+	GroupBySaving:   "CAST(saving_id AS TEXT)",
+	GroupByType:     "type",
+	GroupByCategory: "CAST(category_id AS TEXT)",
+}
+
+// TransactionRollup sums the Transactions of a Saving for one day, type and
+// category. It is kept up to date by every new Transaction and category
+// change, so Analytics never reads the Transactions.
+type TransactionRollup struct {
+	gorm.Model
+	SavingID uint      `gorm:"not null;uniqueIndex:idx_rollup_key"`
+	Day      time.Time `gorm:"type:date;not null;uniqueIndex:idx_rollup_key"`
+	Type     string    `gorm:"size:11;not null;uniqueIndex:idx_rollup_key"`
+	// CategoryID is 0 for Transactions without a category.
+	CategoryID uint   `gorm:"not null;default:0;uniqueIndex:idx_rollup_key"`
+	Currency   string `gorm:"size:3;not null"`
+	// Inflow sums the positive values, Outflow the negative ones as a
+	// positive number.
+	Inflow  int64 `gorm:"not null;default:0"`
+	Outflow int64 `gorm:"not null;default:0"`
+	Count   int64 `gorm:"not null;default:0"`
+}
+
+// AnalyticsQuery selects the Transactions of the Savings a User can see from
+// From until To, excluded.
+type AnalyticsQuery struct {
+	UserID uint
+	// SavingID limits the query to one Saving. 0 for every Saving.
+	SavingID uint
+	From     time.Time
+	To       time.Time
+	Period   string
+	// GroupBy is saving, type or category. Empty for no grouping.
+	GroupBy string
+}
+
+// AnalyticsTotals are the flows of a set of Transactions in one currency.
+type AnalyticsTotals struct {
+	Inflow  Money
+	Outflow Money
+	Net     Money
+	Count   int64
+}
+
+// AnalyticsBucket are the totals of one period and group.
+type AnalyticsBucket struct {
+	Period time.Time
+	// Key is the Saving ID, the type or the category ID (0 for none), by
+	// GroupBy. Label is its name.
+	Key   string `json:",omitempty"`
+	Label string `json:",omitempty"`
+	AnalyticsTotals
+}
+
+// AnalyticsComparison compares the totals of the query range with the range
+// of the same length right before it, in one currency.
+type AnalyticsComparison struct {
+	Currency string
+	Current  AnalyticsTotals
+	Previous AnalyticsTotals
+	// Changes are Current minus Previous.
+	InflowChange  Money
+	OutflowChange Money
+	NetChange     Money
+}
+
+// Analytics is the result of an AnalyticsQuery.
+type Analytics struct {
+	From         time.Time
+	To           time.Time
+	PreviousFrom time.Time
+	Period       string
+	GroupBy      string `json:",omitempty"`
+	Buckets      []AnalyticsBucket
+	Comparisons  []AnalyticsComparison
+}
+
+// rollupRow is one aggregated row of TransactionRollups.
+type rollupRow struct {
+	Period   time.Time
+	GroupKey string
+	Currency string
+	Inflow   int64
+	Outflow  int64
+	Count    int64
+}
+
+// rollupDay returns the day of t in the local time zone.
+func rollupDay(t time.Time) time.Time {
+	t = t.In(time.Local)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// flows splits a value into its inflow and outflow.
+func flows(value int64) (int64, int64) {
+	if value < 0 {
+		return 0, -value
+	}
+	return value, 0
+}
+
+// addRollup adds the Transaction to its TransactionRollup within tx, or
+// removes it with a sign of -1.
+func addRollup(tx *gorm.DB, t *Transaction, sign int64) error {
+	inflow, outflow := flows(t.Value)
+	rollup := TransactionRollup{
+		SavingID: t.SavingID,
+		Day:      rollupDay(t.CreatedAt),
+		Type:     t.Type,
+		Currency: t.Currency,
+		Inflow:   sign * inflow,
+		Outflow:  sign * outflow,
+		Count:    sign,
+	}
+	if t.CategoryID != nil {
+		rollup.CategoryID = *t.CategoryID
+	}
+
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "saving_id"}, {Name: "day"}, {Name: "type"}, {Name: "category_id"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"inflow":     gorm.Expr("transaction_rollups.inflow + ?", rollup.Inflow),
+			"outflow":    gorm.Expr("transaction_rollups.outflow + ?", rollup.Outflow),
+			"count":      gorm.Expr("transaction_rollups.count + ?", rollup.Count),
+			"updated_at": time.Now(),
+		}),
+	}).Create(&rollup).Error
+}
+
+// RebuildRollups recomputes every TransactionRollup from the Transactions, for
+// the history made before rollups existed. New Transactions wait for it to
+// finish. Returns how many rollups there are.
+func RebuildRollups() (int, error) {
+	var count int
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("LOCK TABLE transaction_rollups IN EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("1 = 1").Delete(&TransactionRollup{}).Error; err != nil {
+			return err
+		}
+
+		rows, err := tx.Model(&Transaction{}).
+			Select("saving_id", "created_at", "type", "category_id", "currency", "value").
+			Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		type key struct {
+			savingID   uint
+			day        time.Time
+			kind       string
+			categoryID uint
+		}
+		rollups := map[key]*TransactionRollup{}
+		for rows.Next() {
+			var t Transaction
+			if err := tx.ScanRows(rows, &t); err != nil {
+				return err
+			}
+			k := key{t.SavingID, rollupDay(t.CreatedAt), t.Type, 0}
+			if t.CategoryID != nil {
+				k.categoryID = *t.CategoryID
+			}
+			rollup, ok := rollups[k]
+			if !ok {
+				rollup = &TransactionRollup{
+					SavingID:   k.savingID,
+					Day:        k.day,
+					Type:       k.kind,
+					CategoryID: k.categoryID,
+					Currency:   t.Currency,
+				}
+				rollups[k] = rollup
+			}
+			inflow, outflow := flows(t.Value)
+			rollup.Inflow += inflow
+			rollup.Outflow += outflow
+			rollup.Count++
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		results := make([]TransactionRollup, 0, len(rollups))
+		for _, rollup := range rollups {
+			results = append(results, *rollup)
+		}
+		count = len(results)
+		if count == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(&results, 500).Error
+	})
+	return count, err
+}
+
+// previousFrom returns the start of the range of the same length right before
+// from. Ranges of whole months go back by months.
+func previousFrom(from, to time.Time, period string) time.Time {
+	if period == PeriodMonth && from.Day() == 1 && to.Day() == 1 {
+		months := (to.Year()-from.Year())*12 + int(to.Month()-from.Month())
+		return from.AddDate(0, -months, 0)
+	}
+	return from.Add(-to.Sub(from))
+}
+
+// savingsOf returns the query of the IDs of every Saving the User can see, or
+// only SavingID.
+func (q *AnalyticsQuery) savingsOf() *gorm.DB {
+	if q.SavingID != 0 {
+		return database.DB.Model(&Saving{}).Select("id").Where("id = ?", q.SavingID)
+	}
+	members := database.DB.Model(&SavingMember{}).Select("saving_id").Where("user_id = ?", q.UserID)
+	return database.DB.Model(&Saving{}).Select("id").Where("user_id = ? OR id IN (?)", q.UserID, members)
+}
+
+// rollups aggregates the TransactionRollups of the query from from until to,
+// excluded, by period and group.
+func (q *AnalyticsQuery) rollups(from, to time.Time, period, group string) ([]rollupRow, error) {
+	var results []rollupRow
+	err := database.DB.Model(&TransactionRollup{}).
+		Select(fmt.Sprintf("CAST(date_trunc('%s', day) AS DATE) AS period, %s AS group_key, currency, "+
+			"SUM(inflow) AS inflow, SUM(outflow) AS outflow, SUM(count) AS count", period, rollupGroups[group])).
+		Where("saving_id IN (?) AND day >= ? AND day < ?", q.savingsOf(), rollupDay(from), rollupDay(to)).
+		Group("period, group_key, currency").
+		Order("period, group_key, currency").
+		Scan(&results).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// add adds the flows of row to the totals, which are in the currency of row.
+func (a *AnalyticsTotals) add(row rollupRow) {
+	if a.Net.Currency == "" {
+		a.Inflow = NewMoney(0, row.Currency)
+		a.Outflow = NewMoney(0, row.Currency)
+		a.Net = NewMoney(0, row.Currency)
+	}
+	a.Inflow.Amount += row.Inflow
+	a.Outflow.Amount += row.Outflow
+	a.Net.Amount += row.Inflow - row.Outflow
+	a.Count += row.Count
+}
+
+// labels returns the names of the keys of a grouping.
+func (q *AnalyticsQuery) labels(rows []rollupRow) (map[string]string, error) {
+	results := map[string]string{}
+	switch q.GroupBy {
+	case GroupBySaving:
+		var savings []Saving
+		if err := database.DB.Unscoped().Select("id", "name").Where("id IN (?)", q.savingsOf()).Find(&savings).Error; err != nil {
+			return nil, err
+		}
+		for _, saving := range savings {
+			results[strconv.FormatUint(uint64(saving.ID), 10)] = saving.Name
+		}
+	case GroupByCategory:
+		var ids []string
+		for _, row := range rows {
+			ids = append(ids, row.GroupKey)
+		}
+		var categories []Category
+		if len(ids) > 0 {
+			if err := database.DB.Unscoped().Where("id IN ?", ids).Find(&categories).Error; err != nil {
+				return nil, err
+			}
+		}
+		for _, category := range categories {
+			results[strconv.FormatUint(uint64(category.ID), 10)] = category.Name
+		}
+		results["0"] = "Uncategorized"
+	}
+	return results, nil
+}
+
+// GetAnalytics aggregates the inflows, outflows and net change of the query
+// by period and group, and compares the totals with the previous range.
+func GetAnalytics(q AnalyticsQuery) (*Analytics, error) {
+	if _, ok := rollupGroups[q.GroupBy]; !ok {
+		return nil, ErrInvalidAnalytics
+	}
+	if q.Period != PeriodDay && q.Period != PeriodWeek && q.Period != PeriodMonth {
+		return nil, ErrInvalidAnalytics
+	}
+	if !q.To.After(q.From) {
+		return nil, ErrInvalidPeriod
+	}
+
+	result := Analytics{
+		From:         q.From,
+		To:           q.To,
+		PreviousFrom: previousFrom(q.From, q.To, q.Period),
+		Period:       q.Period,
+		GroupBy:      q.GroupBy,
+	}
+
+	rows, err := q.rollups(q.From, q.To, q.Period, q.GroupBy)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := q.labels(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	comparisons := map[string]*AnalyticsComparison{}
+	comparison := func(currency string) *AnalyticsComparison {
+		if _, ok := comparisons[currency]; !ok {
+			comparisons[currency] = &AnalyticsComparison{Currency: currency}
+		}
+		return comparisons[currency]
+	}
+
+	for _, row := range rows {
+		bucket := AnalyticsBucket{
+			Period: time.Date(row.Period.Year(), row.Period.Month(), row.Period.Day(), 0, 0, 0, 0, time.Local),
+			Key:    row.GroupKey,
+			Label:  labels[row.GroupKey],
+		}
+		if q.GroupBy == GroupByType {
+			bucket.Label = row.GroupKey
+		}
+		bucket.add(row)
+		result.Buckets = append(result.Buckets, bucket)
+		comparison(row.Currency).Current.add(row)
+	}
+
+	previous, err := q.rollups(result.PreviousFrom, q.From, q.Period, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range previous {
+		comparison(row.Currency).Previous.add(row)
+	}
+
+	var currencies []string
+	for currency := range comparisons {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+	for _, currency := range currencies {
+		c := comparisons[currency]
+		zero := AnalyticsTotals{NewMoney(0, currency), NewMoney(0, currency), NewMoney(0, currency), 0}
+		if c.Current.Net.Currency == "" {
+			c.Current = zero
+		}
+		if c.Previous.Net.Currency == "" {
+			c.Previous = zero
+		}
+		c.InflowChange = NewMoney(c.Current.Inflow.Amount-c.Previous.Inflow.Amount, currency)
+		c.OutflowChange = NewMoney(c.Current.Outflow.Amount-c.Previous.Outflow.Amount, currency)
+		c.NetChange = NewMoney(c.Current.Net.Amount-c.Previous.Net.Amount, currency)
+		result.Comparisons = append(result.Comparisons, *c)
+	}
+
+	return &result, nil
+}
+
+// InitRollups builds the TransactionRollups from the history when there are
+// none yet, like on the first start after they were added.
+func InitRollups() error {
+	var count int64
+	if err := database.DB.Model(&TransactionRollup{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := RebuildRollups()
+	return err
+}
@@ -0,0 +1,366 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"b-pay/config/logger"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Audit actions.
+const (
+	AuditUserRegistered      = "user.registered"
+	AuditLogin               = "user.login"
+	AuditLoginFailed         = "user.login_failed"
+	AuditPasswordChanged     = "user.password_changed"
+	AuditSavingCreated       = "saving.created"
+	AuditSavingUpdated       = "saving.updated"
+	AuditPINChanged          = "saving.pin_changed"
+	AuditPINLocked           = "saving.pin_locked"
+	AuditSavingDeleted       = "saving.deleted"
+	AuditTransactionCreated  = "transaction.created"
+	AuditTransactionReversed = "transaction.reversed"
+	AuditMemberRemoved       = "member.removed"
+	AuditWebhookCreated      = "webhook.created"
+	AuditWebhookDeleted      = "webhook.deleted"
+	AuditBudgetDeleted       = "budget.deleted"
+	AuditCategoryDeleted     = "category.deleted"
+	AuditRuleDeleted         = "category_rule.deleted"
+	AuditWithdrawalDecided   = "withdrawal.decided"
+	AuditHoldCaptured        = "hold.captured"
+	AuditFxExecuted          = "fx.executed"
+	AuditTimeDepositOpened   = "time_deposit.opened"
+	AuditTimeDepositBroken   = "time_deposit.broken"
+	AuditImportCommitted     = "import.committed"
+	AuditThresholdChanged    = "saving.threshold_changed"
+	AuditMemberInvited       = "member.invited"
+	AuditMemberJoined        = "member.joined"
+	AuditLimitSet            = "limit.set"
+	AuditLimitDeleted        = "limit.deleted"
+	AuditFeeWaiverCreated    = "fee_waiver.created"
+	AuditFeeWaiverDeleted    = "fee_waiver.deleted"
+	AuditScheduleCreated     = "schedule.created"
+	AuditScheduleUpdated     = "schedule.updated"
+)
+
+// SecurityActions are the actions shown in the security activity of a User.
+var SecurityActions = []string{
+	AuditLogin,
+	AuditLoginFailed,
+	AuditPasswordChanged,
+	AuditPINChanged,
+	AuditPINLocked,
+	AuditSavingDeleted,
+	AuditMemberRemoved,
+	AuditWebhookCreated,
+	AuditWebhookDeleted,
+}
+
+// maxAuditPage is the most entries one audit query returns.
+const maxAuditPage = 200
+
+// ErrAuditImmutable is returned when an AuditLog is about to be changed or
+// removed.
+var ErrAuditImmutable = errors.New("audit log is append-only")
+
+// AuditActor is who made a change, and from where.
+type AuditActor struct {
+	// UserID is nil for the system, and for failed logins of unknown emails.
+	UserID    *uint
+	Email     string
+	IP        string
+	UserAgent string
+	RequestID string
+}
+
+// auditActorKey is the context key of the AuditActor.
+type auditActorKey struct{}
+
+// WithAuditActor returns ctx with the actor of its changes. The money
+// operations given this context write their audit entry in their own DB
+// transaction, see auditTx.
+func WithAuditActor(ctx context.Context, actor AuditActor) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+// auditActorOf returns the actor of ctx, the system without one.
+func auditActorOf(ctx context.Context) AuditActor {
+	if ctx == nil {
+		return AuditActor{}
+	}
+	actor, _ := ctx.Value(auditActorKey{}).(AuditActor)
+	return actor
+}
+
+// AuditLog is an append-only record of a change. Every entry holds the hash
+// of the previous one, so changing or removing an entry breaks the chain
+// after it, see VerifyAuditChain.
+type AuditLog struct {
+	ID         uint      `gorm:"primaryKey"`
+	CreatedAt  time.Time `gorm:"not null;index"`
+	ActorID    *uint     `gorm:"index"`
+	ActorEmail string    `gorm:"size:255"`
+	IP         string    `gorm:"size:45"`
+	UserAgent  string    `gorm:"size:255"`
+	RequestID  string    `gorm:"size:64;index"`
+	Action     string    `gorm:"size:50;not null;index"`
+	TargetType string    `gorm:"size:20;index:idx_audit_target"`
+	TargetID   uint      `gorm:"index:idx_audit_target"`
+	// Before and After are JSON with the secrets redacted.
+	Before   string `gorm:"type:text"`
+	After    string `gorm:"type:text"`
+	PrevHash string `gorm:"size:64;not null"`
+	Hash     string `gorm:"size:64;not null;uniqueIndex"`
+}
+
+// AuditQuery filters the AuditLogs. Zero values match everything.
+type AuditQuery struct {
+	ActorID    uint
+	Action     string
+	TargetType string
+	TargetID   uint
+	RequestID  string
+	From       *time.Time
+	To         *time.Time
+	Page       int
+	Limit      int
+}
+
+// AuditVerification is the result of VerifyAuditChain.
+type AuditVerification struct {
+	Checked int
+	// BrokenID is the first entry which does not match the chain, nil if
+	// every entry matches.
+	BrokenID *uint
+	// Head is the hash of the last entry. Keeping it elsewhere detects the
+	// removal of the last entries too.
+	Head string
+}
+
+// BeforeUpdate refuses every change of an AuditLog.
+func (a *AuditLog) BeforeUpdate(tx *gorm.DB) error {
+	return ErrAuditImmutable
+}
+
+// BeforeDelete refuses every removal of an AuditLog.
+func (a *AuditLog) BeforeDelete(tx *gorm.DB) error {
+	return ErrAuditImmutable
+}
+
+// digest hashes the entry with the hash of the previous one.
+func (a *AuditLog) digest() string {
+	var actorID uint
+	if a.ActorID != nil {
+		actorID = *a.ActorID
+	}
+	fields, _ := json.Marshal([]interface{}{
+		a.PrevHash,
+		a.CreatedAt.UTC().Format(time.RFC3339Nano),
+		actorID,
+		a.ActorEmail,
+		a.IP,
+		a.UserAgent,
+		a.RequestID,
+		a.Action,
+		a.TargetType,
+		a.TargetID,
+		a.Before,
+		a.After,
+	})
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// redactValue replaces the secrets of a decoded JSON value.
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, inner := range v {
+			if logger.SecretKey(key) {
+				v[key] = logger.Redacted
+			} else {
+				v[key] = redactValue(inner)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return value
+}
+
+// redact returns value as JSON with the secrets replaced. Empty for nil.
+func redact(value interface{}) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return "", err
+	}
+	data, err = json.Marshal(redactValue(decoded))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Audit appends an entry about the action of actor on a target to the audit
+// log. before and after are stored as JSON without their secrets, nil for
+// none. Entries are appended one at a time to keep the chain.
+func Audit(actor AuditActor, action, targetType string, targetID uint, before, after interface{}) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		return appendAudit(tx, actor, action, targetType, targetID, before, after)
+	})
+}
+
+// auditTx is Audit within tx, by the actor of the context of tx. The entry
+// commits with the change it records, or neither does.
+func auditTx(tx *gorm.DB, action, targetType string, targetID uint, before, after interface{}) error {
+	return appendAudit(tx, auditActorOf(tx.Statement.Context), action, targetType, targetID, before, after)
+}
+
+// appendAudit appends the entry within tx. The table stays locked until tx
+// ends, so the entries of concurrent DB transactions chain in commit order.
+func appendAudit(tx *gorm.DB, actor AuditActor, action, targetType string, targetID uint, before, after interface{}) error {
+	entry := AuditLog{
+		ActorID:    actor.UserID,
+		ActorEmail: actor.Email,
+		IP:         actor.IP,
+		UserAgent:  actor.UserAgent,
+		RequestID:  actor.RequestID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+	}
+	if len(entry.UserAgent) > 255 {
+		entry.UserAgent = entry.UserAgent[:255]
+	}
+
+	var err error
+	if entry.Before, err = redact(before); err != nil {
+		return err
+	}
+	if entry.After, err = redact(after); err != nil {
+		return err
+	}
+
+	// SQLite, used by the tests, locks the whole database on write instead.
+	if tx.Dialector.Name() == "postgres" {
+		if err := tx.Exec("LOCK TABLE audit_logs IN EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+	}
+	var last AuditLog
+	err = tx.Select("hash").Order("id DESC").Take(&last).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	// The database keeps microseconds, the hash has to match them.
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	entry.PrevHash = last.Hash
+	entry.Hash = entry.digest()
+	return tx.Create(&entry).Error
+}
+
+// GetAuditLogs returns a page of the AuditLogs of the query, newest first.
+func GetAuditLogs(q AuditQuery) ([]AuditLog, error) {
+	limit := q.Limit
+	if limit <= 0 || limit > maxAuditPage {
+		limit = maxAuditPage
+	}
+	page := q.Page
+	if page < 1 {
+		page = 1
+	}
+
+	query := database.DB.Model(&AuditLog{})
+	if q.ActorID != 0 {
+		query = query.Where("actor_id = ?", q.ActorID)
+	}
+	if q.Action != "" {
+		query = query.Where("action = ?", q.Action)
+	}
+	if q.TargetType != "" {
+		query = query.Where("target_type = ?", q.TargetType)
+	}
+	if q.TargetID != 0 {
+		query = query.Where("target_id = ?", q.TargetID)
+	}
+	if q.RequestID != "" {
+		query = query.Where("request_id = ?", q.RequestID)
+	}
+	if q.From != nil {
+		query = query.Where("created_at >= ?", q.From)
+	}
+	if q.To != nil {
+		query = query.Where("created_at < ?", q.To)
+	}
+
+	var results []AuditLog
+	err := query.Order("id DESC").Limit(limit).Offset((page - 1) * limit).Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// GetSecurityActivity returns the latest security actions made by the User
+// or on their account, newest first.
+func GetSecurityActivity(userID uint, limit int) ([]AuditLog, error) {
+	if limit <= 0 || limit > maxAuditPage {
+		limit = maxAuditPage
+	}
+
+	var results []AuditLog
+	err := database.DB.
+		Where("(actor_id = ? OR (target_type = ? AND target_id = ?)) AND action IN ?",
+			userID, "user", userID, SecurityActions).
+		Order("id DESC").
+		Limit(limit).
+		Find(&results).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// VerifyAuditChain hashes every AuditLog again in order, and checks that each
+// holds the hash of the one before it.
+func VerifyAuditChain() (*AuditVerification, error) {
+	result := AuditVerification{}
+	var lastID uint
+	for {
+		var batch []AuditLog
+		err := database.DB.Where("id > ?", lastID).Order("id").Limit(1000).Find(&batch).Error
+		if err != nil {
+			return nil, err
+		}
+		for i := range batch {
+			entry := &batch[i]
+			if entry.PrevHash != result.Head || entry.Hash != entry.digest() {
+				result.BrokenID = &entry.ID
+				return &result, nil
+			}
+			result.Head = entry.Hash
+			result.Checked++
+			lastID = entry.ID
+		}
+		if len(batch) < 1000 {
+			return &result, nil
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"context"
+	"testing"
+	"time"
+)
+
+// auditLogs returns the AuditLogs of the action, oldest first.
+func auditLogs(t *testing.T, action string) []AuditLog {
+	t.Helper()
+	var results []AuditLog
+	if err := database.DB.Where("action = ?", action).Order("id").Find(&results).Error; err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestAuditMoneyEvents(t *testing.T) {
+	setupDB(t)
+	saving := newSaving(t, 1000, time.Now())
+	ctx := WithAuditActor(context.Background(), AuditActor{UserID: &saving.UserID, RequestID: "request"})
+
+	withdrawal := Transaction{SavingID: saving.ID, Type: TypeWithdrawal, Value: -300}
+	if err := withdrawal.WithContext(ctx).Post(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withdrawal.Reverse(100, "OTHER", "refund"); err != nil {
+		t.Fatal(err)
+	}
+
+	created := auditLogs(t, AuditTransactionCreated)
+	if len(created) != 1 || created[0].TargetID != withdrawal.ID || created[0].RequestID != "request" ||
+		created[0].ActorID == nil || *created[0].ActorID != saving.UserID {
+		t.Fatalf("transaction.created entries = %+v", created)
+	}
+	if reversed := auditLogs(t, AuditTransactionReversed); len(reversed) != 1 || reversed[0].RequestID != "request" {
+		t.Fatalf("transaction.reversed entries = %+v", reversed)
+	}
+
+	// A refused Transaction is not recorded.
+	refused := Transaction{SavingID: saving.ID, Type: TypeWithdrawal, Value: -5000}
+	if err := refused.WithContext(ctx).Post(); err != ErrInsufficientBalance {
+		t.Fatalf("err = %v, want %v", err, ErrInsufficientBalance)
+	}
+	if created := auditLogs(t, AuditTransactionCreated); len(created) != 1 {
+		t.Errorf("got %d transaction.created entries, want 1", len(created))
+	}
+
+	verification, err := VerifyAuditChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verification.BrokenID != nil || verification.Checked != 2 {
+		t.Errorf("verification = %+v", verification)
+	}
+}
+
+func TestAuditFailureRollsBack(t *testing.T) {
+	setupDB(t)
+	saving := newSaving(t, 1000, time.Now())
+	if err := database.DB.Migrator().DropTable(&AuditLog{}); err != nil {
+		t.Fatal(err)
+	}
+
+	withdrawal := Transaction{SavingID: saving.ID, Type: TypeWithdrawal, Value: -300}
+	if err := withdrawal.Post(); err == nil {
+		t.Fatal("posted without its audit entry")
+	}
+	if reload(t, saving).Balance != 1000 {
+		t.Error("balance changed without its audit entry")
+	}
+}
+
+func TestAuditImmutable(t *testing.T) {
+	setupDB(t)
+	if err := Audit(AuditActor{}, AuditLogin, "user", 1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	entry := auditLogs(t, AuditLogin)[0]
+
+	if err := database.DB.Model(&entry).Update("action", AuditLoginFailed).Error; err != ErrAuditImmutable {
+		t.Errorf("update err = %v, want %v", err, ErrAuditImmutable)
+	}
+	if err := database.DB.Delete(&entry).Error; err != ErrAuditImmutable {
+		t.Errorf("delete err = %v, want %v", err, ErrAuditImmutable)
+	}
+}
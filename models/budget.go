@@ -0,0 +1,486 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"b-pay/config/events"
+	"b-pay/config/logger"
+	"b-pay/config/notify"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Budget periods.
+const (
+	BudgetWeekly  = "WEEKLY"
+	BudgetMonthly = "MONTHLY"
+	BudgetYearly  = "YEARLY"
+)
+
+// Budget rollovers. UNUSED carries what was not spent in the previous period
+// to the current one, ALL also carries the overspending as a smaller limit.
+const (
+	RolloverNone   = "NONE"
+	RolloverUnused = "UNUSED"
+	RolloverAll    = "ALL"
+)
+
+// Budget alert kinds. A THRESHOLD alert is sent when the spending reaches a
+// percent of the limit, EXCEEDED when it goes over the limit.
+const (
+	AlertThreshold = "THRESHOLD"
+	AlertExceeded  = "EXCEEDED"
+)
+
+// DefaultBudgetThresholds are the thresholds of a Budget created without
+// any.
+const DefaultBudgetThresholds = "80,100"
+
+// ErrInvalidBudget is returned when a Budget is not valid.
+var ErrInvalidBudget = errors.New("budget needs a positive amount, a WEEKLY, MONTHLY or YEARLY period, a NONE, UNUSED or ALL rollover and thresholds from 1 to 1000 percent")
+
+// Budget plans the WITHDRAWALs of a Saving for every period. Keywords narrow
+// it to the WITHDRAWALs whose description has one of them.
+type Budget struct {
+	gorm.Model
+	SavingID uint   `gorm:"not null;index"`
+	Name     string `gorm:"size:100;not null"`
+	// Amount is the limit of every period, in minor units of the currency of
+	// the Saving.
+	Amount   int64  `gorm:"not null"`
+	Period   string `gorm:"size:7;not null;default:MONTHLY"` // WEEKLY, MONTHLY or YEARLY
+	Rollover string `gorm:"size:6;not null;default:NONE"`    // NONE, UNUSED or ALL
+	// Keywords are comma separated and case-insensitive. Empty for every
+	// WITHDRAWAL.
+	Keywords string `gorm:"size:200"`
+	// Thresholds are comma separated percents of the limit, like 80,100.
+	Thresholds string `gorm:"size:50;not null"`
+	Active     bool   `gorm:"not null;default:true"`
+}
+
+// BudgetAlert is an alert sent for a Budget. One per period, kind and
+// threshold, so an alert is never sent twice.
+type BudgetAlert struct {
+	gorm.Model
+	BudgetID   uint      `gorm:"not null;uniqueIndex:idx_budget_alert"`
+	PeriodFrom time.Time `gorm:"type:date;not null;uniqueIndex:idx_budget_alert"`
+	Kind       string    `gorm:"size:9;not null;uniqueIndex:idx_budget_alert"` // THRESHOLD or EXCEEDED
+	// Threshold is the percent reached, 0 when EXCEEDED.
+	Threshold     int   `gorm:"not null;default:0;uniqueIndex:idx_budget_alert"`
+	Spent         int64 `gorm:"not null"`
+	Allowance     int64 `gorm:"not null"` // The limit of the period
+	TransactionID uint
+}
+
+// BudgetUsage is the spending of a Budget in its current period.
+type BudgetUsage struct {
+	Budget Budget
+	From   time.Time
+	To     time.Time
+	// Carried is the amount rolled over from the previous period. Limit is
+	// the Amount plus Carried.
+	Carried   Money
+	Limit     Money
+	Spent     Money
+	Remaining Money
+	Percent   int64
+	Alerts    []BudgetAlert
+}
+
+// keywords returns the lowercase keywords of the Budget.
+func (b *Budget) keywords() []string {
+	var results []string
+	for _, keyword := range strings.Split(b.Keywords, ",") {
+		if keyword = strings.ToLower(strings.TrimSpace(keyword)); keyword != "" {
+			results = append(results, keyword)
+		}
+	}
+	return results
+}
+
+// thresholds returns the threshold percents of the Budget in ascending order.
+func (b *Budget) thresholds() ([]int, error) {
+	var results []int
+	for _, value := range strings.Split(b.Thresholds, ",") {
+		percent, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || percent < 1 || percent > 1000 {
+			return nil, ErrInvalidBudget
+		}
+		results = append(results, percent)
+	}
+	sort.Ints(results)
+	return results, nil
+}
+
+// Validate checks whether the Budget is valid and normalizes it.
+func (b *Budget) Validate() error {
+	b.Period = strings.ToUpper(b.Period)
+	if b.Period == "" {
+		b.Period = BudgetMonthly
+	}
+	b.Rollover = strings.ToUpper(b.Rollover)
+	if b.Rollover == "" {
+		b.Rollover = RolloverNone
+	}
+	if b.Thresholds == "" {
+		b.Thresholds = DefaultBudgetThresholds
+	}
+
+	if b.Amount <= 0 || strings.TrimSpace(b.Name) == "" {
+		return ErrInvalidBudget
+	}
+	if b.Period != BudgetWeekly && b.Period != BudgetMonthly && b.Period != BudgetYearly {
+		return ErrInvalidBudget
+	}
+	if b.Rollover != RolloverNone && b.Rollover != RolloverUnused && b.Rollover != RolloverAll {
+		return ErrInvalidBudget
+	}
+	thresholds, err := b.thresholds()
+	if err != nil {
+		return err
+	}
+	var normalized []string
+	for _, percent := range thresholds {
+		normalized = append(normalized, strconv.Itoa(percent))
+	}
+	b.Thresholds = strings.Join(normalized, ",")
+	b.Keywords = strings.Join(b.keywords(), ",")
+	return nil
+}
+
+// Store creates the Budget.
+func (b *Budget) Store() error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	return database.DB.Create(&b).Error
+}
+
+// GetBudgetByID gets/fetches a Budget by searching the ID.
+func GetBudgetByID(id string) *Budget {
+	var result Budget
+	if err := database.DB.Where("id = ?", id).First(&result).Error; err != nil {
+		return nil
+	}
+	return &result
+}
+
+// Delete removes the Budget. Its alerts are kept.
+func (b *Budget) Delete() error {
+	return database.DB.Delete(&b).Error
+}
+
+// periodOf returns the period of the Budget which contains t, To is
+// excluded. Weeks start on Monday.
+func (b *Budget) periodOf(t time.Time) (time.Time, time.Time) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch b.Period {
+	case BudgetWeekly:
+		from := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return from, from.AddDate(0, 0, 7)
+	case BudgetYearly:
+		from := time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+		return from, from.AddDate(1, 0, 0)
+	default:
+		from := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return from, from.AddDate(0, 1, 0)
+	}
+}
+
+// matchesKeywords reports whether the description has one of the keywords
+// of the Budget.
+func (b *Budget) matchesKeywords(description string) bool {
+	keywords := b.keywords()
+	if len(keywords) == 0 {
+		return true
+	}
+	description = strings.ToLower(description)
+	for _, keyword := range keywords {
+		if strings.Contains(description, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// spent sums the WITHDRAWALs of the Budget from from until to, excluded,
+// minus what was reversed of them in that time.
+func (b *Budget) spent(tx *gorm.DB, from, to time.Time) (int64, error) {
+	withdrawals := tx.Model(&Transaction{}).
+		Select("id").
+		Where("saving_id = ? AND type = ?", b.SavingID, TypeWithdrawal)
+	var conditions []string
+	var args []interface{}
+	escape := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	for _, keyword := range b.keywords() {
+		conditions = append(conditions, "LOWER(description) LIKE ?")
+		args = append(args, "%"+escape.Replace(keyword)+"%")
+	}
+	if len(conditions) > 0 {
+		withdrawals = withdrawals.Where(strings.Join(conditions, " OR "), args...)
+	}
+
+	var total int64
+	err := tx.Model(&Transaction{}).
+		Select("COALESCE(-SUM(value), 0)").
+		Where("created_at >= ? AND created_at < ?", from, to).
+		Where("id IN (?) OR reversal_of IN (?)", withdrawals, withdrawals).
+		Scan(&total).
+		Error
+	return total, err
+}
+
+// limitAt returns the limit of the Budget for the period starting at from,
+// and how much of it was carried from the previous period. Only the previous
+// period is carried, not what it carried itself.
+func (b *Budget) limitAt(tx *gorm.DB, from time.Time) (int64, int64, error) {
+	if b.Rollover == RolloverNone {
+		return b.Amount, 0, nil
+	}
+	previousFrom, previousTo := b.periodOf(from.Add(-time.Nanosecond))
+	if !previousTo.After(b.CreatedAt) {
+		return b.Amount, 0, nil
+	}
+
+	spent, err := b.spent(tx, previousFrom, previousTo)
+	if err != nil {
+		return 0, 0, err
+	}
+	carried := b.Amount - spent
+	if carried < 0 && b.Rollover == RolloverUnused {
+		carried = 0
+	}
+	return b.Amount + carried, carried, nil
+}
+
+// Usage returns the spending of the Budget in the period which contains now.
+func (b *Budget) Usage(currency string, now time.Time) (*BudgetUsage, error) {
+	from, to := b.periodOf(now)
+	limit, carried, err := b.limitAt(database.DB, from)
+	if err != nil {
+		return nil, err
+	}
+	spent, err := b.spent(database.DB, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := BudgetUsage{
+		Budget:    *b,
+		From:      from,
+		To:        to,
+		Carried:   NewMoney(carried, currency),
+		Limit:     NewMoney(limit, currency),
+		Spent:     NewMoney(spent, currency),
+		Remaining: NewMoney(limit-spent, currency),
+		Percent:   percentOf(spent, limit),
+	}
+	err = database.DB.
+		Where("budget_id = ? AND period_from = ?", b.ID, from).
+		Order("created_at").
+		Find(&usage.Alerts).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// percentOf returns spent as a whole percent of limit, rounded down. A limit
+// of 0 or less is always over 100 percent once anything is spent.
+func percentOf(spent, limit int64) int64 {
+	if limit <= 0 {
+		if spent > 0 {
+			return 1000
+		}
+		return 0
+	}
+	return spent * 100 / limit
+}
+
+// GetBudgetUsages returns the usage of every active Budget of the Saving in
+// its current period.
+func (s *Saving) GetBudgetUsages(now time.Time) (*[]BudgetUsage, error) {
+	var budgets []Budget
+	if err := database.DB.Where("saving_id = ? AND active", s.ID).Order("id").Find(&budgets).Error; err != nil {
+		return nil, err
+	}
+
+	results := []BudgetUsage{}
+	for i := range budgets {
+		usage, err := budgets[i].Usage(s.Currency, now)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *usage)
+	}
+	return &results, nil
+}
+
+// BudgetAlertEvent is the payload of budget.alert.
+type BudgetAlertEvent struct {
+	AlertID    uint
+	BudgetID   uint
+	BudgetName string
+	SavingID   uint
+	SavingName string
+	UserID     uint
+	Kind       string
+	Threshold  int
+	Spent      int64
+	Allowance  int64
+	Currency   string
+	PeriodFrom time.Time
+}
+
+// evaluateBudgets checks a WITHDRAWAL against every active Budget of its
+// Saving it matches, within tx, and records the alerts it triggers with a
+// budget.alert event each. An alert is sent once per period.
+func evaluateBudgets(tx *gorm.DB, saving *Saving, t *Transaction) error {
+	var budgets []Budget
+	if err := tx.Where("saving_id = ? AND active", saving.ID).Find(&budgets).Error; err != nil {
+		return err
+	}
+
+	for i := range budgets {
+		budget := &budgets[i]
+		if !budget.matchesKeywords(t.Description) {
+			continue
+		}
+		alerts, err := budget.evaluate(tx, t)
+		if err != nil {
+			return err
+		}
+		for _, alert := range alerts {
+			err := writeOutbox(tx, TopicBudgetAlert, "budget", budget.ID, BudgetAlertEvent{
+				AlertID:    alert.ID,
+				BudgetID:   budget.ID,
+				BudgetName: budget.Name,
+				SavingID:   saving.ID,
+				SavingName: saving.Name,
+				UserID:     saving.UserID,
+				Kind:       alert.Kind,
+				Threshold:  alert.Threshold,
+				Spent:      alert.Spent,
+				Allowance:  alert.Allowance,
+				Currency:   saving.Currency,
+				PeriodFrom: alert.PeriodFrom,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// evaluate records the alerts of the Budget reached by its spending up to t
+// which were not sent in the period yet, within tx.
+func (b *Budget) evaluate(tx *gorm.DB, t *Transaction) ([]BudgetAlert, error) {
+	from, to := b.periodOf(t.CreatedAt)
+	limit, _, err := b.limitAt(tx, from)
+	if err != nil {
+		return nil, err
+	}
+	spent, err := b.spent(tx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	thresholds, err := b.thresholds()
+	if err != nil {
+		return nil, err
+	}
+
+	var reached []BudgetAlert
+	percent := percentOf(spent, limit)
+	for _, threshold := range thresholds {
+		if percent >= int64(threshold) {
+			reached = append(reached, BudgetAlert{Kind: AlertThreshold, Threshold: threshold})
+		}
+	}
+	if spent > limit {
+		reached = append(reached, BudgetAlert{Kind: AlertExceeded})
+	}
+
+	var results []BudgetAlert
+	for _, alert := range reached {
+		alert.BudgetID = b.ID
+		alert.PeriodFrom = from
+		alert.Spent = spent
+		alert.Allowance = limit
+		alert.TransactionID = t.ID
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&alert)
+		if result.Error != nil {
+			return results, result.Error
+		}
+		if result.RowsAffected > 0 {
+			results = append(results, alert)
+		}
+	}
+	return results, nil
+}
+
+// GetBudgetAlerts returns the alerts the Transaction triggered.
+func (t *Transaction) GetBudgetAlerts() ([]BudgetAlert, error) {
+	var results []BudgetAlert
+	err := database.DB.Where("transaction_id = ?", t.ID).Order("id").Find(&results).Error
+	return results, err
+}
+
+// InitBudgetAlerts sends the budget.alert events of events.LocalBus to the
+// owners of the Savings. Each instance sends the alerts its outbox relay
+// publishes, once per event.
+func InitBudgetAlerts() {
+	events.LocalBus.Subscribe(TopicBudgetAlert, sendBudgetAlert)
+}
+
+// sendBudgetAlert sends the alert of a budget.alert event to the owner of the
+// Saving. A failing send is published again by the relay.
+func sendBudgetAlert(m events.Message) error {
+	var alert BudgetAlertEvent
+	if err := json.Unmarshal(m.Payload, &alert); err != nil {
+		logger.Log.Error("budget alert failed", zap.String("event_id", m.ID), zap.Error(err))
+		return nil
+	}
+
+	err := ConsumeOnce("budget-alerts", m, func(tx *gorm.DB) error {
+		var owner User
+		err := tx.Where("id = ?", alert.UserID).First(&owner).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			logger.Log.Warn("budget alert without owner", zap.Uint("budget_alert_id", alert.AlertID))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		spent := NewMoney(alert.Spent, alert.Currency)
+		limit := NewMoney(alert.Allowance, alert.Currency)
+		subject := fmt.Sprintf("Budget %s reached %d%%", alert.BudgetName, alert.Threshold)
+		if alert.Kind == AlertExceeded {
+			subject = fmt.Sprintf("Budget %s is exceeded", alert.BudgetName)
+		}
+		body := fmt.Sprintf("You spent %s of your %s budget %s on %s since %s.",
+			spent, limit, alert.BudgetName, alert.SavingName, alert.PeriodFrom.Format("2006-01-02"))
+
+		return notify.Default.Notify(notify.Notification{
+			UserID:  owner.ID,
+			Email:   owner.Email,
+			Kind:    "BUDGET_" + alert.Kind,
+			Subject: subject,
+			Body:    body,
+		})
+	})
+	if errors.Is(err, ErrEventProcessed) {
+		return nil
+	}
+	return err
+}
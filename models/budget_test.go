@@ -0,0 +1,120 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"b-pay/config/notify"
+	"testing"
+	"time"
+)
+
+// recordingNotifier keeps the Notifications instead of sending them.
+type recordingNotifier struct {
+	sent []notify.Notification
+}
+
+func (r *recordingNotifier) Notify(n notify.Notification) error {
+	r.sent = append(r.sent, n)
+	return nil
+}
+
+// newBudget stores a MONTHLY Budget of amount alerting at 80 and 100 percent.
+func newBudget(t *testing.T, saving *Saving, amount int64) *Budget {
+	t.Helper()
+	budget := Budget{SavingID: saving.ID, Name: "Food", Amount: amount, Thresholds: "80,100"}
+	if err := budget.Store(); err != nil {
+		t.Fatal(err)
+	}
+	return &budget
+}
+
+// budgetAlertEvents returns the budget.alert events in the outbox.
+func budgetAlertEvents(t *testing.T) []OutboxEvent {
+	t.Helper()
+	var results []OutboxEvent
+	if err := database.DB.Where("topic = ?", TopicBudgetAlert).Order("id").Find(&results).Error; err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestBudgetAlertsArePosted(t *testing.T) {
+	setupDB(t)
+	saving := newSaving(t, 1000, time.Now())
+	newBudget(t, saving, 500)
+
+	withdrawal := Transaction{SavingID: saving.ID, Type: TypeWithdrawal, Value: -450}
+	if err := withdrawal.Post(); err != nil {
+		t.Fatal(err)
+	}
+	alerts, err := withdrawal.GetBudgetAlerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].Kind != AlertThreshold || alerts[0].Threshold != 80 {
+		t.Fatalf("alerts = %+v, want one THRESHOLD alert at 80", alerts)
+	}
+
+	// The same threshold alerts once per period.
+	again := Transaction{SavingID: saving.ID, Type: TypeWithdrawal, Value: -10}
+	if err := again.Post(); err != nil {
+		t.Fatal(err)
+	}
+	events := budgetAlertEvents(t)
+	if len(events) != 1 {
+		t.Fatalf("got %d budget.alert events, want 1", len(events))
+	}
+
+	recorder := &recordingNotifier{}
+	defer func(old notify.Notifier) { notify.Default = old }(notify.Default)
+	notify.Default = recorder
+
+	// The relay publishes at least once, the owner gets the alert once.
+	for i := 0; i < 2; i++ {
+		if err := sendBudgetAlert(events[0].message()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(recorder.sent) != 1 {
+		t.Fatalf("sent %d notifications, want 1", len(recorder.sent))
+	}
+	if got := recorder.sent[0]; got.UserID != saving.UserID || got.Kind != "BUDGET_"+AlertThreshold {
+		t.Errorf("notification = %+v", got)
+	}
+}
+
+func TestBudgetAlertsOnApproval(t *testing.T) {
+	setupDB(t)
+	saving := newSaving(t, 1000, time.Now())
+	addOwner(100)(t, saving)
+	newBudget(t, saving, 500)
+
+	var other SavingMember
+	if err := database.DB.Where("saving_id = ? AND user_id <> ?", saving.ID, saving.UserID).First(&other).Error; err != nil {
+		t.Fatal(err)
+	}
+	pending := PendingWithdrawal{
+		SavingID:    saving.ID,
+		RequestedBy: saving.UserID,
+		Value:       600,
+		Status:      ApprovalPending,
+	}
+	if err := database.DB.Create(&pending).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	transaction, err := pending.Decide(other.UserID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alerts, err := transaction.GetBudgetAlerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 120% reaches both thresholds and exceeds the Budget.
+	if len(alerts) != 3 {
+		t.Fatalf("got %d alerts, want 3", len(alerts))
+	}
+	if events := budgetAlertEvents(t); len(events) != 3 {
+		t.Fatalf("got %d budget.alert events, want 3", len(events))
+	}
+}
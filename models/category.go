@@ -0,0 +1,473 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"errors"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Where the category of a Transaction comes from. A MANUAL category is never
+// changed by the rules.
+const (
+	CategoryByRule   = "RULE"
+	CategoryByManual = "MANUAL"
+)
+
+// maxTags is the number of tags a Transaction can have.
+const maxTags = 10
+
+// SystemCategories are the categories every User has.
+var SystemCategories = []string{
+	"Income",
+	"Salary",
+	"Transfer",
+	"Groceries",
+	"Dining",
+	"Transport",
+	"Utilities",
+	"Housing",
+	"Health",
+	"Shopping",
+	"Entertainment",
+	"Education",
+	"Fees",
+	"Interest",
+	"Other",
+}
+
+var (
+	// ErrCategoryNotFound is returned when a category does not exist or
+	// belongs to another User.
+	ErrCategoryNotFound = errors.New("category is not found")
+	// ErrCategoryExists is returned when a User already has a category of
+	// the same name.
+	ErrCategoryExists = errors.New("category already exists")
+	// ErrInvalidCategoryRule is returned when a CategoryRule is not valid.
+	ErrInvalidCategoryRule = errors.New("invalid category rule")
+	// ErrInvalidTag is returned when a tag is empty or too long, or there are
+	// too many.
+	ErrInvalidTag = errors.New("tags must have 1 to 30 characters, at most 10 per transaction")
+)
+
+// Category of Transactions. System categories have no UserID.
+type Category struct {
+	gorm.Model
+	UserID *uint  `gorm:"uniqueIndex:idx_category_name"`
+	Name   string `gorm:"size:50;not null;uniqueIndex:idx_category_name"`
+}
+
+// TransactionTag is one free-form tag of a Transaction.
+type TransactionTag struct {
+	TransactionID uint   `gorm:"primaryKey"`
+	Tag           string `gorm:"primaryKey;size:30;index"`
+}
+
+// CategoryRule assigns CategoryID to the Transactions of the Savings of a User
+// which match every condition. Rules are tried by Priority, lowest first,
+// and the first match wins.
+type CategoryRule struct {
+	gorm.Model
+	UserID     uint `gorm:"not null;index"`
+	CategoryID uint `gorm:"not null"`
+	// Pattern is a case-insensitive regular expression matched against the
+	// Description. Empty matches every Description.
+	Pattern string `gorm:"size:200"`
+	// Type limits the rule to one Transaction type. Empty for every type.
+	Type string `gorm:"size:11"`
+	// MinAmount and MaxAmount bound the absolute Value, both included. 0
+	// means no bound.
+	MinAmount int64 `gorm:"not null;default:0"`
+	MaxAmount int64 `gorm:"not null;default:0"`
+	Priority  int   `gorm:"not null;default:0"`
+
+	pattern *regexp.Regexp
+}
+
+// TransactionFilter filters the Transactions of a Saving. Every empty field
+// matches all.
+type TransactionFilter struct {
+	Type       string
+	CategoryID uint
+	// Uncategorized only matches Transactions without a category.
+	Uncategorized bool
+	Tag           string
+}
+
+// SeedCategories creates the SystemCategories which do not exist yet.
+func SeedCategories() error {
+	for _, name := range SystemCategories {
+		var count int64
+		err := database.DB.Model(&Category{}).
+			Where("user_id IS NULL AND name = ?", name).
+			Count(&count).
+			Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if err := database.DB.Create(&Category{Name: name}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCategories gets/fetches the system categories and the categories of the
+// User.
+func GetCategories(userID uint) (*[]Category, error) {
+	var results []Category
+	err := database.DB.
+		Where("user_id IS NULL OR user_id = ?", userID).
+		Order("user_id NULLS FIRST, name").
+		Find(&results).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// visibleCategory gets the category with id if it is a system category or
+// one of the User.
+func visibleCategory(tx *gorm.DB, userID, id uint) (*Category, error) {
+	var result Category
+	err := tx.Where("id = ? AND (user_id IS NULL OR user_id = ?)", id, userID).First(&result).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCategoryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Store creates a category of the User. Its name can not be the name of a
+// system category or of another category of the User.
+func (c *Category) Store() error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" || len(c.Name) > 50 || c.UserID == nil {
+		return errors.New("category name must have 1 to 50 characters")
+	}
+
+	var count int64
+	err := database.DB.Model(&Category{}).
+		Where("(user_id IS NULL OR user_id = ?) AND LOWER(name) = LOWER(?)", *c.UserID, c.Name).
+		Count(&count).
+		Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrCategoryExists
+	}
+
+	return database.DB.Create(&c).Error
+}
+
+// DeleteCategory removes a category of the User with its rules. Its
+// Transactions lose their category, also a MANUAL one, and the other rules
+// are applied to them again.
+func DeleteCategory(userID, id uint) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var category Category
+		err := tx.Where("id = ? AND user_id = ?", id, userID).First(&category).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrCategoryNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		var transactions []Transaction
+		if err := tx.Where("category_id = ?", id).Find(&transactions).Error; err != nil {
+			return err
+		}
+		for i := range transactions {
+			if err := setTransactionCategory(tx, &transactions[i], nil, ""); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("category_id = ?", id).Delete(&CategoryRule{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&category).Error; err != nil {
+			return err
+		}
+
+		_, err = reapplyRules(tx, userID)
+		return err
+	})
+}
+
+// compile compiles the Pattern of the rule.
+func (r *CategoryRule) compile() error {
+	pattern, err := regexp.Compile("(?i)" + r.Pattern)
+	if err != nil {
+		return err
+	}
+	r.pattern = pattern
+	return nil
+}
+
+// Validate checks whether the rule is valid and its category is visible to
+// its User.
+func (r *CategoryRule) Validate() error {
+	r.Type = strings.ToUpper(r.Type)
+	if r.MinAmount < 0 || r.MaxAmount < 0 || (r.MaxAmount > 0 && r.MinAmount > r.MaxAmount) {
+		return ErrInvalidCategoryRule
+	}
+	if err := r.compile(); err != nil {
+		return ErrInvalidCategoryRule
+	}
+	_, err := visibleCategory(database.DB, r.UserID, r.CategoryID)
+	return err
+}
+
+// Store creates the rule. It only applies to new Transactions until the rules
+// are applied again, see ReapplyRules.
+func (r *CategoryRule) Store() error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	return database.DB.Create(&r).Error
+}
+
+// DeleteCategoryRule removes a rule of the User by ID.
+func DeleteCategoryRule(userID uint, id string) error {
+	result := database.DB.Where("id = ? AND user_id = ?", id, userID).Delete(&CategoryRule{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetCategoryRules gets/fetches every rule of the User in the order they are
+// tried.
+func GetCategoryRules(userID uint) (*[]CategoryRule, error) {
+	rules, err := loadRules(database.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &rules, nil
+}
+
+// loadRules gets the compiled rules of the User in the order they are tried.
+func loadRules(tx *gorm.DB, userID uint) ([]CategoryRule, error) {
+	var rules []CategoryRule
+	err := tx.Where("user_id = ?", userID).Order("priority, id").Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// matches reports whether the Transaction meets every condition of the rule.
+func (r *CategoryRule) matches(t *Transaction) bool {
+	if r.Type != "" && r.Type != t.Type {
+		return false
+	}
+	value := abs(t.Value)
+	if value < r.MinAmount || (r.MaxAmount > 0 && value > r.MaxAmount) {
+		return false
+	}
+	return r.pattern.MatchString(t.Description)
+}
+
+// matchCategory returns the category of the first rule that matches the
+// Transaction, or nil.
+func matchCategory(rules []CategoryRule, t *Transaction) *uint {
+	for i := range rules {
+		if rules[i].matches(t) {
+			id := rules[i].CategoryID
+			return &id
+		}
+	}
+	return nil
+}
+
+// categorize assigns the category of the rules of the owner of the Saving to
+// a new Transaction, within tx. A Transaction which already has a category
+// keeps it.
+func categorize(tx *gorm.DB, saving *Saving, t *Transaction) error {
+	if t.CategoryID != nil {
+		return nil
+	}
+	rules, err := loadRules(tx, saving.UserID)
+	if err != nil {
+		return err
+	}
+	if t.CategoryID = matchCategory(rules, t); t.CategoryID != nil {
+		t.CategorySource = CategoryByRule
+	}
+	return nil
+}
+
+// ReapplyRules applies the current rules of the User again to every
+// Transaction of their Savings, except the MANUAL ones. Returns how many
+// Transactions changed category.
+func ReapplyRules(userID uint) (int, error) {
+	var changed int
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		changed, err = reapplyRules(tx, userID)
+		return err
+	})
+	return changed, err
+}
+
+// reapplyRules is ReapplyRules within tx.
+func reapplyRules(tx *gorm.DB, userID uint) (int, error) {
+	rules, err := loadRules(tx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	owned := tx.Model(&Saving{}).Select("id").Where("user_id = ?", userID)
+	var transactions []Transaction
+	err = tx.Select("id", "saving_id", "created_at", "type", "value", "currency", "description", "category_id").
+		Where("saving_id IN (?) AND category_source <> ?", owned, CategoryByManual).
+		Find(&transactions).
+		Error
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for i := range transactions {
+		t := &transactions[i]
+		category := matchCategory(rules, t)
+		if sameCategory(category, t.CategoryID) {
+			continue
+		}
+
+		source := ""
+		if category != nil {
+			source = CategoryByRule
+		}
+		if err := setTransactionCategory(tx, t, category, source); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// setTransactionCategory changes the category of the Transaction within tx
+// and moves it to the TransactionRollup of the new category.
+func setTransactionCategory(tx *gorm.DB, t *Transaction, category *uint, source string) error {
+	if err := addRollup(tx, t, -1); err != nil {
+		return err
+	}
+	t.CategoryID, t.CategorySource = category, source
+	if err := addRollup(tx, t, 1); err != nil {
+		return err
+	}
+
+	return tx.Model(&Transaction{}).
+		Where("id = ?", t.ID).
+		Updates(map[string]interface{}{"category_id": category, "category_source": source}).
+		Error
+}
+
+// sameCategory reports whether two optional category IDs are equal.
+func sameCategory(a, b *uint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// SetCategory overrides the category of the Transaction by hand, the rules
+// never change it again. A categoryID of 0 removes the override and applies
+// the rules of userID, the owner of the Saving, again.
+func (t *Transaction) SetCategory(userID, categoryID uint) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if categoryID != 0 {
+			if _, err := visibleCategory(tx, userID, categoryID); err != nil {
+				return err
+			}
+			return setTransactionCategory(tx, t, &categoryID, CategoryByManual)
+		}
+
+		rules, err := loadRules(tx, userID)
+		if err != nil {
+			return err
+		}
+		category, source := matchCategory(rules, t), ""
+		if category != nil {
+			source = CategoryByRule
+		}
+		return setTransactionCategory(tx, t, category, source)
+	})
+}
+
+// SetTags replaces the tags of the Transaction. Tags are lowercase and
+// unique.
+func (t *Transaction) SetTags(tags []string) error {
+	seen := map[string]bool{}
+	var results []TransactionTag
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len(tag) > 30 {
+			return ErrInvalidTag
+		}
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		results = append(results, TransactionTag{TransactionID: t.ID, Tag: tag})
+	}
+	if len(results) > maxTags {
+		return ErrInvalidTag
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("transaction_id = ?", t.ID).Delete(&TransactionTag{}).Error; err != nil {
+			return err
+		}
+		t.Tags = results
+		if len(results) == 0 {
+			return nil
+		}
+		return tx.Create(&results).Error
+	})
+}
+
+// GetTransactions gets/fetches the Transactions of the Saving which match the
+// filter, with their tags, newest first.
+func (s *Saving) GetTransactions(filter TransactionFilter) (*[]Transaction, error) {
+	query := database.DB.Preload("Tags").Where("saving_id = ?", s.ID)
+	if filter.Type != "" {
+		query = query.Where("type = ?", strings.ToUpper(filter.Type))
+	}
+	if filter.Uncategorized {
+		query = query.Where("category_id IS NULL")
+	} else if filter.CategoryID != 0 {
+		query = query.Where("category_id = ?", filter.CategoryID)
+	}
+	if filter.Tag != "" {
+		tagged := database.DB.Model(&TransactionTag{}).
+			Select("transaction_id").
+			Where("tag = ?", strings.ToLower(strings.TrimSpace(filter.Tag)))
+		query = query.Where("id IN (?)", tagged)
+	}
+
+	var results []Transaction
+	if err := query.Order("created_at DESC, id DESC").Find(&results).Error; err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
@@ -0,0 +1,145 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCron is returned when a cron expression can not be parsed.
+var ErrInvalidCron = errors.New("invalid cron expression")
+
+// cronSpec is a parsed 5 field cron expression:
+// minute, hour, day of month, month and day of week.
+type cronSpec struct {
+	minute, hour, dom, month, dow map[int]bool
+	// domAny and dowAny are true when the field is "*". When both day fields
+	// are restricted, a day matches if either of them matches.
+	domAny, dowAny bool
+}
+
+// parseCron parses a standard 5 field cron expression. Every field supports
+// "*", numbers, ranges ("1-5"), lists ("1,15") and steps ("*/2", "1-10/3").
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, ErrInvalidCron
+	}
+
+	var spec cronSpec
+	var err error
+	if spec.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if spec.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if spec.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if spec.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if spec.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	// Both 0 and 7 are Sunday.
+	if spec.dow[7] {
+		spec.dow[0] = true
+	}
+	spec.domAny = fields[2] == "*"
+	spec.dowAny = fields[4] == "*"
+
+	return &spec, nil
+}
+
+// parseCronField parses one field of a cron expression into the set of values
+// it matches.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := map[int]bool{}
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return nil, ErrInvalidCron
+			}
+			step = s
+			part = part[:i]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			l, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, ErrInvalidCron
+			}
+			low, high = l, l
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, ErrInvalidCron
+				}
+			} else if step > 1 {
+				// "5/15" means from 5 to the end, every 15.
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, ErrInvalidCron
+		}
+
+		for v := low; v <= high; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// matchesDay reports whether the date of t matches the day fields.
+func (c *cronSpec) matchesDay(t time.Time) bool {
+	if !c.month[int(t.Month())] {
+		return false
+	}
+	dom := c.dom[t.Day()]
+	dow := c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first time matching the spec which is after t. Returns the
+// zero time if there is none within 5 years.
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for i := 0; i < 5*366; i++ {
+		d := day.AddDate(0, 0, i)
+		if !c.matchesDay(d) {
+			continue
+		}
+		for h := 0; h < 24; h++ {
+			if !c.hour[h] {
+				continue
+			}
+			for m := 0; m < 60; m++ {
+				if !c.minute[m] {
+					continue
+				}
+				candidate := time.Date(d.Year(), d.Month(), d.Day(), h, m, 0, 0, d.Location())
+				if candidate.After(t) {
+					return candidate
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,393 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// rateUnits is the scale of exchange rates. A Rate of 1575000000000 is
+// 15750 units of the quote currency for 1 unit of the base currency.
+const rateUnits = 100000000
+
+// Quote lock limits, in seconds.
+const (
+	DefaultQuoteLock = 30
+	MaxQuoteLock     = 300
+)
+
+var (
+	// ErrRateNotFound is returned when there is no effective rate for a
+	// currency pair.
+	ErrRateNotFound = errors.New("no exchange rate for this currency pair")
+	// ErrInvalidRate is returned when a rate is not a positive decimal.
+	ErrInvalidRate = errors.New("rate must be a positive decimal")
+	// ErrQuoteInvalid is returned when a quote is unknown, expired, already
+	// used or for another User, Saving or side.
+	ErrQuoteInvalid = errors.New("quote is invalid or expired")
+)
+
+// ExchangeRate is the rate of one Base currency unit in Quote currency units
+// from EffectiveAt until the next rate of the pair. The bank buys Base at the
+// bid, MidRate minus BidSpreadBps, and sells at the ask, MidRate plus
+// AskSpreadBps.
+type ExchangeRate struct {
+	gorm.Model
+	Base         string    `gorm:"size:3;not null;uniqueIndex:idx_rate_pair"`
+	Quote        string    `gorm:"size:3;not null;uniqueIndex:idx_rate_pair"`
+	MidRate      int64     `gorm:"not null"` // In rateUnits
+	BidSpreadBps int64     `gorm:"not null;default:0"`
+	AskSpreadBps int64     `gorm:"not null;default:0"`
+	EffectiveAt  time.Time `gorm:"not null;uniqueIndex:idx_rate_pair"`
+}
+
+// FxQuote is a conversion of ForeignAmount into the currency of a Saving,
+// locked until ExpiresAt. A DEPOSIT quote buys the foreign currency at the
+// bid, a WITHDRAWAL quote sells it at the ask. It can be executed once.
+type FxQuote struct {
+	gorm.Model
+	UserID          uint      `gorm:"not null"`
+	SavingID        uint      `gorm:"not null;index"`
+	Side            string    `gorm:"size:10;not null"` // DEPOSIT or WITHDRAWAL
+	ForeignCurrency string    `gorm:"size:3;not null"`
+	ForeignAmount   int64     `gorm:"not null"` // In minor units of ForeignCurrency
+	Currency        string    `gorm:"size:3;not null"`
+	Amount          int64     `gorm:"not null"` // In minor units of Currency
+	RateID          uint      `gorm:"not null"`
+	Rate            int64     `gorm:"not null"` // Applied rate, in rateUnits
+	SpreadBps       int64     `gorm:"not null"`
+	ExpiresAt       time.Time `gorm:"not null"`
+	TransactionID   *uint
+	// ctx is the context of the queries of the quote, see WithContext.
+	ctx context.Context
+}
+
+// WithContext sets the context of the queries of the FxQuote, with the
+// AuditActor of its execution.
+func (q *FxQuote) WithContext(ctx context.Context) *FxQuote {
+	q.ctx = ctx
+	return q
+}
+
+// ParseRate parses a decimal rate like "15750.25" into rateUnits.
+func ParseRate(value string) (int64, error) {
+	rate, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+	if !ok || rate.Sign() <= 0 {
+		return 0, ErrInvalidRate
+	}
+	rate.Mul(rate, new(big.Rat).SetInt64(rateUnits))
+	scaled := new(big.Int).Quo(rate.Num(), rate.Denom())
+	if !scaled.IsInt64() || scaled.Sign() <= 0 {
+		return 0, ErrInvalidRate
+	}
+	return scaled.Int64(), nil
+}
+
+// Validate checks the currencies, the rate and the spreads of the
+// ExchangeRate.
+func (r *ExchangeRate) Validate() error {
+	if !ValidCurrency(r.Base) || !ValidCurrency(r.Quote) {
+		return ErrUnknownCurrency
+	}
+	if r.Base == r.Quote {
+		return errors.New("base and quote currencies must be different")
+	}
+	if r.MidRate <= 0 {
+		return ErrInvalidRate
+	}
+	if r.BidSpreadBps < 0 || r.BidSpreadBps >= bpsUnits || r.AskSpreadBps < 0 {
+		return errors.New("spreads must be between 0 and 10000 basis points")
+	}
+	return nil
+}
+
+// Store stores the ExchangeRate. Storing the same pair and EffectiveAt again
+// replaces the rate and the spreads.
+func (r *ExchangeRate) Store() error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	return database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "base"}, {Name: "quote"}, {Name: "effective_at"}},
+		DoUpdates: clause.AssignmentColumns([]string{"mid_rate", "bid_spread_bps", "ask_spread_bps", "updated_at"}),
+	}).Create(&r).Error
+}
+
+// LoadExchangeRates stores every rate of a CSV with the columns base, quote,
+// mid, bid spread bps, ask spread bps and effective at (RFC 3339). A first
+// row starting with "base" is a header. Loading the same file again changes
+// nothing.
+func LoadExchangeRates(r io.Reader) (int, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 6
+	reader.TrimLeadingSpace = true
+
+	count := 0
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if line == 1 && strings.EqualFold(record[0], "base") {
+			continue
+		}
+
+		rate, err := parseRateRecord(record)
+		if err != nil {
+			return count, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		if err := rate.Store(); err != nil {
+			return count, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		count++
+	}
+}
+
+// LoadExchangeRatesFile loads the rates of the CSV file at path, see
+// LoadExchangeRates.
+func LoadExchangeRatesFile(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return LoadExchangeRates(file)
+}
+
+// parseRateRecord parses one CSV record of LoadExchangeRates.
+func parseRateRecord(record []string) (*ExchangeRate, error) {
+	mid, err := ParseRate(record[2])
+	if err != nil {
+		return nil, err
+	}
+	bid, err := strconv.ParseInt(record[3], 10, 64)
+	if err != nil {
+		return nil, errors.New("bid spread must be a number of basis points")
+	}
+	ask, err := strconv.ParseInt(record[4], 10, 64)
+	if err != nil {
+		return nil, errors.New("ask spread must be a number of basis points")
+	}
+	effectiveAt, err := time.Parse(time.RFC3339, record[5])
+	if err != nil {
+		return nil, errors.New("effective at must be in RFC 3339 format")
+	}
+
+	return &ExchangeRate{
+		Base:         strings.ToUpper(record[0]),
+		Quote:        strings.ToUpper(record[1]),
+		MidRate:      mid,
+		BidSpreadBps: bid,
+		AskSpreadBps: ask,
+		EffectiveAt:  effectiveAt,
+	}, nil
+}
+
+// GetEffectiveRate gets/fetches the rate of a pair which is effective at now.
+func GetEffectiveRate(base, quote string, now time.Time) (*ExchangeRate, error) {
+	var result ExchangeRate
+	err := database.DB.
+		Where("base = ? AND quote = ? AND effective_at <= ?", base, quote, now).
+		Order("effective_at DESC").
+		First(&result).
+		Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetEffectiveRates gets/fetches the effective rate of every pair at now.
+func GetEffectiveRates(now time.Time) (*[]ExchangeRate, error) {
+	latest := database.DB.Model(&ExchangeRate{}).
+		Select("base, quote, MAX(effective_at)").
+		Where("effective_at <= ?", now).
+		Group("base, quote")
+
+	var results []ExchangeRate
+	err := database.DB.
+		Where("(base, quote, effective_at) IN (?)", latest).
+		Order("base, quote").
+		Find(&results).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// applySpread returns the rate after moving it by spreadBps, down for the bid
+// and up for the ask.
+func applySpread(mid, spreadBps int64, up bool) int64 {
+	if up {
+		spreadBps = -spreadBps
+	}
+	rate := new(big.Int).Mul(big.NewInt(mid), big.NewInt(bpsUnits-spreadBps))
+	return rate.Quo(rate, big.NewInt(bpsUnits)).Int64()
+}
+
+// convert converts amount minor units of from at rate into minor units of to.
+// Rounds down, or up when roundUp is set.
+func convert(amount int64, from, to string, rate int64, roundUp bool) (int64, error) {
+	num := new(big.Int).Mul(big.NewInt(amount), big.NewInt(rate))
+	den := big.NewInt(rateUnits)
+
+	shift := currencyExponents[to] - currencyExponents[from]
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(int64(shift)))), nil)
+	if shift > 0 {
+		num.Mul(num, scale)
+	} else {
+		den.Mul(den, scale)
+	}
+
+	result, remainder := new(big.Int).QuoRem(num, den, new(big.Int))
+	if roundUp && remainder.Sign() > 0 {
+		result.Add(result, big.NewInt(1))
+	}
+	if !result.IsInt64() {
+		return 0, ErrMoneyOverflow
+	}
+	return result.Int64(), nil
+}
+
+// NewFxQuote quotes the conversion of foreignAmount for a DEPOSIT to or a
+// WITHDRAWAL from the Saving, and locks it for lock seconds. Amounts always
+// round in favour of the bank.
+func NewFxQuote(userID uint, saving *Saving, side, foreignCurrency string, foreignAmount int64, lock int) (*FxQuote, error) {
+	if side != TypeDeposit && side != TypeWithdrawal {
+		return nil, errors.New("side must be DEPOSIT or WITHDRAWAL")
+	}
+	if !ValidCurrency(foreignCurrency) {
+		return nil, ErrUnknownCurrency
+	}
+	if foreignCurrency == saving.Currency {
+		return nil, errors.New("foreign currency must differ from the Saving currency")
+	}
+	if foreignAmount <= 0 {
+		return nil, errors.New("amount must be more than 0")
+	}
+	if lock <= 0 || lock > MaxQuoteLock {
+		return nil, fmt.Errorf("lock must be between 1 and %d seconds", MaxQuoteLock)
+	}
+
+	now := time.Now()
+	rate, err := GetEffectiveRate(foreignCurrency, saving.Currency, now)
+	if err != nil {
+		return nil, err
+	}
+
+	quote := FxQuote{
+		UserID:          userID,
+		SavingID:        saving.ID,
+		Side:            side,
+		ForeignCurrency: foreignCurrency,
+		ForeignAmount:   foreignAmount,
+		Currency:        saving.Currency,
+		RateID:          rate.ID,
+		ExpiresAt:       now.Add(time.Duration(lock) * time.Second),
+	}
+	if side == TypeDeposit {
+		quote.SpreadBps = rate.BidSpreadBps
+		quote.Rate = applySpread(rate.MidRate, rate.BidSpreadBps, false)
+	} else {
+		quote.SpreadBps = rate.AskSpreadBps
+		quote.Rate = applySpread(rate.MidRate, rate.AskSpreadBps, true)
+	}
+
+	quote.Amount, err = convert(foreignAmount, foreignCurrency, saving.Currency, quote.Rate, side == TypeWithdrawal)
+	if err != nil {
+		return nil, err
+	}
+	if quote.Amount <= 0 {
+		return nil, errors.New("amount is too small to convert")
+	}
+
+	if err := database.DB.Create(&quote).Error; err != nil {
+		return nil, err
+	}
+	return &quote, nil
+}
+
+// GetFxQuoteByID gets/fetches an FxQuote by searching the ID.
+func (q *FxQuote) GetFxQuoteByID(id string) *FxQuote {
+	var result FxQuote
+	err := database.DB.Where("id = ?", id).First(&result).Error
+	if err != nil {
+		return nil
+	}
+	return &result
+}
+
+// Execute posts the Transaction of the quote for the User, recording the
+// foreign amount, the rate and the spread on it. The quote must be of side,
+// unused and not expired.
+func (q *FxQuote) Execute(userID uint, side, description string) (*Transaction, error) {
+	var transaction Transaction
+	err := withContext(q.ctx).Transaction(func(tx *gorm.DB) error {
+		// Lock the Saving first, like every other balance change.
+		if _, err := lockSaving(tx, q.SavingID); err != nil {
+			return err
+		}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&q, q.ID).Error
+		if err != nil {
+			return err
+		}
+		if q.UserID != userID || q.Side != side || q.TransactionID != nil || !q.ExpiresAt.After(time.Now()) {
+			return ErrQuoteInvalid
+		}
+
+		quoteID := q.ID
+		transaction = Transaction{
+			SavingID:        q.SavingID,
+			Type:            q.Side,
+			Value:           q.Amount,
+			Currency:        q.Currency,
+			Description:     description,
+			ForeignCurrency: q.ForeignCurrency,
+			ForeignValue:    q.ForeignAmount,
+			FxRate:          q.Rate,
+			FxSpreadBps:     q.SpreadBps,
+			FxQuoteID:       &quoteID,
+		}
+		if q.Side == TypeWithdrawal {
+			transaction.Value = -q.Amount
+			transaction.ForeignValue = -q.ForeignAmount
+		}
+		if err := post(tx, &transaction); err != nil {
+			return err
+		}
+
+		if err := tx.Model(&q).Update("transaction_id", transaction.ID).Error; err != nil {
+			return err
+		}
+		return auditTx(tx, AuditFxExecuted, "fx_quote", q.ID, nil, transaction)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &transaction, nil
+}
+
+// FormatRate formats a rate in rateUnits as a decimal, like "15750.25".
+func FormatRate(rate int64) string {
+	formatted := big.NewRat(rate, rateUnits).FloatString(8)
+	formatted = strings.TrimRight(formatted, "0")
+	return strings.TrimSuffix(formatted, ".")
+}
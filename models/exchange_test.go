@@ -0,0 +1,88 @@
+package models
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		err   bool
+	}{
+		{"15750.25", 1575025000000, false},
+		{" 1 ", 100000000, false},
+		{"0.00000001", 1, false},
+		{"0.123456789", 12345678, false},
+		{"0.000000001", 0, true},
+		{"0", 0, true},
+		{"-1.5", 0, true},
+		{"abc", 0, true},
+		{"100000000000000", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := ParseRate(tt.value)
+			if (err != nil) != tt.err {
+				t.Fatalf("ParseRate() err = %v, want error %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseRate() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplySpread(t *testing.T) {
+	tests := []struct {
+		name   string
+		mid    int64
+		spread int64
+		up     bool
+		want   int64
+	}{
+		{"bid", 1000000000, 50, false, 995000000},
+		{"ask", 1000000000, 50, true, 1005000000},
+		{"no spread", 1000000000, 0, true, 1000000000},
+		{"bid rounds down", 3, 1, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applySpread(tt.mid, tt.spread, tt.up); got != tt.want {
+				t.Errorf("applySpread() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   int64
+		from, to string
+		rate     int64
+		roundUp  bool
+		want     int64
+		err      error
+	}{
+		// 10.00 USD at 15750.25 IDR.
+		{"to fewer decimals", 1000, "USD", "IDR", 1575025000000, false, 157502, nil},
+		{"to fewer decimals rounds up", 1000, "USD", "IDR", 1575025000000, true, 157503, nil},
+		// 15750 IDR at 0.0000635 USD.
+		{"to more decimals", 15750, "IDR", "USD", 6350, false, 100, nil},
+		{"to more decimals rounds up", 15751, "IDR", "USD", 6350, true, 101, nil},
+		{"exact does not round up", 15625, "IDR", "USD", 6400, true, 100, nil},
+		// 1.000 KWD at 3.25 USD.
+		{"three decimals", 1000, "KWD", "USD", 325000000, false, 325, nil},
+		{"overflow", 1 << 62, "USD", "IDR", 1575025000000, false, 0, ErrMoneyOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := convert(tt.amount, tt.from, tt.to, tt.rate, tt.roundUp)
+			if err != tt.err {
+				t.Fatalf("convert() err = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("convert() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
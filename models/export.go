@@ -0,0 +1,284 @@
+package models
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportBankID identifies this bank in the exported files.
+const exportBankID = "BPAY"
+
+// fitID returns the stable ID of a Transaction in every export format.
+func fitID(transactionID uint) string {
+	return strconv.FormatUint(uint64(transactionID), 10)
+}
+
+// truncate cuts text to at most max runes, as the export formats limit their
+// text fields.
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) > max {
+		return string(runes[:max])
+	}
+	return text
+}
+
+// ofxTime formats t as an OFX date time in UTC.
+func ofxTime(t time.Time) string {
+	return t.UTC().Format("20060102150405.000") + "[0:GMT]"
+}
+
+// ofxTransactionTypes maps the Transaction types to OFX TRNTYPEs. Missing
+// types are CREDIT or DEBIT by their sign.
+var ofxTransactionTypes = map[string]string{
+	TypeDeposit:  "DEP",
+	TypeInterest: "INT",
+	TypeFee:      "FEE",
+	TypePenalty:  "FEE",
+	TypeFunding:  "XFER",
+	TypeMaturity: "XFER",
+	TypeBreak:    "XFER",
+}
+
+type ofxStatus struct {
+	Code     int    `xml:"CODE"`
+	Severity string `xml:"SEVERITY"`
+}
+
+type ofxBalance struct {
+	Amount string `xml:"BALAMT"`
+	AsOf   string `xml:"DTASOF"`
+}
+
+type ofxTransaction struct {
+	Type   string `xml:"TRNTYPE"`
+	Posted string `xml:"DTPOSTED"`
+	Amount string `xml:"TRNAMT"`
+	FITID  string `xml:"FITID"`
+	Name   string `xml:"NAME"`
+	Memo   string `xml:"MEMO,omitempty"`
+}
+
+type ofxDocument struct {
+	XMLName xml.Name `xml:"OFX"`
+	Signon  struct {
+		Status   ofxStatus `xml:"STATUS"`
+		Server   string    `xml:"DTSERVER"`
+		Language string    `xml:"LANGUAGE"`
+	} `xml:"SIGNONMSGSRSV1>SONRS"`
+	Response struct {
+		UID       string    `xml:"TRNUID"`
+		Status    ofxStatus `xml:"STATUS"`
+		Statement struct {
+			Currency string `xml:"CURDEF"`
+			Account  struct {
+				BankID string `xml:"BANKID"`
+				ID     string `xml:"ACCTID"`
+				Type   string `xml:"ACCTTYPE"`
+			} `xml:"BANKACCTFROM"`
+			List struct {
+				Start        string           `xml:"DTSTART"`
+				End          string           `xml:"DTEND"`
+				Transactions []ofxTransaction `xml:"STMTTRN"`
+			} `xml:"BANKTRANLIST"`
+			Ledger ofxBalance `xml:"LEDGERBAL"`
+		} `xml:"STMTRS"`
+	} `xml:"BANKMSGSRSV1>STMTTRNRS"`
+}
+
+// OFX renders the Statement as an OFX 2.2 bank statement. FITIDs are the
+// Transaction IDs and the ledger balance is the closing balance.
+func (s *Statement) OFX(now time.Time) ([]byte, error) {
+	var doc ofxDocument
+	doc.Signon.Status = ofxStatus{0, "INFO"}
+	doc.Signon.Server = ofxTime(now)
+	doc.Signon.Language = "ENG"
+
+	doc.Response.UID = fmt.Sprintf("%d-%s", s.SavingID, s.From.Format("20060102"))
+	doc.Response.Status = ofxStatus{0, "INFO"}
+
+	statement := &doc.Response.Statement
+	statement.Currency = s.Currency
+	statement.Account.BankID = exportBankID
+	statement.Account.ID = strconv.FormatUint(uint64(s.SavingID), 10)
+	statement.Account.Type = "SAVINGS"
+	statement.List.Start = ofxTime(s.From)
+	statement.List.End = ofxTime(s.To)
+	for _, line := range s.Lines {
+		kind, ok := ofxTransactionTypes[line.Type]
+		if !ok {
+			kind = "CREDIT"
+			if line.Value.Amount < 0 {
+				kind = "DEBIT"
+			}
+		}
+		name := line.Description
+		if name == "" {
+			name = line.Type
+		}
+		statement.List.Transactions = append(statement.List.Transactions, ofxTransaction{
+			Type:   kind,
+			Posted: ofxTime(line.Date),
+			Amount: line.Value.Decimal(),
+			FITID:  fitID(line.TransactionID),
+			Name:   truncate(name, 32),
+			Memo:   truncate(line.Description, 255),
+		})
+	}
+	statement.Ledger = ofxBalance{s.ClosingBalance.Decimal(), ofxTime(s.To)}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="no"?>` + "\n")
+	buffer.WriteString(`<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n")
+	encoder := xml.NewEncoder(&buffer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// QIF renders the Statement as a QIF bank account. The opening balance is the
+// first entry, as QIF has no balance block. The Transaction ID is the number
+// of every other entry.
+func (s *Statement) QIF() []byte {
+	var buffer bytes.Buffer
+	clean := strings.NewReplacer("\r", " ", "\n", " ")
+
+	buffer.WriteString("!Type:Bank\n")
+	fmt.Fprintf(&buffer, "D%s\nT%s\nPOpening Balance\nL[Saving %d]\n^\n",
+		s.From.Format("01/02/2006"), s.OpeningBalance.Decimal(), s.SavingID)
+	for _, line := range s.Lines {
+		fmt.Fprintf(&buffer, "D%s\nT%s\nN%s\nP%s\nM%s\n^\n",
+			line.Date.Format("01/02/2006"),
+			line.Value.Decimal(),
+			fitID(line.TransactionID),
+			clean.Replace(line.Description),
+			line.Type,
+		)
+	}
+	return buffer.Bytes()
+}
+
+// camtNamespace is the ISO 20022 namespace of CAMT.053 version 2.
+const camtNamespace = "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02"
+
+type camtAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type camtDate struct {
+	Date string `xml:"Dt"`
+}
+
+type camtBalance struct {
+	Code   string     `xml:"Tp>CdOrPrtry>Cd"`
+	Amount camtAmount `xml:"Amt"`
+	Sign   string     `xml:"CdtDbtInd"`
+	Date   camtDate   `xml:"Dt"`
+}
+
+type camtEntry struct {
+	Reference   string     `xml:"NtryRef"`
+	Amount      camtAmount `xml:"Amt"`
+	Sign        string     `xml:"CdtDbtInd"`
+	Reversal    bool       `xml:"RvslInd,omitempty"`
+	Status      string     `xml:"Sts"`
+	BookingDate camtDate   `xml:"BookgDt"`
+	ValueDate   camtDate   `xml:"ValDt"`
+	ServicerRef string     `xml:"AcctSvcrRef"`
+	Code        string     `xml:"BkTxCd>Prtry>Cd"`
+	Details     struct {
+		ServicerRef string `xml:"Refs>AcctSvcrRef"`
+		Info        string `xml:"AddtlTxInf,omitempty"`
+	} `xml:"NtryDtls>TxDtls"`
+}
+
+type camtDocument struct {
+	XMLName   xml.Name `xml:"Document"`
+	Namespace string   `xml:"xmlns,attr"`
+	Header    struct {
+		MessageID string `xml:"MsgId"`
+		CreatedAt string `xml:"CreDtTm"`
+	} `xml:"BkToCstmrStmt>GrpHdr"`
+	Statement struct {
+		ID        string `xml:"Id"`
+		CreatedAt string `xml:"CreDtTm"`
+		From      string `xml:"FrToDt>FrDtTm"`
+		To        string `xml:"FrToDt>ToDtTm"`
+		Account   struct {
+			ID       string `xml:"Id>Othr>Id"`
+			Currency string `xml:"Ccy"`
+		} `xml:"Acct"`
+		Balances []camtBalance `xml:"Bal"`
+		Entries  []camtEntry   `xml:"Ntry"`
+	} `xml:"BkToCstmrStmt>Stmt"`
+}
+
+// camtSigned splits m into its absolute amount and CRDT or DBIT.
+func camtSigned(m Money) (camtAmount, string) {
+	if m.Amount < 0 {
+		return camtAmount{m.Currency, m.Neg().Decimal()}, "DBIT"
+	}
+	return camtAmount{m.Currency, m.Decimal()}, "CRDT"
+}
+
+// CAMT053 renders the Statement as an ISO 20022 CAMT.053.001.02 bank to
+// customer statement, with the opening (OPBD) and closing (CLBD) booked
+// balances. Entry references are the Transaction IDs.
+func (s *Statement) CAMT053(now time.Time) ([]byte, error) {
+	var doc camtDocument
+	doc.Namespace = camtNamespace
+
+	id := fmt.Sprintf("%d-%s-%s", s.SavingID, s.From.Format("20060102"), s.lastDay().Format("20060102"))
+	doc.Header.MessageID = truncate(id+"-"+now.Format("150405"), 35)
+	doc.Header.CreatedAt = now.Format("2006-01-02T15:04:05")
+
+	statement := &doc.Statement
+	statement.ID = truncate(id, 35)
+	statement.CreatedAt = doc.Header.CreatedAt
+	statement.From = s.From.Format("2006-01-02T15:04:05")
+	statement.To = s.lastDay().Format("2006-01-02T15:04:05")
+	statement.Account.ID = strconv.FormatUint(uint64(s.SavingID), 10)
+	statement.Account.Currency = s.Currency
+
+	opening, openingSign := camtSigned(s.OpeningBalance)
+	closing, closingSign := camtSigned(s.ClosingBalance)
+	statement.Balances = []camtBalance{
+		{"OPBD", opening, openingSign, camtDate{s.From.Format("2006-01-02")}},
+		{"CLBD", closing, closingSign, camtDate{s.lastDay().Format("2006-01-02")}},
+	}
+
+	for _, line := range s.Lines {
+		amount, sign := camtSigned(line.Value)
+		date := camtDate{line.Date.Format("2006-01-02")}
+		entry := camtEntry{
+			Reference:   fitID(line.TransactionID),
+			Amount:      amount,
+			Sign:        sign,
+			Reversal:    line.Type == TypeReversal,
+			Status:      "BOOK",
+			BookingDate: date,
+			ValueDate:   date,
+			ServicerRef: fitID(line.TransactionID),
+			Code:        line.Type,
+		}
+		entry.Details.ServicerRef = entry.ServicerRef
+		entry.Details.Info = truncate(line.Description, 500)
+		statement.Entries = append(statement.Entries, entry)
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buffer)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
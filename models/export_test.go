@@ -0,0 +1,335 @@
+package models
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The exports are validated with xmllint against the official schemas in
+// testdata/xsd: camt.053.001.02.xsd of ISO 20022, and the OFX 2.2 schemas in
+// testdata/xsd/ofx. The tests fail while they or xmllint are missing. The
+// element order, cardinality and facets below are taken from the same
+// schemas, and give a clearer error.
+const (
+	camtSchema = "testdata/xsd/camt.053.001.02.xsd"
+	ofxSchema  = "testdata/xsd/ofx/OFX2_Protocol.xsd"
+)
+
+// ofxNamespace is the target namespace of the OFX 2.2 schemas. OFX files
+// leave it out, it is added to validate them.
+const ofxNamespace = "http://ofx.net/types/2003/04"
+
+// xmlNode is an element of a parsed export.
+type xmlNode struct {
+	name     string
+	attrs    map[string]string
+	text     string
+	children []*xmlNode
+}
+
+// parseXML parses doc into a tree of xmlNodes.
+func parseXML(t *testing.T, doc []byte) *xmlNode {
+	t.Helper()
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	var stack []*xmlNode
+	var root *xmlNode
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("export is not well-formed: %v", err)
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: token.Name.Local, attrs: map[string]string{}}
+			for _, attr := range token.Attr {
+				node.attrs[attr.Name.Local] = attr.Value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+			} else {
+				root = node
+			}
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += strings.TrimSpace(string(token))
+			}
+		}
+	}
+	return root
+}
+
+// xmlRule is the sequence of an element of a schema: its children in order,
+// and the ones which must be there.
+type xmlRule struct {
+	sequence []string
+	required []string
+}
+
+// xmlFacet restricts the text of an element.
+type xmlFacet struct {
+	maxLength int
+	pattern   *regexp.Regexp
+}
+
+// checkXML checks every element under node, at path, against the rules and
+// the facets.
+func checkXML(t *testing.T, node *xmlNode, path string, rules map[string]xmlRule, facets map[string]xmlFacet) {
+	t.Helper()
+	path += "/" + node.name
+
+	if facet, ok := facets[path]; ok {
+		if facet.maxLength > 0 && len([]rune(node.text)) > facet.maxLength {
+			t.Errorf("%s is longer than %d: %q", path, facet.maxLength, node.text)
+		}
+		if facet.pattern != nil && !facet.pattern.MatchString(node.text) {
+			t.Errorf("%s does not match %s: %q", path, facet.pattern, node.text)
+		}
+	}
+
+	rule, ok := rules[path]
+	if !ok {
+		if len(node.children) > 0 {
+			t.Errorf("%s has no rule", path)
+		}
+		return
+	}
+
+	last := -1
+	seen := map[string]bool{}
+	for _, child := range node.children {
+		index := -1
+		for i, name := range rule.sequence {
+			if name == child.name {
+				index = i
+			}
+		}
+		switch {
+		case index < 0:
+			t.Errorf("%s can not contain %s", path, child.name)
+		case index < last:
+			t.Errorf("%s has %s out of order", path, child.name)
+		default:
+			last = index
+		}
+		seen[child.name] = true
+		checkXML(t, child, path, rules, facets)
+	}
+	for _, name := range rule.required {
+		if !seen[name] {
+			t.Errorf("%s is missing %s", path, name)
+		}
+	}
+}
+
+// validateSchema validates doc against the XSD at schema with xmllint. Fails
+// when either is missing.
+func validateSchema(t *testing.T, doc []byte, schema string) {
+	t.Helper()
+	if _, err := os.Stat(schema); err != nil {
+		t.Fatalf("%s is missing: %v", schema, err)
+	}
+	xmllint, err := exec.LookPath("xmllint")
+	if err != nil {
+		t.Fatalf("xmllint is missing: %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "export.xml")
+	if err := ioutil.WriteFile(file, doc, 0600); err != nil {
+		t.Fatal(err)
+	}
+	output, err := exec.Command(xmllint, "--noout", "--schema", schema, file).CombinedOutput()
+	if err != nil {
+		t.Errorf("export does not validate against %s: %v\n%s", schema, err, output)
+	}
+}
+
+// exportStatement is a Statement with every kind of line the exports treat
+// differently.
+func exportStatement() *Statement {
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	return &Statement{
+		SavingID:       42,
+		SavingName:     "Holiday",
+		Currency:       "USD",
+		From:           from,
+		To:             from.AddDate(0, 1, 0),
+		OpeningBalance: NewMoney(100000, "USD"),
+		ClosingBalance: NewMoney(-2550, "USD"),
+		Lines: []StatementLine{
+			{1, from.Add(time.Hour), TypeDeposit, "Salary & bonus <March>", NewMoney(50000, "USD"), NewMoney(150000, "USD")},
+			{2, from.AddDate(0, 0, 2), TypeWithdrawal, strings.Repeat("Very long description ", 30), NewMoney(-152550, "USD"), NewMoney(-2550, "USD")},
+			{3, from.AddDate(0, 0, 3), TypeReversal, "", NewMoney(1, "USD"), NewMoney(-2549, "USD")},
+			{4, from.AddDate(0, 0, 4), TypeFee, "Fee", NewMoney(-1, "USD"), NewMoney(-2550, "USD")},
+		},
+	}
+}
+
+var (
+	ofxDateTime   = regexp.MustCompile(`^\d{8}(\d{6}(\.\d{3})?)?(\[[+-]?\d{1,2}(\.\d{2})?(:[A-Za-z]{1,6})?\])?$`)
+	ofxAmount     = regexp.MustCompile(`^-?\d{1,32}(\.\d{1,3})?$`)
+	currencyCode  = regexp.MustCompile(`^[A-Z]{3}$`)
+	isoDateTime   = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})?$`)
+	isoDate       = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+	camtDecimal   = regexp.MustCompile(`^\d{1,13}(\.\d{1,5})?$`)
+	camtIndicator = regexp.MustCompile(`^(CRDT|DBIT)$`)
+)
+
+func TestOFXSchema(t *testing.T) {
+	doc, err := exportStatement().OFX(time.Date(2026, 4, 1, 8, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// From OFX2_Protocol.xsd, OFX2_Common.xsd and OFX2_Bank.xsd of OFX 2.2.
+	rules := map[string]xmlRule{
+		"/OFX":                                            {[]string{"SIGNONMSGSRSV1", "BANKMSGSRSV1"}, []string{"SIGNONMSGSRSV1"}},
+		"/OFX/SIGNONMSGSRSV1":                             {[]string{"SONRS"}, []string{"SONRS"}},
+		"/OFX/SIGNONMSGSRSV1/SONRS":                       {[]string{"STATUS", "DTSERVER", "USERKEY", "TSKEYEXPIRE", "LANGUAGE"}, []string{"STATUS", "DTSERVER", "LANGUAGE"}},
+		"/OFX/SIGNONMSGSRSV1/SONRS/STATUS":                {[]string{"CODE", "SEVERITY", "MESSAGE"}, []string{"CODE", "SEVERITY"}},
+		"/OFX/BANKMSGSRSV1":                               {[]string{"STMTTRNRS"}, nil},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS":                     {[]string{"TRNUID", "STATUS", "CLTCOOKIE", "STMTRS"}, []string{"TRNUID", "STATUS"}},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STATUS":              {[]string{"CODE", "SEVERITY", "MESSAGE"}, []string{"CODE", "SEVERITY"}},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS":              {[]string{"CURDEF", "BANKACCTFROM", "BANKTRANLIST", "LEDGERBAL", "AVAILBAL"}, []string{"CURDEF", "BANKACCTFROM", "LEDGERBAL"}},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/BANKACCTFROM": {[]string{"BANKID", "BRANCHID", "ACCTID", "ACCTTYPE", "ACCTKEY"}, []string{"BANKID", "ACCTID", "ACCTTYPE"}},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/BANKTRANLIST": {[]string{"DTSTART", "DTEND", "STMTTRN"}, []string{"DTSTART", "DTEND"}},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/BANKTRANLIST/STMTTRN": {
+			[]string{"TRNTYPE", "DTPOSTED", "DTUSER", "DTAVAIL", "TRNAMT", "FITID", "CORRECTFITID", "CORRECTACTION", "SRVRTID", "CHECKNUM", "REFNUM", "SIC", "PAYEEID", "NAME", "MEMO"},
+			[]string{"TRNTYPE", "DTPOSTED", "TRNAMT", "FITID"},
+		},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/LEDGERBAL": {[]string{"BALAMT", "DTASOF"}, []string{"BALAMT", "DTASOF"}},
+	}
+	list := "/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/BANKTRANLIST"
+	facets := map[string]xmlFacet{
+		"/OFX/SIGNONMSGSRSV1/SONRS/DTSERVER":                       {pattern: ofxDateTime},
+		"/OFX/SIGNONMSGSRSV1/SONRS/LANGUAGE":                       {pattern: regexp.MustCompile(`^[A-Z]{3}$`)},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/TRNUID":                       {maxLength: 36},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/CURDEF":                {pattern: currencyCode},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/BANKACCTFROM/BANKID":   {maxLength: 9},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/BANKACCTFROM/ACCTID":   {maxLength: 22},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/BANKACCTFROM/ACCTTYPE": {pattern: regexp.MustCompile(`^(CHECKING|SAVINGS|MONEYMRKT|CREDITLINE|CD)$`)},
+		list + "/DTSTART":                                     {pattern: ofxDateTime},
+		list + "/DTEND":                                       {pattern: ofxDateTime},
+		list + "/STMTTRN/TRNTYPE":                             {pattern: regexp.MustCompile(`^(CREDIT|DEBIT|INT|DIV|FEE|SRVCHG|DEP|ATM|POS|XFER|CHECK|PAYMENT|CASH|DIRECTDEP|DIRECTDEBIT|REPEATPMT|HOLD|OTHER)$`)},
+		list + "/STMTTRN/DTPOSTED":                            {pattern: ofxDateTime},
+		list + "/STMTTRN/TRNAMT":                              {pattern: ofxAmount},
+		list + "/STMTTRN/FITID":                               {maxLength: 255},
+		list + "/STMTTRN/NAME":                                {maxLength: 32},
+		list + "/STMTTRN/MEMO":                                {maxLength: 255},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/LEDGERBAL/BALAMT": {pattern: ofxAmount},
+		"/OFX/BANKMSGSRSV1/STMTTRNRS/STMTRS/LEDGERBAL/DTASOF": {pattern: ofxDateTime},
+	}
+	checkXML(t, parseXML(t, doc), "", rules, facets)
+
+	t.Run("xsd", func(t *testing.T) {
+		namespaced := bytes.Replace(doc, []byte("<OFX>"), []byte(`<ofx:OFX xmlns:ofx="`+ofxNamespace+`">`), 1)
+		namespaced = bytes.Replace(namespaced, []byte("</OFX>"), []byte("</ofx:OFX>"), 1)
+		validateSchema(t, namespaced, ofxSchema)
+	})
+}
+
+func TestCAMT053Schema(t *testing.T) {
+	doc, err := exportStatement().CAMT053(time.Date(2026, 4, 1, 8, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := parseXML(t, doc)
+	if root.attrs["xmlns"] != camtNamespace {
+		t.Errorf("namespace = %q, want %q", root.attrs["xmlns"], camtNamespace)
+	}
+
+	// From camt.053.001.02.xsd.
+	stmt := "/Document/BkToCstmrStmt/Stmt"
+	rules := map[string]xmlRule{
+		"/Document":                         {[]string{"BkToCstmrStmt"}, []string{"BkToCstmrStmt"}},
+		"/Document/BkToCstmrStmt":           {[]string{"GrpHdr", "Stmt", "SplmtryData"}, []string{"GrpHdr", "Stmt"}},
+		"/Document/BkToCstmrStmt/GrpHdr":    {[]string{"MsgId", "CreDtTm", "MsgRcpt", "MsgPgntn", "AddtlInf"}, []string{"MsgId", "CreDtTm"}},
+		stmt:                                {[]string{"Id", "ElctrncSeqNb", "LglSeqNb", "CreDtTm", "FrToDt", "CpyDplctInd", "RptgSrc", "Acct", "RltdAcct", "Intrst", "Bal", "TxsSummry", "Ntry", "AddtlStmtInf"}, []string{"Id", "CreDtTm", "Acct", "Bal"}},
+		stmt + "/FrToDt":                    {[]string{"FrDtTm", "ToDtTm"}, []string{"FrDtTm", "ToDtTm"}},
+		stmt + "/Acct":                      {[]string{"Id", "Tp", "Ccy", "Nm", "Ownr", "Svcr"}, []string{"Id"}},
+		stmt + "/Acct/Id":                   {[]string{"IBAN", "Othr"}, nil},
+		stmt + "/Acct/Id/Othr":              {[]string{"Id", "SchmeNm", "Issr"}, []string{"Id"}},
+		stmt + "/Bal":                       {[]string{"Tp", "CdtLine", "Amt", "CdtDbtInd", "Dt", "Avlbty"}, []string{"Tp", "Amt", "CdtDbtInd", "Dt"}},
+		stmt + "/Bal/Tp":                    {[]string{"CdOrPrtry", "SubTp"}, []string{"CdOrPrtry"}},
+		stmt + "/Bal/Tp/CdOrPrtry":          {[]string{"Cd", "Prtry"}, nil},
+		stmt + "/Bal/Dt":                    {[]string{"Dt", "DtTm"}, nil},
+		stmt + "/Ntry":                      {[]string{"NtryRef", "Amt", "CdtDbtInd", "RvslInd", "Sts", "BookgDt", "ValDt", "AcctSvcrRef", "Avlbty", "BkTxCd", "ComssnWvrInd", "AddtlInfInd", "AmtDtls", "Chrgs", "TechInptChanl", "Intrst", "NtryDtls", "AddtlNtryInf"}, []string{"Amt", "CdtDbtInd", "Sts", "BkTxCd"}},
+		stmt + "/Ntry/BookgDt":              {[]string{"Dt", "DtTm"}, nil},
+		stmt + "/Ntry/ValDt":                {[]string{"Dt", "DtTm"}, nil},
+		stmt + "/Ntry/BkTxCd":               {[]string{"Domn", "Prtry"}, nil},
+		stmt + "/Ntry/BkTxCd/Prtry":         {[]string{"Cd", "Issr"}, []string{"Cd"}},
+		stmt + "/Ntry/NtryDtls":             {[]string{"Btch", "TxDtls"}, nil},
+		stmt + "/Ntry/NtryDtls/TxDtls":      {[]string{"Refs", "AmtDtls", "Avlbty", "BkTxCd", "Chrgs", "Intrst", "RltdPties", "RltdAgts", "Purp", "RltdRmtInf", "RmtInf", "RltdDts", "RltdPric", "RltdQties", "FinInstrmId", "Tax", "RtrInf", "CorpActn", "SfkpgAcct", "AddtlTxInf"}, nil},
+		stmt + "/Ntry/NtryDtls/TxDtls/Refs": {[]string{"MsgId", "AcctSvcrRef", "PmtInfId", "InstrId", "EndToEndId", "TxId", "MndtId", "ChqNb", "ClrSysRef", "Prtry"}, nil},
+	}
+	amount := xmlFacet{pattern: camtDecimal}
+	facets := map[string]xmlFacet{
+		"/Document/BkToCstmrStmt/GrpHdr/MsgId":          {maxLength: 35},
+		"/Document/BkToCstmrStmt/GrpHdr/CreDtTm":        {pattern: isoDateTime},
+		stmt + "/Id":                                    {maxLength: 35},
+		stmt + "/CreDtTm":                               {pattern: isoDateTime},
+		stmt + "/FrToDt/FrDtTm":                         {pattern: isoDateTime},
+		stmt + "/FrToDt/ToDtTm":                         {pattern: isoDateTime},
+		stmt + "/Acct/Id/Othr/Id":                       {maxLength: 34},
+		stmt + "/Acct/Ccy":                              {pattern: currencyCode},
+		stmt + "/Bal/Tp/CdOrPrtry/Cd":                   {pattern: regexp.MustCompile(`^(OPBD|CLBD|ITBD|CLAV|FWAV|INFO|OPAV|PRCD|XPCD|ITAV)$`)},
+		stmt + "/Bal/Amt":                               amount,
+		stmt + "/Bal/CdtDbtInd":                         {pattern: camtIndicator},
+		stmt + "/Bal/Dt/Dt":                             {pattern: isoDate},
+		stmt + "/Ntry/NtryRef":                          {maxLength: 35},
+		stmt + "/Ntry/Amt":                              amount,
+		stmt + "/Ntry/CdtDbtInd":                        {pattern: camtIndicator},
+		stmt + "/Ntry/RvslInd":                          {pattern: regexp.MustCompile(`^(true|false)$`)},
+		stmt + "/Ntry/Sts":                              {pattern: regexp.MustCompile(`^(BOOK|PDNG|INFO)$`)},
+		stmt + "/Ntry/BookgDt/Dt":                       {pattern: isoDate},
+		stmt + "/Ntry/ValDt/Dt":                         {pattern: isoDate},
+		stmt + "/Ntry/AcctSvcrRef":                      {maxLength: 35},
+		stmt + "/Ntry/BkTxCd/Prtry/Cd":                  {maxLength: 35},
+		stmt + "/Ntry/NtryDtls/TxDtls/Refs/AcctSvcrRef": {maxLength: 35},
+		stmt + "/Ntry/NtryDtls/TxDtls/AddtlTxInf":       {maxLength: 500},
+	}
+	checkXML(t, root, "", rules, facets)
+
+	// Amounts carry their currency, and are never negative.
+	for _, path := range [][]string{{"BkToCstmrStmt", "Stmt", "Bal", "Amt"}, {"BkToCstmrStmt", "Stmt", "Ntry", "Amt"}} {
+		for _, node := range findXML(root, path...) {
+			if !currencyCode.MatchString(node.attrs["Ccy"]) {
+				t.Errorf("%s has currency %q", strings.Join(path, "/"), node.attrs["Ccy"])
+			}
+		}
+	}
+
+	t.Run("xsd", func(t *testing.T) {
+		validateSchema(t, doc, camtSchema)
+	})
+}
+
+// findXML returns every element under node at path.
+func findXML(node *xmlNode, path ...string) []*xmlNode {
+	if len(path) == 0 {
+		return []*xmlNode{node}
+	}
+	var results []*xmlNode
+	for _, child := range node.children {
+		if child.name == path[0] {
+			results = append(results, findXML(child, path[1:]...)...)
+		}
+	}
+	return results
+}
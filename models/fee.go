@@ -0,0 +1,415 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"b-pay/config/logger"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// TypeFee is the Transaction type of every fee.
+const TypeFee = "FEE"
+
+// What a FeeSchedule charges for. TRANSFER is the outgoing leg of a transfer
+// between Savings, MAINTENANCE is charged once a month.
+const (
+	FeeOnDeposit     = "DEPOSIT"
+	FeeOnWithdrawal  = "WITHDRAWAL"
+	FeeOnTransfer    = "TRANSFER"
+	FeeOnMaintenance = "MAINTENANCE"
+)
+
+// Fee methods.
+const (
+	FeeFlat    = "FLAT"
+	FeePercent = "PERCENT"
+)
+
+// ErrInvalidFeeSchedule is returned when a FeeSchedule is not valid.
+var ErrInvalidFeeSchedule = errors.New("invalid fee schedule")
+
+// FeeSchedule defines one fee. A FLAT fee is Flat, a PERCENT fee is RateBps of
+// the Transaction value, kept between Min and Max. A Max of 0 means no
+// maximum. It only applies to the Savings of its Currency, which Flat, Min,
+// Max and MinBalance are in.
+type FeeSchedule struct {
+	gorm.Model
+	Name      string `gorm:"size:100;not null"`
+	Currency  string `gorm:"size:3;not null;default:IDR;index"` // ISO 4217
+	AppliesTo string `gorm:"size:11;not null;index"`            // DEPOSIT, WITHDRAWAL, TRANSFER or MAINTENANCE
+	Method    string `gorm:"size:7;not null"`                   // FLAT or PERCENT
+	// Kind limits the fee to the Savings of one kind. Empty for every kind.
+	Kind    string `gorm:"size:12"`
+	Flat    int64  `gorm:"not null;default:0"`
+	RateBps int64  `gorm:"not null;default:0"`
+	Min     int64  `gorm:"not null;default:0"`
+	Max     int64  `gorm:"not null;default:0"`
+	// MinBalance is the balance under which a MAINTENANCE fee is charged.
+	MinBalance int64 `gorm:"not null;default:0"`
+	Active     bool  `gorm:"not null;default:true"`
+}
+
+// FeeWaiver exempts a User from one FeeSchedule, or from every fee when
+// FeeScheduleID is nil, until Until. A nil Until never ends.
+type FeeWaiver struct {
+	gorm.Model
+	UserID        uint `gorm:"not null;index"`
+	FeeScheduleID *uint
+	Until         *time.Time
+	Reason        string `gorm:"size:200"`
+}
+
+// MaintenanceCharge is the maintenance fee of a Saving for one month. One per
+// month and FeeSchedule, so a month is never charged twice.
+type MaintenanceCharge struct {
+	gorm.Model
+	SavingID      uint   `gorm:"not null;uniqueIndex:idx_maintenance_period"`
+	FeeScheduleID uint   `gorm:"not null;uniqueIndex:idx_maintenance_period"`
+	Period        string `gorm:"size:7;not null;uniqueIndex:idx_maintenance_period"` // YYYY-MM
+	Balance       int64  `gorm:"not null"`
+	Amount        int64  `gorm:"not null"`
+	TransactionID *uint
+}
+
+// FeeQuote is one fee that a Transaction would be charged.
+type FeeQuote struct {
+	FeeScheduleID uint
+	Name          string
+	Amount        int64
+	Waived        bool
+}
+
+// Validate checks the currency, the method and the values of the
+// FeeSchedule.
+func (f *FeeSchedule) Validate() error {
+	if !ValidCurrency(f.Currency) {
+		return ErrUnknownCurrency
+	}
+	switch f.AppliesTo {
+	case FeeOnDeposit, FeeOnWithdrawal, FeeOnTransfer, FeeOnMaintenance:
+	default:
+		return errors.New("fee must be on DEPOSIT, WITHDRAWAL, TRANSFER or MAINTENANCE")
+	}
+	if f.Method != FeeFlat && f.Method != FeePercent {
+		return errors.New("fee method must be FLAT or PERCENT")
+	}
+	if f.AppliesTo == FeeOnMaintenance && f.Method != FeeFlat {
+		return errors.New("maintenance fees must be FLAT")
+	}
+	if f.Flat < 0 || f.RateBps < 0 || f.Min < 0 || f.Max < 0 || f.MinBalance < 0 {
+		return ErrInvalidFeeSchedule
+	}
+	if f.Max > 0 && f.Min > f.Max {
+		return errors.New("fee minimum can not be more than its maximum")
+	}
+	return nil
+}
+
+// Store creates a FeeSchedule record to Database. A FeeSchedule without
+// currency is in the DefaultCurrency.
+func (f *FeeSchedule) Store() error {
+	if f.Currency == "" {
+		f.Currency = DefaultCurrency
+	}
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	return database.DB.Create(&f).Error
+}
+
+// GetFeeSchedules gets/fetches every FeeSchedule.
+func (f *FeeSchedule) GetFeeSchedules() (*[]FeeSchedule, error) {
+	var results []FeeSchedule
+	err := database.DB.Order("id").Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// UpdateActive turns the FeeSchedule with id on or off.
+func (f *FeeSchedule) UpdateActive(id string, active bool) error {
+	result := database.DB.Model(&FeeSchedule{}).Where("id = ?", id).Update("active", active)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// Amount computes the fee of a Transaction of value. Always rounds down.
+func (f *FeeSchedule) Amount(value int64) int64 {
+	amount := f.Flat
+	if f.Method == FeePercent {
+		fee := new(big.Int).Mul(big.NewInt(abs(value)), big.NewInt(f.RateBps))
+		fee.Quo(fee, big.NewInt(bpsUnits))
+		amount = fee.Int64()
+	}
+
+	if amount < f.Min {
+		amount = f.Min
+	}
+	if f.Max > 0 && amount > f.Max {
+		amount = f.Max
+	}
+	return amount
+}
+
+// Store creates a FeeWaiver record to Database.
+func (w *FeeWaiver) Store() error {
+	return database.DB.Create(&w).Error
+}
+
+// GetFeeWaiversByUserID gets/fetches every FeeWaiver of a User.
+func (w *FeeWaiver) GetFeeWaiversByUserID(userID string) (*[]FeeWaiver, error) {
+	var results []FeeWaiver
+	err := database.DB.Where("user_id = ?", userID).Order("id").Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// DeleteFeeWaiver removes a FeeWaiver by ID.
+func DeleteFeeWaiver(id string) error {
+	return database.DB.Unscoped().Where("id = ?", id).Delete(&FeeWaiver{}).Error
+}
+
+// activeFeeSchedules gets/fetches every active FeeSchedule on a Transaction
+// kind which applies to the Saving and its currency.
+func activeFeeSchedules(tx *gorm.DB, on string, saving *Saving) ([]FeeSchedule, error) {
+	var results []FeeSchedule
+	err := tx.
+		Where("active = ? AND applies_to = ? AND currency = ?", true, on, saving.Currency).
+		Where("kind = '' OR kind IS NULL OR kind = ?", saving.Kind).
+		Order("id").
+		Find(&results).
+		Error
+	return results, err
+}
+
+// isWaived reports whether the User has a FeeWaiver for the FeeSchedule at
+// now.
+func isWaived(tx *gorm.DB, userID uint, scheduleID uint, now time.Time) (bool, error) {
+	var count int64
+	err := tx.Model(&FeeWaiver{}).
+		Where("user_id = ?", userID).
+		Where("fee_schedule_id IS NULL OR fee_schedule_id = ?", scheduleID).
+		Where("until IS NULL OR until > ?", now).
+		Count(&count).
+		Error
+	return count > 0, err
+}
+
+// quoteFees computes the fees of a Transaction of value on the Saving, within
+// tx. Waived fees are quoted with Waived set.
+func quoteFees(tx *gorm.DB, saving *Saving, on string, value int64, now time.Time) ([]FeeQuote, error) {
+	schedules, err := activeFeeSchedules(tx, on, saving)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []FeeQuote
+	for _, schedule := range schedules {
+		amount := schedule.Amount(value)
+		if amount <= 0 {
+			continue
+		}
+		waived, err := isWaived(tx, saving.UserID, schedule.ID, now)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, FeeQuote{
+			FeeScheduleID: schedule.ID,
+			Name:          schedule.Name,
+			Amount:        amount,
+			Waived:        waived,
+		})
+	}
+	return results, nil
+}
+
+// PreviewFees computes the fees a Transaction of value on the Saving would be
+// charged, and their total without waived fees. on is DEPOSIT, WITHDRAWAL or
+// TRANSFER.
+func (s *Saving) PreviewFees(on string, value int64) ([]FeeQuote, int64, error) {
+	quotes, err := quoteFees(database.DB, s, on, value, time.Now())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int64
+	for _, quote := range quotes {
+		if !quote.Waived {
+			total += quote.Amount
+		}
+	}
+	return quotes, total, nil
+}
+
+// chargeFees posts every fee of t on the locked saving as its own FEE
+// Transaction linked to t, within tx. t must be stored already.
+func chargeFees(tx *gorm.DB, saving *Saving, t *Transaction, on string) error {
+	quotes, err := quoteFees(tx, saving, on, t.Value, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, quote := range quotes {
+		if quote.Waived {
+			continue
+		}
+		// apply changed the balance of the Saving, reload it.
+		if err := tx.First(saving, saving.ID).Error; err != nil {
+			return err
+		}
+		triggerID := t.ID
+		err := apply(tx, saving, &Transaction{
+			SavingID:    saving.ID,
+			Type:        TypeFee,
+			Value:       -quote.Amount,
+			Description: fmt.Sprintf("%s fee of transaction %d", quote.Name, t.ID),
+			FeeOf:       &triggerID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ChargeMaintenanceFees charges every active MAINTENANCE FeeSchedule of the
+// month of date to the Savings whose balance at the end of the month is under
+// its MinBalance. Time deposits are never charged. Running it again for the
+// same month charges nothing. A Saving which fails is logged and skipped, the
+// run then returns an error counting the failures.
+func ChargeMaintenanceFees(date time.Time) error {
+	var schedules []FeeSchedule
+	err := database.DB.Where("active = ? AND applies_to = ?", true, FeeOnMaintenance).Order("id").Find(&schedules).Error
+	if err != nil {
+		return err
+	}
+	if len(schedules) == 0 {
+		return nil
+	}
+
+	var savings []Saving
+	err = database.DB.Where("kind <> ?", KindTimeDeposit).Order("id").Find(&savings).Error
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	var lastErr error
+	for i := range schedules {
+		for j := range savings {
+			if schedules[i].Kind != "" && schedules[i].Kind != savings[j].Kind {
+				continue
+			}
+			if schedules[i].Currency != savings[j].Currency {
+				continue
+			}
+			if err := chargeMaintenance(&savings[j], &schedules[i], date); err != nil {
+				logger.Log.Error("maintenance fee failed",
+					zap.Uint("saving_id", savings[j].ID), zap.Uint("fee_schedule_id", schedules[i].ID), zap.Error(err))
+				failed++
+				lastErr = err
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d maintenance fees failed, the last one: %w", failed, lastErr)
+	}
+	return nil
+}
+
+// chargeMaintenance charges one MAINTENANCE fee of the month of date to the
+// Saving. The fee is never more than the available balance.
+func chargeMaintenance(saving *Saving, schedule *FeeSchedule, date time.Time) error {
+	start := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, date.Location())
+	lastDay := start.AddDate(0, 1, -1)
+	period := start.Format("2006-01")
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		locked, err := lockSaving(tx, saving.ID)
+		if err != nil {
+			return err
+		}
+
+		var charged int64
+		err = tx.Model(&MaintenanceCharge{}).
+			Where("saving_id = ? AND fee_schedule_id = ? AND period = ?", saving.ID, schedule.ID, period).
+			Count(&charged).
+			Error
+		if err != nil || charged > 0 {
+			return err
+		}
+
+		balance, err := balanceAt(tx, saving.ID, lastDay)
+		if err != nil {
+			return err
+		}
+		if balance >= schedule.MinBalance {
+			return nil
+		}
+
+		charge := MaintenanceCharge{
+			SavingID:      saving.ID,
+			FeeScheduleID: schedule.ID,
+			Period:        period,
+			Balance:       balance,
+		}
+
+		waived, err := isWaived(tx, locked.UserID, schedule.ID, lastDay)
+		if err != nil {
+			return err
+		}
+		if !waived {
+			available, err := availableBalance(tx, locked)
+			if err != nil {
+				return err
+			}
+			charge.Amount = schedule.Amount(0)
+			if charge.Amount > available {
+				charge.Amount = available
+			}
+		}
+
+		if charge.Amount > 0 {
+			fee := Transaction{
+				SavingID:    saving.ID,
+				Type:        TypeFee,
+				Value:       -charge.Amount,
+				Description: fmt.Sprintf("%s %s", schedule.Name, period),
+			}
+			if err := apply(tx, locked, &fee); err != nil {
+				return err
+			}
+			charge.TransactionID = &fee.ID
+		}
+
+		return tx.Create(&charge).Error
+	})
+}
+
+// feeOn returns what a Transaction of type kind is charged for. Empty when it
+// is never charged.
+func feeOn(kind string) string {
+	switch kind {
+	case TypeDeposit:
+		return FeeOnDeposit
+	case TypeWithdrawal:
+		return FeeOnWithdrawal
+	case TypeFunding:
+		// Funding a time deposit is a transfer between Savings.
+		return FeeOnTransfer
+	}
+	return ""
+}
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestFeeScheduleAmount(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule FeeSchedule
+		value    int64
+		want     int64
+	}{
+		{"flat", FeeSchedule{Method: FeeFlat, Flat: 250}, -10000, 250},
+		{"percent", FeeSchedule{Method: FeePercent, RateBps: 150}, -10000, 150},
+		{"percent of a deposit", FeeSchedule{Method: FeePercent, RateBps: 150}, 10000, 150},
+		{"percent rounds down", FeeSchedule{Method: FeePercent, RateBps: 150}, -99, 1},
+		{"percent under the minimum", FeeSchedule{Method: FeePercent, RateBps: 100, Min: 50}, -1000, 50},
+		{"percent over the maximum", FeeSchedule{Method: FeePercent, RateBps: 100, Max: 500}, -100000, 500},
+		{"no maximum", FeeSchedule{Method: FeePercent, RateBps: 100}, -100000, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.Amount(tt.value); got != tt.want {
+				t.Errorf("Amount(%d) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostFees(t *testing.T) {
+	tests := []struct {
+		name    string
+		waive   bool
+		kind    string
+		t       Transaction
+		balance int64
+		fees    int64
+	}{
+		{"withdrawal", false, "", Transaction{Type: TypeWithdrawal, Value: -10000}, 89800, 1},
+		{"deposit is not charged the withdrawal fee", false, "", Transaction{Type: TypeDeposit, Value: 10000}, 110000, 0},
+		{"waived", true, "", Transaction{Type: TypeWithdrawal, Value: -10000}, 90000, 0},
+		{"other kind", false, KindTimeDeposit, Transaction{Type: TypeWithdrawal, Value: -10000}, 90000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDB(t)
+			saving := newSaving(t, 100000, time.Now())
+			schedule := FeeSchedule{
+				Name:      "Withdrawal",
+				AppliesTo: FeeOnWithdrawal,
+				Method:    FeePercent,
+				RateBps:   100,
+				Min:       200,
+				Kind:      tt.kind,
+				Active:    true,
+			}
+			if err := schedule.Store(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.waive {
+				waiver := FeeWaiver{UserID: saving.UserID, FeeScheduleID: &schedule.ID}
+				if err := waiver.Store(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			txn := tt.t
+			txn.SavingID = saving.ID
+			mustPost(t, &txn)
+
+			if got := reload(t, saving).Balance; got != tt.balance {
+				t.Errorf("balance = %d, want %d", got, tt.balance)
+			}
+			var fees []Transaction
+			if err := database.DB.Where("saving_id = ? AND type = ?", saving.ID, TypeFee).Find(&fees).Error; err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(fees)) != tt.fees {
+				t.Fatalf("fees = %d, want %d", len(fees), tt.fees)
+			}
+			if len(fees) == 1 && (fees[0].FeeOf == nil || *fees[0].FeeOf != txn.ID) {
+				t.Errorf("fee of %v, want %d", fees[0].FeeOf, txn.ID)
+			}
+		})
+	}
+}
+
+func TestChargeMaintenanceFees(t *testing.T) {
+	setupDB(t)
+	low := newSaving(t, 500, day(2026, 3, 1))
+	high := newSaving(t, 5000, day(2026, 3, 1))
+	schedule := FeeSchedule{
+		Name:       "Maintenance",
+		AppliesTo:  FeeOnMaintenance,
+		Method:     FeeFlat,
+		Flat:       800,
+		MinBalance: 1000,
+		Active:     true,
+	}
+	if err := schedule.Store(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := ChargeMaintenanceFees(day(2026, 3, 15)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The fee is capped to the available balance, and charged once.
+	if got := reload(t, low).Balance; got != 0 {
+		t.Errorf("low balance = %d, want 0", got)
+	}
+	if got := reload(t, high).Balance; got != 5000 {
+		t.Errorf("high balance = %d, want 5000", got)
+	}
+}
+
+func TestChargeMaintenanceFeesSkipsFailures(t *testing.T) {
+	setupDB(t)
+	failing := newSaving(t, 500, day(2026, 3, 1))
+	low := newSaving(t, 500, day(2026, 3, 1))
+	schedule := FeeSchedule{Name: "Maintenance", AppliesTo: FeeOnMaintenance, Method: FeeFlat, Flat: 100, MinBalance: 1000, Active: true}
+	if err := schedule.Store(); err != nil {
+		t.Fatal(err)
+	}
+	// The fee of the first Saving can not be stored.
+	err := database.DB.Callback().Create().Before("gorm:create").Register("test:fail_fee", func(db *gorm.DB) {
+		if txn, ok := db.Statement.Dest.(*Transaction); ok && txn.SavingID == failing.ID {
+			db.AddError(errors.New("database is down"))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ChargeMaintenanceFees(day(2026, 3, 15)); err == nil {
+		t.Error("no error with a failed fee")
+	}
+	if got := reload(t, failing).Balance; got != 500 {
+		t.Errorf("failing balance = %d, want 500", got)
+	}
+	if got := reload(t, low).Balance; got != 400 {
+		t.Errorf("low balance = %d, want 400", got)
+	}
+}
@@ -0,0 +1,227 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// goalMilestones are the progress percentages recorded as GoalMilestones.
+var goalMilestones = []int{25, 50, 75, 100}
+
+// projectionWindow is how far back the deposit history is used to project the
+// completion of a goal.
+const projectionWindow = 90 * 24 * time.Hour
+
+// ErrGoalLocked is returned when withdrawing from a Saving which is locked
+// until its goal is reached.
+var ErrGoalLocked = errors.New("withdrawals are locked until the goal or its date is reached")
+
+// ErrGoalLockWeakened is returned when changing the goal of a locked Saving
+// would let it unlock earlier.
+var ErrGoalLockWeakened = errors.New("the goal lock can not be weakened until the goal or its date is reached")
+
+// GoalMilestone is recorded the first time a Saving reaches a Percent of its
+// TargetAmount.
+type GoalMilestone struct {
+	gorm.Model
+	SavingID  uint      `gorm:"not null;uniqueIndex:idx_goal_milestone"`
+	Percent   int       `gorm:"not null;uniqueIndex:idx_goal_milestone"`
+	Target    int64     `gorm:"not null"`
+	ReachedAt time.Time `gorm:"not null"`
+}
+
+// GoalProgress is the progress of a Saving towards its goal.
+type GoalProgress struct {
+	TargetAmount int64
+	TargetDate   *time.Time
+	Remaining    int64
+	// Percent is rounded down and never more than 100.
+	Percent int
+	Reached bool
+	// ProjectedCompletion is based on the deposits of the last 90 days. Nil
+	// when there are no deposits or the goal is already reached.
+	ProjectedCompletion *time.Time
+	// OnTrack is true when the projection is before the TargetDate.
+	OnTrack    bool
+	Milestones []GoalMilestone
+}
+
+// HasGoal reports whether the Saving has a target amount.
+func (s *Saving) HasGoal() bool {
+	return s.TargetAmount > 0
+}
+
+// goalPercent returns how many percent of the TargetAmount balance is.
+func (s *Saving) goalPercent(balance int64) int {
+	if !s.HasGoal() || balance <= 0 {
+		return 0
+	}
+	if balance >= s.TargetAmount {
+		return 100
+	}
+	return int(balance * 100 / s.TargetAmount)
+}
+
+// goalLocked reports whether withdrawals are blocked at now. A locked Saving
+// unlocks when the goal or the TargetDate is reached.
+func (s *Saving) goalLocked(now time.Time) bool {
+	if !s.LockUntilGoal {
+		return false
+	}
+	if s.HasGoal() && s.Balance >= s.TargetAmount {
+		return false
+	}
+	if s.TargetDate != nil && !now.Before(*s.TargetDate) {
+		return false
+	}
+	return s.HasGoal() || s.TargetDate != nil
+}
+
+// weakensGoalLock reports whether changing the goal of a locked Saving to
+// target, date and lock would unlock it earlier: unlocking it, lowering the
+// target, pulling the date earlier, or adding a target or a date it did not
+// wait for.
+func (s *Saving) weakensGoalLock(target int64, date *time.Time, lock bool, now time.Time) bool {
+	if !s.goalLocked(now) {
+		return false
+	}
+	changed := Saving{
+		Balance:       s.Balance,
+		TargetAmount:  target,
+		TargetDate:    date,
+		LockUntilGoal: lock,
+	}
+	if !changed.goalLocked(now) {
+		return true
+	}
+	if changed.HasGoal() && (!s.HasGoal() || target < s.TargetAmount) {
+		return true
+	}
+	if date != nil && (s.TargetDate == nil || date.Before(*s.TargetDate)) {
+		return true
+	}
+	return false
+}
+
+// recordMilestones records every milestone reached by balance, within tx.
+// Milestones already reached are kept.
+func recordMilestones(tx *gorm.DB, saving *Saving, balance int64) error {
+	if !saving.HasGoal() {
+		return nil
+	}
+	percent := saving.goalPercent(balance)
+	for _, milestone := range goalMilestones {
+		if percent < milestone {
+			break
+		}
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&GoalMilestone{
+			SavingID:  saving.ID,
+			Percent:   milestone,
+			Target:    saving.TargetAmount,
+			ReachedAt: time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateGoal updates the goal of the Saving. Milestones of the previous
+// target are removed, so they can be reached again. While the Saving is
+// locked, the lock can only be made stricter, see ErrGoalLockWeakened.
+func (s *Saving) UpdateGoal(target int64, date *time.Time, lock bool) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		saving, err := lockSaving(tx, s.ID)
+		if err != nil {
+			return err
+		}
+		if saving.weakensGoalLock(target, date, lock, time.Now()) {
+			return ErrGoalLockWeakened
+		}
+
+		if saving.TargetAmount != target {
+			err := tx.Unscoped().Where("saving_id = ?", s.ID).Delete(&GoalMilestone{}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		saving.TargetAmount = target
+		saving.TargetDate = date
+		saving.LockUntilGoal = lock
+		err = tx.Model(saving).Updates(map[string]interface{}{
+			"target_amount":   target,
+			"target_date":     date,
+			"lock_until_goal": lock,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return recordMilestones(tx, saving, saving.Balance)
+	})
+}
+
+// GetGoalProgress returns the progress of the Saving towards its goal. Nil if
+// the Saving has no goal.
+func (s *Saving) GetGoalProgress() (*GoalProgress, error) {
+	if !s.HasGoal() {
+		return nil, nil
+	}
+
+	progress := GoalProgress{
+		TargetAmount: s.TargetAmount,
+		TargetDate:   s.TargetDate,
+		Percent:      s.goalPercent(s.Balance),
+		Reached:      s.Balance >= s.TargetAmount,
+	}
+	if !progress.Reached {
+		progress.Remaining = s.TargetAmount - s.Balance
+	}
+
+	err := database.DB.Where("saving_id = ?", s.ID).Order("percent").Find(&progress.Milestones).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if progress.Reached {
+		progress.OnTrack = true
+		return &progress, nil
+	}
+
+	// Average deposit per day since the first deposit of the window.
+	now := time.Now()
+	deposits := func() *gorm.DB {
+		return database.DB.Model(&Transaction{}).
+			Where("saving_id = ? AND type = ? AND created_at >= ?", s.ID, TypeDeposit, now.Add(-projectionWindow))
+	}
+	var total int64
+	if err := deposits().Select("COALESCE(SUM(value), 0)").Scan(&total).Error; err != nil {
+		return nil, err
+	}
+	if total <= 0 {
+		return &progress, nil
+	}
+	var first Transaction
+	if err := deposits().Order("created_at").First(&first).Error; err != nil {
+		return nil, err
+	}
+
+	days := now.Sub(first.CreatedAt).Hours() / 24
+	if days < 1 {
+		days = 1
+	}
+	perDay := float64(total) / days
+	// Projections of more than 100 years are left out.
+	if remainingDays := float64(progress.Remaining) / perDay; remainingDays <= 36500 {
+		projected := now.Add(time.Duration(remainingDays * 24 * float64(time.Hour)))
+		progress.ProjectedCompletion = &projected
+		progress.OnTrack = s.TargetDate == nil || !projected.After(*s.TargetDate)
+	}
+
+	return &progress, nil
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWeakensGoalLock(t *testing.T) {
+	now := day(2026, 6, 1)
+	date := day(2026, 12, 1)
+	earlier := day(2026, 9, 1)
+	later := day(2027, 3, 1)
+	past := day(2026, 1, 1)
+
+	tests := []struct {
+		name   string
+		saving Saving
+		target int64
+		date   *time.Time
+		lock   bool
+		want   bool
+	}{
+		{"not locked", Saving{Balance: 100, TargetAmount: 1000}, 0, nil, false, false},
+		{"goal reached", Saving{Balance: 1000, TargetAmount: 1000, LockUntilGoal: true}, 0, nil, false, false},
+		{"date reached", Saving{TargetDate: &past, LockUntilGoal: true}, 0, nil, false, false},
+		{"unlock", Saving{Balance: 100, TargetAmount: 1000, LockUntilGoal: true}, 1000, nil, false, true},
+		{"lower target", Saving{Balance: 100, TargetAmount: 1000, LockUntilGoal: true}, 500, nil, true, true},
+		{"raise target", Saving{Balance: 100, TargetAmount: 1000, LockUntilGoal: true}, 2000, nil, true, false},
+		{"remove the only target", Saving{Balance: 100, TargetAmount: 1000, LockUntilGoal: true}, 0, nil, true, true},
+		{"add a target to a date lock", Saving{TargetDate: &date, LockUntilGoal: true}, 1000, &date, true, true},
+		{"add a date to a target lock", Saving{TargetAmount: 1000, LockUntilGoal: true}, 1000, &date, true, true},
+		{"pull the date earlier", Saving{TargetDate: &date, LockUntilGoal: true}, 0, &earlier, true, true},
+		{"push the date later", Saving{TargetDate: &date, LockUntilGoal: true}, 0, &later, true, false},
+		{"remove the date of both", Saving{TargetAmount: 1000, TargetDate: &date, LockUntilGoal: true}, 1000, nil, true, false},
+		{"same goal", Saving{TargetAmount: 1000, TargetDate: &date, LockUntilGoal: true}, 1000, &date, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.saving.weakensGoalLock(tt.target, tt.date, tt.lock, now); got != tt.want {
+				t.Errorf("weakensGoalLock() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateGoalLocked(t *testing.T) {
+	setupDB(t)
+	saving := newSaving(t, 100, day(2026, 1, 1))
+	if err := saving.UpdateGoal(1000, nil, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := saving.UpdateGoal(500, nil, true); err != ErrGoalLockWeakened {
+		t.Errorf("lowering the target: err = %v, want %v", err, ErrGoalLockWeakened)
+	}
+	if err := saving.UpdateGoal(1000, nil, false); err != ErrGoalLockWeakened {
+		t.Errorf("unlocking: err = %v, want %v", err, ErrGoalLockWeakened)
+	}
+	if err := saving.UpdateGoal(2000, nil, true); err != nil {
+		t.Errorf("raising the target: err = %v", err)
+	}
+	if got := reload(t, saving); got.TargetAmount != 2000 || !got.LockUntilGoal {
+		t.Errorf("goal = %d locked %v, want 2000 locked", got.TargetAmount, got.LockUntilGoal)
+	}
+
+	// Once the goal is reached, the lock can be changed.
+	deposit(t, saving, 1900, time.Now())
+	if err := saving.UpdateGoal(0, nil, false); err != nil {
+		t.Errorf("after the goal: err = %v", err)
+	}
+}
+
+func TestGetGoalProgress(t *testing.T) {
+	setupDB(t)
+	now := time.Now()
+	// Deposits before the projection window are not part of the projection.
+	saving := newSaving(t, 200, now.AddDate(0, 0, -100))
+	targetDate := now.AddDate(0, 0, 60)
+	if err := saving.UpdateGoal(1000, &targetDate, false); err != nil {
+		t.Fatal(err)
+	}
+	deposit(t, saving, 100, now.AddDate(0, 0, -10))
+	deposit(t, saving, 100, now.AddDate(0, 0, -5))
+
+	progress, err := reload(t, saving).GetGoalProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Percent != 40 || progress.Remaining != 600 || progress.Reached {
+		t.Errorf("progress = %+v", progress)
+	}
+	// 200 in 10 days leaves 30 days for the remaining 600.
+	want := now.AddDate(0, 0, 30)
+	if p := progress.ProjectedCompletion; p == nil || p.Before(want.Add(-time.Hour)) || p.After(want.Add(time.Hour)) {
+		t.Errorf("ProjectedCompletion = %v, want about %v", p, want)
+	}
+	if !progress.OnTrack {
+		t.Error("not on track before the TargetDate")
+	}
+	if len(progress.Milestones) != 1 || progress.Milestones[0].Percent != 25 {
+		t.Errorf("Milestones = %+v", progress.Milestones)
+	}
+}
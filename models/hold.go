@@ -0,0 +1,228 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Hold statuses.
+const (
+	HoldActive   = "ACTIVE"
+	HoldCaptured = "CAPTURED"
+	HoldReleased = "RELEASED"
+	HoldExpired  = "EXPIRED"
+)
+
+var (
+	// ErrHoldNotActive is returned when a Hold is already captured, released
+	// or expired.
+	ErrHoldNotActive = errors.New("hold is not active")
+	// ErrHoldExpired is returned when an active Hold has passed its expiry.
+	ErrHoldExpired = errors.New("hold is expired")
+	// ErrCaptureTooLarge is returned when capturing more than the Hold amount.
+	ErrCaptureTooLarge = errors.New("capture value exceeds the hold amount")
+	// ErrInsufficientAvailableBalance is returned when the available balance
+	// is not enough for the operation.
+	ErrInsufficientAvailableBalance = errors.New("available balance is not enough")
+)
+
+// Hold reserves an Amount of a Saving until ExpiresAt. It lowers the
+// available balance without changing the ledger Balance.
+//
+// A Hold can be captured once. Capturing less than the Amount releases the
+// rest.
+type Hold struct {
+	gorm.Model
+	SavingID       uint      `gorm:"not null;index"`
+	Amount         int64     `gorm:"not null"`
+	CapturedAmount int64     `gorm:"not null;default:0"`
+	Reference      string    `gorm:"size:100;not null"`
+	Status         string    `gorm:"size:10;not null;index"`
+	ExpiresAt      time.Time `gorm:"not null"`
+	// TransactionID is the WITHDRAWAL made by the capture.
+	TransactionID *uint
+	// ctx is the context of the queries of the Hold, see WithContext.
+	ctx context.Context
+}
+
+// WithContext sets the context of the queries of the Hold, with the
+// AuditActor of its capture.
+func (h *Hold) WithContext(ctx context.Context) *Hold {
+	h.ctx = ctx
+	return h
+}
+
+// heldAmount sums the active Holds of a Saving which have not expired yet.
+func heldAmount(tx *gorm.DB, savingID uint) (int64, error) {
+	var total int64
+	err := tx.Model(&Hold{}).
+		Select("COALESCE(SUM(amount), 0)").
+		Where("saving_id = ? AND status = ? AND expires_at > ?", savingID, HoldActive, time.Now()).
+		Scan(&total).
+		Error
+	return total, err
+}
+
+// availableBalance is the ledger Balance minus the held amount.
+func availableBalance(tx *gorm.DB, saving *Saving) (int64, error) {
+	held, err := heldAmount(tx, saving.ID)
+	if err != nil {
+		return 0, err
+	}
+	return saving.Balance - held, nil
+}
+
+// isExpired reports whether an active Hold has passed its expiry.
+func (h *Hold) isExpired() bool {
+	return h.Status == HoldActive && !h.ExpiresAt.After(time.Now())
+}
+
+// Store places the Hold on its Saving. Fails when the available balance is
+// lower than the Hold amount.
+func (h *Hold) Store() error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		saving, err := lockSaving(tx, h.SavingID)
+		if err != nil {
+			return err
+		}
+
+		if saving.goalLocked(time.Now()) {
+			return ErrGoalLocked
+		}
+		if saving.IsTimeDeposit() {
+			return ErrTimeDepositLocked
+		}
+
+		available, err := availableBalance(tx, saving)
+		if err != nil {
+			return err
+		}
+		if available < h.Amount {
+			return ErrInsufficientAvailableBalance
+		}
+
+		h.Status = HoldActive
+		return tx.Create(&h).Error
+	})
+}
+
+// GetHoldByID gets/fetches a Hold by searching the ID.
+func (h *Hold) GetHoldByID(id string) *Hold {
+	var result Hold
+	err := database.DB.Where("id = ?", id).First(&result).Error
+	if err != nil {
+		return nil
+	}
+	return &result
+}
+
+// GetHoldsBySavingID gets/fetches every Hold of a Saving.
+func (h *Hold) GetHoldsBySavingID(savingID uint) (*[]Hold, error) {
+	var results []Hold
+	err := database.DB.Where("saving_id = ?", savingID).Order("id").Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// lockActive reloads the Hold within tx with its row locked and makes sure it
+// is still active.
+func (h *Hold) lockActive(tx *gorm.DB) error {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ?", h.ID).
+		First(&h).
+		Error
+	if err != nil {
+		return err
+	}
+
+	if h.isExpired() {
+		return ErrHoldExpired
+	}
+	if h.Status != HoldActive {
+		return ErrHoldNotActive
+	}
+	return nil
+}
+
+// Capture settles value of the Hold as a WITHDRAWAL. 0 captures the whole
+// Amount. Whatever is left of the Hold is released.
+func (h *Hold) Capture(value int64) (*Transaction, error) {
+	var transaction Transaction
+	err := withContext(h.ctx).Transaction(func(tx *gorm.DB) error {
+		saving, err := lockSaving(tx, h.SavingID)
+		if err != nil {
+			return err
+		}
+
+		if err := h.lockActive(tx); err != nil {
+			return err
+		}
+
+		if value == 0 {
+			value = h.Amount
+		}
+		if value > h.Amount {
+			return ErrCaptureTooLarge
+		}
+
+		// Settle the Hold first, so the available balance it reserved can
+		// pay for the WITHDRAWAL. The WITHDRAWAL is posted like any other,
+		// with its limits, fees, goal lock and approval.
+		err = tx.Model(&h).Updates(map[string]interface{}{
+			"status":          HoldCaptured,
+			"captured_amount": value,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		transaction = Transaction{
+			SavingID:    h.SavingID,
+			Type:        TypeWithdrawal,
+			Value:       -value,
+			Currency:    saving.Currency,
+			Description: fmt.Sprintf("Capture of hold %s", h.Reference),
+		}
+		if err := post(tx, &transaction); err != nil {
+			return err
+		}
+
+		if err := tx.Model(&h).Update("transaction_id", transaction.ID).Error; err != nil {
+			return err
+		}
+		return auditTx(tx, AuditHoldCaptured, "hold", h.ID, nil, transaction)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &transaction, nil
+}
+
+// Release releases the whole Hold without moving any money.
+func (h *Hold) Release() error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := h.lockActive(tx); err != nil {
+			return err
+		}
+		return tx.Model(&h).Update("status", HoldReleased).Error
+	})
+}
+
+// ExpireHolds marks every active Hold which has passed its expiry as EXPIRED.
+// Expired Holds are already ignored by the available balance, this only keeps
+// their status up to date.
+func ExpireHolds() error {
+	return database.DB.Model(&Hold{}).
+		Where("status = ? AND expires_at <= ?", HoldActive, time.Now()).
+		Update("status", HoldExpired).
+		Error
+}
@@ -0,0 +1,466 @@
+package models
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrImportInvalid is returned when committing an import whose report
+	// has bad rows or makes the balance negative.
+	ErrImportInvalid = errors.New("import has errors, see the report")
+	// errImportDryRun rolls back the DB transaction of a dry run.
+	errImportDryRun = errors.New("dry run")
+)
+
+// ImportMapping maps the CSV columns to Transaction fields, by header name.
+// Type is optional: without it, the sign of the amount decides.
+type ImportMapping struct {
+	Date        string
+	Amount      string
+	Type        string
+	Description string
+	Reference   string
+	// DateFormat is a Go time layout.
+	DateFormat string
+}
+
+// DefaultImportMapping is the mapping used for every empty ImportMapping
+// field.
+var DefaultImportMapping = ImportMapping{
+	Date:        "date",
+	Amount:      "amount",
+	Type:        "type",
+	Description: "description",
+	Reference:   "reference",
+	DateFormat:  "2006-01-02",
+}
+
+// ImportIssue is a problem of one CSV line. Line 0 is the whole file.
+type ImportIssue struct {
+	Line      int
+	Reference string `json:",omitempty"`
+	Error     string
+}
+
+// ImportReport is the validation report of an import. Duplicates are skipped,
+// they are not errors.
+type ImportReport struct {
+	Rows            int
+	Valid           int
+	Errors          []ImportIssue
+	Duplicates      []ImportIssue
+	NegativeBalance *ImportIssue
+	Total           Money
+	Committed       bool
+}
+
+// importRow is one valid CSV line.
+type importRow struct {
+	line        int
+	date        time.Time
+	kind        string
+	value       int64
+	description string
+	reference   string
+}
+
+// OK reports whether the import can be committed.
+func (r *ImportReport) OK() bool {
+	return len(r.Errors) == 0 && r.NegativeBalance == nil
+}
+
+// withDefaults fills every empty field of m with DefaultImportMapping.
+func (m ImportMapping) withDefaults() ImportMapping {
+	defaults := DefaultImportMapping
+	if m.Date == "" {
+		m.Date = defaults.Date
+	}
+	if m.Amount == "" {
+		m.Amount = defaults.Amount
+	}
+	if m.Type == "" {
+		m.Type = defaults.Type
+	}
+	if m.Description == "" {
+		m.Description = defaults.Description
+	}
+	if m.Reference == "" {
+		m.Reference = defaults.Reference
+	}
+	if m.DateFormat == "" {
+		m.DateFormat = defaults.DateFormat
+	}
+	return m
+}
+
+// parseImport reads every CSV line into rows and adds the bad ones to the
+// report. The first line is the header. DEPOSIT rows are bad unless deposits
+// is set.
+func parseImport(r io.Reader, mapping ImportMapping, currency string, deposits bool, report *ImportReport) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.New("CSV header is missing")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	column := func(name string) int {
+		if i, ok := columns[strings.ToLower(name)]; ok {
+			return i
+		}
+		return -1
+	}
+
+	dateColumn, amountColumn := column(mapping.Date), column(mapping.Amount)
+	typeColumn, descColumn, refColumn := column(mapping.Type), column(mapping.Description), column(mapping.Reference)
+	if dateColumn < 0 || amountColumn < 0 || refColumn < 0 {
+		return nil, fmt.Errorf("CSV needs the columns %q, %q and %q", mapping.Date, mapping.Amount, mapping.Reference)
+	}
+
+	field := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var rows []importRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		report.Rows++
+		if err != nil {
+			report.Errors = append(report.Errors, ImportIssue{Line: line, Error: err.Error()})
+			continue
+		}
+
+		row := importRow{
+			line:        line,
+			description: field(record, descColumn),
+			reference:   field(record, refColumn),
+		}
+		issue := func(text string) {
+			report.Errors = append(report.Errors, ImportIssue{Line: line, Reference: row.reference, Error: text})
+		}
+
+		if row.reference == "" || len(row.reference) > 100 {
+			issue("reference must have 1 to 100 characters")
+			continue
+		}
+		if len(row.description) > 200 {
+			issue("description can not be longer than 200 characters")
+			continue
+		}
+		if row.date, err = time.ParseInLocation(mapping.DateFormat, field(record, dateColumn), time.Local); err != nil {
+			issue(fmt.Sprintf("date must be in %s format", mapping.DateFormat))
+			continue
+		}
+		if row.date.After(time.Now()) {
+			issue("date can not be in the future")
+			continue
+		}
+		if row.value, err = ParseAmount(field(record, amountColumn), currency); err != nil || row.value == 0 {
+			issue("amount must be a non-zero decimal in the currency of the Saving")
+			continue
+		}
+
+		// With a type column the amount is absolute, without one its sign
+		// is the type.
+		row.kind = strings.ToUpper(field(record, typeColumn))
+		switch {
+		case row.kind == "" && row.value > 0:
+			row.kind = TypeDeposit
+		case row.kind == "":
+			row.kind = TypeWithdrawal
+		case row.kind == TypeDeposit:
+			row.value = abs(row.value)
+		case row.kind == TypeWithdrawal:
+			row.value = -abs(row.value)
+		default:
+			issue("type must be DEPOSIT or WITHDRAWAL")
+			continue
+		}
+		if row.kind == TypeDeposit && !deposits {
+			issue("only admins can import DEPOSIT rows")
+			continue
+		}
+
+		rows = append(rows, row)
+	}
+}
+
+// ImportTransactions validates the DEPOSITs and WITHDRAWALs of a CSV and,
+// when commit is set and the report is OK, posts them at their dates, all in
+// one DB transaction. Rows whose reference was already imported, or appears
+// earlier in the file, are skipped. Only admins can import DEPOSITs, as they
+// add money to the Saving.
+//
+// Rows are posted like any other Transaction, so the goal lock, the Limits
+// and the approvals apply to them. Imported Transactions are history, so they
+// pay no fees. Rows dated in a month whose interest or Statement is already
+// posted are refused.
+func (s *Saving) ImportTransactions(r io.Reader, mapping ImportMapping, commit, admin bool) (*ImportReport, error) {
+	if s.IsTimeDeposit() {
+		return nil, ErrTimeDepositLocked
+	}
+
+	mapping = mapping.withDefaults()
+	report := ImportReport{Total: NewMoney(0, s.Currency)}
+	rows, err := parseImport(r, mapping, s.Currency, admin, &report)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db().Transaction(func(tx *gorm.DB) error {
+		saving, err := lockSaving(tx, s.ID)
+		if err != nil {
+			return err
+		}
+
+		rows, err = dedupeImport(tx, saving.ID, rows, &report)
+		if err != nil {
+			return err
+		}
+		rows, err = checkImportPeriods(tx, saving.ID, rows, &report)
+		if err != nil {
+			return err
+		}
+		report.Valid = len(rows)
+		for _, row := range rows {
+			if report.Total, err = report.Total.Add(NewMoney(row.value, saving.Currency)); err != nil {
+				return err
+			}
+		}
+
+		if err := checkImportBalance(tx, saving, rows, &report); err != nil {
+			return err
+		}
+		// A dry run posts the rows too, to report the ones the rules refuse,
+		// and is rolled back. So is an import with any bad row.
+		sort.SliceStable(rows, func(i, j int) bool {
+			return rows[i].date.Before(rows[j].date)
+		})
+		for _, row := range rows {
+			reference := row.reference
+			transaction := Transaction{
+				SavingID:    saving.ID,
+				Type:        row.kind,
+				Value:       row.value,
+				Currency:    saving.Currency,
+				Description: row.description,
+				ExternalRef: &reference,
+			}
+			transaction.CreatedAt = row.date
+			if err := postWithFees(tx, &transaction, ""); err != nil {
+				if !isRuleError(err) {
+					return err
+				}
+				report.Errors = append(report.Errors, ImportIssue{Line: row.line, Reference: row.reference, Error: err.Error()})
+			}
+		}
+
+		if !commit {
+			return errImportDryRun
+		}
+		if !report.OK() {
+			return ErrImportInvalid
+		}
+		report.Committed = true
+		return auditTx(tx, AuditImportCommitted, "saving", saving.ID, nil, report)
+	})
+	if err != nil && err != errImportDryRun {
+		if err == ErrImportInvalid {
+			return &report, err
+		}
+		return nil, err
+	}
+	return &report, nil
+}
+
+// isRuleError reports whether err is the refusal of a Transaction by a rule
+// of its Saving, rather than a failure.
+func isRuleError(err error) bool {
+	var limitErr *LimitError
+	switch {
+	case errors.As(err, &limitErr):
+		return true
+	case err == ErrGoalLocked, err == ErrApprovalRequired, err == ErrTimeDepositLocked,
+		err == ErrInsufficientBalance, err == ErrInsufficientAvailableBalance:
+		return true
+	}
+	return false
+}
+
+// checkImportPeriods removes the rows dated before the end of the last month
+// whose interest is capitalised or whose Statement is stored, as those are
+// closed, and reports them.
+func checkImportPeriods(tx *gorm.DB, savingID uint, rows []importRow, report *ImportReport) ([]importRow, error) {
+	var periods []string
+	for _, model := range []interface{}{&InterestPosting{}, &StoredStatement{}} {
+		var last []string
+		err := tx.Model(model).
+			Where("saving_id = ?", savingID).
+			Order("period DESC").
+			Limit(1).
+			Pluck("period", &last).
+			Error
+		if err != nil {
+			return nil, err
+		}
+		periods = append(periods, last...)
+	}
+
+	closed := ""
+	for _, period := range periods {
+		if period > closed {
+			closed = period
+		}
+	}
+	if closed == "" {
+		return rows, nil
+	}
+	start, err := time.ParseInLocation("2006-01", closed, time.Local)
+	if err != nil {
+		return nil, err
+	}
+	open := start.AddDate(0, 1, 0)
+
+	var results []importRow
+	for _, row := range rows {
+		if row.date.Before(open) {
+			report.Errors = append(report.Errors, ImportIssue{
+				Line:      row.line,
+				Reference: row.reference,
+				Error:     fmt.Sprintf("date must be after %s, whose interest or statement is already posted", closed),
+			})
+			continue
+		}
+		results = append(results, row)
+	}
+	return results, nil
+}
+
+// dedupeImport removes the rows whose reference is already imported to the
+// Saving or repeated in the file, and reports them as duplicates.
+func dedupeImport(tx *gorm.DB, savingID uint, rows []importRow, report *ImportReport) ([]importRow, error) {
+	var references []string
+	for _, row := range rows {
+		references = append(references, row.reference)
+	}
+
+	var existing []string
+	if len(references) > 0 {
+		err := tx.Model(&Transaction{}).
+			Where("saving_id = ? AND external_ref IN ?", savingID, references).
+			Pluck("external_ref", &existing).
+			Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, reference := range existing {
+		seen[reference] = true
+	}
+
+	var results []importRow
+	for _, row := range rows {
+		if seen[row.reference] {
+			report.Duplicates = append(report.Duplicates, ImportIssue{
+				Line:      row.line,
+				Reference: row.reference,
+				Error:     "reference is already imported",
+			})
+			continue
+		}
+		seen[row.reference] = true
+		results = append(results, row)
+	}
+	return results, nil
+}
+
+// checkImportBalance replays the Transactions of the Saving with the rows in
+// date order and reports the first time the available balance would go below
+// 0. Active Holds count from the time they were placed. Rows are placed after
+// the Transactions of the same time.
+func checkImportBalance(tx *gorm.DB, saving *Saving, rows []importRow, report *ImportReport) error {
+	var existing []Transaction
+	err := tx.Select("created_at", "value").
+		Where("saving_id = ?", saving.ID).
+		Order("created_at, id").
+		Find(&existing).
+		Error
+	if err != nil {
+		return err
+	}
+
+	var holds []Hold
+	err = tx.Select("created_at", "amount").
+		Where("saving_id = ? AND status = ? AND expires_at > ?", saving.ID, HoldActive, time.Now()).
+		Order("created_at").
+		Find(&holds).
+		Error
+	if err != nil {
+		return err
+	}
+
+	type event struct {
+		at    time.Time
+		value int64
+		line  int
+	}
+	events := make([]event, 0, len(existing)+len(rows))
+	for _, t := range existing {
+		events = append(events, event{t.CreatedAt, t.Value, 0})
+	}
+	for _, row := range rows {
+		events = append(events, event{row.date, row.value, row.line})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].at.Before(events[j].at)
+	})
+
+	var balance, held int64
+	next := 0
+	for _, e := range events {
+		for ; next < len(holds) && !holds[next].CreatedAt.After(e.at); next++ {
+			held += holds[next].Amount
+		}
+		balance += e.value
+		if balance-held < 0 {
+			report.NegativeBalance = &ImportIssue{
+				Line: e.line,
+				Error: fmt.Sprintf("available balance would be %s on %s",
+					NewMoney(balance-held, saving.Currency), e.at.Format("2006-01-02")),
+			}
+			return nil
+		}
+	}
+
+	// Holds placed after the last row still need the balance now.
+	for ; next < len(holds); next++ {
+		held += holds[next].Amount
+	}
+	if balance-held < 0 {
+		report.NegativeBalance = &ImportIssue{
+			Error: fmt.Sprintf("available balance would be %s", NewMoney(balance-held, saving.Currency)),
+		}
+	}
+	return nil
+}
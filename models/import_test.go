@@ -0,0 +1,158 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportTransactions(t *testing.T) {
+	csv := func(rows ...string) *strings.Reader {
+		return strings.NewReader("date,amount,reference,description\n" + strings.Join(rows, "\n") + "\n")
+	}
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, saving *Saving)
+		rows  []string
+		admin bool
+		// errors is the number of bad rows, negative whether the available
+		// balance goes below 0.
+		errors   int
+		negative bool
+		balance  int64
+	}{
+		{
+			name:    "withdrawals",
+			rows:    []string{"2025-02-01,-300,a,Rent", "2025-02-02,-200,b,Food"},
+			balance: 500,
+		},
+		{
+			name:    "deposits by an admin",
+			rows:    []string{"2025-02-01,300,a,Salary"},
+			admin:   true,
+			balance: 1300,
+		},
+		{
+			name:    "deposits by an owner",
+			rows:    []string{"2025-02-01,300,a,Salary", "2025-02-01,-100,b,Food"},
+			errors:  1,
+			balance: 1000,
+		},
+		{
+			name:     "negative balance in the past",
+			rows:     []string{"2024-12-01,-100,a,Before the deposit"},
+			negative: true,
+			balance:  1000,
+		},
+		{
+			name:     "held balance",
+			setup:    holdAmount(900),
+			rows:     []string{"2025-02-01,-200,a,Food"},
+			errors:   1,
+			negative: true,
+			balance:  1000,
+		},
+		{
+			name: "month with capitalised interest",
+			setup: func(t *testing.T, saving *Saving) {
+				posting := InterestPosting{SavingID: saving.ID, Period: "2025-02"}
+				if err := database.DB.Create(&posting).Error; err != nil {
+					t.Fatal(err)
+				}
+			},
+			rows:    []string{"2025-02-28,-100,a,Closed", "2025-03-01,-100,b,Open"},
+			errors:  1,
+			balance: 1000,
+		},
+		{
+			name: "month with a stored statement",
+			setup: func(t *testing.T, saving *Saving) {
+				statement := StoredStatement{SavingID: saving.ID, Period: "2025-03", Currency: "IDR", PDF: []byte{}, CSV: []byte{}}
+				if err := database.DB.Create(&statement).Error; err != nil {
+					t.Fatal(err)
+				}
+			},
+			rows:    []string{"2025-03-31,-100,a,Closed"},
+			errors:  1,
+			balance: 1000,
+		},
+		{
+			name:    "goal lock",
+			setup:   setGoal(5000, nil),
+			rows:    []string{"2025-02-01,-100,a,Locked"},
+			errors:  1,
+			balance: 1000,
+		},
+		{
+			name:    "limit",
+			setup:   setLimit(ScopeSaving, TypeWithdrawal, Limit{PerTransaction: 50}),
+			rows:    []string{"2025-02-01,-100,a,Too much"},
+			errors:  1,
+			balance: 1000,
+		},
+		{
+			name:    "approval",
+			setup:   addOwner(50),
+			rows:    []string{"2025-02-01,-100,a,Too much"},
+			errors:  1,
+			balance: 1000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDB(t)
+			saving := newSaving(t, 1000, time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local))
+			if tt.setup != nil {
+				tt.setup(t, saving)
+			}
+
+			// The dry run reports the same errors, and changes nothing.
+			for _, commit := range []bool{false, true} {
+				report, err := saving.ImportTransactions(csv(tt.rows...), ImportMapping{}, commit, tt.admin)
+				if report == nil {
+					t.Fatalf("ImportTransactions(%v) err = %v", commit, err)
+				}
+				ok := tt.errors == 0 && !tt.negative
+				if report.OK() != ok || (err == nil) != (ok || !commit) || report.Committed != (ok && commit) {
+					t.Errorf("ImportTransactions(%v) err = %v, committed %v", commit, err, report.Committed)
+				}
+				if len(report.Errors) != tt.errors {
+					t.Errorf("ImportTransactions(%v) errors = %v, want %d", commit, report.Errors, tt.errors)
+				}
+				if (report.NegativeBalance != nil) != tt.negative {
+					t.Errorf("ImportTransactions(%v) negative balance = %v, want %v", commit, report.NegativeBalance, tt.negative)
+				}
+			}
+			if got := reload(t, saving).Balance; got != tt.balance {
+				t.Errorf("balance = %d, want %d", got, tt.balance)
+			}
+		})
+	}
+}
+
+func TestImportTransactionsDuplicates(t *testing.T) {
+	setupDB(t)
+	saving := newSaving(t, 1000, time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local))
+	file := "date,amount,reference\n2025-02-01,-100,a\n2025-02-02,-100,a\n"
+
+	report, err := saving.ImportTransactions(strings.NewReader(file), ImportMapping{}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid != 1 || len(report.Duplicates) != 1 {
+		t.Errorf("first import = %d valid, %d duplicates, want 1 and 1", report.Valid, len(report.Duplicates))
+	}
+
+	report, err = saving.ImportTransactions(strings.NewReader(file), ImportMapping{}, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Valid != 0 || len(report.Duplicates) != 2 {
+		t.Errorf("second import = %d valid, %d duplicates, want 0 and 2", report.Valid, len(report.Duplicates))
+	}
+	if got := reload(t, saving).Balance; got != 900 {
+		t.Errorf("balance = %d, want 900", got)
+	}
+}
@@ -0,0 +1,440 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"b-pay/config/logger"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Day count conventions.
+const (
+	DayCountACT365 = "ACT/365"
+	DayCount30360  = "30/360"
+)
+
+// Interest Transaction types.
+const (
+	TypeInterest = "INTEREST"
+	TypeTax      = "TAX"
+)
+
+// microUnits is the scale of accrued interest. Accruals are stored in
+// millionths of the balance unit so that daily rounding does not lose money.
+const microUnits = 1000000
+
+// bpsUnits is 100% in basis points.
+const bpsUnits = 10000
+
+// ErrInvalidProduct is returned when an InterestProduct is not valid.
+var ErrInvalidProduct = errors.New("invalid interest product")
+
+// InterestProduct defines how a Saving earns interest. Rates are in basis
+// points per year, 250 is 2.5%.
+type InterestProduct struct {
+	gorm.Model
+	Name string `gorm:"size:100;not null"`
+	// Currency is the currency of the Savings which can earn it, and of the
+	// MinBalance of its Tiers.
+	Currency      string `gorm:"size:3;not null;default:IDR"` // ISO 4217
+	AnnualRateBps int64  `gorm:"not null"`
+	DayCount      string `gorm:"size:7;not null"` // ACT/365 or 30/360
+	// WithholdingTaxBps is taken from every capitalised interest. Optional.
+	WithholdingTaxBps int64 `gorm:"not null;default:0"`
+	// Tiers replace AnnualRateBps by balance band. Optional.
+	Tiers []InterestTier `gorm:"foreignKey:ProductID"`
+}
+
+// InterestTier is the rate of the part of the balance from MinBalance up to
+// the MinBalance of the next tier. MinBalance is in the currency of the
+// InterestProduct.
+type InterestTier struct {
+	gorm.Model
+	ProductID  uint  `gorm:"not null;index"`
+	MinBalance int64 `gorm:"not null"`
+	RateBps    int64 `gorm:"not null"`
+}
+
+// InterestAccrual is the interest earned by a Saving on one day. Accruing the
+// same day again overwrites it.
+type InterestAccrual struct {
+	gorm.Model
+	SavingID uint      `gorm:"not null;uniqueIndex:idx_accrual_day"`
+	Date     time.Time `gorm:"type:date;not null;uniqueIndex:idx_accrual_day"`
+	Balance  int64     `gorm:"not null"`
+	// Amount is in micro units, see microUnits.
+	Amount int64 `gorm:"not null"`
+}
+
+// InterestPosting is the monthly capitalisation of a Saving. One per month,
+// so a month is never posted twice.
+type InterestPosting struct {
+	gorm.Model
+	SavingID uint   `gorm:"not null;uniqueIndex:idx_posting_period"`
+	Period   string `gorm:"size:7;not null;uniqueIndex:idx_posting_period"` // YYYY-MM
+	// Accrued is the sum of the month accruals plus the carry of the previous
+	// month, in micro units.
+	Accrued int64 `gorm:"not null"`
+	// Carry is the part of Accrued below 1 unit, carried to the next month.
+	Carry                 int64 `gorm:"not null"`
+	Interest              int64 `gorm:"not null"`
+	Tax                   int64 `gorm:"not null"`
+	InterestTransactionID *uint
+	TaxTransactionID      *uint
+}
+
+// Validate checks the currency, the rates and the day count of the
+// InterestProduct.
+func (p *InterestProduct) Validate() error {
+	if !ValidCurrency(p.Currency) {
+		return ErrUnknownCurrency
+	}
+	if p.DayCount != DayCountACT365 && p.DayCount != DayCount30360 {
+		return ErrInvalidProduct
+	}
+	if p.AnnualRateBps < 0 || p.WithholdingTaxBps < 0 || p.WithholdingTaxBps > bpsUnits {
+		return ErrInvalidProduct
+	}
+	for _, tier := range p.Tiers {
+		if tier.MinBalance < 0 || tier.RateBps < 0 {
+			return ErrInvalidProduct
+		}
+	}
+	return nil
+}
+
+// Store stores the InterestProduct with its tiers. A product without currency
+// is in the DefaultCurrency.
+func (p *InterestProduct) Store() error {
+	if p.Currency == "" {
+		p.Currency = DefaultCurrency
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	return database.DB.Create(&p).Error
+}
+
+// GetInterestProducts gets/fetches every InterestProduct with its tiers.
+func (p *InterestProduct) GetInterestProducts() (*[]InterestProduct, error) {
+	var results []InterestProduct
+	err := database.DB.Preload("Tiers").Order("id").Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// GetInterestProductByID gets/fetches an InterestProduct with its tiers.
+func (p *InterestProduct) GetInterestProductByID(id string) *InterestProduct {
+	var result InterestProduct
+	err := database.DB.Preload("Tiers").Where("id = ?", id).First(&result).Error
+	if err != nil {
+		return nil
+	}
+	return &result
+}
+
+// checkProductCurrency rejects a Saving which earns the interest of a product
+// in another currency, within tx.
+func checkProductCurrency(tx *gorm.DB, saving *Saving) error {
+	if saving.InterestProductID == nil {
+		return nil
+	}
+	var product InterestProduct
+	if err := tx.Select("currency").First(&product, *saving.InterestProductID).Error; err != nil {
+		return err
+	}
+	if product.Currency != saving.Currency {
+		return ErrCurrencyMismatch
+	}
+	return nil
+}
+
+// yearlyInterest returns balance times the yearly rate, in basis point units.
+// With tiers, each band of the balance earns its own rate.
+func (p *InterestProduct) yearlyInterest(balance int64) *big.Int {
+	total := new(big.Int)
+	if balance <= 0 {
+		return total
+	}
+	if len(p.Tiers) == 0 {
+		return total.Mul(big.NewInt(balance), big.NewInt(p.AnnualRateBps))
+	}
+
+	tiers := make([]InterestTier, len(p.Tiers))
+	copy(tiers, p.Tiers)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinBalance < tiers[j].MinBalance })
+
+	for i, tier := range tiers {
+		if balance <= tier.MinBalance {
+			break
+		}
+		upper := balance
+		if i+1 < len(tiers) && tiers[i+1].MinBalance < balance {
+			upper = tiers[i+1].MinBalance
+		}
+		band := new(big.Int).Mul(big.NewInt(upper-tier.MinBalance), big.NewInt(tier.RateBps))
+		total.Add(total, band)
+	}
+	return total
+}
+
+// dayWeight returns the number of days the date counts for, and the number of
+// days in a year, according to the day count convention.
+//
+// 30/360 counts every month as 30 days: the 31st counts for nothing and the
+// last day of February counts for the missing days.
+func (p *InterestProduct) dayWeight(date time.Time) (int64, int64) {
+	if p.DayCount == DayCountACT365 {
+		return 1, 365
+	}
+	switch {
+	case date.Day() == 31:
+		return 0, 360
+	case date.Month() == time.February && date.Day() == lastDayOfMonth(date):
+		return int64(30 - date.Day() + 1), 360
+	default:
+		return 1, 360
+	}
+}
+
+// DailyInterest returns the interest earned by balance on date, in micro
+// units. Always rounds down.
+func (p *InterestProduct) DailyInterest(balance int64, date time.Time) int64 {
+	weight, yearDays := p.dayWeight(date)
+	amount := p.yearlyInterest(balance)
+	amount.Mul(amount, big.NewInt(weight*microUnits))
+	amount.Quo(amount, big.NewInt(bpsUnits*yearDays))
+	return amount.Int64()
+}
+
+// startOfDay returns date at 00:00 in its location.
+func startOfDay(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+}
+
+// balanceAt returns the balance of a Saving at the end of date, from its
+// Transactions. It does not depend on when it is called.
+func balanceAt(tx *gorm.DB, savingID uint, date time.Time) (int64, error) {
+	var total int64
+	err := tx.Model(&Transaction{}).
+		Select("COALESCE(SUM(value), 0)").
+		Where("saving_id = ? AND created_at < ?", savingID, startOfDay(date).AddDate(0, 0, 1)).
+		Scan(&total).
+		Error
+	return total, err
+}
+
+// savingsWithProduct gets/fetches every Saving which earns interest.
+func savingsWithProduct() ([]Saving, error) {
+	var results []Saving
+	err := database.DB.Where("interest_product_id IS NOT NULL").Order("id").Find(&results).Error
+	return results, err
+}
+
+// productCache keeps the InterestProducts used by one engine run.
+type productCache map[uint]*InterestProduct
+
+func (c productCache) get(id uint) *InterestProduct {
+	if product, ok := c[id]; ok {
+		return product
+	}
+	var p InterestProduct
+	product := p.GetInterestProductByID(fmt.Sprint(id))
+	c[id] = product
+	return product
+}
+
+// AccrueInterest accrues one day of interest for every Saving with an
+// InterestProduct. The balance is the balance at the end of date. Running it
+// again for the same date gives the same result. A Saving which fails is
+// logged and skipped.
+func AccrueInterest(date time.Time) error {
+	date = startOfDay(date)
+	savings, err := savingsWithProduct()
+	if err != nil {
+		return err
+	}
+
+	products := productCache{}
+	for _, saving := range savings {
+		product := products.get(*saving.InterestProductID)
+		if product == nil || product.Currency != saving.Currency {
+			continue
+		}
+		if err := accrue(saving.ID, product, date); err != nil {
+			logger.Log.Error("interest accrual failed", zap.Uint("saving_id", saving.ID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// AccrueInterestUntil accrues every day from the day after the last accrual
+// of each Saving up to until, so the days missed while the engine did not run
+// are not lost. A Saving without accruals starts at until. A Saving which
+// fails is logged and skipped.
+func AccrueInterestUntil(until time.Time) error {
+	until = startOfDay(until)
+	savings, err := savingsWithProduct()
+	if err != nil {
+		return err
+	}
+
+	products := productCache{}
+	for _, saving := range savings {
+		product := products.get(*saving.InterestProductID)
+		if product == nil || product.Currency != saving.Currency {
+			continue
+		}
+
+		date := until
+		var last InterestAccrual
+		err := database.DB.Where("saving_id = ?", saving.ID).Order("date DESC").First(&last).Error
+		if err == nil {
+			date = time.Date(last.Date.Year(), last.Date.Month(), last.Date.Day(), 0, 0, 0, 0, until.Location()).AddDate(0, 0, 1)
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			logger.Log.Error("interest accrual failed", zap.Uint("saving_id", saving.ID), zap.Error(err))
+			continue
+		}
+
+		for ; !date.After(until); date = date.AddDate(0, 0, 1) {
+			if err := accrue(saving.ID, product, date); err != nil {
+				logger.Log.Error("interest accrual failed", zap.Uint("saving_id", saving.ID), zap.Error(err))
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// accrue stores one day of interest of one Saving.
+func accrue(savingID uint, product *InterestProduct, date time.Time) error {
+	balance, err := balanceAt(database.DB, savingID, date)
+	if err != nil {
+		return err
+	}
+
+	accrual := InterestAccrual{
+		SavingID: savingID,
+		Date:     date,
+		Balance:  balance,
+		Amount:   product.DailyInterest(balance, date),
+	}
+	return database.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "saving_id"}, {Name: "date"}},
+		DoUpdates: clause.AssignmentColumns([]string{"balance", "amount", "updated_at"}),
+	}).Create(&accrual).Error
+}
+
+// CapitaliseInterest posts the interest accrued in the month of date for every
+// Saving with an InterestProduct, as an INTEREST Transaction, and the
+// withholding tax as a separate TAX Transaction. A month already posted is
+// skipped. A Saving which fails is logged and skipped, and is posted by the
+// next run.
+func CapitaliseInterest(date time.Time) error {
+	savings, err := savingsWithProduct()
+	if err != nil {
+		return err
+	}
+
+	products := productCache{}
+	for _, saving := range savings {
+		product := products.get(*saving.InterestProductID)
+		if product == nil || product.Currency != saving.Currency {
+			continue
+		}
+		if err := capitalise(saving.ID, product, date); err != nil {
+			logger.Log.Error("interest capitalisation failed", zap.Uint("saving_id", saving.ID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// capitalise posts one month of interest of one Saving.
+func capitalise(savingID uint, product *InterestProduct, date time.Time) error {
+	start := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, date.Location())
+	end := start.AddDate(0, 1, 0)
+	period := start.Format("2006-01")
+	previous := start.AddDate(0, -1, 0).Format("2006-01")
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockSaving(tx, savingID); err != nil {
+			return err
+		}
+
+		var posted int64
+		err := tx.Model(&InterestPosting{}).
+			Where("saving_id = ? AND period = ?", savingID, period).
+			Count(&posted).
+			Error
+		if err != nil || posted > 0 {
+			return err
+		}
+
+		var accrued int64
+		err = tx.Model(&InterestAccrual{}).
+			Select("COALESCE(SUM(amount), 0)").
+			Where("saving_id = ? AND date >= ? AND date < ?", savingID, start, end).
+			Scan(&accrued).
+			Error
+		if err != nil {
+			return err
+		}
+
+		var carry int64
+		err = tx.Model(&InterestPosting{}).
+			Select("COALESCE(SUM(carry), 0)").
+			Where("saving_id = ? AND period = ?", savingID, previous).
+			Scan(&carry).
+			Error
+		if err != nil {
+			return err
+		}
+
+		posting := InterestPosting{
+			SavingID: savingID,
+			Period:   period,
+			Accrued:  accrued + carry,
+		}
+		posting.Interest = posting.Accrued / microUnits
+		posting.Carry = posting.Accrued % microUnits
+		posting.Tax = posting.Interest * product.WithholdingTaxBps / bpsUnits
+
+		if posting.Interest > 0 {
+			interest := Transaction{
+				SavingID:    savingID,
+				Type:        TypeInterest,
+				Value:       posting.Interest,
+				Description: fmt.Sprintf("Interest %s", period),
+			}
+			if err := post(tx, &interest); err != nil {
+				return err
+			}
+			posting.InterestTransactionID = &interest.ID
+		}
+
+		if posting.Tax > 0 {
+			tax := Transaction{
+				SavingID:    savingID,
+				Type:        TypeTax,
+				Value:       -posting.Tax,
+				Description: fmt.Sprintf("Withholding tax on interest %s", period),
+				withheld:    true,
+			}
+			if err := post(tx, &tax); err != nil {
+				return err
+			}
+			posting.TaxTransactionID = &tax.ID
+		}
+
+		return tx.Create(&posting).Error
+	})
+}
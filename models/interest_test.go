@@ -0,0 +1,238 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDailyInterest(t *testing.T) {
+	tiered := InterestProduct{
+		AnnualRateBps: 9999,
+		DayCount:      DayCountACT365,
+		Tiers: []InterestTier{
+			{MinBalance: 1000000, RateBps: 7300},
+			{MinBalance: 0, RateBps: 3650},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		product InterestProduct
+		balance int64
+		date    time.Time
+		want    int64
+	}{
+		{"act/365", InterestProduct{AnnualRateBps: 3650, DayCount: DayCountACT365}, 1000000, day(2026, 3, 31), 1000 * microUnits},
+		{"rounds down", InterestProduct{AnnualRateBps: 1, DayCount: DayCountACT365}, 1, day(2026, 3, 1), 0},
+		{"keeps micro units", InterestProduct{AnnualRateBps: 3650, DayCount: DayCountACT365}, 1000001, day(2026, 3, 1), 1000001000},
+		{"no interest on a negative balance", InterestProduct{AnnualRateBps: 3650, DayCount: DayCountACT365}, -1000, day(2026, 3, 1), 0},
+		{"30/360", InterestProduct{AnnualRateBps: 3600, DayCount: DayCount30360}, 1000000, day(2026, 3, 30), 1000 * microUnits},
+		{"30/360 on the 31st", InterestProduct{AnnualRateBps: 3600, DayCount: DayCount30360}, 1000000, day(2026, 3, 31), 0},
+		{"30/360 on the last day of February", InterestProduct{AnnualRateBps: 3600, DayCount: DayCount30360}, 1000000, day(2026, 2, 28), 3000 * microUnits},
+		{"30/360 on a leap February", InterestProduct{AnnualRateBps: 3600, DayCount: DayCount30360}, 1000000, day(2028, 2, 29), 2000 * microUnits},
+		{"tiers below the first band", tiered, 500000, day(2026, 3, 1), 500 * microUnits},
+		{"tiers across bands", tiered, 1500000, day(2026, 3, 1), 2000 * microUnits},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.product.DailyInterest(tt.balance, tt.date); got != tt.want {
+				t.Errorf("DailyInterest(%d) = %d, want %d", tt.balance, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccrueInterestUntil(t *testing.T) {
+	setupDB(t)
+	product := newProduct(t, 3650, 0)
+	saving := newSaving(t, 1000000, day(2026, 3, 1))
+	setProduct(t, saving, product)
+
+	// A Saving without accruals only accrues the last day.
+	if err := AccrueInterestUntil(day(2026, 3, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if got := countAccruals(t, saving); got != 1 {
+		t.Fatalf("accruals = %d, want 1", got)
+	}
+
+	// The days missed since the last accrual are back-filled.
+	deposit(t, saving, 1000000, day(2026, 3, 4))
+	if err := AccrueInterestUntil(day(2026, 3, 5)); err != nil {
+		t.Fatal(err)
+	}
+	var accruals []InterestAccrual
+	if err := database.DB.Where("saving_id = ?", saving.ID).Order("date").Find(&accruals).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{1000000, 1000000, 2000000, 2000000}
+	if len(accruals) != len(want) {
+		t.Fatalf("accruals = %d, want %d", len(accruals), len(want))
+	}
+	for i, accrual := range accruals {
+		if accrual.Balance != want[i] {
+			t.Errorf("accrual %d balance = %d, want %d", i, accrual.Balance, want[i])
+		}
+		if accrual.Amount != want[i]/1000*microUnits {
+			t.Errorf("accrual %d amount = %d, want %d", i, accrual.Amount, want[i]/1000*microUnits)
+		}
+	}
+
+	// Running again accrues nothing twice.
+	if err := AccrueInterestUntil(day(2026, 3, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if got := countAccruals(t, saving); got != 4 {
+		t.Errorf("accruals = %d, want 4", got)
+	}
+}
+
+func TestCapitaliseInterest(t *testing.T) {
+	setupDB(t)
+	product := newProduct(t, 3650, 2000)
+	saving := newSaving(t, 1000001, day(2026, 3, 1))
+	setProduct(t, saving, product)
+	accrueMonth(t, 2026, 3)
+
+	if err := CapitaliseInterest(day(2026, 3, 15)); err != nil {
+		t.Fatal(err)
+	}
+
+	var posting InterestPosting
+	if err := database.DB.Where("saving_id = ? AND period = ?", saving.ID, "2026-03").First(&posting).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 31 days of 1000.001 a day.
+	if posting.Interest != 31000 || posting.Carry != 31000 || posting.Tax != 6200 {
+		t.Errorf("posting = %d interest, %d carry, %d tax, want 31000, 31000, 6200",
+			posting.Interest, posting.Carry, posting.Tax)
+	}
+	if got := reload(t, saving).Balance; got != 1000001+31000-6200 {
+		t.Errorf("balance = %d, want %d", got, 1000001+31000-6200)
+	}
+
+	// A month is never posted twice.
+	if err := CapitaliseInterest(day(2026, 3, 31)); err != nil {
+		t.Fatal(err)
+	}
+	if got := reload(t, saving).Balance; got != 1000001+31000-6200 {
+		t.Errorf("balance after a second run = %d, want %d", got, 1000001+31000-6200)
+	}
+
+	// The carry goes to the next month.
+	accrueMonth(t, 2026, 4)
+	if err := CapitaliseInterest(day(2026, 4, 1)); err != nil {
+		t.Fatal(err)
+	}
+	var april InterestPosting
+	if err := database.DB.Where("saving_id = ? AND period = ?", saving.ID, "2026-04").First(&april).Error; err != nil {
+		t.Fatal(err)
+	}
+	// The postings are made after April, so April accrues on 1000001.
+	if april.Accrued != 30*1000001000+31000 {
+		t.Errorf("april accrued = %d, want %d", april.Accrued, 30*1000001000+31000)
+	}
+}
+
+func TestCapitaliseInterestTaxOnHeldBalance(t *testing.T) {
+	setupDB(t)
+	product := newProduct(t, 3650, 2000)
+	saving := newSaving(t, 1000000, day(2026, 3, 1))
+	setProduct(t, saving, product)
+	accrueMonth(t, 2026, 3)
+
+	// Everything, the interest included, is held.
+	hold := Hold{
+		SavingID:  saving.ID,
+		Amount:    1031000,
+		Reference: "card",
+		Status:    HoldActive,
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+	if err := database.DB.Create(&hold).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CapitaliseInterest(day(2026, 3, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := reload(t, saving).Balance; got != 1000000+31000-6200 {
+		t.Errorf("balance = %d, want %d", got, 1000000+31000-6200)
+	}
+}
+
+func TestCapitaliseInterestSkipsFailingSaving(t *testing.T) {
+	setupDB(t)
+	product := newProduct(t, 3650, 0)
+	failing := newSaving(t, 1000000, day(2026, 3, 1))
+	setProduct(t, failing, product)
+	saving := newSaving(t, 1000000, day(2026, 3, 1))
+	setProduct(t, saving, product)
+	accrueMonth(t, 2026, 3)
+
+	// The interest of the first Saving overflows its balance.
+	if err := database.DB.Model(failing).Update("balance", int64(math.MaxInt64)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CapitaliseInterest(day(2026, 3, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := reload(t, saving).Balance; got != 1031000 {
+		t.Errorf("balance = %d, want 1031000", got)
+	}
+	if got := reload(t, failing).Balance; got != math.MaxInt64 {
+		t.Errorf("failing balance = %d, want it unchanged", got)
+	}
+}
+
+// day returns the start of a day in UTC.
+func day(year int, month time.Month, d int) time.Time {
+	return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+// newProduct stores an ACT/365 InterestProduct.
+func newProduct(t *testing.T, rateBps, taxBps int64) *InterestProduct {
+	t.Helper()
+	product := InterestProduct{
+		Name:              "Test",
+		AnnualRateBps:     rateBps,
+		DayCount:          DayCountACT365,
+		WithholdingTaxBps: taxBps,
+	}
+	if err := product.Store(); err != nil {
+		t.Fatal(err)
+	}
+	return &product
+}
+
+// setProduct makes saving earn the interest of product.
+func setProduct(t *testing.T, saving *Saving, product *InterestProduct) {
+	t.Helper()
+	if err := database.DB.Model(saving).Update("interest_product_id", product.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// accrueMonth accrues every day of a month.
+func accrueMonth(t *testing.T, year int, month time.Month) {
+	t.Helper()
+	if err := AccrueInterest(day(year, month, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := AccrueInterestUntil(day(year, month+1, 1).AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countAccruals counts the InterestAccruals of saving.
+func countAccruals(t *testing.T, saving *Saving) int64 {
+	t.Helper()
+	var count int64
+	if err := database.DB.Model(&InterestAccrual{}).Where("saving_id = ?", saving.ID).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
@@ -0,0 +1,222 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Post stores the Transaction and applies its Value to the balance of its
+// Saving, in one DB transaction with its audit entry.
+func (t *Transaction) Post() error {
+	return t.db().Transaction(func(tx *gorm.DB) error {
+		if err := post(tx, t); err != nil {
+			return err
+		}
+		return auditTx(tx, AuditTransactionCreated, "transaction", t.ID, nil, t)
+	})
+}
+
+// lockSaving gets the Saving with id within tx and locks its row until tx
+// ends.
+func lockSaving(tx *gorm.DB, id uint) (*Saving, error) {
+	var saving Saving
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ?", id).
+		First(&saving).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &saving, nil
+}
+
+// lockSavings locks the rows of every Saving in ids. Rows are always locked in
+// ascending ID order so that concurrent transfers can not deadlock.
+func lockSavings(tx *gorm.DB, ids ...uint) error {
+	var savings []Saving
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id IN ?", ids).
+		Order("id").
+		Find(&savings).
+		Error
+}
+
+// post stores t and applies its Value to the balance of its Saving, within
+// tx. A negative Value can only use the available balance. The fees of its
+// type are charged with it.
+func post(tx *gorm.DB, t *Transaction) error {
+	return postWithFees(tx, t, feeOn(t.Type))
+}
+
+// postWithFees is post charging the fees on the operation on instead. Empty
+// on charges no fee and does not evaluate the Budgets, as imported rows are
+// not new spending.
+func postWithFees(tx *gorm.DB, t *Transaction, on string) error {
+	saving, err := lockSaving(tx, t.SavingID)
+	if err != nil {
+		return err
+	}
+
+	if !t.signMatches(saving) {
+		return ErrValueSign
+	}
+	if t.outgoing() && saving.goalLocked(time.Now()) {
+		return ErrGoalLocked
+	}
+	// Time deposits only move money through their own operations.
+	if saving.IsTimeDeposit() && (t.Type == TypeDeposit || t.Type == TypeWithdrawal) {
+		return ErrTimeDepositLocked
+	}
+	if err := checkLimits(tx, saving, t); err != nil {
+		return err
+	}
+	if err := checkApproval(tx, saving, t); err != nil {
+		return err
+	}
+
+	if err := apply(tx, saving, t); err != nil {
+		return err
+	}
+	if on == "" {
+		return nil
+	}
+	if err := chargeFees(tx, saving, t, on); err != nil {
+		return err
+	}
+	if t.Type != TypeWithdrawal {
+		return nil
+	}
+	return evaluateBudgets(tx, saving, t)
+}
+
+// signMatches reports whether the sign of the Value of t matches its type on
+// the locked saving. DEPOSIT and INTEREST are credits and WITHDRAWAL a debit.
+// FUNDING is a debit of the funding Saving and a credit of the time deposit.
+func (t *Transaction) signMatches(saving *Saving) bool {
+	switch t.Type {
+	case TypeDeposit, TypeInterest:
+		return t.Value >= 0
+	case TypeWithdrawal:
+		return t.Value <= 0
+	case TypeFunding:
+		if saving.IsTimeDeposit() {
+			return t.Value >= 0
+		}
+		return t.Value <= 0
+	default:
+		return true
+	}
+}
+
+// outgoing reports whether t takes money out of its Saving on behalf of a
+// member, as a WITHDRAWAL or the FUNDING of a time deposit. The goal lock,
+// the WITHDRAWAL limits and the approvals apply to it.
+func (t *Transaction) outgoing() bool {
+	return t.Value < 0 && (t.Type == TypeWithdrawal || t.Type == TypeFunding)
+}
+
+// checkApproval rejects money leaving the locked saving which needs the
+// approval of another owner, unless t has it.
+func checkApproval(tx *gorm.DB, saving *Saving, t *Transaction) error {
+	if t.approved || !t.outgoing() {
+		return nil
+	}
+	needs, err := needsApproval(tx, saving, -t.Value)
+	if err != nil {
+		return err
+	}
+	if needs {
+		return ErrApprovalRequired
+	}
+	return nil
+}
+
+// apply stores t and applies its Value to the balance of the locked saving,
+// within tx. Unlike post, it does not check the rules of the Saving. t takes
+// the currency of the Saving when it has none, and is refused when it has
+// another one.
+func apply(tx *gorm.DB, saving *Saving, t *Transaction) error {
+	if t.Currency == "" {
+		t.Currency = saving.Currency
+	}
+	balance, err := saving.Money().Add(t.Money())
+	if err != nil {
+		return err
+	}
+
+	newBalance := balance.Amount
+	if newBalance < 0 {
+		return ErrInsufficientBalance
+	}
+	if t.Value < 0 && !t.withheld {
+		available, err := availableBalance(tx, saving)
+		if err != nil {
+			return err
+		}
+		if available+t.Value < 0 {
+			return ErrInsufficientAvailableBalance
+		}
+	}
+
+	if err := categorize(tx, saving, t); err != nil {
+		return err
+	}
+	if err := tx.Create(t).Error; err != nil {
+		return err
+	}
+
+	return setBalance(tx, saving, newBalance)
+}
+
+// setBalance changes the Balance of a locked Saving within tx, writes the
+// saving.balance_changed event and records the goal milestones it reaches.
+func setBalance(tx *gorm.DB, saving *Saving, balance int64) error {
+	change := BalanceChange{
+		SavingID:   saving.ID,
+		Currency:   saving.Currency,
+		OldBalance: saving.Balance,
+		NewBalance: balance,
+	}
+	if err := tx.Model(saving).Update("balance", balance).Error; err != nil {
+		return err
+	}
+	if err := writeOutbox(tx, TopicBalanceChanged, "saving", saving.ID, change); err != nil {
+		return err
+	}
+	return recordMilestones(tx, saving, balance)
+}
+
+// transfer moves value from one Saving to another as a WITHDRAWAL and a
+// DEPOSIT, within tx. Only the TRANSFER fees are charged, on the WITHDRAWAL.
+func transfer(tx *gorm.DB, fromID, toID uint, value int64, description string) (*Transaction, *Transaction, error) {
+	if err := lockSavings(tx, fromID, toID); err != nil {
+		return nil, nil, err
+	}
+
+	withdrawal := Transaction{
+		SavingID:    fromID,
+		Type:        TypeWithdrawal,
+		Value:       -value,
+		Description: description,
+	}
+	if err := postWithFees(tx, &withdrawal, FeeOnTransfer); err != nil {
+		return nil, nil, err
+	}
+
+	// The deposit is in the currency of the withdrawal, so a transfer to a
+	// Saving of another currency is refused.
+	deposit := Transaction{
+		SavingID:    toID,
+		Type:        TypeDeposit,
+		Value:       value,
+		Currency:    withdrawal.Currency,
+		Description: description,
+	}
+	if err := postWithFees(tx, &deposit, ""); err != nil {
+		return nil, nil, err
+	}
+
+	return &withdrawal, &deposit, nil
+}
@@ -0,0 +1,273 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestPost(t *testing.T) {
+	future := time.Now().AddDate(1, 0, 0)
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, saving *Saving)
+		t     Transaction
+		// err is the wanted error, reason the wanted LimitError reason.
+		err     error
+		reason  string
+		balance int64
+	}{
+		{
+			name:    "deposit",
+			t:       Transaction{Type: TypeDeposit, Value: 500},
+			balance: 1500,
+		},
+		{
+			name:    "withdrawal",
+			t:       Transaction{Type: TypeWithdrawal, Value: -1000},
+			balance: 0,
+		},
+		{
+			name:    "withdrawal over the balance",
+			t:       Transaction{Type: TypeWithdrawal, Value: -1001},
+			err:     ErrInsufficientBalance,
+			balance: 1000,
+		},
+		{
+			name:    "withdrawal over the available balance",
+			setup:   holdAmount(600),
+			t:       Transaction{Type: TypeWithdrawal, Value: -500},
+			err:     ErrInsufficientAvailableBalance,
+			balance: 1000,
+		},
+		{
+			name:    "withdrawal within the available balance",
+			setup:   holdAmount(600),
+			t:       Transaction{Type: TypeWithdrawal, Value: -400},
+			balance: 600,
+		},
+		{
+			name:    "negative deposit",
+			t:       Transaction{Type: TypeDeposit, Value: -500},
+			err:     ErrValueSign,
+			balance: 1000,
+		},
+		{
+			name:    "positive withdrawal",
+			t:       Transaction{Type: TypeWithdrawal, Value: 500},
+			err:     ErrValueSign,
+			balance: 1000,
+		},
+		{
+			name:    "negative interest",
+			t:       Transaction{Type: TypeInterest, Value: -500},
+			err:     ErrValueSign,
+			balance: 1000,
+		},
+		{
+			name:    "positive funding of a regular saving",
+			t:       Transaction{Type: TypeFunding, Value: 500},
+			err:     ErrValueSign,
+			balance: 1000,
+		},
+		{
+			name:    "other currency",
+			t:       Transaction{Type: TypeDeposit, Value: 500, Currency: "USD"},
+			err:     ErrCurrencyMismatch,
+			balance: 1000,
+		},
+		{
+			name:    "withdrawal of a goal locked saving",
+			setup:   setGoal(5000, nil),
+			t:       Transaction{Type: TypeWithdrawal, Value: -100},
+			err:     ErrGoalLocked,
+			balance: 1000,
+		},
+		{
+			name:    "deposit to a goal locked saving",
+			setup:   setGoal(5000, nil),
+			t:       Transaction{Type: TypeDeposit, Value: 100},
+			balance: 1100,
+		},
+		{
+			name:    "withdrawal before the date of a goal lock",
+			setup:   setGoal(0, &future),
+			t:       Transaction{Type: TypeWithdrawal, Value: -100},
+			err:     ErrGoalLocked,
+			balance: 1000,
+		},
+		{
+			name:    "withdrawal over the per transaction limit",
+			setup:   setLimit(ScopeSaving, TypeWithdrawal, Limit{PerTransaction: 300}),
+			t:       Transaction{Type: TypeWithdrawal, Value: -301},
+			reason:  ReasonPerTransaction,
+			balance: 1000,
+		},
+		{
+			name:    "withdrawal at the per transaction limit",
+			setup:   setLimit(ScopeSaving, TypeWithdrawal, Limit{PerTransaction: 300}),
+			t:       Transaction{Type: TypeWithdrawal, Value: -300},
+			balance: 700,
+		},
+		{
+			name: "withdrawal over the daily limit",
+			setup: func(t *testing.T, saving *Saving) {
+				setLimit(ScopeUser, TypeWithdrawal, Limit{Daily: 500})(t, saving)
+				mustPost(t, &Transaction{SavingID: saving.ID, Type: TypeWithdrawal, Value: -400})
+			},
+			t:       Transaction{Type: TypeWithdrawal, Value: -200},
+			reason:  ReasonDaily,
+			balance: 600,
+		},
+		{
+			name:    "deposit over the monthly limit",
+			setup:   setLimit(ScopeProduct, TypeDeposit, Limit{Monthly: 1500}),
+			t:       Transaction{Type: TypeDeposit, Value: 600},
+			reason:  ReasonMonthly,
+			balance: 1000,
+		},
+		{
+			name:    "withdrawal limit does not limit deposits",
+			setup:   setLimit(ScopeSaving, TypeWithdrawal, Limit{PerTransaction: 1}),
+			t:       Transaction{Type: TypeDeposit, Value: 600},
+			balance: 1600,
+		},
+		{
+			name:    "withdrawal over the approval threshold",
+			setup:   addOwner(300),
+			t:       Transaction{Type: TypeWithdrawal, Value: -301},
+			err:     ErrApprovalRequired,
+			balance: 1000,
+		},
+		{
+			name:    "approved withdrawal over the approval threshold",
+			setup:   addOwner(300),
+			t:       Transaction{Type: TypeWithdrawal, Value: -301, approved: true},
+			balance: 699,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupDB(t)
+			saving := newSaving(t, 1000, time.Now())
+			if tt.setup != nil {
+				tt.setup(t, saving)
+			}
+
+			txn := tt.t
+			txn.SavingID = saving.ID
+			err := database.DB.Transaction(func(tx *gorm.DB) error {
+				return post(tx, &txn)
+			})
+
+			var limitErr *LimitError
+			switch {
+			case tt.reason != "":
+				if !errors.As(err, &limitErr) || limitErr.Reason != tt.reason {
+					t.Errorf("post() err = %v, want %s", err, tt.reason)
+				}
+			case err != tt.err:
+				t.Errorf("post() err = %v, want %v", err, tt.err)
+			}
+			if got := reload(t, saving).Balance; got != tt.balance {
+				t.Errorf("balance = %d, want %d", got, tt.balance)
+			}
+		})
+	}
+}
+
+func TestPostTimeDeposit(t *testing.T) {
+	setupDB(t)
+	saving := newSaving(t, 1000, time.Now())
+	if err := database.DB.Model(saving).Update("kind", KindTimeDeposit).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, txn := range []Transaction{
+		{SavingID: saving.ID, Type: TypeDeposit, Value: 100},
+		{SavingID: saving.ID, Type: TypeWithdrawal, Value: -100},
+	} {
+		err := database.DB.Transaction(func(tx *gorm.DB) error {
+			return post(tx, &txn)
+		})
+		if err != ErrTimeDepositLocked {
+			t.Errorf("post(%s) err = %v, want %v", txn.Type, err, ErrTimeDepositLocked)
+		}
+	}
+}
+
+// mustPost posts t or fails the test.
+func mustPost(t *testing.T, txn *Transaction) {
+	t.Helper()
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		return post(tx, txn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// holdAmount holds amount of the Saving.
+func holdAmount(amount int64) func(t *testing.T, saving *Saving) {
+	return func(t *testing.T, saving *Saving) {
+		hold := Hold{
+			SavingID:  saving.ID,
+			Amount:    amount,
+			Reference: "test",
+			Status:    HoldActive,
+			ExpiresAt: time.Now().Add(time.Hour),
+		}
+		if err := database.DB.Create(&hold).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// setGoal locks the Saving until target or date.
+func setGoal(target int64, date *time.Time) func(t *testing.T, saving *Saving) {
+	return func(t *testing.T, saving *Saving) {
+		if err := saving.UpdateGoal(target, date, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// setLimit stores an admin Limit of scope on the Saving.
+func setLimit(scope, direction string, limit Limit) func(t *testing.T, saving *Saving) {
+	return func(t *testing.T, saving *Saving) {
+		limit.Scope = scope
+		limit.Direction = direction
+		limit.SetBy = SetByAdmin
+		switch scope {
+		case ScopeProduct:
+			limit.ScopeRef = saving.Kind
+		case ScopeUser:
+			limit.ScopeRef = strconv.FormatUint(uint64(saving.UserID), 10)
+		default:
+			limit.ScopeRef = strconv.FormatUint(uint64(saving.ID), 10)
+		}
+		if err := limit.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// addOwner adds a second owner to the Saving and sets its approval
+// threshold.
+func addOwner(threshold int64) func(t *testing.T, saving *Saving) {
+	return func(t *testing.T, saving *Saving) {
+		owner := newUser(t, "owner@example.com")
+		member := SavingMember{SavingID: saving.ID, UserID: owner.ID, Role: RoleOwner}
+		if err := database.DB.Create(&member).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := database.DB.Model(saving).Update("approval_threshold", threshold).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
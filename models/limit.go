@@ -0,0 +1,302 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Limit scopes. PRODUCT limits apply to every Saving of a kind, USER limits
+// to all Savings of a User together, SAVING limits to one Saving.
+const (
+	ScopeProduct = "PRODUCT"
+	ScopeUser    = "USER"
+	ScopeSaving  = "SAVING"
+)
+
+// Who set a Limit. Limits set by a User can only be lowered by that User.
+const (
+	SetByAdmin = "ADMIN"
+	SetByUser  = "USER"
+)
+
+// Limit rejection reasons.
+const (
+	ReasonPerTransaction = "PER_TRANSACTION_LIMIT"
+	ReasonDaily          = "DAILY_LIMIT"
+	ReasonMonthly        = "MONTHLY_LIMIT"
+)
+
+// ErrLimitRaise is returned when a User tries to raise a limit.
+var ErrLimitRaise = errors.New("limits can only be lowered")
+
+// Limit caps the DEPOSITs or WITHDRAWALs of its scope in its Currency. It only
+// applies to the Savings of that Currency. A value of 0 means no cap. When
+// many Limits apply, the most restrictive one wins.
+type Limit struct {
+	gorm.Model
+	Scope          string `gorm:"size:7;not null;uniqueIndex:idx_limit"`
+	ScopeRef       string `gorm:"size:20;not null;uniqueIndex:idx_limit"` // Kind, User ID or Saving ID
+	Direction      string `gorm:"size:11;not null;uniqueIndex:idx_limit"` // DEPOSIT or WITHDRAWAL
+	SetBy          string `gorm:"size:5;not null;uniqueIndex:idx_limit"`
+	Currency       string `gorm:"size:3;not null;default:IDR;uniqueIndex:idx_limit"` // ISO 4217
+	PerTransaction int64  `gorm:"not null;default:0"`
+	Daily          int64  `gorm:"not null;default:0"`
+	Monthly        int64  `gorm:"not null;default:0"`
+}
+
+// LimitError is returned when a Transaction is rejected by a Limit.
+type LimitError struct {
+	Reason    string
+	Scope     string
+	Limit     int64
+	Remaining int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s of %s scope exceeded, remaining allowance is %d", e.Reason, e.Scope, e.Remaining)
+}
+
+// Allowance is what a Saving can still move in one direction. Nil means there
+// is no cap.
+type Allowance struct {
+	Direction        string
+	PerTransaction   *int64
+	DailyRemaining   *int64
+	MonthlyRemaining *int64
+}
+
+// Validate checks the scope, the direction, the currency and the values of
+// the Limit.
+func (l *Limit) Validate() error {
+	if !ValidCurrency(l.Currency) {
+		return ErrUnknownCurrency
+	}
+	if l.Scope != ScopeProduct && l.Scope != ScopeUser && l.Scope != ScopeSaving {
+		return errors.New("scope must be PRODUCT, USER or SAVING")
+	}
+	if l.Direction != TypeDeposit && l.Direction != TypeWithdrawal {
+		return errors.New("direction must be DEPOSIT or WITHDRAWAL")
+	}
+	if l.PerTransaction < 0 || l.Daily < 0 || l.Monthly < 0 {
+		return errors.New("limits can not be negative")
+	}
+	return nil
+}
+
+// lowerOrEqual reports whether every cap of l is at most the one of old. A
+// cap of 0 is no cap, so it is the highest.
+func (l *Limit) lowerOrEqual(old *Limit) bool {
+	lower := func(v, o int64) bool {
+		return o == 0 || (v != 0 && v <= o)
+	}
+	return lower(l.PerTransaction, old.PerTransaction) &&
+		lower(l.Daily, old.Daily) &&
+		lower(l.Monthly, old.Monthly)
+}
+
+// Save creates or replaces the Limit of its scope, direction, setter and
+// currency. A Limit set by a User can only be lowered. A Limit without
+// currency is in the DefaultCurrency.
+func (l *Limit) Save() error {
+	if l.Currency == "" {
+		l.Currency = DefaultCurrency
+	}
+	if err := l.Validate(); err != nil {
+		return err
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var old Limit
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("scope = ? AND scope_ref = ? AND direction = ? AND set_by = ? AND currency = ?", l.Scope, l.ScopeRef, l.Direction, l.SetBy, l.Currency).
+			First(&old).
+			Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return tx.Create(&l).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		if l.SetBy == SetByUser && !l.lowerOrEqual(&old) {
+			return ErrLimitRaise
+		}
+
+		l.ID = old.ID
+		return tx.Model(&old).Updates(map[string]interface{}{
+			"per_transaction": l.PerTransaction,
+			"daily":           l.Daily,
+			"monthly":         l.Monthly,
+		}).Error
+	})
+}
+
+// DeleteLimit removes a Limit by ID.
+func DeleteLimit(id string) error {
+	return database.DB.Unscoped().Where("id = ?", id).Delete(&Limit{}).Error
+}
+
+// applicableLimits gets/fetches every Limit of a direction which applies to
+// the Saving and its currency.
+func applicableLimits(tx *gorm.DB, saving *Saving, direction string) ([]Limit, error) {
+	var results []Limit
+	err := tx.
+		Where("direction = ? AND currency = ?", direction, saving.Currency).
+		Where(
+			tx.Where("scope = ? AND scope_ref = ?", ScopeProduct, saving.Kind).
+				Or("scope = ? AND scope_ref = ?", ScopeUser, strconv.FormatUint(uint64(saving.UserID), 10)).
+				Or("scope = ? AND scope_ref = ?", ScopeSaving, strconv.FormatUint(uint64(saving.ID), 10)),
+		).
+		Find(&results).
+		Error
+	return results, err
+}
+
+// usage sums the Transactions of a direction since a time. USER scope counts
+// every Saving of the User in the currency of the Saving, other scopes only
+// the Saving itself. The FUNDING of time deposits counts as WITHDRAWAL.
+func usage(tx *gorm.DB, saving *Saving, scope, direction string, since time.Time) (int64, error) {
+	query := tx.Model(&Transaction{}).
+		Select("COALESCE(SUM(ABS(value)), 0)").
+		Where("created_at >= ?", since)
+	if direction == TypeWithdrawal {
+		query = query.Where("(type = ? OR (type = ? AND value < 0))", TypeWithdrawal, TypeFunding)
+	} else {
+		query = query.Where("type = ?", direction)
+	}
+	if scope == ScopeUser {
+		savings := tx.Model(&Saving{}).Select("id").Where("user_id = ? AND currency = ?", saving.UserID, saving.Currency)
+		query = query.Where("saving_id IN (?)", savings)
+	} else {
+		query = query.Where("saving_id = ?", saving.ID)
+	}
+
+	var total int64
+	err := query.Scan(&total).Error
+	return total, err
+}
+
+// periodStarts returns the start of the day and of the month of now.
+func periodStarts(now time.Time) (time.Time, time.Time) {
+	day := startOfDay(now)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	return day, month
+}
+
+// tighten lowers the cap in current to remaining when it is more restrictive.
+// Returns the new cap and whether it changed. Nil is no cap.
+func tighten(current *int64, remaining int64) (*int64, bool) {
+	if remaining < 0 {
+		remaining = 0
+	}
+	if current == nil || remaining < *current {
+		return &remaining, true
+	}
+	return current, false
+}
+
+// allowanceWithin computes the Allowance of the Saving in one direction,
+// within tx. Also returns the most restrictive Limit of each reason, to
+// explain a rejection.
+func allowanceWithin(tx *gorm.DB, saving *Saving, direction string, now time.Time) (*Allowance, map[string]*LimitError, error) {
+	limits, err := applicableLimits(tx, saving, direction)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allowance := Allowance{Direction: direction}
+	reasons := map[string]*LimitError{}
+	dayStart, monthStart := periodStarts(now)
+
+	var changed bool
+	for _, limit := range limits {
+		if limit.PerTransaction > 0 {
+			allowance.PerTransaction, changed = tighten(allowance.PerTransaction, limit.PerTransaction)
+			if changed {
+				reasons[ReasonPerTransaction] = &LimitError{ReasonPerTransaction, limit.Scope, limit.PerTransaction, limit.PerTransaction}
+			}
+		}
+		if limit.Daily > 0 {
+			used, err := usage(tx, saving, limit.Scope, direction, dayStart)
+			if err != nil {
+				return nil, nil, err
+			}
+			allowance.DailyRemaining, changed = tighten(allowance.DailyRemaining, limit.Daily-used)
+			if changed {
+				reasons[ReasonDaily] = &LimitError{ReasonDaily, limit.Scope, limit.Daily, *allowance.DailyRemaining}
+			}
+		}
+		if limit.Monthly > 0 {
+			used, err := usage(tx, saving, limit.Scope, direction, monthStart)
+			if err != nil {
+				return nil, nil, err
+			}
+			allowance.MonthlyRemaining, changed = tighten(allowance.MonthlyRemaining, limit.Monthly-used)
+			if changed {
+				reasons[ReasonMonthly] = &LimitError{ReasonMonthly, limit.Scope, limit.Monthly, *allowance.MonthlyRemaining}
+			}
+		}
+	}
+	return &allowance, reasons, nil
+}
+
+// checkLimits rejects t with a LimitError when it goes over any Limit which
+// applies to the locked saving. Only DEPOSITs and outgoing Transactions are
+// limited, the FUNDING of a time deposit as a WITHDRAWAL.
+func checkLimits(tx *gorm.DB, saving *Saving, t *Transaction) error {
+	direction := t.Type
+	switch {
+	case t.outgoing():
+		direction = TypeWithdrawal
+	case t.Type != TypeDeposit:
+		return nil
+	}
+
+	allowance, reasons, err := allowanceWithin(tx, saving, direction, time.Now())
+	if err != nil {
+		return err
+	}
+
+	value := abs(t.Value)
+	switch {
+	case allowance.PerTransaction != nil && value > *allowance.PerTransaction:
+		return reasons[ReasonPerTransaction]
+	case allowance.DailyRemaining != nil && value > *allowance.DailyRemaining:
+		return reasons[ReasonDaily]
+	case allowance.MonthlyRemaining != nil && value > *allowance.MonthlyRemaining:
+		return reasons[ReasonMonthly]
+	}
+	return nil
+}
+
+// GetAllowances returns what the Saving can still deposit and withdraw.
+func (s *Saving) GetAllowances() ([]Allowance, error) {
+	var results []Allowance
+	for _, direction := range []string{TypeDeposit, TypeWithdrawal} {
+		allowance, _, err := allowanceWithin(database.DB, s, direction, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *allowance)
+	}
+	return results, nil
+}
+
+// GetLimits gets/fetches every Limit which applies to the Saving.
+func (s *Saving) GetLimits() ([]Limit, error) {
+	var results []Limit
+	for _, direction := range []string{TypeDeposit, TypeWithdrawal} {
+		limits, err := applicableLimits(database.DB, s, direction)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, limits...)
+	}
+	return results, nil
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+// setupDB points database.DB to a new in-memory database for the test. One
+// connection is used, so a query made outside of a database transaction
+// while it is open blocks the test.
+func setupDB(t *testing.T) {
+	t.Helper()
+
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := gorm.Open(sqlite.Open("file:"+name+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: gormlogger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	if err := db.AutoMigrate(AllModels...); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() {
+		database.DB = previous
+		sqlDB.Close()
+	})
+}
+
+// newUser stores a User for the test.
+func newUser(t *testing.T, email string) *User {
+	t.Helper()
+	user := User{Name: email, Email: email, Password: []byte("-")}
+	if err := user.StoreUser(); err != nil {
+		t.Fatal(err)
+	}
+	return &user
+}
+
+// users counts the Users made by newSaving.
+var users int
+
+// newSaving stores an IDR Saving of a new User for the test, with a DEPOSIT
+// of balance made at.
+func newSaving(t *testing.T, balance int64, at time.Time) *Saving {
+	t.Helper()
+	users++
+	user := newUser(t, fmt.Sprintf("user%d@example.com", users))
+	saving := Saving{UserID: user.ID, Name: "Test"}
+	if err := saving.Store(); err != nil {
+		t.Fatal(err)
+	}
+	if balance != 0 {
+		deposit(t, &saving, balance, at)
+	}
+	return &saving
+}
+
+// deposit stores a DEPOSIT of value made at into saving, without the rules
+// of the ledger.
+func deposit(t *testing.T, saving *Saving, value int64, at time.Time) {
+	t.Helper()
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		locked, err := lockSaving(tx, saving.ID)
+		if err != nil {
+			return err
+		}
+		d := Transaction{SavingID: saving.ID, Type: "DEPOSIT", Value: value}
+		d.CreatedAt = at
+		if err := apply(tx, locked, &d); err != nil {
+			return err
+		}
+		*saving = *locked
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reload gets the stored Saving again.
+func reload(t *testing.T, saving *Saving) *Saving {
+	t.Helper()
+	var result Saving
+	if err := database.DB.First(&result, saving.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &result
+}
@@ -0,0 +1,556 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Member roles. An OWNER can do everything, a CONTRIBUTOR can only deposit
+// and a VIEWER can only see the Saving.
+const (
+	RoleOwner       = "OWNER"
+	RoleContributor = "CONTRIBUTOR"
+	RoleViewer      = "VIEWER"
+)
+
+// Invitation statuses. An OWNER invitation which waits for the approval of
+// another owner can not be accepted yet.
+const (
+	InvitationPending  = "PENDING"
+	InvitationApproval = "APPROVAL"
+	InvitationAccepted = "ACCEPTED"
+)
+
+// Pending change kinds. They all weaken the approval of withdrawals, so they
+// need another owner as well.
+const (
+	ChangeThreshold   = "THRESHOLD"
+	ChangeRemoveOwner = "REMOVE_OWNER"
+	ChangeInviteOwner = "INVITE_OWNER"
+)
+
+// Pending withdrawal and change statuses.
+const (
+	ApprovalPending  = "PENDING"
+	ApprovalApproved = "APPROVED"
+	ApprovalRejected = "REJECTED"
+)
+
+// invitationLifetime is how long an invitation can be accepted.
+const invitationLifetime = 7 * 24 * time.Hour
+
+// roleRanks orders the roles, a higher rank can do everything a lower one can.
+var roleRanks = map[string]int{
+	RoleViewer:      1,
+	RoleContributor: 2,
+	RoleOwner:       3,
+}
+
+var (
+	// ErrInvalidRole is returned when a role is unknown.
+	ErrInvalidRole = errors.New("role must be OWNER, CONTRIBUTOR or VIEWER")
+	// ErrInvitationInvalid is returned when an invitation token is unknown,
+	// expired, already used or for another email.
+	ErrInvitationInvalid = errors.New("invitation is invalid or expired")
+	// ErrApprovalInvalid is returned when a pending withdrawal can not be
+	// approved or rejected.
+	ErrApprovalInvalid = errors.New("withdrawal is not pending or needs another owner")
+	// ErrApprovalRequired is returned when posting a WITHDRAWAL which needs
+	// the approval of another owner without it.
+	ErrApprovalRequired = errors.New("withdrawal needs the approval of another owner")
+	// ErrChangeInvalid is returned when a pending change can not be approved
+	// or rejected.
+	ErrChangeInvalid = errors.New("change is not pending or needs another owner")
+)
+
+// SavingMember gives a User a Role on a Saving. The User in Saving.UserID is
+// always an OWNER and has no SavingMember row.
+type SavingMember struct {
+	gorm.Model
+	SavingID uint   `gorm:"not null;uniqueIndex:idx_saving_member"`
+	UserID   uint   `gorm:"not null;uniqueIndex:idx_saving_member;index"`
+	Role     string `gorm:"size:11;not null"`
+}
+
+// SavingInvitation invites an email to become a member of a Saving. Only the
+// hash of the token is stored.
+type SavingInvitation struct {
+	gorm.Model
+	SavingID  uint      `gorm:"not null;index"`
+	Email     string    `gorm:"size:300;not null"`
+	Role      string    `gorm:"size:11;not null"`
+	InvitedBy uint      `gorm:"not null"`
+	TokenHash string    `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	Status    string    `gorm:"size:8;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// PendingWithdrawal is a WITHDRAWAL above the ApprovalThreshold of a Saving
+// with more than one owner. It is posted once another owner approves it.
+type PendingWithdrawal struct {
+	gorm.Model
+	SavingID      uint   `gorm:"not null;index"`
+	RequestedBy   uint   `gorm:"not null"`
+	Value         int64  `gorm:"not null"`
+	Description   string `gorm:"size:200"`
+	Status        string `gorm:"size:8;not null"`
+	DecidedBy     *uint
+	TransactionID *uint
+	// ctx is the context of the queries of the withdrawal, see
+	// WithContext.
+	ctx context.Context
+}
+
+// WithContext sets the context of the queries of the PendingWithdrawal, with
+// the AuditActor of its decision.
+func (w *PendingWithdrawal) WithContext(ctx context.Context) *PendingWithdrawal {
+	w.ctx = ctx
+	return w
+}
+
+// PendingChange is a change of a Saving with more than one owner which
+// weakens the approval of withdrawals: lowering the ApprovalThreshold,
+// removing another owner or inviting a new one. It is made once another
+// owner approves it.
+type PendingChange struct {
+	gorm.Model
+	SavingID    uint   `gorm:"not null;index"`
+	RequestedBy uint   `gorm:"not null"`
+	Kind        string `gorm:"size:12;not null"` // THRESHOLD, REMOVE_OWNER or INVITE_OWNER
+	// Threshold is the new ApprovalThreshold of a THRESHOLD change.
+	Threshold int64 `gorm:"not null;default:0"`
+	// MemberID is the owner removed by a REMOVE_OWNER change.
+	MemberID uint `gorm:"not null;default:0"`
+	// InvitationID is the SavingInvitation of an INVITE_OWNER change.
+	InvitationID uint   `gorm:"not null;default:0"`
+	Status       string `gorm:"size:8;not null"`
+	DecidedBy    *uint
+}
+
+// ValidRole reports whether role is a known role.
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// RoleOf returns the role of the User on the Saving. Empty if the User is not
+// a member.
+func (s *Saving) RoleOf(userID uint) string {
+	return roleOf(s.db(), s, userID)
+}
+
+// roleOf is RoleOf within tx.
+func roleOf(tx *gorm.DB, s *Saving, userID uint) string {
+	if s.UserID == userID {
+		return RoleOwner
+	}
+
+	var member SavingMember
+	err := tx.Where("saving_id = ? AND user_id = ?", s.ID, userID).First(&member).Error
+	if err != nil {
+		return ""
+	}
+	return member.Role
+}
+
+// HasRole reports whether the User has at least role on the Saving.
+func (s *Saving) HasRole(userID uint, role string) bool {
+	return roleRanks[s.RoleOf(userID)] >= roleRanks[role]
+}
+
+// hasRole is HasRole within tx, for the Saving with savingID. false if the
+// Saving does not exist anymore.
+func hasRole(tx *gorm.DB, savingID, userID uint, role string) (bool, error) {
+	var saving Saving
+	err := tx.First(&saving, savingID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return roleRanks[roleOf(tx, &saving, userID)] >= roleRanks[role], nil
+}
+
+// countOwners counts every owner of the Saving, including Saving.UserID,
+// within tx.
+func countOwners(tx *gorm.DB, s *Saving) (int64, error) {
+	var count int64
+	err := tx.Model(&SavingMember{}).
+		Where("saving_id = ? AND role = ?", s.ID, RoleOwner).
+		Count(&count).
+		Error
+	return count + 1, err
+}
+
+// needsApproval is NeedsApproval within tx.
+func needsApproval(tx *gorm.DB, s *Saving, value int64) (bool, error) {
+	if s.ApprovalThreshold <= 0 || value <= s.ApprovalThreshold {
+		return false, nil
+	}
+	owners, err := countOwners(tx, s)
+	return owners > 1, err
+}
+
+// NeedsApproval reports whether a WITHDRAWAL of value needs the approval of
+// another owner. Posting it without one fails with ErrApprovalRequired.
+func (s *Saving) NeedsApproval(value int64) (bool, error) {
+	return needsApproval(s.db(), s, value)
+}
+
+// weakensApproval reports whether changing the ApprovalThreshold to
+// threshold lets bigger withdrawals through without another owner. 0 turns
+// approvals off.
+func (s *Saving) weakensApproval(threshold int64) bool {
+	if s.ApprovalThreshold <= 0 {
+		return false
+	}
+	return threshold <= 0 || threshold > s.ApprovalThreshold
+}
+
+// UpdateApprovalThreshold changes the withdrawal approval threshold. 0 turns
+// approvals off. On a Saving with more than one owner, a change which lets
+// bigger withdrawals through is stored as a PendingChange for another owner
+// to approve, and returned.
+func (s *Saving) UpdateApprovalThreshold(userID uint, threshold int64) (*PendingChange, error) {
+	var pending *PendingChange
+	err := s.db().Transaction(func(tx *gorm.DB) error {
+		locked, err := lockSaving(tx, s.ID)
+		if err != nil {
+			return err
+		}
+		owners, err := countOwners(tx, locked)
+		if err != nil {
+			return err
+		}
+		if owners > 1 && locked.weakensApproval(threshold) {
+			pending = &PendingChange{
+				SavingID:    s.ID,
+				RequestedBy: userID,
+				Kind:        ChangeThreshold,
+				Threshold:   threshold,
+				Status:      ApprovalPending,
+			}
+			return tx.Create(pending).Error
+		}
+		s.ApprovalThreshold = threshold
+		return tx.Model(locked).Update("approval_threshold", threshold).Error
+	})
+	return pending, err
+}
+
+// GetMembers gets/fetches every member of the Saving, except Saving.UserID.
+func (s *Saving) GetMembers() (*[]SavingMember, error) {
+	var results []SavingMember
+	err := s.db().Where("saving_id = ?", s.ID).Order("id").Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// removeMember removes a User from the members of the Saving, within tx.
+func removeMember(tx *gorm.DB, savingID, userID uint) error {
+	return tx.Unscoped().
+		Where("saving_id = ? AND user_id = ?", savingID, userID).
+		Delete(&SavingMember{}).
+		Error
+}
+
+// RemoveMember removes a User from the members of the Saving, on behalf of
+// the User with byID. An owner removing another owner of a Saving which
+// needs approvals is stored as a PendingChange for another owner to approve,
+// and returned. Members can always leave.
+func (s *Saving) RemoveMember(byID, userID uint) (*PendingChange, error) {
+	var pending *PendingChange
+	err := s.db().Transaction(func(tx *gorm.DB) error {
+		locked, err := lockSaving(tx, s.ID)
+		if err != nil {
+			return err
+		}
+		if byID != userID && locked.ApprovalThreshold > 0 && roleOf(tx, locked, userID) == RoleOwner {
+			pending = &PendingChange{
+				SavingID:    s.ID,
+				RequestedBy: byID,
+				Kind:        ChangeRemoveOwner,
+				MemberID:    userID,
+				Status:      ApprovalPending,
+			}
+			return tx.Create(pending).Error
+		}
+		return removeMember(tx, s.ID, userID)
+	})
+	return pending, err
+}
+
+// hashToken hashes an invitation token for storage.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store stores the invitation with a new random token. Returns the token,
+// which is only known by the invited email from now on. An OWNER invitation
+// to a Saving with more than one owner which needs approvals can only be
+// accepted once another owner approves it, its PendingChange is returned.
+func (i *SavingInvitation) Store() (string, *PendingChange, error) {
+	if !ValidRole(i.Role) {
+		return "", nil, ErrInvalidRole
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(raw)
+
+	i.Email = strings.ToLower(i.Email)
+	i.TokenHash = hashToken(token)
+	i.Status = InvitationPending
+	i.ExpiresAt = time.Now().Add(invitationLifetime)
+
+	var pending *PendingChange
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		saving, err := lockSaving(tx, i.SavingID)
+		if err != nil {
+			return err
+		}
+		owners, err := countOwners(tx, saving)
+		if err != nil {
+			return err
+		}
+		needsApproval := i.Role == RoleOwner && saving.ApprovalThreshold > 0 && owners > 1
+		if needsApproval {
+			i.Status = InvitationApproval
+		}
+		if err := tx.Create(&i).Error; err != nil {
+			return err
+		}
+		if !needsApproval {
+			return nil
+		}
+
+		pending = &PendingChange{
+			SavingID:     i.SavingID,
+			RequestedBy:  i.InvitedBy,
+			Kind:         ChangeInviteOwner,
+			InvitationID: i.ID,
+			Status:       ApprovalPending,
+		}
+		return tx.Create(pending).Error
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, pending, nil
+}
+
+// AcceptInvitation makes the User a member of the Saving of the invitation
+// with token. The invitation must be for the email of the User.
+func AcceptInvitation(token string, user *User) (*SavingMember, error) {
+	var member SavingMember
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var invitation SavingInvitation
+		err := tx.Where("token_hash = ? AND status = ?", hashToken(token), InvitationPending).
+			First(&invitation).
+			Error
+		if err != nil {
+			return ErrInvitationInvalid
+		}
+		if invitation.ExpiresAt.Before(time.Now()) || invitation.Email != strings.ToLower(user.Email) {
+			return ErrInvitationInvalid
+		}
+
+		// Owners of the Saving are already members.
+		var saving Saving
+		if err := tx.First(&saving, invitation.SavingID).Error; err != nil {
+			return err
+		}
+		if saving.UserID == user.ID {
+			return ErrInvitationInvalid
+		}
+
+		// Accepting again replaces the previous role.
+		err = tx.Unscoped().
+			Where("saving_id = ? AND user_id = ?", invitation.SavingID, user.ID).
+			Delete(&SavingMember{}).
+			Error
+		if err != nil {
+			return err
+		}
+
+		member = SavingMember{
+			SavingID: invitation.SavingID,
+			UserID:   user.ID,
+			Role:     invitation.Role,
+		}
+		if err := tx.Create(&member).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&invitation).Update("status", InvitationAccepted).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// Store stores the PendingWithdrawal.
+func (w *PendingWithdrawal) Store() error {
+	w.Status = ApprovalPending
+	return database.DB.Create(&w).Error
+}
+
+// GetPendingWithdrawalByID gets/fetches a PendingWithdrawal by searching the
+// ID.
+func (w *PendingWithdrawal) GetPendingWithdrawalByID(id string) *PendingWithdrawal {
+	var result PendingWithdrawal
+	err := database.DB.Where("id = ?", id).First(&result).Error
+	if err != nil {
+		return nil
+	}
+	return &result
+}
+
+// GetPendingWithdrawalsBySavingID gets/fetches every pending withdrawal of a
+// Saving.
+func (w *PendingWithdrawal) GetPendingWithdrawalsBySavingID(savingID uint) (*[]PendingWithdrawal, error) {
+	var results []PendingWithdrawal
+	err := database.DB.
+		Where("saving_id = ? AND status = ?", savingID, ApprovalPending).
+		Order("id").
+		Find(&results).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// Decide approves or rejects the PendingWithdrawal. It must be decided by an
+// owner who did not request it. An approved withdrawal is posted in the same
+// DB transaction.
+func (w *PendingWithdrawal) Decide(ownerID uint, approve bool) (*Transaction, error) {
+	var transaction *Transaction
+	err := withContext(w.ctx).Transaction(func(tx *gorm.DB) error {
+		// Lock the Saving first, like every other balance change.
+		if _, err := lockSaving(tx, w.SavingID); err != nil {
+			return err
+		}
+		if err := tx.First(&w, w.ID).Error; err != nil {
+			return err
+		}
+		if w.Status != ApprovalPending || w.RequestedBy == ownerID {
+			return ErrApprovalInvalid
+		}
+
+		updates := map[string]interface{}{
+			"status":     ApprovalRejected,
+			"decided_by": ownerID,
+		}
+		if approve {
+			transaction = &Transaction{
+				SavingID:    w.SavingID,
+				Type:        TypeWithdrawal,
+				Value:       -w.Value,
+				Description: w.Description,
+				approved:    true,
+			}
+			if err := post(tx, transaction); err != nil {
+				return err
+			}
+			if err := auditTx(tx, AuditTransactionCreated, "transaction", transaction.ID, nil, transaction); err != nil {
+				return err
+			}
+			updates["status"] = ApprovalApproved
+			updates["transaction_id"] = transaction.ID
+		}
+
+		before := *w
+		if err := tx.Model(&w).Updates(updates).Error; err != nil {
+			return err
+		}
+		return auditTx(tx, AuditWithdrawalDecided, "withdrawal", w.ID, before, w)
+	})
+	return transaction, err
+}
+
+// GetPendingChangeByID gets/fetches a PendingChange by searching the ID.
+func (p *PendingChange) GetPendingChangeByID(id string) *PendingChange {
+	var result PendingChange
+	err := database.DB.Where("id = ?", id).First(&result).Error
+	if err != nil {
+		return nil
+	}
+	return &result
+}
+
+// GetPendingChangesBySavingID gets/fetches every pending change of a Saving.
+func (p *PendingChange) GetPendingChangesBySavingID(savingID uint) (*[]PendingChange, error) {
+	var results []PendingChange
+	err := database.DB.
+		Where("saving_id = ? AND status = ?", savingID, ApprovalPending).
+		Order("id").
+		Find(&results).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// Decide approves or rejects the PendingChange. It must be decided by an
+// owner who did not request it, the owner it removes can agree to leave. An
+// approved change is made in the same DB transaction.
+func (p *PendingChange) Decide(ownerID uint, approve bool) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if _, err := lockSaving(tx, p.SavingID); err != nil {
+			return err
+		}
+		if err := tx.First(&p, p.ID).Error; err != nil {
+			return err
+		}
+		if p.Status != ApprovalPending || p.RequestedBy == ownerID {
+			return ErrChangeInvalid
+		}
+
+		status := ApprovalRejected
+		if approve {
+			status = ApprovalApproved
+			var err error
+			switch p.Kind {
+			case ChangeThreshold:
+				err = tx.Model(&Saving{}).Where("id = ?", p.SavingID).Update("approval_threshold", p.Threshold).Error
+			case ChangeRemoveOwner:
+				err = removeMember(tx, p.SavingID, p.MemberID)
+			case ChangeInviteOwner:
+				// The invitation can be accepted for its whole lifetime from
+				// now on.
+				err = tx.Model(&SavingInvitation{}).
+					Where("id = ? AND status = ?", p.InvitationID, InvitationApproval).
+					Updates(map[string]interface{}{
+						"status":     InvitationPending,
+						"expires_at": time.Now().Add(invitationLifetime),
+					}).
+					Error
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&p).Updates(map[string]interface{}{
+			"status":     status,
+			"decided_by": ownerID,
+		}).Error
+	})
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInviteOwnerNeedsApproval(t *testing.T) {
+	setupDB(t)
+	saving := newSaving(t, 0, time.Now())
+	addOwner(500)(t, saving)
+	members, err := saving.GetMembers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := (*members)[0].UserID
+
+	contributor := SavingInvitation{SavingID: saving.ID, Email: "contributor@example.com", Role: RoleContributor, InvitedBy: saving.UserID}
+	if _, pending, err := contributor.Store(); err != nil || pending != nil {
+		t.Fatalf("contributor invitation: pending = %+v, err = %v", pending, err)
+	}
+
+	invitation := SavingInvitation{SavingID: saving.ID, Email: "Owner2@example.com", Role: RoleOwner, InvitedBy: saving.UserID}
+	token, pending, err := invitation.Store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending == nil || pending.Kind != ChangeInviteOwner || pending.InvitationID != invitation.ID {
+		t.Fatalf("pending = %+v", pending)
+	}
+
+	user := newUser(t, "owner2@example.com")
+	if _, err := AcceptInvitation(token, user); err != ErrInvitationInvalid {
+		t.Fatalf("accepting before the approval: err = %v, want %v", err, ErrInvitationInvalid)
+	}
+	if err := pending.Decide(saving.UserID, true); err != ErrChangeInvalid {
+		t.Fatalf("approving by the inviting owner: err = %v, want %v", err, ErrChangeInvalid)
+	}
+	if err := pending.Decide(other, true); err != nil {
+		t.Fatal(err)
+	}
+
+	member, err := AcceptInvitation(token, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member.Role != RoleOwner || !reload(t, saving).HasRole(user.ID, RoleOwner) {
+		t.Errorf("member = %+v", member)
+	}
+}
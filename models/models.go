@@ -0,0 +1,39 @@
+package models
+
+// AllModels are the Models with a table, in the order of the migration.
+var AllModels = []interface{}{
+	&User{},
+	&Saving{},
+	&Transaction{},
+	&Hold{},
+	&Schedule{},
+	&ScheduleRun{},
+	&InterestProduct{},
+	&InterestTier{},
+	&InterestAccrual{},
+	&InterestPosting{},
+	&GoalMilestone{},
+	&TimeDeposit{},
+	&SavingMember{},
+	&SavingInvitation{},
+	&PendingWithdrawal{},
+	&PendingChange{},
+	&Limit{},
+	&FeeSchedule{},
+	&FeeWaiver{},
+	&MaintenanceCharge{},
+	&ExchangeRate{},
+	&FxQuote{},
+	&StoredStatement{},
+	&Category{},
+	&TransactionTag{},
+	&CategoryRule{},
+	&TransactionRollup{},
+	&Budget{},
+	&BudgetAlert{},
+	&WebhookSubscription{},
+	&WebhookDelivery{},
+	&OutboxEvent{},
+	&ProcessedEvent{},
+	&AuditLog{},
+}
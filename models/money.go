@@ -0,0 +1,183 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is the currency of a Saving created without one.
+const DefaultCurrency = "IDR"
+
+// currencyExponents are the ISO 4217 minor unit exponents of every supported
+// currency. An amount of 12345 USD is 123.45 dollars. Rupiah have no minor
+// unit in use, so IDR amounts are whole rupiah, like the balances stored
+// before currencies existed.
+var currencyExponents = map[string]int{
+	"AUD": 2,
+	"BHD": 3,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"HKD": 2,
+	"IDR": 0,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"MYR": 2,
+	"PHP": 2,
+	"SGD": 2,
+	"THB": 2,
+	"USD": 2,
+}
+
+var (
+	// ErrCurrencyMismatch is returned when adding or comparing Money of two
+	// currencies.
+	ErrCurrencyMismatch = errors.New("currencies do not match")
+	// ErrUnknownCurrency is returned when a currency is not supported.
+	ErrUnknownCurrency = errors.New("currency is not supported")
+	// ErrMoneyOverflow is returned when an amount does not fit in int64.
+	ErrMoneyOverflow = errors.New("amount is too large")
+)
+
+// ValidCurrency reports whether code is a supported ISO 4217 currency.
+func ValidCurrency(code string) bool {
+	_, ok := currencyExponents[code]
+	return ok
+}
+
+// ParseAmount parses a decimal amount like "-1234.50" into minor units of
+// currency. It refuses more fraction digits than the currency has.
+func ParseAmount(value string, currency string) (int64, error) {
+	value = strings.TrimSpace(value)
+	exponent := currencyExponents[currency]
+	if i := strings.IndexByte(value, '.'); i >= 0 && len(value)-i-1 > exponent {
+		return 0, fmt.Errorf("amount %q has more than %d decimals", value, exponent)
+	}
+
+	amount, ok := new(big.Rat).SetString(value)
+	if !ok || strings.ContainsAny(value, "/eE") {
+		return 0, fmt.Errorf("amount %q is not a decimal", value)
+	}
+	amount.Mul(amount, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exponent)), nil)))
+	if !amount.IsInt() || !amount.Num().IsInt64() {
+		return 0, ErrMoneyOverflow
+	}
+	return amount.Num().Int64(), nil
+}
+
+// Money is an amount in the minor units of its Currency. Money of different
+// currencies can not be added or compared.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// NewMoney returns amount minor units of currency. An empty currency is the
+// DefaultCurrency.
+func NewMoney(amount int64, currency string) Money {
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Add returns m plus o.
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency != o.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+	if (o.Amount > 0 && m.Amount > math.MaxInt64-o.Amount) ||
+		(o.Amount < 0 && m.Amount < math.MinInt64-o.Amount) {
+		return Money{}, ErrMoneyOverflow
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}, nil
+}
+
+// Sub returns m minus o.
+func (m Money) Sub(o Money) (Money, error) {
+	if o.Amount == math.MinInt64 {
+		return Money{}, ErrMoneyOverflow
+	}
+	return m.Add(o.Neg())
+}
+
+// Neg returns m with the opposite sign.
+func (m Money) Neg() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Cmp compares m and o. Returns -1, 0 or 1 like strings.Compare.
+func (m Money) Cmp(o Money) (int, error) {
+	if m.Currency != o.Currency {
+		return 0, ErrCurrencyMismatch
+	}
+	switch {
+	case m.Amount < o.Amount:
+		return -1, nil
+	case m.Amount > o.Amount:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// split returns the sign, the whole and the fraction digits of m.
+func (m Money) split() (string, string, string) {
+	exponent := currencyExponents[m.Currency]
+
+	sign := ""
+	digits := strconv.FormatInt(m.Amount, 10)
+	if strings.HasPrefix(digits, "-") {
+		sign = "-"
+		digits = digits[1:]
+	}
+	for len(digits) <= exponent {
+		digits = "0" + digits
+	}
+
+	return sign, digits[:len(digits)-exponent], digits[len(digits)-exponent:]
+}
+
+// Decimal formats m as a plain decimal without currency code or separators,
+// like "1234.50".
+func (m Money) Decimal() string {
+	sign, whole, fraction := m.split()
+	if fraction == "" {
+		return sign + whole
+	}
+	return sign + whole + "." + fraction
+}
+
+// String formats m with its currency code, thousands separators and the
+// minor units of its currency, like "USD 1,234.50".
+func (m Money) String() string {
+	sign, whole, fraction := m.split()
+
+	var grouped strings.Builder
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(digit)
+	}
+
+	if fraction == "" {
+		return fmt.Sprintf("%s %s%s", m.Currency, sign, grouped.String())
+	}
+	return fmt.Sprintf("%s %s%s.%s", m.Currency, sign, grouped.String(), fraction)
+}
+
+// MarshalJSON returns the raw minor units, the currency and the formatted
+// amount.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Minor     int64  `json:"minor"`
+		Currency  string `json:"currency"`
+		Formatted string `json:"formatted"`
+	}{m.Amount, m.Currency, m.String()})
+}
@@ -0,0 +1,123 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		value    string
+		currency string
+		want     int64
+		err      bool
+	}{
+		{"1234.50", "USD", 123450, false},
+		{"-1234.5", "USD", -123450, false},
+		{" 12 ", "USD", 1200, false},
+		{"0.01", "USD", 1, false},
+		{"1.001", "USD", 0, true},
+		{"1.234", "KWD", 1234, false},
+		{"1500", "IDR", 1500, false},
+		{"1500.5", "IDR", 0, true},
+		{"100", "JPY", 100, false},
+		{"1e3", "USD", 0, true},
+		{"1/2", "USD", 0, true},
+		{"abc", "USD", 0, true},
+		{"92233720368547758.08", "USD", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value+" "+tt.currency, func(t *testing.T) {
+			got, err := ParseAmount(tt.value, tt.currency)
+			if (err != nil) != tt.err {
+				t.Fatalf("ParseAmount() err = %v, want error %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseAmount() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoneyFormat(t *testing.T) {
+	tests := []struct {
+		money   Money
+		decimal string
+		str     string
+	}{
+		{NewMoney(123450, "USD"), "1234.50", "USD 1,234.50"},
+		{NewMoney(-5, "USD"), "-0.05", "USD -0.05"},
+		{NewMoney(1234567, "IDR"), "1234567", "IDR 1,234,567"},
+		{NewMoney(1234, ""), "1234", "IDR 1,234"},
+		{NewMoney(1234, "KWD"), "1.234", "KWD 1.234"},
+		{NewMoney(0, "JPY"), "0", "JPY 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			if got := tt.money.Decimal(); got != tt.decimal {
+				t.Errorf("Decimal() = %q, want %q", got, tt.decimal)
+			}
+			if got := tt.money.String(); got != tt.str {
+				t.Errorf("String() = %q, want %q", got, tt.str)
+			}
+		})
+	}
+}
+
+func TestMoneyAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b Money
+		want int64
+		err  error
+	}{
+		{"add", NewMoney(100, "USD"), NewMoney(-30, "USD"), 70, nil},
+		{"other currency", NewMoney(100, "USD"), NewMoney(1, "EUR"), 0, ErrCurrencyMismatch},
+		{"overflow", NewMoney(math.MaxInt64, "USD"), NewMoney(1, "USD"), 0, ErrMoneyOverflow},
+		{"underflow", NewMoney(math.MinInt64, "USD"), NewMoney(-1, "USD"), 0, ErrMoneyOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.a.Add(tt.b)
+			if err != tt.err {
+				t.Fatalf("Add() err = %v, want %v", err, tt.err)
+			}
+			if got.Amount != tt.want {
+				t.Errorf("Add() = %d, want %d", got.Amount, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewMoney(0, "USD").Sub(NewMoney(math.MinInt64, "USD")); err != ErrMoneyOverflow {
+		t.Errorf("Sub(MinInt64) err = %v, want %v", err, ErrMoneyOverflow)
+	}
+}
+
+func TestCurrencyRules(t *testing.T) {
+	setupDB(t)
+	saving := newSaving(t, 100000, time.Now())
+	if err := database.DB.Model(saving).Update("currency", "USD").Error; err != nil {
+		t.Fatal(err)
+	}
+	saving = reload(t, saving)
+
+	// Fees and limits of another currency do not apply.
+	fee := FeeSchedule{Name: "IDR", AppliesTo: FeeOnWithdrawal, Method: FeeFlat, Flat: 5000, Active: true}
+	if err := fee.Store(); err != nil {
+		t.Fatal(err)
+	}
+	setLimit(ScopeSaving, TypeWithdrawal, Limit{PerTransaction: 10})(t, saving)
+	mustPost(t, &Transaction{SavingID: saving.ID, Type: TypeWithdrawal, Value: -1000})
+	if got := reload(t, saving).Balance; got != 99000 {
+		t.Errorf("balance = %d, want 99000", got)
+	}
+
+	// An interest product of another currency can not be used.
+	product := newProduct(t, 100, 0)
+	other := Saving{UserID: saving.UserID, Currency: "USD", InterestProductID: &product.ID}
+	if err := other.Store(); err != ErrCurrencyMismatch {
+		t.Errorf("Store() err = %v, want %v", err, ErrCurrencyMismatch)
+	}
+}
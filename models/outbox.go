@@ -0,0 +1,225 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"b-pay/config/events"
+	"b-pay/config/logger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Outbox topics.
+const (
+	TopicTransactionCreated = "transaction.created"
+	TopicBalanceChanged     = "saving.balance_changed"
+	TopicSavingCreated      = "saving.created"
+	TopicSavingDeleted      = "saving.deleted"
+	TopicBudgetAlert        = "budget.alert"
+)
+
+const (
+	// outboxBatch is how many events one relay run publishes.
+	outboxBatch = 100
+	// outboxMaxAttempts is how many times an event is published before it
+	// is FAILED and skipped.
+	outboxMaxAttempts = 10
+	// outboxBackoff is the wait before the second attempt. It doubles after
+	// every failed attempt.
+	outboxBackoff = 5 * time.Second
+)
+
+// ErrEventProcessed is returned by ConsumeOnce when the consumer already
+// processed the event.
+var ErrEventProcessed = errors.New("event is already processed")
+
+// OutboxEvent is a domain event written in the same DB transaction as the
+// change it describes, so it exists if and only if the change is committed.
+// The relay publishes it to events.Default at least once.
+type OutboxEvent struct {
+	gorm.Model
+	// EventID identifies the event for the consumers, see events.Message.
+	EventID       string     `gorm:"size:32;not null;uniqueIndex"`
+	Topic         string     `gorm:"size:50;not null"`
+	AggregateType string     `gorm:"size:20;not null"`
+	AggregateID   uint       `gorm:"not null"`
+	Payload       string     `gorm:"type:text;not null"`
+	PublishedAt   *time.Time `gorm:"index"`
+	Attempts      int        `gorm:"not null;default:0"`
+	LastError     string     `gorm:"size:500"`
+	// NextAttemptAt is when a failed event is published again.
+	NextAttemptAt *time.Time
+	// FailedAt is set when the event failed outboxMaxAttempts times. It is
+	// not published again nor pruned.
+	FailedAt *time.Time `gorm:"index"`
+}
+
+// ProcessedEvent records that a consumer processed an event, see
+// ConsumeOnce.
+type ProcessedEvent struct {
+	Consumer  string `gorm:"primaryKey;size:50"`
+	EventID   string `gorm:"primaryKey;size:32"`
+	CreatedAt time.Time
+}
+
+// BalanceChange is the payload of saving.balance_changed.
+type BalanceChange struct {
+	SavingID   uint
+	Currency   string
+	OldBalance int64
+	NewBalance int64
+}
+
+// writeOutbox writes an event about an aggregate within tx.
+func writeOutbox(tx *gorm.DB, topic, aggregateType string, aggregateID uint, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	eventID, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&OutboxEvent{
+		EventID:       eventID,
+		Topic:         topic,
+		AggregateType: aggregateType,
+		AggregateID:   aggregateID,
+		Payload:       string(payload),
+	}).Error
+}
+
+// message returns the event as an events.Message.
+func (e *OutboxEvent) message() events.Message {
+	return events.Message{
+		ID:        e.EventID,
+		Sequence:  e.ID,
+		Topic:     e.Topic,
+		Key:       fmt.Sprintf("%s:%d", e.AggregateType, e.AggregateID),
+		Payload:   json.RawMessage(e.Payload),
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// RelayOutbox publishes the unpublished events to events.Default in the
+// order they were written, per Key. A failing event is tried again with
+// exponential backoff and holds back the later events of its Key only, until
+// it is FAILED after outboxMaxAttempts. Concurrent relays skip the events
+// locked by each other.
+func RelayOutbox(now time.Time) (int, error) {
+	published := 0
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var pending []OutboxEvent
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("published_at IS NULL AND failed_at IS NULL").
+			Order("id").
+			Limit(outboxBatch).
+			Find(&pending).
+			Error
+		if err != nil {
+			return err
+		}
+
+		// blocked are the Keys with an event which is not published yet.
+		blocked := map[string]bool{}
+		for i := range pending {
+			event := &pending[i]
+			message := event.message()
+			if blocked[message.Key] {
+				continue
+			}
+			if event.NextAttemptAt != nil && event.NextAttemptAt.After(now) {
+				blocked[message.Key] = true
+				continue
+			}
+
+			if err := events.Default.Publish(message); err != nil {
+				if err := event.fail(tx, now, err); err != nil {
+					return err
+				}
+				if event.FailedAt == nil {
+					blocked[message.Key] = true
+				}
+				continue
+			}
+
+			err := tx.Model(event).Updates(map[string]interface{}{
+				"attempts":     gorm.Expr("attempts + 1"),
+				"published_at": now,
+				"last_error":   "",
+			}).Error
+			if err != nil {
+				return err
+			}
+			published++
+		}
+		return nil
+	})
+	return published, err
+}
+
+// fail records a failed attempt to publish the event, within tx, and when to
+// try again. The event is FAILED after outboxMaxAttempts.
+func (e *OutboxEvent) fail(tx *gorm.DB, now time.Time, cause error) error {
+	e.Attempts++
+	e.LastError = cause.Error()
+	if len(e.LastError) > 500 {
+		e.LastError = e.LastError[:500]
+	}
+	backoff := outboxBackoff
+	for i := 1; i < e.Attempts; i++ {
+		backoff *= 2
+	}
+	next := now.Add(backoff)
+	e.NextAttemptAt = &next
+	if e.Attempts >= outboxMaxAttempts {
+		e.FailedAt = &now
+		logger.Log.Error("outbox event failed",
+			zap.String("event_id", e.EventID),
+			zap.String("topic", e.Topic),
+			zap.Int("attempts", e.Attempts),
+			zap.Error(cause))
+	}
+
+	return tx.Model(e).Updates(map[string]interface{}{
+		"attempts":        e.Attempts,
+		"last_error":      e.LastError,
+		"next_attempt_at": e.NextAttemptAt,
+		"failed_at":       e.FailedAt,
+	}).Error
+}
+
+// PruneOutbox removes the events published before before, and what the
+// consumers processed before it.
+func PruneOutbox(before time.Time) error {
+	err := database.DB.Unscoped().Where("published_at < ?", before).Delete(&OutboxEvent{}).Error
+	if err != nil {
+		return err
+	}
+	return database.DB.Where("created_at < ?", before).Delete(&ProcessedEvent{}).Error
+}
+
+// ConsumeOnce runs fn for the Message unless consumer already processed it,
+// then returns ErrEventProcessed. fn runs in the same DB transaction as the
+// record of the processing, so its changes and the record commit together.
+func ConsumeOnce(consumer string, m events.Message, fn func(tx *gorm.DB) error) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ProcessedEvent{
+			Consumer: consumer,
+			EventID:  m.ID,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrEventProcessed
+		}
+		return fn(tx)
+	})
+}
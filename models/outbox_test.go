@@ -0,0 +1,92 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"b-pay/config/events"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingSink records the published Messages and fails the events in fail.
+type failingSink struct {
+	fail map[string]bool
+	got  []string
+}
+
+func (s *failingSink) Publish(m events.Message) error {
+	if s.fail[m.ID] {
+		return errors.New("sink is down")
+	}
+	s.got = append(s.got, m.Key+" "+m.Topic)
+	return nil
+}
+
+// writeEvents writes an event of topic for each of the Savings with ids.
+func writeEvents(t *testing.T, topic string, ids ...uint) []OutboxEvent {
+	t.Helper()
+	var results []OutboxEvent
+	for _, id := range ids {
+		if err := writeOutbox(database.DB, topic, "saving", id, nil); err != nil {
+			t.Fatal(err)
+		}
+		var event OutboxEvent
+		if err := database.DB.Order("id DESC").First(&event).Error; err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, event)
+	}
+	return results
+}
+
+func TestRelayOutbox(t *testing.T) {
+	setupDB(t)
+	sink := &failingSink{fail: map[string]bool{}}
+	defer func(old events.Sink) { events.Default = old }(events.Default)
+	events.Default = sink
+
+	first := writeEvents(t, TopicSavingCreated, 1, 2)
+	second := writeEvents(t, TopicBalanceChanged, 1, 2)
+	sink.fail[first[0].EventID] = true
+
+	// The failing event only holds back the later events of saving:1.
+	now := time.Now()
+	published, err := RelayOutbox(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published != 2 || len(sink.got) != 2 || sink.got[0] != "saving:2 saving.created" || sink.got[1] != "saving:2 saving.balance_changed" {
+		t.Fatalf("published %d: %v", published, sink.got)
+	}
+
+	// It is tried again after its backoff, until it fails for good.
+	if published, _ := RelayOutbox(now.Add(outboxBackoff - time.Second)); published != 0 {
+		t.Fatalf("published %d before the backoff", published)
+	}
+	for i := 1; i < outboxMaxAttempts; i++ {
+		now = now.Add(time.Duration(1<<uint(i)) * outboxBackoff)
+		if _, err := RelayOutbox(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var failed OutboxEvent
+	if err := database.DB.First(&failed, first[0].ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if failed.FailedAt == nil || failed.PublishedAt != nil || failed.Attempts != outboxMaxAttempts || failed.LastError != "sink is down" {
+		t.Errorf("failed event = %+v", failed)
+	}
+
+	// The later events of saving:1 are published once it failed.
+	if len(sink.got) != 3 || sink.got[2] != "saving:1 saving.balance_changed" {
+		t.Errorf("published %v", sink.got)
+	}
+	var later OutboxEvent
+	if err := database.DB.First(&later, second[0].ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if later.PublishedAt == nil {
+		t.Error("later event of saving:1 is not published")
+	}
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// pinMaxFailures is how many wrong PINs or keys in a row lock the PIN of
+	// a Saving.
+	pinMaxFailures = 5
+	// pinLockout is how long the PIN stays locked.
+	pinLockout = 15 * time.Minute
+)
+
+// ErrPINLocked is returned when the PIN of a Saving is locked after too many
+// wrong attempts.
+var ErrPINLocked = errors.New("PIN is locked after too many wrong attempts, try again later")
+
+// PINLocked reports whether the PIN of the Saving is locked at now.
+func (s *Saving) PINLocked(now time.Time) bool {
+	return s.PINLockedUntil != nil && now.Before(*s.PINLockedUntil)
+}
+
+// RecordPINFailure counts a wrong PIN or key for the Saving. The
+// pinMaxFailures-th one in a row locks the PIN for pinLockout, and returns
+// true.
+func (s *Saving) RecordPINFailure(now time.Time) (bool, error) {
+	locked := false
+	err := s.db().Transaction(func(tx *gorm.DB) error {
+		saving, err := lockSaving(tx, s.ID)
+		if err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{"pin_failures": saving.PINFailures + 1}
+		if saving.PINFailures+1 >= pinMaxFailures {
+			updates = map[string]interface{}{
+				"pin_failures":     0,
+				"pin_locked_until": now.Add(pinLockout),
+			}
+			locked = true
+		}
+		return tx.Model(&Saving{}).Where("id = ?", s.ID).Updates(updates).Error
+	})
+	return locked, err
+}
+
+// ResetPINFailures forgets the wrong PINs and keys of the Saving, after a
+// right one.
+func (s *Saving) ResetPINFailures() error {
+	if s.PINFailures == 0 {
+		return nil
+	}
+	return s.db().Model(&Saving{}).Where("id = ?", s.ID).Update("pin_failures", 0).Error
+}
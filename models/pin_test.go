@@ -0,0 +1,46 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPINLockout(t *testing.T) {
+	setupDB(t)
+	saving := newSaving(t, 0, time.Now())
+	now := time.Now()
+
+	for i := 1; i <= pinMaxFailures; i++ {
+		locked, err := saving.RecordPINFailure(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if locked != (i == pinMaxFailures) {
+			t.Fatalf("failure %d: locked = %v", i, locked)
+		}
+	}
+
+	saving = reload(t, saving)
+	if !saving.PINLocked(now) || !saving.PINLocked(now.Add(pinLockout-time.Second)) {
+		t.Error("PIN is not locked after too many failures")
+	}
+	if saving.PINLocked(now.Add(pinLockout)) {
+		t.Error("PIN is still locked after pinLockout")
+	}
+	if saving.PINFailures != 0 {
+		t.Errorf("PINFailures = %d after the lockout, want 0", saving.PINFailures)
+	}
+
+	// A right PIN starts the count over.
+	for i := 1; i < pinMaxFailures; i++ {
+		if _, err := saving.RecordPINFailure(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reload(t, saving).ResetPINFailures(); err != nil {
+		t.Fatal(err)
+	}
+	if locked, _ := saving.RecordPINFailure(now); locked {
+		t.Error("locked after a right PIN")
+	}
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"b-pay/config/database"
+)
+
+// BalanceMismatch is a Saving whose Balance is not the sum of its
+// Transactions.
+type BalanceMismatch struct {
+	SavingID uint
+	Balance  int64
+	Ledger   int64
+}
+
+// ReconcileBalances compares the Balance of every Saving with the sum of its
+// Transactions, and returns the ones which differ. One statement reads both,
+// so Transactions posted meanwhile do not show up as mismatches.
+func ReconcileBalances() ([]BalanceMismatch, error) {
+	var results []BalanceMismatch
+	err := database.DB.Raw(`
+		SELECT savings.id AS saving_id, savings.balance, COALESCE(SUM(transactions.value), 0) AS ledger
+		FROM savings
+		LEFT JOIN transactions ON transactions.saving_id = savings.id AND transactions.deleted_at IS NULL
+		WHERE savings.deleted_at IS NULL
+		GROUP BY savings.id, savings.balance
+		HAVING savings.balance <> COALESCE(SUM(transactions.value), 0)
+		ORDER BY savings.id`).
+		Scan(&results).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
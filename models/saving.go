@@ -2,51 +2,145 @@ package models
 
 import (
 	"b-pay/config/database"
+	"context"
+	"time"
 
 	"gorm.io/gorm"
 )
 
+// Saving kinds.
+const (
+	KindRegular     = "REGULAR"
+	KindTimeDeposit = "TIME_DEPOSIT"
+)
+
 // Saving defines every saving's data.
 type Saving struct {
 	gorm.Model
-	UserID       uint   `gorm:"not null"`
-	Name         string `gorm:"size:100"`
-	Balance      int64  `gorm:"not null"`
-	PIN          []byte `gorm:"size:6"`
-	Transactions []Transaction
+	UserID   uint   `gorm:"not null"`
+	Kind     string `gorm:"size:12;not null;default:REGULAR"` // REGULAR or TIME_DEPOSIT
+	Name     string `gorm:"size:100"`
+	Balance  int64  `gorm:"not null"`                    // In minor units of Currency
+	Currency string `gorm:"size:3;not null;default:IDR"` // ISO 4217
+	PIN      []byte `gorm:"size:6"`
+	// PINFailures are the wrong PINs and keys in a row, PINLockedUntil is
+	// set once there are too many, see RecordPINFailure.
+	PINFailures    int        `gorm:"not null;default:0" json:"-"`
+	PINLockedUntil *time.Time `json:"-"`
+	Transactions   []Transaction
+	// InterestProductID is set when the Saving earns interest.
+	InterestProductID *uint
+	// TargetAmount and TargetDate are the goal of the Saving. Optional.
+	TargetAmount int64 `gorm:"not null;default:0"`
+	TargetDate   *time.Time
+	// LockUntilGoal blocks withdrawals until TargetAmount or TargetDate is
+	// reached.
+	LockUntilGoal bool `gorm:"not null;default:false"`
+	// ApprovalThreshold is the WITHDRAWAL value above which a second owner
+	// must approve. 0 turns approvals off.
+	ApprovalThreshold int64 `gorm:"not null;default:0"`
+	// AvailableBalance is the Balance minus active Holds. Not stored.
+	AvailableBalance int64 `gorm:"-"`
+	// BalanceFormatted is the Balance with its currency. Not stored.
+	BalanceFormatted string `gorm:"-"`
+	// ctx is the context of the queries of the Saving, see WithContext.
+	ctx context.Context
 }
 
 // SavingIndex is a struct for GetSavingsByUserID return value.
 type SavingIndex struct {
-	ID      int
-	Name    string
-	Balance string
+	ID   int
+	Name string
+	// Balance is the formatted BalanceMinor, with its currency.
+	Balance      string `gorm:"-"`
+	BalanceMinor int64
+	Currency     string
+	TargetAmount int64
+	TargetDate   *time.Time
+	Progress     *GoalProgress `gorm:"-"`
+}
+
+// withContext returns database.DB with ctx, or without a context for nil.
+func withContext(ctx context.Context) *gorm.DB {
+	if ctx == nil {
+		return database.DB
+	}
+	return database.DB.WithContext(ctx)
+}
+
+// WithContext sets the context of the queries of the Saving, so they are
+// traced as part of a request. The Savings it gets keep the context.
+func (s *Saving) WithContext(ctx context.Context) *Saving {
+	s.ctx = ctx
+	return s
+}
+
+// db returns database.DB with the context of the Saving.
+func (s *Saving) db() *gorm.DB {
+	return withContext(s.ctx)
 }
 
 // Store stores Saving data to DB.
 func (s *Saving) Store() error {
-	err := database.DB.Create(&s).Error
+	if s.Currency == "" {
+		s.Currency = DefaultCurrency
+	}
+	if !ValidCurrency(s.Currency) {
+		return ErrUnknownCurrency
+	}
+	if err := checkProductCurrency(s.db(), s); err != nil {
+		return err
+	}
+	err := s.db().Create(&s).Error
 	return err
 }
 
+// Money returns the Balance of the Saving with its currency.
+func (s *Saving) Money() Money {
+	return NewMoney(s.Balance, s.Currency)
+}
+
+// AfterFind formats the Balance of every loaded Saving.
+func (s *Saving) AfterFind(tx *gorm.DB) error {
+	s.BalanceFormatted = s.Money().String()
+	return nil
+}
+
+// AfterSave formats the Balance of every stored Saving.
+func (s *Saving) AfterSave(tx *gorm.DB) error {
+	s.BalanceFormatted = s.Money().String()
+	return nil
+}
+
+// AfterCreate writes the saving.created event of every new Saving, in the
+// same DB transaction.
+func (s *Saving) AfterCreate(tx *gorm.DB) error {
+	return writeOutbox(tx, TopicSavingCreated, "saving", s.ID, s.event())
+}
+
 // GetSavingsByUserID get/fetch multiple Saving data with corresponded userID.
+// Includes the Savings shared with the User.
 func (s *Saving) GetSavingsByUserID(userID string) (*[]SavingIndex, error) {
 	var results []SavingIndex
-	query := database.DB.Model(&Saving{}).
-		Select("id, name, balance").
-		Where("user_id = ?", userID).
+	members := s.db().Model(&SavingMember{}).Select("saving_id").Where("user_id = ?", userID)
+	query := s.db().Model(&Saving{}).
+		Select("id, name, balance AS balance_minor, currency, target_amount, target_date").
+		Where("user_id = ? OR id IN (?)", userID, members).
 		Scan(&results)
 
 	if query.Error != nil {
 		return nil, query.Error
 	}
+	for i := range results {
+		results[i].Balance = NewMoney(results[i].BalanceMinor, results[i].Currency).String()
+	}
 	return &results, nil
 }
 
 // GetPINBySavingID gets/fetches a Saving PIN by searching Saving ID.
 func (s *Saving) GetPINBySavingID(savingID string) string {
 	var result string
-	err := database.DB.Model(&Saving{}).
+	err := s.db().Model(&Saving{}).
 		Select("pin").
 		Where("id = ?", savingID).
 		First(&result).
@@ -63,34 +157,52 @@ func (s *Saving) GetPINBySavingID(savingID string) string {
 func (s *Saving) GetSavingByID(id string) *Saving {
 	var result Saving
 	// err := database.DB.Where("id = ?", id).First(&result).Error
-	err := database.DB.Preload("Transactions").Where("savings.id = ?", id).First(&result).Error
+	err := s.db().Preload("Transactions").Where("savings.id = ?", id).First(&result).Error
 	if err != nil {
 		return nil
 	}
+	result.ctx = s.ctx
 	return &result
 }
 
 // Update updates the "source" data with the inputted data.
 func (s *Saving) Update(source *Saving) error {
-	err := database.DB.Model(&source).Updates(&s).Error
+	err := source.db().Model(&source).Updates(&s).Error
 	return err
 }
 
 // Delete deletes a Saving account data.
 // Changes balance to 0 first before soft-deleting the data.
 func (s *Saving) Delete() error {
-	err := database.DB.Model(&s).Update("balance", 0).Error
-	if err != nil {
-		return err
-	}
+	return s.db().Transaction(func(tx *gorm.DB) error {
+		if err := writeOutbox(tx, TopicSavingDeleted, "saving", s.ID, s.event()); err != nil {
+			return err
+		}
 
-	err = database.DB.Delete(&s).Error
-	return err
+		err := tx.Model(&s).Update("balance", 0).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete(&s).Error
+	})
 }
 
 // ChangeBalance changes the Balance of a Saving.
 // Call with the Source, in this case, the s.
 func (s *Saving) ChangeBalance(value int64) error {
-	err := database.DB.Model(&s).Update("balance", value).Error
+	err := s.db().Transaction(func(tx *gorm.DB) error {
+		return setBalance(tx, s, value)
+	})
 	return err
 }
+
+// IsTimeDeposit reports whether the Saving is a time deposit.
+func (s *Saving) IsTimeDeposit() bool {
+	return s.Kind == KindTimeDeposit
+}
+
+// GetAvailableBalance returns the Balance minus every active Hold.
+func (s *Saving) GetAvailableBalance() (int64, error) {
+	return availableBalance(s.db(), s)
+}
@@ -0,0 +1,451 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Schedule rules.
+const (
+	RuleDaily      = "DAILY"
+	RuleWeekly     = "WEEKLY"
+	RuleMonthly    = "MONTHLY"
+	RuleEndOfMonth = "END_OF_MONTH"
+	RuleCron       = "CRON"
+)
+
+// Schedule types. DEPOSIT and WITHDRAWAL work like a normal Transaction,
+// TRANSFER moves money from SavingID to TargetSavingID.
+const (
+	ScheduleTransfer = "TRANSFER"
+)
+
+// Missed run policies.
+const (
+	// MissedSkip only executes the latest due run, older ones are skipped.
+	MissedSkip = "SKIP"
+	// MissedCatchUp executes every due run in order.
+	MissedCatchUp = "CATCH_UP"
+)
+
+// Schedule statuses.
+const (
+	ScheduleActive    = "ACTIVE"
+	SchedulePaused    = "PAUSED"
+	ScheduleCancelled = "CANCELLED"
+	ScheduleFinished  = "FINISHED"
+)
+
+// Schedule run statuses.
+const (
+	RunPending   = "PENDING"
+	RunSucceeded = "SUCCEEDED"
+	RunFailed    = "FAILED"
+	RunSkipped   = "SKIPPED"
+)
+
+// retryBaseDelay is the delay before the first retry of a run. It doubles on
+// every attempt.
+const retryBaseDelay = 5 * time.Minute
+
+var (
+	// ErrInvalidRule is returned when a Schedule rule is unknown or misses
+	// its parameters.
+	ErrInvalidRule = errors.New("invalid schedule rule")
+	// ErrScheduleNotActive is returned when a Schedule can not run anymore.
+	ErrScheduleNotActive = errors.New("schedule is not active")
+	// ErrScheduleForbidden is the error of a run whose Schedule creator lost
+	// their role on one of its Savings.
+	ErrScheduleForbidden = errors.New("schedule creator is no longer allowed to use the saving")
+)
+
+// Schedule is a recurring Transaction. Every occurrence is executed once as a
+// ScheduleRun.
+type Schedule struct {
+	gorm.Model
+	UserID         uint   `gorm:"not null;index"`
+	SavingID       uint   `gorm:"not null;index"`
+	TargetSavingID *uint  // Only for TRANSFER.
+	Type           string `gorm:"size:11;not null"` // DEPOSIT, WITHDRAWAL or TRANSFER
+	Value          int64  `gorm:"not null"`
+	Description    string `gorm:"size:200"`
+
+	Rule string `gorm:"size:12;not null"`
+	// Hour and Minute of the day for every rule except CRON.
+	Hour   int `gorm:"not null;default:0"`
+	Minute int `gorm:"not null;default:0"`
+	// Weekday for WEEKLY, 0 is Sunday.
+	Weekday int `gorm:"not null;default:0"`
+	// DayOfMonth for MONTHLY. Months without that day run on their last day.
+	DayOfMonth int `gorm:"not null;default:0"`
+	// CronExpr for CRON, e.g. "0 9 1,15 * *".
+	CronExpr string `gorm:"size:100"`
+
+	MissedPolicy string     `gorm:"size:8;not null"`
+	MaxRetries   int        `gorm:"not null;default:3"`
+	Status       string     `gorm:"size:10;not null;index"`
+	NextRunAt    time.Time  `gorm:"not null;index"`
+	EndAt        *time.Time // No more runs after EndAt. Optional.
+	Runs         []ScheduleRun
+}
+
+// ScheduleRun is one occurrence of a Schedule. (ScheduleID, RunAt) is unique,
+// so an occurrence can never be executed twice.
+type ScheduleRun struct {
+	gorm.Model
+	ScheduleID    uint      `gorm:"not null;uniqueIndex:idx_schedule_run"`
+	RunAt         time.Time `gorm:"not null;uniqueIndex:idx_schedule_run"`
+	Status        string    `gorm:"size:10;not null;index"`
+	Attempts      int       `gorm:"not null;default:0"`
+	NextAttemptAt *time.Time
+	TransactionID *uint
+	Error         string `gorm:"size:200"`
+}
+
+// Validate checks the rule parameters and the Transaction of the Schedule.
+func (s *Schedule) Validate() error {
+	switch s.Rule {
+	case RuleDaily, RuleEndOfMonth:
+	case RuleWeekly:
+		if s.Weekday < 0 || s.Weekday > 6 {
+			return ErrInvalidRule
+		}
+	case RuleMonthly:
+		if s.DayOfMonth < 1 || s.DayOfMonth > 31 {
+			return ErrInvalidRule
+		}
+	case RuleCron:
+		if _, err := parseCron(s.CronExpr); err != nil {
+			return err
+		}
+	default:
+		return ErrInvalidRule
+	}
+
+	if s.Rule != RuleCron && (s.Hour < 0 || s.Hour > 23 || s.Minute < 0 || s.Minute > 59) {
+		return ErrInvalidRule
+	}
+
+	if s.MissedPolicy != MissedSkip && s.MissedPolicy != MissedCatchUp {
+		return errors.New("missed policy must be SKIP or CATCH_UP")
+	}
+
+	if s.Value <= 0 {
+		return errors.New("value must be more than 0")
+	}
+
+	switch s.Type {
+	case TypeDeposit, TypeWithdrawal:
+	case ScheduleTransfer:
+		if s.TargetSavingID == nil || *s.TargetSavingID == s.SavingID {
+			return errors.New("transfer needs a different target saving")
+		}
+	default:
+		return errors.New("type must be DEPOSIT, WITHDRAWAL or TRANSFER")
+	}
+	return nil
+}
+
+// lastDayOfMonth returns the number of days in the month of t.
+func lastDayOfMonth(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, t.Location()).Day()
+}
+
+// matchesDay reports whether the date of d is a run day of a calendar rule.
+func (s *Schedule) matchesDay(d time.Time) bool {
+	switch s.Rule {
+	case RuleDaily:
+		return true
+	case RuleWeekly:
+		return int(d.Weekday()) == s.Weekday
+	case RuleMonthly:
+		day := s.DayOfMonth
+		if last := lastDayOfMonth(d); day > last {
+			day = last
+		}
+		return d.Day() == day
+	case RuleEndOfMonth:
+		return d.Day() == lastDayOfMonth(d)
+	}
+	return false
+}
+
+// NextAfter returns the first occurrence of the Schedule after t.
+func (s *Schedule) NextAfter(t time.Time) time.Time {
+	if s.Rule == RuleCron {
+		spec, err := parseCron(s.CronExpr)
+		if err != nil {
+			return time.Time{}
+		}
+		return spec.next(t)
+	}
+
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	// Every calendar rule runs at least once in 2 months.
+	for i := 0; i < 62; i++ {
+		d := day.AddDate(0, 0, i)
+		if !s.matchesDay(d) {
+			continue
+		}
+		candidate := time.Date(d.Year(), d.Month(), d.Day(), s.Hour, s.Minute, 0, 0, d.Location())
+		if candidate.After(t) {
+			return candidate
+		}
+	}
+	return time.Time{}
+}
+
+// Store validates and stores the Schedule. The first run is the first
+// occurrence after now.
+func (s *Schedule) Store() error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	s.Status = ScheduleActive
+	s.NextRunAt = s.NextAfter(time.Now())
+	return database.DB.Create(&s).Error
+}
+
+// GetSchedulesByUserID gets/fetches every Schedule of a User.
+func (s *Schedule) GetSchedulesByUserID(userID string) (*[]Schedule, error) {
+	var results []Schedule
+	err := database.DB.Where("user_id = ?", userID).Order("id").Find(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// GetScheduleByID gets/fetches a Schedule with its runs by searching the ID.
+func (s *Schedule) GetScheduleByID(id string) *Schedule {
+	var result Schedule
+	err := database.DB.Preload("Runs").Where("id = ?", id).First(&result).Error
+	if err != nil {
+		return nil
+	}
+	return &result
+}
+
+// UpdateStatus changes the Status of the Schedule. Resuming a paused Schedule
+// continues from the next occurrence, missed ones are not executed.
+func (s *Schedule) UpdateStatus(status string) error {
+	if s.Status == ScheduleCancelled || s.Status == ScheduleFinished {
+		return ErrScheduleNotActive
+	}
+	updates := map[string]interface{}{"status": status}
+	if status == ScheduleActive && s.Status == SchedulePaused {
+		updates["next_run_at"] = s.NextAfter(time.Now())
+	}
+	return database.DB.Model(&s).Updates(updates).Error
+}
+
+// GetDueSchedules gets/fetches every active Schedule whose next run is due.
+func GetDueSchedules(now time.Time) ([]Schedule, error) {
+	var results []Schedule
+	err := database.DB.
+		Where("status = ? AND next_run_at <= ?", ScheduleActive, now).
+		Order("next_run_at").
+		Find(&results).
+		Error
+	return results, err
+}
+
+// GetRetryableRuns gets/fetches every pending run whose next attempt is due.
+func GetRetryableRuns(now time.Time) ([]ScheduleRun, error) {
+	var results []ScheduleRun
+	err := database.DB.
+		Where("status = ? AND next_attempt_at <= ?", RunPending, now).
+		Order("next_attempt_at").
+		Find(&results).
+		Error
+	return results, err
+}
+
+// Advance creates a run for every occurrence of the Schedule due at now and
+// moves NextRunAt to the first occurrence after now. With the SKIP policy
+// only the latest due occurrence is kept, the others are stored as SKIPPED.
+//
+// Runs are created in the same DB transaction as the NextRunAt update, so an
+// occurrence is never created twice. Returns the runs that must be executed.
+func (s *Schedule) Advance(now time.Time) ([]ScheduleRun, error) {
+	var runs []ScheduleRun
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", s.ID).
+			First(&s).
+			Error
+		if err != nil {
+			return err
+		}
+		// Another worker has already advanced it.
+		if s.Status != ScheduleActive || s.NextRunAt.After(now) {
+			return nil
+		}
+
+		var due []time.Time
+		next := s.NextRunAt
+		for !next.IsZero() && !next.After(now) {
+			if s.EndAt != nil && next.After(*s.EndAt) {
+				break
+			}
+			due = append(due, next)
+			next = s.NextAfter(next)
+		}
+
+		for i, runAt := range due {
+			// A pending run is picked up by the retries if the worker
+			// stops before executing it.
+			attemptAt := runAt
+			run := ScheduleRun{
+				ScheduleID:    s.ID,
+				RunAt:         runAt,
+				Status:        RunPending,
+				NextAttemptAt: &attemptAt,
+			}
+			if s.MissedPolicy == MissedSkip && i < len(due)-1 {
+				run.Status = RunSkipped
+				run.NextAttemptAt = nil
+			}
+			// The unique index ignores an occurrence which already exists.
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&run)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 1 && run.Status == RunPending {
+				runs = append(runs, run)
+			}
+		}
+
+		updates := map[string]interface{}{"next_run_at": next}
+		if next.IsZero() || (s.EndAt != nil && next.After(*s.EndAt)) {
+			updates["status"] = ScheduleFinished
+		}
+		return tx.Model(&s).Updates(updates).Error
+	})
+	return runs, err
+}
+
+// Execute executes a pending run. On success the Transaction is posted and
+// the run is SUCCEEDED. When the balance is not enough, the run is retried
+// with an exponential back-off until the Schedule MaxRetries is reached. Runs
+// of a paused or cancelled Schedule are SKIPPED. When the creator lost their
+// role on one of its Savings, the run FAILS and the Schedule is cancelled.
+//
+// The run row is locked while executing, so it can never post twice.
+func (r *ScheduleRun) Execute(now time.Time) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", r.ID).
+			First(&r).
+			Error
+		if err != nil {
+			return err
+		}
+		if r.Status != RunPending {
+			return nil
+		}
+
+		var schedule Schedule
+		if err := tx.Where("id = ?", r.ScheduleID).First(&schedule).Error; err != nil {
+			return err
+		}
+		// Pausing or cancelling a Schedule also stops its runs waiting for
+		// a retry.
+		if schedule.Status == SchedulePaused || schedule.Status == ScheduleCancelled {
+			r.Status = RunSkipped
+			r.NextAttemptAt = nil
+			return tx.Save(&r).Error
+		}
+
+		allowed, err := schedule.allowed(tx)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			r.Status = RunFailed
+			r.NextAttemptAt = nil
+			r.Error = ErrScheduleForbidden.Error()
+			if err := tx.Model(&schedule).Update("status", ScheduleCancelled).Error; err != nil {
+				return err
+			}
+			err := auditTx(tx, AuditScheduleUpdated, "schedule", schedule.ID, nil, map[string]string{"Status": ScheduleCancelled})
+			if err != nil {
+				return err
+			}
+			return tx.Save(&r).Error
+		}
+
+		// Failures of the posting are rolled back to this savepoint, so the
+		// run itself can still be updated.
+		if err := tx.SavePoint("schedule_run").Error; err != nil {
+			return err
+		}
+
+		transaction, err := schedule.post(tx, r.RunAt)
+		r.Attempts++
+		if err == nil {
+			r.Status = RunSucceeded
+			r.TransactionID = &transaction.ID
+			r.NextAttemptAt = nil
+			r.Error = ""
+			return tx.Save(&r).Error
+		}
+
+		if err := tx.RollbackTo("schedule_run").Error; err != nil {
+			return err
+		}
+
+		r.Error = err.Error()
+		if len(r.Error) > 200 {
+			r.Error = r.Error[:200]
+		}
+		retryable := err == ErrInsufficientBalance || err == ErrInsufficientAvailableBalance
+		if !retryable || r.Attempts > schedule.MaxRetries {
+			r.Status = RunFailed
+			r.NextAttemptAt = nil
+		} else {
+			nextAttempt := now.Add(retryBaseDelay << uint(r.Attempts-1))
+			r.NextAttemptAt = &nextAttempt
+		}
+		return tx.Save(&r).Error
+	})
+}
+
+// allowed reports whether the User of the Schedule still has the roles it
+// was created with, within tx. Contributors can only schedule deposits.
+func (s *Schedule) allowed(tx *gorm.DB) (bool, error) {
+	sourceRole := RoleOwner
+	if s.Type == TypeDeposit {
+		sourceRole = RoleContributor
+	}
+	ok, err := hasRole(tx, s.SavingID, s.UserID, sourceRole)
+	if err != nil || !ok || s.TargetSavingID == nil {
+		return ok, err
+	}
+	return hasRole(tx, *s.TargetSavingID, s.UserID, RoleContributor)
+}
+
+// post posts the Transaction of an occurrence of the Schedule within tx.
+func (s *Schedule) post(tx *gorm.DB, runAt time.Time) (*Transaction, error) {
+	description := s.Description
+	if description == "" {
+		description = fmt.Sprintf("Scheduled %s of %s", s.Type, runAt.Format("2006-01-02"))
+	}
+
+	switch s.Type {
+	case ScheduleTransfer:
+		withdrawal, _, err := transfer(tx, s.SavingID, *s.TargetSavingID, s.Value, description)
+		return withdrawal, err
+	case TypeWithdrawal:
+		transaction := Transaction{SavingID: s.SavingID, Type: TypeWithdrawal, Value: -s.Value, Description: description}
+		return &transaction, post(tx, &transaction)
+	default:
+		transaction := Transaction{SavingID: s.SavingID, Type: TypeDeposit, Value: s.Value, Description: description}
+		return &transaction, post(tx, &transaction)
+	}
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"testing"
+	"time"
+)
+
+func TestScheduleRunChecksRoles(t *testing.T) {
+	setupDB(t)
+	now := time.Now()
+	saving := newSaving(t, 1000, now)
+	owner := newUser(t, "owner@example.com")
+	if err := database.DB.Create(&SavingMember{SavingID: saving.ID, UserID: owner.ID, Role: RoleOwner}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	schedule := Schedule{UserID: owner.ID, SavingID: saving.ID, Type: TypeWithdrawal, Value: 100, Rule: RuleDaily, MissedPolicy: MissedCatchUp}
+	if err := schedule.Store(); err != nil {
+		t.Fatal(err)
+	}
+	execute := func(runAt time.Time) *ScheduleRun {
+		t.Helper()
+		run := ScheduleRun{ScheduleID: schedule.ID, RunAt: runAt, Status: RunPending}
+		if err := database.DB.Create(&run).Error; err != nil {
+			t.Fatal(err)
+		}
+		if err := run.Execute(now); err != nil {
+			t.Fatal(err)
+		}
+		return &run
+	}
+
+	if run := execute(now); run.Status != RunSucceeded {
+		t.Fatalf("run of an owner = %+v", run)
+	}
+
+	// Once demoted, the Schedule of the former owner stops.
+	if err := database.DB.Model(&SavingMember{}).Where("user_id = ?", owner.ID).Update("role", RoleContributor).Error; err != nil {
+		t.Fatal(err)
+	}
+	run := execute(now.Add(time.Hour))
+	if run.Status != RunFailed || run.Error != ErrScheduleForbidden.Error() || run.TransactionID != nil {
+		t.Errorf("run of a contributor = %+v", run)
+	}
+	if reload(t, saving).Balance != 900 {
+		t.Errorf("balance = %d, want 900", reload(t, saving).Balance)
+	}
+	var stored Schedule
+	if err := database.DB.First(&stored, schedule.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != ScheduleCancelled {
+		t.Errorf("schedule status = %s, want %s", stored.Status, ScheduleCancelled)
+	}
+}
@@ -0,0 +1,335 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"b-pay/config/logger"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidPeriod is returned when a statement period ends before it starts.
+var ErrInvalidPeriod = errors.New("period must end after it starts")
+
+// StatementLine is one Transaction of a Statement with the balance after it.
+type StatementLine struct {
+	TransactionID uint
+	Date          time.Time
+	Type          string
+	Description   string
+	Value         Money
+	Balance       Money
+}
+
+// Statement is the activity of a Saving from From until To, excluded.
+type Statement struct {
+	SavingID       uint
+	SavingName     string
+	Currency       string
+	From           time.Time
+	To             time.Time
+	OpeningBalance Money
+	ClosingBalance Money
+	Lines          []StatementLine
+	// Totals sums the Transaction values of every type.
+	Totals map[string]Money
+}
+
+// StoredStatement is a monthly Statement generated for later download. One
+// per month, so a month is never generated twice.
+type StoredStatement struct {
+	gorm.Model
+	SavingID       uint      `gorm:"not null;uniqueIndex:idx_statement_period"`
+	Period         string    `gorm:"size:7;not null;uniqueIndex:idx_statement_period"` // YYYY-MM
+	From           time.Time `gorm:"not null"`
+	To             time.Time `gorm:"not null"`
+	Currency       string    `gorm:"size:3;not null"`
+	OpeningBalance int64     `gorm:"not null"`
+	ClosingBalance int64     `gorm:"not null"`
+	PDF            []byte    `gorm:"not null" json:"-"`
+	CSV            []byte    `gorm:"not null" json:"-"`
+}
+
+// BuildStatement builds the Statement of the Saving from from until to,
+// excluded, from its Transactions.
+func BuildStatement(saving *Saving, from, to time.Time) (*Statement, error) {
+	if !to.After(from) {
+		return nil, ErrInvalidPeriod
+	}
+
+	var opening int64
+	err := database.DB.Model(&Transaction{}).
+		Select("COALESCE(SUM(value), 0)").
+		Where("saving_id = ? AND created_at < ?", saving.ID, from).
+		Scan(&opening).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	var transactions []Transaction
+	err = database.DB.
+		Where("saving_id = ? AND created_at >= ? AND created_at < ?", saving.ID, from, to).
+		Order("created_at, id").
+		Find(&transactions).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	statement := Statement{
+		SavingID:       saving.ID,
+		SavingName:     saving.Name,
+		Currency:       saving.Currency,
+		From:           from,
+		To:             to,
+		OpeningBalance: NewMoney(opening, saving.Currency),
+		Totals:         map[string]Money{},
+	}
+
+	balance := statement.OpeningBalance
+	for _, t := range transactions {
+		balance, err = balance.Add(t.Money())
+		if err != nil {
+			return nil, err
+		}
+		total, ok := statement.Totals[t.Type]
+		if !ok {
+			total = NewMoney(0, saving.Currency)
+		}
+		if statement.Totals[t.Type], err = total.Add(t.Money()); err != nil {
+			return nil, err
+		}
+
+		statement.Lines = append(statement.Lines, StatementLine{
+			TransactionID: t.ID,
+			Date:          t.CreatedAt,
+			Type:          t.Type,
+			Description:   t.Description,
+			Value:         t.Money(),
+			Balance:       balance,
+		})
+	}
+	statement.ClosingBalance = balance
+
+	return &statement, nil
+}
+
+// types returns the Transaction types of the Totals in order.
+func (s *Statement) types() []string {
+	var results []string
+	for kind := range s.Totals {
+		results = append(results, kind)
+	}
+	sort.Strings(results)
+	return results
+}
+
+// lastDay returns the last day of the Statement, To is excluded.
+func (s *Statement) lastDay() time.Time {
+	return s.To.Add(-time.Nanosecond)
+}
+
+// csvText quotes text written by Users for a CSV cell. Text starting like a
+// formula gets a ' in front, so spreadsheets show it as text.
+func csvText(text string) string {
+	if text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+// CSV renders the Statement as CSV. Amounts are plain decimals in the
+// currency of the Saving.
+func (s *Statement) CSV() ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+
+	rows := [][]string{
+		{"Statement", csvText(s.SavingName)},
+		{"Saving", strconv.FormatUint(uint64(s.SavingID), 10)},
+		{"Currency", s.Currency},
+		{"Period", s.From.Format("2006-01-02"), s.lastDay().Format("2006-01-02")},
+		{"Opening balance", s.OpeningBalance.Decimal()},
+		{},
+		{"Date", "Transaction", "Type", "Description", "Value", "Balance"},
+	}
+	for _, line := range s.Lines {
+		rows = append(rows, []string{
+			line.Date.Format("2006-01-02 15:04:05"),
+			strconv.FormatUint(uint64(line.TransactionID), 10),
+			line.Type,
+			csvText(line.Description),
+			line.Value.Decimal(),
+			line.Balance.Decimal(),
+		})
+	}
+	rows = append(rows, []string{}, []string{"Closing balance", s.ClosingBalance.Decimal()})
+	for _, kind := range s.types() {
+		rows = append(rows, []string{"Total " + kind, s.Totals[kind].Decimal()})
+	}
+
+	if err := writer.WriteAll(rows); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// PDF renders the Statement as an A4 PDF.
+func (s *Statement) PDF() ([]byte, error) {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	widths := []float64{32, 22, 66, 35, 35}
+
+	header := func() {
+		pdf.SetFont("Helvetica", "B", 9)
+		for i, title := range []string{"Date", "Type", "Description", "Value", "Balance"} {
+			align := "L"
+			if i >= 3 {
+				align = "R"
+			}
+			pdf.CellFormat(widths[i], 7, title, "B", 0, align, false, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont("Helvetica", "", 9)
+	}
+
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-15)
+		pdf.SetFont("Helvetica", "", 8)
+		pdf.CellFormat(0, 10, fmt.Sprintf("Page %d", pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 14)
+	pdf.CellFormat(0, 10, tr(fmt.Sprintf("Statement of %s", s.SavingName)), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.CellFormat(0, 6, fmt.Sprintf("Saving %d, %s", s.SavingID, s.Currency), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, fmt.Sprintf("Period %s to %s", s.From.Format("2006-01-02"), s.lastDay().Format("2006-01-02")), "", 1, "L", false, 0, "")
+	pdf.CellFormat(0, 6, fmt.Sprintf("Opening balance %s", s.OpeningBalance), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	header()
+	for _, line := range s.Lines {
+		// Repeat the table header on every new page.
+		if pdf.GetY() > 270 {
+			pdf.AddPage()
+			header()
+		}
+		description := []rune(line.Description)
+		if len(description) > 40 {
+			description = description[:40]
+		}
+		pdf.CellFormat(widths[0], 6, line.Date.Format("2006-01-02 15:04"), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[1], 6, line.Type, "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[2], 6, tr(string(description)), "", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[3], 6, line.Value.Decimal(), "", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 6, line.Balance.Decimal(), "", 1, "R", false, 0, "")
+	}
+
+	pdf.Ln(4)
+	pdf.SetFont("Helvetica", "B", 10)
+	pdf.CellFormat(0, 6, fmt.Sprintf("Closing balance %s", s.ClosingBalance), "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 10)
+	for _, kind := range s.types() {
+		pdf.CellFormat(0, 6, fmt.Sprintf("Total %s %s", kind, s.Totals[kind]), "", 1, "L", false, 0, "")
+	}
+
+	var buffer bytes.Buffer
+	if err := pdf.Output(&buffer); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// GetStoredStatementsBySavingID gets/fetches every StoredStatement of a
+// Saving, without their files.
+func GetStoredStatementsBySavingID(savingID uint) (*[]StoredStatement, error) {
+	var results []StoredStatement
+	err := database.DB.
+		Omit("pdf", "csv").
+		Where("saving_id = ?", savingID).
+		Order("period DESC").
+		Find(&results).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// GetStoredStatement gets/fetches the StoredStatement of a Saving for a
+// period.
+func GetStoredStatement(savingID uint, period string) *StoredStatement {
+	var result StoredStatement
+	err := database.DB.Where("saving_id = ? AND period = ?", savingID, period).First(&result).Error
+	if err != nil {
+		return nil
+	}
+	return &result
+}
+
+// GenerateMonthlyStatements generates and stores the Statement of the month
+// of date for every Saving which existed by the end of the month. Running it
+// again for the same month generates nothing.
+func GenerateMonthlyStatements(date time.Time) error {
+	from := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, date.Location())
+	to := from.AddDate(0, 1, 0)
+	period := from.Format("2006-01")
+
+	generated := database.DB.Model(&StoredStatement{}).Select("saving_id").Where("period = ?", period)
+
+	var savings []Saving
+	err := database.DB.
+		Where("created_at < ? AND id NOT IN (?)", to, generated).
+		Order("id").
+		Find(&savings).
+		Error
+	if err != nil {
+		return err
+	}
+
+	for i := range savings {
+		if err := storeStatement(&savings[i], period, from, to); err != nil {
+			logger.Log.Error("statement failed", zap.Uint("saving_id", savings[i].ID), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// storeStatement builds, renders and stores one monthly Statement.
+func storeStatement(saving *Saving, period string, from, to time.Time) error {
+	statement, err := BuildStatement(saving, from, to)
+	if err != nil {
+		return err
+	}
+	pdf, err := statement.PDF()
+	if err != nil {
+		return err
+	}
+	csv, err := statement.CSV()
+	if err != nil {
+		return err
+	}
+
+	return database.DB.Create(&StoredStatement{
+		SavingID:       saving.ID,
+		Period:         period,
+		From:           from,
+		To:             to,
+		Currency:       saving.Currency,
+		OpeningBalance: statement.OpeningBalance.Amount,
+		ClosingBalance: statement.ClosingBalance.Amount,
+		PDF:            pdf,
+		CSV:            csv,
+	}).Error
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestStatementCSVFormulas(t *testing.T) {
+	from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	statement := Statement{
+		SavingName:     "=HYPERLINK(\"http://example.com\")",
+		Currency:       "IDR",
+		From:           from,
+		To:             from.AddDate(0, 1, 0),
+		OpeningBalance: NewMoney(0, "IDR"),
+		ClosingBalance: NewMoney(0, "IDR"),
+	}
+	descriptions := []string{"=1+1", "+1", "-1", "@SUM(A1)", "\tTab", "Lunch - cafe", ""}
+	for i, description := range descriptions {
+		statement.Lines = append(statement.Lines, StatementLine{uint(i + 1), from, TypeDeposit, description, NewMoney(0, "IDR"), NewMoney(0, "IDR")})
+	}
+
+	doc, err := statement.CSV()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := csv.NewReader(bytes.NewReader(doc))
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rows[0][1] != "'=HYPERLINK(\"http://example.com\")" {
+		t.Errorf("saving name = %q", rows[0][1])
+	}
+	want := []string{"'=1+1", "'+1", "'-1", "'@SUM(A1)", "'\tTab", "Lunch - cafe", ""}
+	for i := range want {
+		// The lines follow the header and the column titles, the reader skips
+		// the empty row.
+		if got := rows[6+i][3]; got != want[i] {
+			t.Errorf("description %q = %q, want %q", descriptions[i], got, want[i])
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"b-pay/config/events"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// StreamTopics are the outbox topics pushed to the live streams of the
+// Savings.
+var StreamTopics = []string{TopicBalanceChanged, TopicTransactionCreated}
+
+const (
+	// StreamLookback is how late an outbox event can commit after an event
+	// with a greater ID and still be streamed. IDs are taken when the events
+	// are written, not when they commit.
+	StreamLookback = time.Minute
+	// streamTailBatch is how many events one StreamTail read returns.
+	streamTailBatch = 500
+	// streamMaxGap is the most IDs a StreamTail read can skip at once and
+	// read again. Greater jumps, like after the outbox was pruned empty, are
+	// not gaps.
+	streamMaxGap = 1000
+)
+
+// StreamEvent is an outbox event of a Saving as the live streams send it. ID
+// is the sequence of the event, clients resume after it.
+type StreamEvent struct {
+	ID        uint
+	Topic     string
+	SavingID  uint
+	Payload   json.RawMessage
+	CreatedAt time.Time
+}
+
+// NewStreamEvent returns the StreamEvent of a Message. False if the Message is
+// not about a Saving.
+func NewStreamEvent(m events.Message) (StreamEvent, bool) {
+	var savingID uint
+	if _, err := fmt.Sscanf(m.Key, "saving:%d", &savingID); err != nil {
+		return StreamEvent{}, false
+	}
+	return StreamEvent{
+		ID:        m.Sequence,
+		Topic:     m.Topic,
+		SavingID:  savingID,
+		Payload:   m.Payload,
+		CreatedAt: m.CreatedAt,
+	}, true
+}
+
+// GetViewableSavingIDs returns the IDs of every Saving the User can see,
+// owned or shared.
+func GetViewableSavingIDs(userID uint) ([]uint, error) {
+	var results []uint
+	members := database.DB.Model(&SavingMember{}).Select("saving_id").Where("user_id = ?", userID)
+	err := database.DB.Model(&Saving{}).
+		Where("user_id = ? OR id IN (?)", userID, members).
+		Pluck("id", &results).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// StreamTail reads the outbox events of every Saving as they commit, so each
+// instance streams every event, whichever instance relayed it. The IDs
+// skipped by a read are read again until StreamLookback, for the events which
+// commit after a greater ID.
+type StreamTail struct {
+	lastID uint
+	// gaps are the skipped IDs, with when they were first skipped.
+	gaps map[uint]time.Time
+}
+
+// NewStreamTail returns a StreamTail starting after the latest event.
+func NewStreamTail() (*StreamTail, error) {
+	var lastIDs []uint
+	if err := database.DB.Model(&OutboxEvent{}).Order("id DESC").Limit(1).Pluck("id", &lastIDs).Error; err != nil {
+		return nil, err
+	}
+	tail := &StreamTail{gaps: map[uint]time.Time{}}
+	if len(lastIDs) > 0 {
+		tail.lastID = lastIDs[0]
+	}
+	return tail, nil
+}
+
+// Next returns the stream events committed since the last read, each once,
+// ID order within a read.
+func (t *StreamTail) Next(now time.Time) ([]StreamEvent, error) {
+	gapIDs := make([]uint, 0, len(t.gaps))
+	for id, since := range t.gaps {
+		if now.Sub(since) > StreamLookback {
+			delete(t.gaps, id)
+			continue
+		}
+		gapIDs = append(gapIDs, id)
+	}
+
+	query := database.DB.Where("id > ?", t.lastID)
+	if len(gapIDs) > 0 {
+		query = query.Or("id IN ?", gapIDs)
+	}
+	var outbox []OutboxEvent
+	if err := query.Order("id").Limit(streamTailBatch).Find(&outbox).Error; err != nil {
+		return nil, err
+	}
+
+	var results []StreamEvent
+	for i := range outbox {
+		id := outbox[i].ID
+		delete(t.gaps, id)
+		for gap := t.lastID + 1; gap < id && id-t.lastID <= streamMaxGap; gap++ {
+			t.gaps[gap] = now
+		}
+		if id > t.lastID {
+			t.lastID = id
+		}
+		if !isStreamTopic(outbox[i].Topic) {
+			continue
+		}
+		if event, ok := NewStreamEvent(outbox[i].message()); ok {
+			results = append(results, event)
+		}
+	}
+	return results, nil
+}
+
+// isStreamTopic reports whether topic is one of StreamTopics.
+func isStreamTopic(topic string) bool {
+	for _, streamed := range StreamTopics {
+		if topic == streamed {
+			return true
+		}
+	}
+	return false
+}
+
+// GetStreamResumeID returns the ID to resume the stream of the Savings after,
+// for a client whose last event is lastID. It goes StreamLookback back, so
+// the events committed after lastID with a smaller ID are sent too. Clients
+// skip the IDs they already have.
+func GetStreamResumeID(savingIDs []uint, lastID uint) (uint, error) {
+	var last OutboxEvent
+	err := database.DB.Where("id = ?", lastID).First(&last).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Pruned, or never written: resume after it as it is.
+		return lastID, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var firstIDs []uint
+	err = database.DB.Model(&OutboxEvent{}).
+		Where("id <= ? AND created_at >= ? AND aggregate_type = ? AND aggregate_id IN ? AND topic IN ?",
+			lastID, last.CreatedAt.Add(-StreamLookback), "saving", savingIDs, StreamTopics).
+		Order("id").
+		Limit(1).
+		Pluck("id", &firstIDs).
+		Error
+	if err != nil || len(firstIDs) == 0 || firstIDs[0] == lastID {
+		return lastID, err
+	}
+	return firstIDs[0] - 1, nil
+}
+
+// GetStreamEvents returns at most limit events of the Savings written after
+// the event afterID, oldest first. Events pruned from the outbox are gone.
+func GetStreamEvents(savingIDs []uint, afterID uint, limit int) ([]StreamEvent, error) {
+	if len(savingIDs) == 0 {
+		return nil, nil
+	}
+
+	var outbox []OutboxEvent
+	err := database.DB.
+		Where("id > ? AND aggregate_type = ? AND aggregate_id IN ? AND topic IN ?",
+			afterID, "saving", savingIDs, StreamTopics).
+		Order("id").
+		Limit(limit).
+		Find(&outbox).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]StreamEvent, 0, len(outbox))
+	for i := range outbox {
+		event, _ := NewStreamEvent(outbox[i].message())
+		results = append(results, event)
+	}
+	return results, nil
+}
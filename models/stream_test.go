@@ -0,0 +1,121 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"testing"
+	"time"
+)
+
+// hideEvents removes the events from the outbox, as if they were not
+// committed yet, and returns them.
+func hideEvents(t *testing.T, hidden ...OutboxEvent) []OutboxEvent {
+	t.Helper()
+	for _, event := range hidden {
+		if err := database.DB.Unscoped().Delete(&OutboxEvent{}, event.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return hidden
+}
+
+// commitEvents writes the hidden events back with their IDs.
+func commitEvents(t *testing.T, hidden ...OutboxEvent) {
+	t.Helper()
+	for _, event := range hidden {
+		if err := database.DB.Create(&event).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// streamIDs returns the IDs of the events.
+func streamIDs(events []StreamEvent) []uint {
+	var results []uint
+	for _, event := range events {
+		results = append(results, event.ID)
+	}
+	return results
+}
+
+func TestStreamTail(t *testing.T) {
+	setupDB(t)
+	writeEvents(t, TopicBalanceChanged, 1)
+	tail, err := NewStreamTail()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := writeEvents(t, TopicBalanceChanged, 1, 2, 3, 4)
+	// Not streamed, but not a gap either.
+	writeEvents(t, TopicSavingCreated, 5)
+	late := hideEvents(t, written[1], written[2])
+
+	now := time.Now()
+	events, err := tail.Next(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := streamIDs(events); len(ids) != 2 || ids[0] != written[0].ID || ids[1] != written[3].ID {
+		t.Fatalf("first read = %v", ids)
+	}
+
+	// The late events are read once they commit, within StreamLookback.
+	commitEvents(t, late[0])
+	events, err = tail.Next(now.Add(StreamLookback / 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := streamIDs(events); len(ids) != 1 || ids[0] != late[0].ID {
+		t.Fatalf("second read = %v, want [%d]", ids, late[0].ID)
+	}
+	if events[0].SavingID != 2 {
+		t.Errorf("SavingID = %d, want 2", events[0].SavingID)
+	}
+
+	// Each event is read once.
+	if events, _ := tail.Next(now.Add(StreamLookback / 2)); len(events) != 0 {
+		t.Fatalf("read again %v", streamIDs(events))
+	}
+
+	// A gap older than StreamLookback is given up.
+	commitEvents(t, late[1])
+	if events, _ := tail.Next(now.Add(2 * StreamLookback)); len(events) != 0 {
+		t.Fatalf("read %v after StreamLookback", streamIDs(events))
+	}
+}
+
+func TestStreamResume(t *testing.T) {
+	setupDB(t)
+	written := writeEvents(t, TopicBalanceChanged, 1, 1, 2, 1)
+
+	// The client has the last event, the one before it commits late.
+	resumeID, err := GetStreamResumeID([]uint{1}, written[3].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := GetStreamEvents([]uint{1}, resumeID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := streamIDs(events); len(ids) != 3 || ids[0] != written[0].ID || ids[2] != written[3].ID {
+		t.Errorf("resumed = %v", ids)
+	}
+
+	// Old events are not sent again.
+	old := time.Now().Add(-2 * StreamLookback)
+	if err := database.DB.Model(&OutboxEvent{}).Where("id < ?", written[3].ID).Update("created_at", old).Error; err != nil {
+		t.Fatal(err)
+	}
+	resumeID, err = GetStreamResumeID([]uint{1}, written[3].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumeID != written[3].ID {
+		t.Errorf("resume after %d, want %d", resumeID, written[3].ID)
+	}
+
+	// An unknown event resumes after it.
+	if resumeID, _ := GetStreamResumeID([]uint{1}, 1000); resumeID != 1000 {
+		t.Errorf("resume after %d, want 1000", resumeID)
+	}
+}
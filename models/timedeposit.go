@@ -0,0 +1,358 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Time deposit Transaction types.
+const (
+	TypeFunding  = "FUNDING"
+	TypeMaturity = "MATURITY"
+	TypeBreak    = "BREAK"
+	TypePenalty  = "PENALTY"
+)
+
+// Maturity actions.
+const (
+	MaturityRollover = "ROLLOVER"
+	MaturityPayout   = "PAYOUT"
+)
+
+// Time deposit statuses.
+const (
+	DepositActive  = "ACTIVE"
+	DepositMatured = "MATURED"
+	DepositBroken  = "BROKEN"
+)
+
+// penaltyRates are the early break penalties by tenor in months, in basis
+// points of the balance for a break right after funding.
+var penaltyRates = map[int]int64{
+	1:  100,
+	3:  150,
+	6:  200,
+	12: 300,
+}
+
+var (
+	// ErrTimeDepositLocked is returned when depositing to or withdrawing
+	// from a time deposit outside of its own operations.
+	ErrTimeDepositLocked = errors.New("time deposits are locked until maturity")
+	// ErrInvalidTenor is returned when the tenor is not 1, 3, 6 or 12 months.
+	ErrInvalidTenor = errors.New("tenor must be 1, 3, 6 or 12 months")
+	// ErrDepositNotActive is returned when the time deposit is already
+	// matured or broken.
+	ErrDepositNotActive = errors.New("time deposit is not active")
+)
+
+// TimeDeposit is the term of a Saving of TIME_DEPOSIT kind. It is funded
+// once, locked for TenorMonths and at maturity either rolled over for another
+// tenor or paid out to PayoutSavingID.
+type TimeDeposit struct {
+	gorm.Model
+	SavingID       uint      `gorm:"not null;uniqueIndex"`
+	PayoutSavingID uint      `gorm:"not null"`
+	Principal      int64     `gorm:"not null"`
+	TenorMonths    int       `gorm:"not null"`
+	MaturityAction string    `gorm:"size:8;not null"` // ROLLOVER or PAYOUT
+	PenaltyBps     int64     `gorm:"not null"`
+	StartAt        time.Time `gorm:"not null"`
+	MaturityAt     time.Time `gorm:"not null;index"`
+	Rollovers      int       `gorm:"not null;default:0"`
+	Status         string    `gorm:"size:8;not null;index"`
+	// ctx is the context of the queries of the TimeDeposit, see
+	// WithContext.
+	ctx context.Context
+}
+
+// WithContext sets the context of the queries of the TimeDeposit, with the
+// AuditActor of its opening or break.
+func (d *TimeDeposit) WithContext(ctx context.Context) *TimeDeposit {
+	d.ctx = ctx
+	return d
+}
+
+// Validate checks the tenor and the maturity action of the TimeDeposit.
+func (d *TimeDeposit) Validate() error {
+	if _, ok := penaltyRates[d.TenorMonths]; !ok {
+		return ErrInvalidTenor
+	}
+	if d.MaturityAction != MaturityRollover && d.MaturityAction != MaturityPayout {
+		return errors.New("maturity action must be ROLLOVER or PAYOUT")
+	}
+	if d.Principal <= 0 {
+		return errors.New("principal must be more than 0")
+	}
+	return nil
+}
+
+// Open creates the time deposit Saving and funds it with Principal from the
+// Saving fromID, in one DB transaction. The PayoutSavingID must be in the
+// currency of the Saving fromID, which is paid out at maturity.
+func (d *TimeDeposit) Open(saving *Saving, fromID uint) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+
+	return withContext(d.ctx).Transaction(func(tx *gorm.DB) error {
+		from, err := lockSaving(tx, fromID)
+		if err != nil {
+			return err
+		}
+		if from.IsTimeDeposit() {
+			return ErrTimeDepositLocked
+		}
+		var payout Saving
+		if err := tx.First(&payout, d.PayoutSavingID).Error; err != nil {
+			return err
+		}
+		if payout.Currency != from.Currency {
+			return ErrCurrencyMismatch
+		}
+
+		// The time deposit is in the currency of the Saving funding it.
+		saving.Kind = KindTimeDeposit
+		saving.Balance = 0
+		saving.Currency = from.Currency
+		if err := checkProductCurrency(tx, saving); err != nil {
+			return err
+		}
+		if err := tx.Create(saving).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		d.SavingID = saving.ID
+		d.PenaltyBps = penaltyRates[d.TenorMonths]
+		d.StartAt = now
+		d.MaturityAt = now.AddDate(0, d.TenorMonths, 0)
+		d.Status = DepositActive
+		if err := tx.Create(d).Error; err != nil {
+			return err
+		}
+
+		if err := d.fund(tx, from, saving); err != nil {
+			return err
+		}
+		return auditTx(tx, AuditTimeDepositOpened, "time_deposit", d.ID, nil, d)
+	})
+}
+
+// fund moves the Principal from the Saving from to the new time deposit
+// saving, within tx. The outgoing FUNDING is posted like a WITHDRAWAL, so the
+// goal lock, the limits, the approvals and the TRANSFER fees apply to it.
+func (d *TimeDeposit) fund(tx *gorm.DB, from, saving *Saving) error {
+	if err := lockSavings(tx, from.ID, saving.ID); err != nil {
+		return err
+	}
+
+	description := fmt.Sprintf("Funding of time deposit %d", saving.ID)
+	err := post(tx, &Transaction{
+		SavingID:    from.ID,
+		Type:        TypeFunding,
+		Value:       -d.Principal,
+		Currency:    from.Currency,
+		Description: description,
+	})
+	if err != nil {
+		return err
+	}
+
+	return postWithFees(tx, &Transaction{
+		SavingID:    saving.ID,
+		Type:        TypeFunding,
+		Value:       d.Principal,
+		Currency:    from.Currency,
+		Description: description,
+	}, "")
+}
+
+// move moves value between two Savings of the time deposit as Transactions of
+// type kind, within tx. Both Savings are locked in ID order before moving.
+func (d *TimeDeposit) move(tx *gorm.DB, from, to *Saving, value int64, kind, description string) error {
+	if err := lockSavings(tx, from.ID, to.ID); err != nil {
+		return err
+	}
+	// Reload the balances under the lock.
+	if err := tx.First(from, from.ID).Error; err != nil {
+		return err
+	}
+	if err := tx.First(to, to.ID).Error; err != nil {
+		return err
+	}
+
+	err := apply(tx, from, &Transaction{
+		SavingID:    from.ID,
+		Type:        kind,
+		Value:       -value,
+		Currency:    from.Currency,
+		Description: description,
+	})
+	if err != nil {
+		return err
+	}
+
+	return apply(tx, to, &Transaction{
+		SavingID:    to.ID,
+		Type:        kind,
+		Value:       value,
+		Currency:    from.Currency,
+		Description: description,
+	})
+}
+
+// GetTimeDepositBySavingID gets/fetches the TimeDeposit of a Saving.
+func (d *TimeDeposit) GetTimeDepositBySavingID(savingID string) *TimeDeposit {
+	var result TimeDeposit
+	err := database.DB.Where("saving_id = ?", savingID).First(&result).Error
+	if err != nil {
+		return nil
+	}
+	return &result
+}
+
+// Penalty returns the early break penalty of balance at now. It is PenaltyBps
+// of the balance, reduced in proportion to the time already served. Always
+// rounds down.
+func (d *TimeDeposit) Penalty(balance int64, now time.Time) int64 {
+	if balance <= 0 || !now.Before(d.MaturityAt) {
+		return 0
+	}
+	term := int64(d.MaturityAt.Sub(d.StartAt) / time.Second)
+	remaining := int64(d.MaturityAt.Sub(now) / time.Second)
+	if term <= 0 {
+		return 0
+	}
+
+	penalty := new(big.Int).Mul(big.NewInt(balance), big.NewInt(d.PenaltyBps))
+	penalty.Mul(penalty, big.NewInt(remaining))
+	penalty.Quo(penalty, big.NewInt(bpsUnits*term))
+	return penalty.Int64()
+}
+
+// Break pays the time deposit out before maturity. The penalty is posted as
+// its own PENALTY Transaction, then the rest goes to PayoutSavingID.
+func (d *TimeDeposit) Break(now time.Time) (int64, error) {
+	var penalty int64
+	err := withContext(d.ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(d, d.ID).Error; err != nil {
+			return err
+		}
+		if d.Status != DepositActive {
+			return ErrDepositNotActive
+		}
+
+		saving, err := lockSaving(tx, d.SavingID)
+		if err != nil {
+			return err
+		}
+
+		penalty = d.Penalty(saving.Balance, now)
+		if penalty > 0 {
+			err := apply(tx, saving, &Transaction{
+				SavingID:    saving.ID,
+				Type:        TypePenalty,
+				Value:       -penalty,
+				Description: fmt.Sprintf("Early break penalty of time deposit %d", saving.ID),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := d.payout(tx, saving, TypeBreak); err != nil {
+			return err
+		}
+		before := *d
+		if err := tx.Model(d).Update("status", DepositBroken).Error; err != nil {
+			return err
+		}
+		return auditTx(tx, AuditTimeDepositBroken, "time_deposit", d.ID, before, map[string]interface{}{
+			"Status":  d.Status,
+			"Penalty": penalty,
+		})
+	})
+	return penalty, err
+}
+
+// payout moves the whole balance of the time deposit to PayoutSavingID.
+func (d *TimeDeposit) payout(tx *gorm.DB, saving *Saving, kind string) error {
+	if err := tx.First(saving, saving.ID).Error; err != nil {
+		return err
+	}
+	if saving.Balance == 0 {
+		return nil
+	}
+
+	var to Saving
+	if err := tx.First(&to, d.PayoutSavingID).Error; err != nil {
+		return err
+	}
+
+	description := fmt.Sprintf("Payout of time deposit %d", saving.ID)
+	return d.move(tx, saving, &to, saving.Balance, kind, description)
+}
+
+// Mature processes the TimeDeposit at its maturity. Interest accrued in the
+// month so far is capitalised first. Then it either rolls over for another
+// tenor from the maturity date, or pays everything out.
+func (d *TimeDeposit) Mature(now time.Time) error {
+	var saving Saving
+	if err := database.DB.First(&saving, d.SavingID).Error; err != nil {
+		return err
+	}
+
+	if d.MaturityAction == MaturityPayout && saving.InterestProductID != nil {
+		products := productCache{}
+		if product := products.get(*saving.InterestProductID); product != nil {
+			if err := capitalise(saving.ID, product, d.MaturityAt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(d, d.ID).Error; err != nil {
+			return err
+		}
+		if d.Status != DepositActive || d.MaturityAt.After(now) {
+			return nil
+		}
+
+		if d.MaturityAction == MaturityRollover {
+			return tx.Model(d).Updates(map[string]interface{}{
+				"start_at":    d.MaturityAt,
+				"maturity_at": d.MaturityAt.AddDate(0, d.TenorMonths, 0),
+				"rollovers":   d.Rollovers + 1,
+			}).Error
+		}
+
+		locked, err := lockSaving(tx, d.SavingID)
+		if err != nil {
+			return err
+		}
+		if err := d.payout(tx, locked, TypeMaturity); err != nil {
+			return err
+		}
+		return tx.Model(d).Update("status", DepositMatured).Error
+	})
+}
+
+// GetMaturedTimeDeposits gets/fetches every active TimeDeposit which has
+// reached its maturity.
+func GetMaturedTimeDeposits(now time.Time) ([]TimeDeposit, error) {
+	var results []TimeDeposit
+	err := database.DB.
+		Where("status = ? AND maturity_at <= ?", DepositActive, now).
+		Order("maturity_at").
+		Find(&results).
+		Error
+	return results, err
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"testing"
+	"time"
+)
+
+func TestOpenTimeDepositPayoutCurrency(t *testing.T) {
+	setupDB(t)
+	from := newSaving(t, 1000, time.Now())
+	usd := Saving{UserID: from.UserID, Name: "Dollars", Currency: "USD"}
+	if err := usd.Store(); err != nil {
+		t.Fatal(err)
+	}
+
+	deposit := TimeDeposit{PayoutSavingID: usd.ID, Principal: 600, TenorMonths: 1, MaturityAction: MaturityPayout}
+	if err := deposit.Open(&Saving{UserID: from.UserID, Name: "Term"}, from.ID); err != ErrCurrencyMismatch {
+		t.Fatalf("payout in another currency: err = %v, want %v", err, ErrCurrencyMismatch)
+	}
+	var count int64
+	if err := database.DB.Model(&Saving{}).Where("kind = ?", KindTimeDeposit).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 || reload(t, from).Balance != 1000 {
+		t.Errorf("refused time deposit left %d time deposits, balance %d", count, reload(t, from).Balance)
+	}
+
+	// Paid out to the Saving funding it, the time deposit can be broken.
+	deposit = TimeDeposit{PayoutSavingID: from.ID, Principal: 600, TenorMonths: 1, MaturityAction: MaturityPayout}
+	if err := deposit.Open(&Saving{UserID: from.UserID, Name: "Term"}, from.ID); err != nil {
+		t.Fatal(err)
+	}
+	penalty, err := deposit.Break(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reload(t, from).Balance; got != 1000-penalty {
+		t.Errorf("balance after the break = %d, want %d", got, 1000-penalty)
+	}
+}
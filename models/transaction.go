@@ -1,24 +1,250 @@
 package models
 
 import (
-	"b-pay/config/database"
+	"context"
+	"errors"
 
 	"gorm.io/gorm"
 )
 
+// Transaction types. INTEREST and TAX are in interest.go, FEE in fee.go and
+// FUNDING, MATURITY, BREAK and PENALTY in timedeposit.go.
+const (
+	TypeDeposit    = "DEPOSIT"
+	TypeWithdrawal = "WITHDRAWAL"
+	TypeReversal   = "REVERSAL"
+)
+
+var (
+	// ErrTransactionNotFound is returned when the Transaction does not exist.
+	ErrTransactionNotFound = errors.New("transaction not found")
+	// ErrNotReversible is returned when trying to reverse anything but a
+	// DEPOSIT or a WITHDRAWAL.
+	ErrNotReversible = errors.New("only deposits and withdrawals can be reversed")
+	// ErrAlreadyReversed is returned when the Transaction is fully reversed.
+	ErrAlreadyReversed = errors.New("transaction is already fully reversed")
+	// ErrReversalTooLarge is returned when the reversal value is more than
+	// what is left to be reversed.
+	ErrReversalTooLarge = errors.New("reversal value exceeds the remaining reversible value")
+	// ErrInsufficientBalance is returned when a change would make the balance
+	// lower than 0.
+	ErrInsufficientBalance = errors.New("balance can not be lower than 0")
+	// ErrValueSign is returned when posting a credit with a negative Value
+	// or a debit with a positive one.
+	ErrValueSign = errors.New("value sign does not match the transaction type")
+)
+
 // Transaction for each Saving account.
 //
-// Only has 2 types, DEPOSIT or WITHDRAWAL
+// DEPOSIT or WITHDRAWAL, or REVERSAL for a Transaction that undoes (part of)
+// another one, or FEE for a fee charged for another one. Interest and time
+// deposits post their own types, see the Type constants.
 type Transaction struct {
 	gorm.Model
-	SavingID    uint   `gorm:"not null"`
-	Type        string `gorm:"size:11;not null;"` // DEPOSIT or WITHDRAWAL
-	Value       int64  `gorm:"not null"`
+	SavingID    uint   `gorm:"not null;uniqueIndex:idx_transaction_external_ref"`
+	Type        string `gorm:"size:11;not null;"`           // One of the Type constants
+	Value       int64  `gorm:"not null"`                    // In minor units of Currency
+	Currency    string `gorm:"size:3;not null;default:IDR"` // ISO 4217, same as the Saving
 	Description string `gorm:"size:200"`
+	// ReversalOf is the ID of the original Transaction. Only set on reversals.
+	ReversalOf *uint  `gorm:"index"`
+	ReasonCode string `gorm:"size:30"`
+	// FeeOf is the ID of the Transaction which triggered the fee. Only set on
+	// fees.
+	FeeOf *uint `gorm:"index"`
+	// ForeignCurrency, ForeignValue, FxRate (in rateUnits) and FxSpreadBps
+	// record the conversion of a Transaction made against an FxQuote.
+	ForeignCurrency string `gorm:"size:3"`
+	ForeignValue    int64  `gorm:"not null;default:0"`
+	FxRate          int64  `gorm:"not null;default:0"`
+	FxSpreadBps     int64  `gorm:"not null;default:0"`
+	FxQuoteID       *uint
+	// ExternalRef is the reference of an imported Transaction, unique per
+	// Saving so a row is never imported twice.
+	ExternalRef *string `gorm:"size:100;uniqueIndex:idx_transaction_external_ref"`
+	// CategoryID is set by a CategoryRule, or by hand when CategorySource is
+	// MANUAL.
+	CategoryID     *uint  `gorm:"index"`
+	CategorySource string `gorm:"size:6;not null;default:''"` // RULE or MANUAL
+	Tags           []TransactionTag
+	// ValueFormatted is the Value with its currency. Not stored.
+	ValueFormatted string `gorm:"-"`
+	// ctx is the context of the queries of the Transaction, see WithContext.
+	ctx context.Context
+	// approved is set when another owner approved the Transaction, see
+	// PendingWithdrawal.
+	approved bool
+	// withheld is set on the withholding tax of interest, which is taken from
+	// the interest it follows even when the balance is held, see capitalise.
+	withheld bool
+}
+
+// WithContext sets the context of the queries of the Transaction, so they
+// are traced as part of a request. The Transactions it gets keep the context.
+func (t *Transaction) WithContext(ctx context.Context) *Transaction {
+	t.ctx = ctx
+	return t
+}
+
+// db returns database.DB with the context of the Transaction.
+func (t *Transaction) db() *gorm.DB {
+	return withContext(t.ctx)
 }
 
 // Store creates a Transaction record to Database.
 func (t *Transaction) Store() error {
-	err := database.DB.Create(&t).Error
+	err := t.db().Create(&t).Error
 	return err
 }
+
+// Money returns the Value of the Transaction with its currency.
+func (t *Transaction) Money() Money {
+	return NewMoney(t.Value, t.Currency)
+}
+
+// AfterFind formats the Value of every loaded Transaction.
+func (t *Transaction) AfterFind(tx *gorm.DB) error {
+	t.ValueFormatted = t.Money().String()
+	return nil
+}
+
+// AfterSave formats the Value of every stored Transaction.
+func (t *Transaction) AfterSave(tx *gorm.DB) error {
+	t.ValueFormatted = t.Money().String()
+	return nil
+}
+
+// AfterCreate writes the transaction.created event of every new Transaction,
+// adds it to its TransactionRollup and queues its webhooks, in the same DB
+// transaction.
+func (t *Transaction) AfterCreate(tx *gorm.DB) error {
+	if err := writeOutbox(tx, TopicTransactionCreated, "saving", t.SavingID, t); err != nil {
+		return err
+	}
+	if err := addRollup(tx, t, 1); err != nil {
+		return err
+	}
+
+	var ownerID uint
+	err := tx.Model(&Saving{}).Select("user_id").Where("id = ?", t.SavingID).Scan(&ownerID).Error
+	if err != nil {
+		return err
+	}
+	return publishEvent(tx, EventTransactionCreated, ownerID, t)
+}
+
+// GetTransactionByID gets/fetches a Transaction by searching the ID.
+func (t *Transaction) GetTransactionByID(id string) *Transaction {
+	var result Transaction
+	err := t.db().Where("id = ?", id).First(&result).Error
+	if err != nil {
+		return nil
+	}
+	result.ctx = t.ctx
+	return &result
+}
+
+// reversedValue sums the values of every reversal made for the Transaction.
+// The result has the opposite sign of the original Value.
+func reversedValue(tx *gorm.DB, originalID uint) (int64, error) {
+	var total int64
+	err := tx.Model(&Transaction{}).
+		Select("COALESCE(SUM(value), 0)").
+		Where("reversal_of = ?", originalID).
+		Scan(&total).
+		Error
+	return total, err
+}
+
+// Reverse creates a REVERSAL Transaction which undoes value of the original
+// Transaction t and applies it to the Saving balance. value must be positive;
+// 0 reverses everything that is left.
+//
+// The original row is never modified. The Saving row is locked so that
+// concurrent reversals can not refund more than the original value.
+func (t *Transaction) Reverse(value int64, reasonCode, description string) (*Transaction, error) {
+	if t.Type != TypeDeposit && t.Type != TypeWithdrawal {
+		return nil, ErrNotReversible
+	}
+
+	var reversal Transaction
+	err := t.db().Transaction(func(tx *gorm.DB) error {
+		saving, err := lockSaving(tx, t.SavingID)
+		if err != nil {
+			return err
+		}
+		if saving.IsTimeDeposit() {
+			return ErrTimeDepositLocked
+		}
+
+		reversed, err := reversedValue(tx, t.ID)
+		if err != nil {
+			return err
+		}
+
+		// Work with absolute values, reversals have the opposite sign.
+		original := abs(t.Value)
+		remaining := original - abs(reversed)
+		if remaining <= 0 {
+			return ErrAlreadyReversed
+		}
+		if value == 0 {
+			value = remaining
+		}
+		if value > remaining {
+			return ErrReversalTooLarge
+		}
+
+		// A DEPOSIT is reversed by taking money out and vice versa.
+		delta := value
+		if t.Value > 0 {
+			delta = -value
+		}
+
+		newBalance := saving.Balance + delta
+		if newBalance < 0 {
+			return ErrInsufficientBalance
+		}
+		available, err := availableBalance(tx, saving)
+		if err != nil {
+			return err
+		}
+		if available+delta < 0 {
+			return ErrInsufficientAvailableBalance
+		}
+
+		originalID := t.ID
+		reversal = Transaction{
+			SavingID:    t.SavingID,
+			Type:        TypeReversal,
+			Value:       delta,
+			Currency:    saving.Currency,
+			Description: description,
+			ReversalOf:  &originalID,
+			ReasonCode:  reasonCode,
+		}
+		if err := categorize(tx, saving, &reversal); err != nil {
+			return err
+		}
+		if err := tx.Create(&reversal).Error; err != nil {
+			return err
+		}
+
+		if err := setBalance(tx, saving, newBalance); err != nil {
+			return err
+		}
+		return auditTx(tx, AuditTransactionReversed, "transaction", t.ID, nil, reversal)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &reversal, nil
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -12,6 +12,7 @@ type User struct {
 	Name     string `gorm:"size:100;not null;"`
 	Email    string `gorm:"size:300;unique;not null;"`
 	Password []byte `gorm:"not null"`
+	IsAdmin  bool   `gorm:"not null;default:false"`
 	Savings  []Saving
 }
 
@@ -0,0 +1,575 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Webhook events.
+const (
+	EventSavingCreated      = "saving.created"
+	EventSavingDeleted      = "saving.deleted"
+	EventTransactionCreated = "transaction.created"
+	EventPasswordChanged    = "password.changed"
+)
+
+// WebhookEvents are every event a WebhookSubscription can receive.
+var WebhookEvents = map[string]bool{
+	EventSavingCreated:      true,
+	EventSavingDeleted:      true,
+	EventTransactionCreated: true,
+	EventPasswordChanged:    true,
+}
+
+// Webhook delivery statuses. A delivery is FAILED after webhookMaxAttempts.
+const (
+	DeliveryPending   = "PENDING"
+	DeliveryDelivered = "DELIVERED"
+	DeliveryFailed    = "FAILED"
+)
+
+// Webhook request headers. The signature is
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<unix time>.<body>">".
+const (
+	WebhookSignatureHeader = "X-BPay-Signature"
+	WebhookEventHeader     = "X-BPay-Event"
+	WebhookDeliveryHeader  = "X-BPay-Delivery"
+)
+
+const (
+	// webhookMaxAttempts is how many times a delivery is tried.
+	webhookMaxAttempts = 8
+	// webhookBackoff is the wait before the second attempt. It doubles
+	// after every failed attempt, up to webhookMaxBackoff.
+	webhookBackoff    = 30 * time.Second
+	webhookMaxBackoff = 6 * time.Hour
+	// webhookLease is how long a claimed delivery is hidden from other
+	// workers while it is being sent.
+	webhookLease = time.Minute
+	// webhookBatch is how many due deliveries one run sends.
+	webhookBatch = 50
+)
+
+// WebhookClient sends the webhooks. It only connects to public addresses,
+// whatever the URL or a redirect resolves to when it is sent. Replace it to
+// deliver to a test server.
+var WebhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		// No proxy, so the dialed address is the one of the receiver.
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: controlWebhookDial,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// privateNetworks are the networks webhooks can not be sent to: this host,
+// the private and shared networks, link-local addresses (with the cloud
+// metadata services) and the reserved ranges.
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// parseNetworks parses the CIDRs, which must be valid.
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	var results []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		results = append(results, network)
+	}
+	return results
+}
+
+// publicIP reports whether ip is outside of privateNetworks. IPv4 addresses
+// mapped to IPv6 are checked as IPv4.
+func publicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// controlWebhookDial refuses the connections of WebhookClient to an address
+// which is not public, see publicIP.
+func controlWebhookDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return ErrWebhookTarget
+	}
+	return nil
+}
+
+// lookupIP resolves the host of a webhook URL. Replaced by the tests.
+var lookupIP = net.LookupIP
+
+var (
+	// ErrInvalidWebhook is returned when the URL or the events of a
+	// WebhookSubscription are not valid.
+	ErrInvalidWebhook = errors.New("webhook needs an http or https URL and known events")
+	// ErrWebhookTarget is returned when the URL of a WebhookSubscription
+	// does not resolve to public addresses only.
+	ErrWebhookTarget = errors.New("webhook URL must resolve to public addresses")
+	// ErrDeliveryBusy is returned when a delivery is being sent by another
+	// worker.
+	ErrDeliveryBusy = errors.New("delivery is being sent")
+)
+
+// WebhookSubscription sends the events of a User to URL. A subscription
+// without UserID belongs to an app and gets the events of every User.
+type WebhookSubscription struct {
+	gorm.Model
+	UserID *uint  `gorm:"index"`
+	Name   string `gorm:"size:100"`
+	URL    string `gorm:"size:500;not null"`
+	// Events are comma separated, "*" for every event.
+	Events string `gorm:"size:200;not null"`
+	// Secret signs the payloads. Only shown when the subscription is
+	// created.
+	Secret string `gorm:"size:64;not null" json:"-"`
+	Active bool   `gorm:"not null;default:true"`
+}
+
+// WebhookDelivery is one event sent to one WebhookSubscription, with the
+// result of its last attempt.
+type WebhookDelivery struct {
+	gorm.Model
+	SubscriptionID uint `gorm:"not null;index"`
+	// EventID is the same for every delivery of an event, so receivers can
+	// skip duplicates.
+	EventID       string    `gorm:"size:32;not null;index"`
+	Event         string    `gorm:"size:50;not null"`
+	Payload       string    `gorm:"type:text;not null"`
+	Status        string    `gorm:"size:9;not null;default:PENDING;index:idx_delivery_due"` // PENDING, DELIVERED or FAILED
+	NextAttemptAt time.Time `gorm:"not null;index:idx_delivery_due"`
+	Attempts      int       `gorm:"not null;default:0"`
+	StatusCode    int       `gorm:"not null;default:0"`
+	LastError     string    `gorm:"size:500"`
+	DeliveredAt   *time.Time
+	// LockedUntil hides the delivery from other workers while it is being
+	// sent.
+	LockedUntil *time.Time
+}
+
+// webhookPayload is the JSON body of every webhook.
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// randomHex returns n random bytes as hex.
+func randomHex(n int) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// events returns the events of the subscription.
+func (w *WebhookSubscription) events() []string {
+	var results []string
+	for _, event := range strings.Split(w.Events, ",") {
+		if event = strings.ToLower(strings.TrimSpace(event)); event != "" {
+			results = append(results, event)
+		}
+	}
+	return results
+}
+
+// Validate checks whether the subscription is valid and normalizes its
+// events. Its URL must resolve to public addresses only, the addresses are
+// checked again when a webhook is sent.
+func (w *WebhookSubscription) Validate() error {
+	target, err := url.Parse(w.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return ErrInvalidWebhook
+	}
+	if err := checkWebhookHost(target.Hostname()); err != nil {
+		return err
+	}
+
+	events := w.events()
+	if len(events) == 0 {
+		return ErrInvalidWebhook
+	}
+	for _, event := range events {
+		if event != "*" && !WebhookEvents[event] {
+			return ErrInvalidWebhook
+		}
+	}
+	w.Events = strings.Join(events, ",")
+	return nil
+}
+
+// checkWebhookHost checks that host resolves to public addresses only.
+func checkWebhookHost(host string) error {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = lookupIP(host); err != nil || len(ips) == 0 {
+			return ErrWebhookTarget
+		}
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return ErrWebhookTarget
+		}
+	}
+	return nil
+}
+
+// Store creates the subscription with a new random secret, and returns the
+// secret.
+func (w *WebhookSubscription) Store() (string, error) {
+	if err := w.Validate(); err != nil {
+		return "", err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	w.Secret = secret
+	if err := database.DB.Create(&w).Error; err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// GetWebhookSubscriptionByID gets/fetches a WebhookSubscription by searching
+// the ID.
+func GetWebhookSubscriptionByID(id string) *WebhookSubscription {
+	var result WebhookSubscription
+	if err := database.DB.Where("id = ?", id).First(&result).Error; err != nil {
+		return nil
+	}
+	return &result
+}
+
+// GetWebhookSubscriptionsByUserID gets/fetches every WebhookSubscription of
+// a User.
+func GetWebhookSubscriptionsByUserID(userID uint) (*[]WebhookSubscription, error) {
+	var results []WebhookSubscription
+	if err := database.DB.Where("user_id = ?", userID).Order("id").Find(&results).Error; err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// Delete removes the subscription. Its pending deliveries are not sent.
+func (w *WebhookSubscription) Delete() error {
+	return database.DB.Delete(&w).Error
+}
+
+// GetDeliveries gets/fetches the latest deliveries of the subscription,
+// newest first.
+func (w *WebhookSubscription) GetDeliveries(limit int) (*[]WebhookDelivery, error) {
+	var results []WebhookDelivery
+	err := database.DB.
+		Where("subscription_id = ?", w.ID).
+		Order("id DESC").
+		Limit(limit).
+		Find(&results).
+		Error
+	if err != nil {
+		return nil, err
+	}
+	return &results, nil
+}
+
+// GetWebhookDeliveryByID gets/fetches a WebhookDelivery by searching the ID.
+func GetWebhookDeliveryByID(id string) *WebhookDelivery {
+	var result WebhookDelivery
+	if err := database.DB.Where("id = ?", id).First(&result).Error; err != nil {
+		return nil
+	}
+	return &result
+}
+
+// PublishEvent queues the event for every active subscription of the User
+// and of every app which wants it.
+func PublishEvent(event string, userID uint, data interface{}) error {
+	return publishEvent(database.DB, event, userID, data)
+}
+
+// publishEvent is PublishEvent within tx, so the deliveries are only sent
+// when tx commits.
+func publishEvent(tx *gorm.DB, event string, userID uint, data interface{}) error {
+	var subscriptions []WebhookSubscription
+	err := tx.
+		Where("active AND (user_id = ? OR user_id IS NULL)", userID).
+		Find(&subscriptions).
+		Error
+	if err != nil || len(subscriptions) == 0 {
+		return err
+	}
+
+	eventID, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	payload, err := json.Marshal(webhookPayload{eventID, event, now, data})
+	if err != nil {
+		return err
+	}
+
+	var deliveries []WebhookDelivery
+	for _, subscription := range subscriptions {
+		for _, wanted := range subscription.events() {
+			if wanted == "*" || wanted == event {
+				deliveries = append(deliveries, WebhookDelivery{
+					SubscriptionID: subscription.ID,
+					EventID:        eventID,
+					Event:          event,
+					Payload:        string(payload),
+					Status:         DeliveryPending,
+					NextAttemptAt:  now,
+				})
+				break
+			}
+		}
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return tx.Create(&deliveries).Error
+}
+
+// SavingEvent is the data of the saving events, without the PIN.
+type SavingEvent struct {
+	ID       uint
+	UserID   uint
+	Kind     string
+	Name     string
+	Currency string
+	Balance  int64
+}
+
+// event returns the SavingEvent of the Saving.
+func (s *Saving) event() SavingEvent {
+	return SavingEvent{
+		ID:       s.ID,
+		UserID:   s.UserID,
+		Kind:     s.Kind,
+		Name:     s.Name,
+		Currency: s.Currency,
+		Balance:  s.Balance,
+	}
+}
+
+// PublishEvent queues a saving event of the Saving for its owner.
+func (s *Saving) PublishEvent(event string) error {
+	return PublishEvent(event, s.UserID, s.event())
+}
+
+// SignWebhook returns the signature header of body sent at timestamp, see
+// WebhookSignatureHeader.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// VerifyWebhook reports whether signature is a valid signature of body made
+// with secret no longer than tolerance ago.
+func VerifyWebhook(secret, signature string, body []byte, tolerance time.Duration) bool {
+	var timestamp int64
+	for _, part := range strings.Split(signature, ",") {
+		if strings.HasPrefix(part, "t=") {
+			timestamp, _ = strconv.ParseInt(strings.TrimPrefix(part, "t="), 10, 64)
+		}
+	}
+	if timestamp == 0 || time.Since(time.Unix(timestamp, 0)) > tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(SignWebhook(secret, timestamp, body)))
+}
+
+// webhookBackoffAfter returns the wait after the attempts-th failed attempt.
+func webhookBackoffAfter(attempts int) time.Duration {
+	backoff := webhookBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+// claim hides the due delivery from other workers for webhookLease. Returns
+// false if it is not due or another worker claimed it first.
+func (d *WebhookDelivery) claim(now time.Time) (bool, error) {
+	result := database.DB.Model(&WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at <= ?", d.ID, DeliveryPending, now).
+		Where("locked_until IS NULL OR locked_until < ?", now).
+		Update("locked_until", now.Add(webhookLease))
+	return result.RowsAffected == 1, result.Error
+}
+
+// send posts the payload of the delivery to the subscription, signed with its
+// secret.
+func (d *WebhookDelivery) send(subscription *WebhookSubscription, now time.Time) (int, error) {
+	body := []byte(d.Payload)
+	request, err := http.NewRequest(http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "b-pay-webhooks/1")
+	request.Header.Set(WebhookEventHeader, d.Event)
+	request.Header.Set(WebhookDeliveryHeader, d.EventID)
+	request.Header.Set(WebhookSignatureHeader, SignWebhook(subscription.Secret, now.Unix(), body))
+
+	response, err := WebhookClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64<<10))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("receiver answered %d", response.StatusCode)
+	}
+	return response.StatusCode, nil
+}
+
+// attempt sends a claimed delivery once and records the result. A failed
+// attempt is retried with exponential backoff until webhookMaxAttempts.
+func (d *WebhookDelivery) attempt(now time.Time) error {
+	var subscription WebhookSubscription
+	err := database.DB.Unscoped().Where("id = ?", d.SubscriptionID).First(&subscription).Error
+	if err != nil {
+		return err
+	}
+
+	d.Attempts++
+	updates := map[string]interface{}{"attempts": d.Attempts}
+	if subscription.DeletedAt.Valid || !subscription.Active {
+		d.Status, d.LastError = DeliveryFailed, "subscription is removed"
+	} else if d.StatusCode, err = d.send(&subscription, now); err == nil {
+		d.Status, d.LastError, d.DeliveredAt = DeliveryDelivered, "", &now
+	} else {
+		d.LastError = err.Error()
+		if len(d.LastError) > 500 {
+			d.LastError = d.LastError[:500]
+		}
+		d.Status = DeliveryPending
+		d.NextAttemptAt = now.Add(webhookBackoffAfter(d.Attempts))
+		if d.Attempts >= webhookMaxAttempts {
+			d.Status = DeliveryFailed
+		}
+	}
+
+	updates["status"] = d.Status
+	updates["status_code"] = d.StatusCode
+	updates["last_error"] = d.LastError
+	updates["delivered_at"] = d.DeliveredAt
+	updates["next_attempt_at"] = d.NextAttemptAt
+	updates["locked_until"] = nil
+	return database.DB.Model(&WebhookDelivery{}).Where("id = ?", d.ID).Updates(updates).Error
+}
+
+// DeliverDueWebhooks sends every pending delivery whose next attempt is due.
+// Deliveries claimed by another worker are skipped.
+func DeliverDueWebhooks(now time.Time) error {
+	var deliveries []WebhookDelivery
+	err := database.DB.
+		Where("status = ? AND next_attempt_at <= ?", DeliveryPending, now).
+		Order("next_attempt_at, id").
+		Limit(webhookBatch).
+		Find(&deliveries).
+		Error
+	if err != nil {
+		return err
+	}
+
+	for i := range deliveries {
+		claimed, err := deliveries[i].claim(now)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		if err := deliveries[i].attempt(now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Redeliver sends the delivery again now, whatever its status, and records
+// the result. Its attempts start over.
+func (d *WebhookDelivery) Redeliver() error {
+	now := time.Now()
+	result := database.DB.Model(&WebhookDelivery{}).
+		Where("id = ? AND (locked_until IS NULL OR locked_until < ?)", d.ID, now).
+		Updates(map[string]interface{}{
+			"status":       DeliveryPending,
+			"attempts":     0,
+			"locked_until": now.Add(webhookLease),
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrDeliveryBusy
+	}
+
+	d.Attempts = 0
+	return d.attempt(now)
+}
@@ -0,0 +1,243 @@
+package models
+
+import (
+	"b-pay/config/database"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookValidate(t *testing.T) {
+	defer func(old func(string) ([]net.IP, error)) { lookupIP = old }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "example.com":
+			return []net.IP{net.ParseIP("93.184.216.34")}, nil
+		case "localhost":
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		case "mixed.example.com":
+			return []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("10.0.0.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		url string
+		err error
+	}{
+		{"https://example.com/hooks", nil},
+		{"http://93.184.216.34:8080/hooks", nil},
+		{"https://[2606:2800:220:1:248:1893:25c8:1946]/hooks", nil},
+		{"ftp://example.com/hooks", ErrInvalidWebhook},
+		{"https:///hooks", ErrInvalidWebhook},
+		{"http://localhost:8080/hooks", ErrWebhookTarget},
+		{"http://mixed.example.com/hooks", ErrWebhookTarget},
+		{"http://unknown.example.com/hooks", ErrWebhookTarget},
+		{"http://127.0.0.1/hooks", ErrWebhookTarget},
+		{"http://0.0.0.0/hooks", ErrWebhookTarget},
+		{"http://10.1.2.3/hooks", ErrWebhookTarget},
+		{"http://172.16.0.1/hooks", ErrWebhookTarget},
+		{"http://192.168.1.1/hooks", ErrWebhookTarget},
+		{"http://100.64.0.1/hooks", ErrWebhookTarget},
+		{"http://169.254.169.254/latest/meta-data", ErrWebhookTarget},
+		{"http://[::1]/hooks", ErrWebhookTarget},
+		{"http://[fe80::1]/hooks", ErrWebhookTarget},
+		{"http://[fd00::1]/hooks", ErrWebhookTarget},
+		{"http://[::ffff:127.0.0.1]/hooks", ErrWebhookTarget},
+	}
+	for _, test := range tests {
+		subscription := WebhookSubscription{URL: test.url, Events: "*"}
+		if err := subscription.Validate(); err != test.err {
+			t.Errorf("Validate(%s) = %v, want %v", test.url, err, test.err)
+		}
+	}
+}
+
+func TestWebhookClientRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// A name can resolve to a public address in Validate and to loopback
+	// later, so the dialer checks the address it connects to.
+	response, err := WebhookClient.Post(server.URL, "application/json", nil)
+	if err == nil {
+		response.Body.Close()
+		t.Fatal("webhook sent to a loopback address")
+	}
+	if !errors.Is(err, ErrWebhookTarget) {
+		t.Errorf("err = %v, want %v", err, ErrWebhookTarget)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		3:  2 * time.Minute,
+		7:  32 * time.Minute,
+		12: webhookMaxBackoff,
+	}
+	for attempts, want := range tests {
+		if got := webhookBackoffAfter(attempts); got != want {
+			t.Errorf("webhookBackoffAfter(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+// receiver is a webhook receiver answering the statuses in order, then 200.
+type receiver struct {
+	mu       sync.Mutex
+	secret   string
+	statuses []int
+	// got are the event IDs of the requests with a valid signature.
+	got []string
+	bad int
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, request *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(request.Body)
+	signature := request.Header.Get(WebhookSignatureHeader)
+	if request.Header.Get(WebhookEventHeader) != EventSavingCreated || !VerifyWebhook(r.secret, signature, body, 5*time.Minute) {
+		r.bad++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.got = append(r.got, request.Header.Get(WebhookDeliveryHeader))
+
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+// newReceiver starts a receiver, subscribes a new User to it and sends the
+// webhooks to it.
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *User) {
+	t.Helper()
+	r := &receiver{secret: "secret", statuses: statuses}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	old := WebhookClient
+	WebhookClient = server.Client()
+	t.Cleanup(func() { WebhookClient = old })
+
+	users++
+	user := newUser(t, fmt.Sprintf("hooks%d@example.com", users))
+	// Created without Validate, as the test server is on loopback.
+	subscription := WebhookSubscription{UserID: &user.ID, URL: server.URL, Events: "*", Secret: r.secret, Active: true}
+	if err := database.DB.Create(&subscription).Error; err != nil {
+		t.Fatal(err)
+	}
+	return r, user
+}
+
+// lastDelivery returns the latest WebhookDelivery.
+func lastDelivery(t *testing.T) *WebhookDelivery {
+	t.Helper()
+	var delivery WebhookDelivery
+	if err := database.DB.Order("id DESC").First(&delivery).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &delivery
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	setupDB(t)
+	r, user := newReceiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+	if err := PublishEvent(EventSavingCreated, user.ID, SavingEvent{ID: 1, UserID: user.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	steps := []struct {
+		at       time.Time
+		status   string
+		attempts int
+	}{
+		{now, DeliveryPending, 1},
+		// Not due before its backoff.
+		{now.Add(29 * time.Second), DeliveryPending, 1},
+		{now.Add(30 * time.Second), DeliveryPending, 2},
+		{now.Add(89 * time.Second), DeliveryPending, 2},
+		{now.Add(90 * time.Second), DeliveryDelivered, 3},
+		{now.Add(time.Hour), DeliveryDelivered, 3},
+	}
+	for _, step := range steps {
+		if err := DeliverDueWebhooks(step.at); err != nil {
+			t.Fatal(err)
+		}
+		delivery := lastDelivery(t)
+		if delivery.Status != step.status || delivery.Attempts != step.attempts {
+			t.Fatalf("at %v: status %s after %d attempts, want %s after %d",
+				step.at.Sub(now), delivery.Status, delivery.Attempts, step.status, step.attempts)
+		}
+	}
+
+	delivery := lastDelivery(t)
+	if delivery.StatusCode != http.StatusOK || delivery.DeliveredAt == nil || delivery.LastError != "" {
+		t.Errorf("delivered delivery = %+v", delivery)
+	}
+
+	// Redelivering sends the same event again, with a fresh signature.
+	if err := delivery.Redeliver(); err != nil {
+		t.Fatal(err)
+	}
+	if redelivered := lastDelivery(t); redelivered.Status != DeliveryDelivered || redelivered.Attempts != 1 {
+		t.Errorf("redelivered: status %s after %d attempts", redelivered.Status, redelivered.Attempts)
+	}
+
+	if r.bad != 0 {
+		t.Errorf("%d requests with a bad signature", r.bad)
+	}
+	if len(r.got) != 4 {
+		t.Fatalf("receiver got %d requests, want 4", len(r.got))
+	}
+	for _, id := range r.got {
+		if id != delivery.EventID {
+			t.Errorf("event ID %s, want %s every time", id, delivery.EventID)
+		}
+	}
+}
+
+func TestWebhookDeliveryFails(t *testing.T) {
+	setupDB(t)
+	statuses := make([]int, webhookMaxAttempts+1)
+	for i := range statuses {
+		statuses[i] = http.StatusServiceUnavailable
+	}
+	r, user := newReceiver(t, statuses...)
+	if err := PublishEvent(EventSavingCreated, user.ID, SavingEvent{ID: 1, UserID: user.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Now()
+	for i := 0; i < webhookMaxAttempts+2; i++ {
+		if err := DeliverDueWebhooks(at); err != nil {
+			t.Fatal(err)
+		}
+		at = at.Add(webhookMaxBackoff)
+	}
+
+	delivery := lastDelivery(t)
+	if delivery.Status != DeliveryFailed || delivery.Attempts != webhookMaxAttempts {
+		t.Errorf("status %s after %d attempts, want %s after %d",
+			delivery.Status, delivery.Attempts, DeliveryFailed, webhookMaxAttempts)
+	}
+	if delivery.StatusCode != http.StatusServiceUnavailable || delivery.LastError == "" {
+		t.Errorf("failed delivery = %+v", delivery)
+	}
+	if len(r.got) != webhookMaxAttempts {
+		t.Errorf("receiver got %d requests, want %d", len(r.got), webhookMaxAttempts)
+	}
+}